@@ -0,0 +1,50 @@
+package minirpc
+
+import (
+	"context"
+	"log/slog"
+	"math/rand"
+	"time"
+)
+
+// AccessLogConfig AccessLog 的配置
+type AccessLogConfig struct {
+	// Logger 输出访问日志, 为空时使用 slog.Default(), 可以通过 slog.NewJSONHandler 输出 JSON
+	Logger *slog.Logger
+	// SampleRate 记录成功请求的比例, 取值 (0, 1], 0 表示全部记录; 失败的请求总是会被记录
+	SampleRate float64
+}
+
+// AccessLog 返回记录访问日志的服务端拦截器, 每个请求输出一条结构化的日志:
+// method, peer, seq, request_id, duration, bytes (请求 `Body` 的字节数) 和 code
+// 成功的请求使用 Info 级别, 失败的请求使用 Warn 级别并带上 error
+func AccessLog(cfg AccessLogConfig) ServerInterceptor {
+	return func(ctx context.Context, info *CallInfo, argv, replyv interface{}, invoke Invoker) error {
+		start := time.Now()
+		err := invoke(ctx)
+		if err == nil && cfg.SampleRate > 0 && cfg.SampleRate < 1 && rand.Float64() >= cfg.SampleRate {
+			return err
+		}
+		logger := cfg.Logger
+		if logger == nil {
+			logger = slog.Default()
+		}
+		requestID, _ := RequestIDFromContext(ctx)
+		attrs := []slog.Attr{
+			slog.String("method", info.ServiceMethod),
+			slog.String("peer", info.Addr),
+			slog.Uint64("seq", info.Seq),
+			slog.String("request_id", requestID),
+			slog.Duration("duration", time.Since(start)),
+			slog.Int("bytes", info.RequestBytes),
+			slog.String("code", observeCode(err).String()),
+		}
+		level := slog.LevelInfo
+		if err != nil {
+			level = slog.LevelWarn
+			attrs = append(attrs, slog.String("error", err.Error()))
+		}
+		logger.LogAttrs(ctx, level, "rpc server: access", attrs...)
+		return err
+	}
+}
@@ -0,0 +1,69 @@
+// Package admin 提供 minirpc 服务端的管理接口, 挂载到已有的 http.ServeMux 上, 与其他运维接口共用一个端口:
+//
+//	mux := http.NewServeMux()
+//	admin.Handle(mux, "/admin", server)
+//	go http.ListenAndServe(":6060", mux)
+//
+// 提供的接口, 除 pprof 之外都返回 JSON:
+//
+//	/healthz         服务端正常时返回 200, 调用 Shutdown 之后返回 503
+//	/services        注册的服务和方法
+//	/stats           每个方法的调用统计, 见 minirpc.Server.Stats
+//	/connections     正在服务的链接
+//	/debug/pprof/    net/http/pprof 的性能分析接口
+//
+// 导入这个包会像 net/http/pprof 一样在 http.DefaultServeMux 上注册 /debug/pprof/
+package admin
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/pprof"
+	"strings"
+
+	"github.com/fanyeke/minirpc"
+)
+
+// Handle 在 mux 上以 prefix 为前缀注册 server 的管理接口, prefix 可以为空
+func Handle(mux *http.ServeMux, prefix string, server *minirpc.Server) {
+	prefix = strings.TrimSuffix(prefix, "/")
+	mux.HandleFunc(prefix+"/healthz", func(w http.ResponseWriter, r *http.Request) {
+		if server.ShuttingDown() {
+			http.Error(w, "shutting down", http.StatusServiceUnavailable)
+			return
+		}
+		_, _ = w.Write([]byte("ok\n"))
+	})
+	mux.HandleFunc(prefix+"/services", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, server.Services())
+	})
+	mux.HandleFunc(prefix+"/stats", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, server.Stats())
+	})
+	mux.HandleFunc(prefix+"/connections", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, server.Connections())
+	})
+
+	// pprof.Index 按 /debug/pprof/ 之后的路径查找 profile, 需要先去掉前缀
+	pprofMux := http.NewServeMux()
+	pprofMux.HandleFunc("/debug/pprof/", pprof.Index)
+	pprofMux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+	pprofMux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+	pprofMux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+	pprofMux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+	var handler http.Handler = pprofMux
+	if prefix != "" {
+		handler = http.StripPrefix(prefix, pprofMux)
+	}
+	mux.Handle(prefix+"/debug/pprof/", handler)
+}
+
+// writeJSON 以缩进的 JSON 格式返回 v
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(v); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
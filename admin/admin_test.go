@@ -0,0 +1,87 @@
+package admin
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/fanyeke/minirpc"
+)
+
+type Arith int
+
+func (a Arith) Double(n int, reply *int) error {
+	*reply = n * 2
+	return nil
+}
+
+func get(t *testing.T, url string, v interface{}) int {
+	resp, err := http.Get(url)
+	if err != nil {
+		t.Fatalf("failed to get %s: %v", url, err)
+	}
+	defer func() { _ = resp.Body.Close() }()
+	if v != nil {
+		if err := json.NewDecoder(resp.Body).Decode(v); err != nil {
+			t.Fatalf("failed to decode %s: %v", url, err)
+		}
+	}
+	return resp.StatusCode
+}
+
+func TestHandle(t *testing.T) {
+	var a Arith
+	server := minirpc.NewServer()
+	_ = server.Register(&a)
+	client, err := server.NewPipeClient()
+	if err != nil {
+		t.Fatalf("failed to create pipe client: %v", err)
+	}
+	defer func() { _ = client.Close() }()
+	var reply int
+	_ = client.Call(context.Background(), "Arith.Double", 2, &reply)
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/other", func(w http.ResponseWriter, r *http.Request) {})
+	Handle(mux, "/admin/", server)
+	ts := httptest.NewServer(mux)
+	defer ts.Close()
+
+	if code := get(t, ts.URL+"/admin/healthz", nil); code != http.StatusOK {
+		t.Fatalf("expect healthy, got %d", code)
+	}
+	var services []minirpc.ServiceInfo
+	get(t, ts.URL+"/admin/services", &services)
+	if len(services) != 1 || services[0].Name != "Arith" || services[0].Methods[0].ArgType != "int" {
+		t.Fatalf("unexpected services %+v", services)
+	}
+	var stats []minirpc.MethodStats
+	get(t, ts.URL+"/admin/stats", &stats)
+	if len(stats) != 1 || stats[0].ServiceMethod != "Arith.Double" || stats[0].Calls != 1 {
+		t.Fatalf("unexpected stats %+v", stats)
+	}
+	var conns []minirpc.ConnInfo
+	get(t, ts.URL+"/admin/connections", &conns)
+	if len(conns) != 1 || conns[0].RemoteAddr != "pipe" || conns[0].CodecType != minirpc.DefaultOption.CodecType {
+		t.Fatalf("unexpected connections %+v", conns)
+	}
+	resp, err := http.Get(ts.URL + "/admin/debug/pprof/goroutine?debug=1")
+	if err != nil || resp.StatusCode != http.StatusOK {
+		t.Fatalf("failed to get goroutine profile: %v", err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	_ = resp.Body.Close()
+	if !strings.HasPrefix(string(body), "goroutine profile") {
+		t.Fatalf("expect a goroutine profile, got %.64q", body)
+	}
+
+	_ = client.Close()
+	_ = server.Shutdown(context.Background())
+	if code := get(t, ts.URL+"/admin/healthz", nil); code != http.StatusServiceUnavailable {
+		t.Fatalf("expect unhealthy after shutdown, got %d", code)
+	}
+}
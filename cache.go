@@ -0,0 +1,123 @@
+package minirpc
+
+import (
+	"bytes"
+	"container/list"
+	"context"
+	"encoding/gob"
+	"reflect"
+	"sync"
+	"time"
+)
+
+// ResponseCache 客户端的响应缓存, 用于配置查询之类读多写少的方法, 通过 Interceptor 使用
+// 用于 XClient 时放在 NewXClient 的 Option.Interceptors 中, 所有服务实例共用同一个缓存
+// 以方法, 参数, 元数据和返回值类型区分请求, 只缓存成功的响应; 返回值以 gob 编码保存, 每次命中都得到独立的副本
+type ResponseCache struct {
+	// TTL 每个方法的缓存时间, 键是 "Service.Method", 不在其中的方法不缓存
+	TTL map[string]time.Duration
+	// MaxEntries 最多缓存的响应数, 超过时淘汰最久没有使用的, 0 表示不限制
+	MaxEntries int
+
+	mu      sync.Mutex
+	entries map[string]*list.Element
+	lru     *list.List // 最近使用的在前面
+	hits    int64
+	misses  int64
+}
+
+// cacheEntry 一个缓存的响应
+type cacheEntry struct {
+	key     string
+	reply   []byte // gob 编码之后的返回值
+	expires time.Time
+}
+
+// CacheStats 缓存的统计信息
+type CacheStats struct {
+	Entries int
+	Hits    int64
+	Misses  int64
+}
+
+// Interceptor 返回使用这个缓存的客户端拦截器
+func (c *ResponseCache) Interceptor() ClientInterceptor {
+	return func(ctx context.Context, info *CallInfo, args, reply interface{}, invoke Invoker) error {
+		ttl := c.TTL[info.ServiceMethod]
+		if ttl <= 0 {
+			return invoke(ctx)
+		}
+		key, ok := requestKey(ctx, info.ServiceMethod, args, reply)
+		if !ok {
+			return invoke(ctx)
+		}
+		if data, ok := c.get(key); ok {
+			rv := reflect.ValueOf(reply).Elem()
+			rv.Set(reflect.Zero(rv.Type()))
+			if gob.NewDecoder(bytes.NewReader(data)).Decode(reply) == nil {
+				return nil
+			}
+		}
+		if err := invoke(ctx); err != nil {
+			return err
+		}
+		var buf bytes.Buffer
+		if gob.NewEncoder(&buf).Encode(reply) == nil {
+			c.put(key, buf.Bytes(), ttl)
+		}
+		return nil
+	}
+}
+
+// get 返回没有过期的响应, 并把它移到最前面
+func (c *ResponseCache) get(key string) ([]byte, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if el, ok := c.entries[key]; ok {
+		e := el.Value.(*cacheEntry)
+		if time.Now().Before(e.expires) {
+			c.lru.MoveToFront(el)
+			c.hits++
+			return e.reply, true
+		}
+		c.remove(el)
+	}
+	c.misses++
+	return nil, false
+}
+
+// put 缓存一个响应, 超过 MaxEntries 时淘汰最久没有使用的
+func (c *ResponseCache) put(key string, reply []byte, ttl time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.entries == nil {
+		c.entries, c.lru = make(map[string]*list.Element), list.New()
+	}
+	if el, ok := c.entries[key]; ok {
+		c.remove(el)
+	}
+	c.entries[key] = c.lru.PushFront(&cacheEntry{key: key, reply: reply, expires: time.Now().Add(ttl)})
+	for c.MaxEntries > 0 && c.lru.Len() > c.MaxEntries {
+		c.remove(c.lru.Back())
+	}
+}
+
+// remove 删除一个缓存, 调用方需要持有 mu
+func (c *ResponseCache) remove(el *list.Element) {
+	c.lru.Remove(el)
+	delete(c.entries, el.Value.(*cacheEntry).key)
+}
+
+// Purge 清空缓存, 比如已知配置发生了变化
+func (c *ResponseCache) Purge() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.entries, c.lru = nil, nil
+}
+
+// Stats 返回缓存的条数和命中次数
+func (c *ResponseCache) Stats() CacheStats {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return CacheStats{Entries: len(c.entries), Hits: c.hits, Misses: c.misses}
+}
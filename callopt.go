@@ -0,0 +1,130 @@
+package minirpc
+
+import (
+	"context"
+	"math/rand"
+	"time"
+
+	"github.com/fanyeke/minirpc/codec"
+)
+
+// CallOption 单次调用的设置, 传给 Client.Call 和 Client.Go, 覆盖链接级别的 Option
+type CallOption func(*callOptions)
+
+// callOptions CallOption 设置的值, 零值表示使用链接的设置
+type callOptions struct {
+	timeout     time.Duration
+	metadata    map[string]string
+	contentType codec.Type
+	noCompress  bool
+	retry       *RetryPolicy
+}
+
+// newCallOptions 依次应用 opts, 后面的设置覆盖前面的
+func newCallOptions(opts []CallOption) *callOptions {
+	o := &callOptions{}
+	for _, opt := range opts {
+		opt(o)
+	}
+	return o
+}
+
+// apply 把设置写入 Go 发出的 call
+func (o *callOptions) apply(call *Call) {
+	call.Metadata = copyMetadata(o.metadata)
+	call.ContentType = o.contentType
+	call.NoCompress = o.noCompress
+	if o.timeout > 0 {
+		call.Timeout = o.timeout
+		call.Deadline = time.Now().Add(o.timeout)
+	}
+}
+
+// WithTimeout 限制这次调用的时间, 与 ctx 的截止时间取较早的一个; 设置了重试时包括所有的重试
+// Go 发出的请求没有 ctx, 超时只会告诉服务端, 由服务端回复超时
+func WithTimeout(d time.Duration) CallOption {
+	return func(o *callOptions) { o.timeout = d }
+}
+
+// WithMetadata 随这次请求发送的元数据, 与 NewOutgoingContext 设置的元数据合并, 相同的键以 md 为准
+func WithMetadata(md map[string]string) CallOption {
+	return func(o *callOptions) { o.metadata = md }
+}
+
+// MetadataFromCallOptions 返回 opts 中 WithMetadata 设置的元数据, 没有设置时返回 nil
+// 在发出请求之前需要知道元数据的地方使用, 比如 xclient 按元数据路由
+func MetadataFromCallOptions(opts ...CallOption) map[string]string {
+	return newCallOptions(opts).metadata
+}
+
+// WithContentType 使用 typ 编码这次请求和响应的 `Body`, 见 Call.ContentType
+func WithContentType(typ codec.Type) CallOption {
+	return func(o *callOptions) { o.contentType = typ }
+}
+
+// WithoutCompression 这次请求和响应的 `Body` 都不压缩, 用于已经压缩过的数据, 比如图片
+func WithoutCompression() CallOption {
+	return func(o *callOptions) { o.noCompress = true }
+}
+
+// WithRetry 这次调用失败时按 policy 重试, 只对 Call 有效; 每次重试都会经过拦截器, CallInfo.Attempt 依次增加
+func WithRetry(policy RetryPolicy) CallOption {
+	return func(o *callOptions) { o.retry = &policy }
+}
+
+// RetryPolicy 失败之后的重试策略
+type RetryPolicy struct {
+	MaxAttempts int           // 包括第一次在内最多尝试的次数, 小于 2 时不重试
+	Backoff     time.Duration // 第 n 次重试之前等待 Backoff * 2^(n-1), 0 表示立即重试
+	MaxBackoff  time.Duration // 等待时间的上限, 0 表示不限制
+	// Jitter 在等待时间上随机增减的比例, 取值 [0, 1], 避免大量客户端同时重试
+	Jitter float64
+	// RetryOn 返回 err 是否可以重试, 为空时只重试 CodeUnavailable 和 CodeResourceExhausted
+	// 重试会让方法执行多次, 非幂等的方法不要重试可能已经执行过的错误
+	RetryOn func(err error) bool
+}
+
+// Retryable 返回 err 是否可以重试, 由 RetryOn 或者默认的错误码决定
+func (p *RetryPolicy) Retryable(err error) bool {
+	if p.RetryOn != nil {
+		return p.RetryOn(err)
+	}
+	code := codeOf(err)
+	return code == CodeUnavailable || code == CodeResourceExhausted
+}
+
+// backoff 返回第 n 次重试之前的等待时间
+func (p *RetryPolicy) backoff(n int) time.Duration {
+	d := p.Backoff
+	for i := 1; i < n && d > 0; i++ {
+		if d *= 2; p.MaxBackoff > 0 && d >= p.MaxBackoff {
+			break
+		}
+	}
+	if p.MaxBackoff > 0 && d > p.MaxBackoff {
+		d = p.MaxBackoff
+	}
+	if p.Jitter > 0 {
+		d += time.Duration(p.Jitter * (2*rand.Float64() - 1) * float64(d))
+	}
+	return d
+}
+
+// Do 调用 invoke, 失败时按策略重试, 直到成功, 次数用完, 错误不能重试或者 ctx 结束
+// 每次调用 invoke 的 ctx 都记录了重试次数, 见 AttemptFromContext; XClient 等自己选择链接的调用方可以直接使用
+func (p *RetryPolicy) Do(ctx context.Context, invoke Invoker) error {
+	first := AttemptFromContext(ctx)
+	for n := 0; ; n++ {
+		err := invoke(NewAttemptContext(ctx, first+n))
+		if err == nil || n+1 >= p.MaxAttempts || ctx.Err() != nil || !p.Retryable(err) {
+			return err
+		}
+		if d := p.backoff(n + 1); d > 0 {
+			select {
+			case <-time.After(d):
+			case <-ctx.Done():
+				return err
+			}
+		}
+	}
+}
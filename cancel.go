@@ -0,0 +1,64 @@
+package minirpc
+
+import (
+	"context"
+	"errors"
+
+	"github.com/fanyeke/minirpc/codec"
+)
+
+// cancelMethod 客户端取消请求的控制消息, Seq 是被取消的请求的序号, 服务端不回复
+// 服务端收到之后取消对应方法的 context, 并且丢弃这个请求的响应
+const cancelMethod = "MiniRPC.Cancel"
+
+// errCanceledByClient 方法的 context 因为客户端取消而结束时 context.Cause 返回的错误
+var errCanceledByClient = errors.New("rpc server: request canceled by client")
+
+// track 为请求创建可以被客户端取消的 context, 请求处理完成之后需要调用 untrack
+func (c *serverConn) track(ctx context.Context, seq uint64) context.Context {
+	ctx, cancel := context.WithCancelCause(ctx)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.inflight == nil {
+		c.inflight = make(map[uint64]context.CancelCauseFunc)
+	}
+	c.inflight[seq] = cancel
+	return ctx
+}
+
+// untrack 请求处理完成, 释放它的 context
+func (c *serverConn) untrack(seq uint64) {
+	c.mu.Lock()
+	cancel := c.inflight[seq]
+	delete(c.inflight, seq)
+	c.mu.Unlock()
+	if cancel != nil {
+		cancel(context.Canceled)
+	}
+}
+
+// cancel 取消序号为 seq 的请求, 请求已经完成时什么也不做
+func (c *serverConn) cancel(seq uint64) {
+	c.mu.Lock()
+	cancel := c.inflight[seq]
+	c.mu.Unlock()
+	if cancel != nil {
+		cancel(errCanceledByClient)
+	}
+}
+
+// canceledByClient 返回 ctx 是否已经被客户端取消, 此时不需要再回复
+func canceledByClient(ctx context.Context) bool {
+	return context.Cause(ctx) == errCanceledByClient
+}
+
+// sendCancel 通知服务端取消序号为 seq 的请求, 发送失败时忽略, 链接的错误会由 receive 处理
+func (client *Client) sendCancel(seq uint64) {
+	client.lockSending()
+	defer client.unlockSending()
+	h := &codec.Header{ServiceMethod: cancelMethod, Seq: seq}
+	if client.cc.Write(h, invalidRequest) == nil {
+		client.counters.framesWritten.Add(1)
+		client.dump.header("->", h)
+	}
+}
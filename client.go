@@ -3,15 +3,16 @@ package minirpc
 import (
 	"bufio"
 	"context"
-	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
 	"log"
+	"log/slog"
 	"net"
 	"net/http"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/fanyeke/minirpc/codec"
@@ -24,10 +25,22 @@ type Call struct {
 	Reply         interface{}
 	Error         error
 	Done          chan *Call
+	ContentType   codec.Type        // 请求和响应 `Body` 的编码方式, 为空时使用链接的编解码方式
+	Metadata      map[string]string // 随请求发送的元数据, Call 使用 NewOutgoingContext 设置的值
+	ReplyMetadata map[string]string // 服务端在响应中携带的元数据, 由方法通过 SetTrailer 设置
+	Timeout       time.Duration     // 随请求发送的剩余等待时间, 0 表示不限制, Call 根据 ctx 的截止时间设置
+	RequestID     string            // 随请求发送的请求 ID, 为空时自动生成, Call 使用 NewRequestIDContext 设置的值
+	Deadline      time.Time         // 请求过期的时间, 服务端不再处理已经过期的请求, Call 根据 ctx 的截止时间设置
+	NoCompress    bool              // 请求和响应的 `Body` 都不压缩, 见 WithoutCompression
+
+	start    time.Time       // 请求开始发送的时间
+	observer RequestObserver // 来自 Option.Observer
+	size     atomic.Int64    // 请求 `Body` 编码之后的字节数, 编解码器不支持时为 0; 使用发送队列时由另一个 goroutine 写入
 }
 
 // done Done 的类型是 chan *Call, 当调用结束时, 会调用 call.done() 通知调用方
 func (call *Call) done() {
+	call.observe(call.Error)
 	call.Done <- call
 }
 
@@ -35,19 +48,44 @@ func (call *Call) done() {
 type Client struct {
 	cc       codec.Codec // 消息的编解码器
 	opt      *Option
-	sending  sync.Mutex   // 保证请求有序发送
-	header   codec.Header // 请求消息头
+	sending  sync.Mutex // 保证请求有序发送, 写入请求时通过 lockSending 获取
 	mu       sync.Mutex
-	seq      uint64           // 请求编号
-	pending  map[uint64]*Call // 储存未完成的请求
-	closing  bool             // 用户主动关闭
-	shutdown bool             // 发生错误关闭, 都代表 `Client` 处于不可用状态
+	seq      atomic.Uint64      // 最近分配的请求编号
+	pending  *pendingMap        // 储存未完成的请求, 有自己的锁, 不需要持有 mu
+	closing  bool               // 用户主动关闭
+	shutdown bool               // 发生错误关闭, 都代表 `Client` 处于不可用状态
+	draining bool               // 服务端即将关闭链接, 不再发送新的请求, 已经发出的请求完成后关闭
+	addr     string             // 服务端的地址, 链接没有地址时为空
+	counters *connCounters      // 链接读写的字节数和帧数, 见 Stats
+	stats    clientCounters     // 请求数和重连次数, 重连之后继续累计, 见 Stats
+	dump     *wireDumper        // 为 nil 时不输出, 见 Option.WireDump
+	version  int                // 与服务端协商之后的协议版本, 重连之后可能改变
+	compress codec.CompressType // 与服务端协商之后的压缩方式, 重连之后可能改变
+	// reconnecting 链接断开之后正在重连, 新的请求返回 ErrReconnecting, 见 Option.Reconnect
+	reconnecting bool
+	redial       func() (*Client, error) // 重新建立链接并完成握手, 为空时不重连
+	closed       chan struct{}           // Close 时关闭, 结束重连的等待
+	slots        chan struct{}           // 每个未完成的请求占用一个位置, 为 nil 时不限制, 见 Option.MaxPendingCalls
+	flusher      codec.Flusher           // 编解码器支持合并发送时不为 nil, 见 unlockSending
+	sendq        *sendQueue              // 为 nil 时调用方直接写入链接, 见 Option.SendQueueSize
+	writers      atomic.Int32            // 正在写入或者等待写入的 goroutine 数
+	// lastRead 最近一次收到数据的时间, Unix 纳秒时间戳, 见 Option.Keepalive
+	lastRead atomic.Int64
+	// keepaliveExpired 链接因为 ping 没有回复而被关闭, 已经发出的请求返回 ErrKeepaliveTimeout
+	keepaliveExpired atomic.Bool
+	// refusal 不为 nil 时新的请求返回的错误, 由 closing 等状态在 mu 的保护下计算, 发送请求时不需要加锁
+	refusal atomic.Pointer[error]
+	// interceptors 来自 Option.Interceptors 和 Use, 只会整体替换, 读取时不需要加锁
+	interceptors atomic.Pointer[[]ClientInterceptor]
 }
 
 var _ io.Closer = (*Client)(nil)
 
 var ErrShutdown = errors.New("connection is shut down")
 
+// ErrGoAway 服务端即将关闭链接时, 新的请求返回这个错误, 调用方可以换一个链接重试
+var ErrGoAway = errors.New("rpc client: server is going away")
+
 // Close 实现 `io.Closer` 接口
 func (client *Client) Close() error {
 	client.mu.Lock()
@@ -58,6 +96,13 @@ func (client *Client) Close() error {
 	}
 	// 服务端还被主动关闭, 则将其置为关闭状态
 	client.closing = true
+	client.updateRefusal()
+	close(client.closed)
+	client.sendq.stop()
+	// 正在重连时旧的链接已经关闭
+	if client.reconnecting {
+		return nil
+	}
 	// 关闭链接
 	return client.cc.Close()
 }
@@ -66,31 +111,114 @@ func (client *Client) Close() error {
 func (client *Client) IsAvailable() bool {
 	client.mu.Lock()
 	defer client.mu.Unlock()
-	// 两个状态都没有被置为关闭方可返回 `true`
-	return !client.shutdown && !client.closing
+	// 三个状态都没有被置为关闭方可返回 `true`
+	return !client.shutdown && !client.closing && !client.draining && !client.reconnecting
 }
 
-// registerCall 注册请求
-func (client *Client) registerCall(call *Call) (uint64, error) {
+// NumPending 返回已经发出但还没有完成的请求数
+func (client *Client) NumPending() int {
+	return client.pending.len()
+}
+
+// Stats 返回未完成的请求数, 累计的请求数和重连次数, 以及当前链接上读写的字节数和帧数,
+// 字节数和帧数包括握手和取消请求等控制消息, 重连之后从 0 开始; 可以用来导出监控指标
+func (client *Client) Stats() ClientStats {
+	client.mu.Lock()
+	conn := client.counters.snapshot()
+	client.mu.Unlock()
+	return ClientStats{
+		ConnStats:     conn,
+		Pending:       client.pending.len(),
+		CallsSent:     client.stats.callsSent.Load(),
+		CallsReceived: client.stats.callsReceived.Load(),
+		Notifications: client.stats.notifications.Load(),
+		Reconnects:    client.stats.reconnects.Load(),
+	}
+}
+
+// Use 在已有的拦截器之后加入 interceptors, 之后的 Call 都会经过它们, 先加入的在外层
+// 只影响这个客户端, 不会修改创建时传入的 Option
+func (client *Client) Use(interceptors ...ClientInterceptor) {
+	client.mu.Lock()
+	defer client.mu.Unlock()
+	// 复制之后整体替换, 正在进行的 Call 看到的切片不会被修改
+	old := *client.interceptors.Load()
+	all := append(old[:len(old):len(old)], interceptors...)
+	client.interceptors.Store(&all)
+}
+
+// IsDraining 返回服务端是否已经通知即将关闭链接, 此时已经发出的请求仍然会完成
+func (client *Client) IsDraining() bool {
+	client.mu.Lock()
+	defer client.mu.Unlock()
+	return client.draining
+}
+
+// startDraining 收到服务端的 goAwayMethod 之后调用
+func (client *Client) startDraining() {
+	client.mu.Lock()
+	defer client.mu.Unlock()
+	client.draining = true
+	client.updateRefusal()
+}
+
+// drained 返回链接是否正在关闭并且没有未完成的请求
+func (client *Client) drained() bool {
 	client.mu.Lock()
 	defer client.mu.Unlock()
-	if client.closing || client.shutdown {
-		return 0, ErrShutdown
+	return client.draining && client.pending.len() == 0
+}
+
+// updateRefusal 根据 closing 等状态更新新的请求返回的错误, 修改这些状态之后调用, 调用方需要持有 mu
+func (client *Client) updateRefusal() {
+	var err error
+	switch {
+	case client.closing || client.shutdown:
+		err = ErrShutdown
+	case client.draining:
+		err = ErrGoAway
+	case client.reconnecting:
+		err = ErrReconnecting
+	}
+	if err == nil {
+		client.refusal.Store(nil)
+		return
+	}
+	client.refusal.Store(&err)
+}
+
+// registerCall 注册请求
+func (client *Client) registerCall(call *Call) (uint64, error) {
+	seq, err := client.nextSeq()
+	if err != nil {
+		return 0, err
 	}
 	// 客户端seq传递给请求的seq
-	call.Seq = client.seq
+	call.Seq = seq
 	// 注册到map中
-	client.pending[call.Seq] = call
-	client.seq++
-	return call.Seq, nil
+	client.pending.store(seq, call)
+	// 不持有 sending 时可能与 terminateCalls 和 startReconnect 同时进行, 它们先更新 refusal 再清空 pending,
+	// 因此这里再检查一次; 已经被它们结束的请求不能再次结束
+	if err := client.refusal.Load(); err != nil && client.pending.remove(seq) != nil {
+		return 0, *err
+	}
+	return seq, nil
+}
+
+// nextSeq 客户端可用时分配一个请求编号
+func (client *Client) nextSeq() (uint64, error) {
+	if err := client.refusal.Load(); err != nil {
+		return 0, *err
+	}
+	return client.seq.Add(1), nil
 }
 
 // remoceCall 移除请求
 func (client *Client) removeCall(seq uint64) *Call {
-	client.mu.Lock()
-	defer client.mu.Unlock()
-	call := client.pending[seq]
-	delete(client.pending, seq)
+	call := client.pending.remove(seq)
+	if call != nil {
+		client.release()
+	}
 	return call
 }
 
@@ -101,23 +229,68 @@ func (client *Client) terminateCalls(err error) {
 	client.mu.Lock()
 	defer client.mu.Unlock()
 	client.shutdown = true
-	for _, call := range client.pending {
+	client.updateRefusal()
+	client.sendq.stop()
+	client.pending.removeAll(func(call *Call) {
+		client.release()
 		call.Error = err
 		call.done()
-	}
+	})
 }
 
-// erceive 接受服务的处理结果
+// receive 接收服务的处理结果, 链接断开时按 Option.Reconnect 重连, 不重连时终止所有请求
 func (client *Client) receive() {
+	for {
+		err := client.readResponses()
+		if client.keepaliveExpired.Swap(false) {
+			err = ErrKeepaliveTimeout
+		}
+		if client.redial == nil || !client.startReconnect(err) {
+			client.terminateCalls(err)
+			return
+		}
+		if !client.reconnect() {
+			client.terminateCalls(err)
+			return
+		}
+	}
+}
+
+// readResponses 读取响应直到链接出错, 或者服务端通知关闭之后请求全部完成
+func (client *Client) readResponses() error {
 	var err error
 	for err == nil {
+		// 服务端即将关闭链接, 并且已经发出的请求全部完成
+		if client.drained() {
+			_ = client.Close()
+			break
+		}
 		var h codec.Header
 		// 解码服务器消息中的 `Header`
 		if err = client.cc.ReadHeader(&h); err != nil {
+			client.dump.readError(err)
 			break
 		}
+		client.counters.framesRead.Add(1)
+		client.lastRead.Store(time.Now().UnixNano())
+		client.dump.header("<-", &h)
+		// ping 的回复只用于确认链接存活
+		if h.Seq == 0 && h.ServiceMethod == pingMethod {
+			err = client.cc.ReadBody(nil)
+			continue
+		}
+		// 服务端即将关闭链接, 不再发送新的请求
+		if h.Seq == 0 && h.ServiceMethod == goAwayMethod {
+			err = client.cc.ReadBody(nil)
+			client.startDraining()
+			continue
+		}
+		client.stats.callsReceived.Add(1)
 		// 完成请求, 不论如何删除并拿到当初的 `Call`
 		call := client.removeCall(h.Seq)
+		if call != nil {
+			call.ReplyMetadata = h.Metadata
+		}
 
 		/*
 		   1. call 不存在，可能是请求没有发送完整，或者因为其他原因被取消，但是服务端仍旧处理了。
@@ -128,56 +301,141 @@ func (client *Client) receive() {
 		case call == nil:
 			err = client.cc.ReadBody(nil)
 		case h.Error != "":
-			call.Error = fmt.Errorf(h.Error)
-			err = client.cc.ReadBody(nil)
+			rpcErr := responseError(&h)
+			err = readErrorDetails(client.cc, &h, rpcErr)
+			call.Error = rpcErr
 			call.done()
 		default:
 			err = client.cc.ReadBody(call.Reply)
 			if err != nil {
-				call.Error = errors.New("reading body" + err.Error())
+				call.Error = fmt.Errorf("reading body: %w", err)
+				// 只是这一帧无法解码, 数据流没有错位, 链接可以继续使用
+				var decodeErr *codec.DecodeError
+				if errors.As(err, &decodeErr) {
+					err = nil
+				}
 			}
 			call.done()
 		}
 	}
-	// 因为是不断轮询的, 因此走到这里一定是发生错误, 终止所有请求
-	client.terminateCalls(err)
+	return err
 }
 
 // NewClient 创建一个客户端
 func NewClient(conn net.Conn, opt *Option) (*Client, error) {
+	client, err := newClient(conn, opt)
+	if err != nil {
+		return nil, err
+	}
+	client.start()
+	return client, nil
+}
+
+// newClient 在 conn 上完成握手, 返回还没有开始接收响应的客户端
+func newClient(conn net.Conn, opt *Option) (*Client, error) {
+	// 握手失败时 readHandshakeReply 返回的 opt 为空
+	logger := opt.Logger
 	// 客户端获取编解码的函数
 	f := codec.NewCodecFuncMap[opt.CodecType]
 
 	// 如果编解码函数没有定义
 	if f == nil {
 		err := fmt.Errorf("invalid codec error: %s", opt.CodecType)
-		log.Println("rpc client: codec error:", err)
+		logger.logf(slog.LevelError, "rpc client: codec error: %v", err)
+		return nil, err
+	}
+	// 统计链接读写的字节数, 握手也计算在内
+	counters := new(connCounters)
+	dump := newWireDumper(opt.WireDump, "client", conn)
+	rwc := dump.wrap(&countingConn{ReadWriteCloser: conn, counters: counters})
+	// 发送编解码的设置
+	if err := writePreamble(rwc, opt); err != nil {
+		logger.logf(slog.LevelError, "rpc client: options err: %v", err)
+		_ = conn.Close()
 		return nil, err
 	}
-	// 读取编解码的设置
-	if err := json.NewEncoder(conn).Encode(opt); err != nil {
-		log.Println("rpc client: options err:", err)
+	// 读取服务端协商之后的协议版本和压缩方式
+	opt, err := readHandshakeReply(rwc, opt)
+	if err != nil {
+		logger.logf(slog.LevelError, "rpc client: handshake error: %v", err)
 		_ = conn.Close()
 		return nil, err
 	}
 	// 创建客户端编解码器
-	return newClientCodec(f(conn), opt), nil
+	cc := f(rwc)
+	if err := configureCodec(cc, opt, msgLimit(opt.MaxRecvMsgSize), msgLimit(opt.MaxSendMsgSize)); err != nil {
+		logger.logf(slog.LevelError, "rpc client: %v", err)
+		_ = conn.Close()
+		return nil, err
+	}
+	client := newClientCodec(cc, opt, counters, dump)
+	if addr := conn.RemoteAddr(); addr != nil {
+		client.addr = addr.String()
+	}
+	return client, nil
+}
+
+// RemoteAddr 返回服务端的地址
+func (client *Client) RemoteAddr() string {
+	return client.addr
+}
+
+// ProtocolVersion 返回与服务端协商之后的协议版本
+func (client *Client) ProtocolVersion() int {
+	client.mu.Lock()
+	defer client.mu.Unlock()
+	return client.version
 }
 
-// newClientCodec 创建客户端
-func newClientCodec(cc codec.Codec, opt *Option) *Client {
+// CompressType 返回与服务端协商之后的压缩方式
+func (client *Client) CompressType() codec.CompressType {
+	client.mu.Lock()
+	defer client.mu.Unlock()
+	return client.compress
+}
+
+// newClientCodec 创建客户端, 需要调用 start 开始接收响应
+func newClientCodec(cc codec.Codec, opt *Option, counters *connCounters, dump *wireDumper) *Client {
 	client := &Client{
-		seq:     1,
-		cc:      cc,
-		opt:     opt,
-		pending: make(map[uint64]*Call),
+		cc:       cc,
+		opt:      opt,
+		pending:  newPendingMap(),
+		counters: counters,
+		dump:     dump,
+		version:  opt.ProtocolVersion,
+		compress: opt.CompressType,
+		closed:   make(chan struct{}),
 	}
-	// 开启轮询接受消息
-	go client.receive()
+	// 限制容量, Use 不会写入 Option 的底层数组
+	interceptors := opt.Interceptors[:len(opt.Interceptors):len(opt.Interceptors)]
+	client.interceptors.Store(&interceptors)
+	if opt.MaxPendingCalls > 0 {
+		client.slots = make(chan struct{}, opt.MaxPendingCalls)
+	}
+	if opt.SendQueueSize > 0 {
+		client.sendq = newSendQueue(client, opt.SendQueueSize, opt.SendQueueOverflow)
+	}
+	// 并发的请求合并到一次 Flush 中发送
+	if f, ok := cc.(codec.Flusher); ok {
+		f.SetAutoFlush(false)
+		client.flusher = f
+	}
+	client.lastRead.Store(time.Now().UnixNano())
 	return client
 }
 
-// parseOption 解析配置
+// start 开启轮询接受消息, 设置了 Option.Keepalive 时定期检查链接
+func (client *Client) start() {
+	go client.receive()
+	if client.sendq != nil {
+		go client.sendq.run()
+	}
+	if ka := client.opt.Keepalive; ka != nil && ka.Interval > 0 {
+		go client.keepalive(ka)
+	}
+}
+
+// parseOption 解析配置, 返回填好默认值的副本, 不修改调用方的 Option, 多个 goroutine 可以同时使用同一个 Option 建立链接
 func parseOption(opts ...*Option) (*Option, error) {
 	if len(opts) == 0 || opts[0] == nil {
 		return DefaultOption, nil
@@ -185,8 +443,12 @@ func parseOption(opts ...*Option) (*Option, error) {
 	if len(opts) != 1 {
 		return nil, errors.New("number of options is more than 1")
 	}
-	opt := opts[0]
+	o := *opts[0]
+	opt := &o
 	opt.MagicNumber = DefaultOption.MagicNumber
+	if opt.ProtocolVersion == 0 {
+		opt.ProtocolVersion = DefaultOption.ProtocolVersion
+	}
 	if opt.CodecType == "" {
 		opt.CodecType = DefaultOption.CodecType
 	}
@@ -194,62 +456,230 @@ func parseOption(opts ...*Option) (*Option, error) {
 }
 
 // send 客户端发送请求, 传入参数是一个call
-func (client *Client) send(call *Call) {
-	client.sending.Lock()
-	defer client.sending.Unlock()
+// 设置了 Option.SendQueueSize 时注册之后放入发送队列, 由 sendQueue 写入链接, ctx 用于等待队列的空位
+func (client *Client) send(ctx context.Context, call *Call) {
+	call.start, call.observer = time.Now(), client.opt.Observer
+	// 请求 ID 随元数据发送, 用于关联客户端和服务端的日志
+	if call.RequestID == "" {
+		call.RequestID = newRequestID()
+	}
+	if client.sendq != nil {
+		if _, err := client.registerCall(call); err != nil {
+			client.release()
+			call.Error = err
+			call.done()
+			return
+		}
+		client.sendq.push(ctx, call)
+		return
+	}
+	client.lockSending()
+	defer client.unlockSending()
 	// 首先把这个call注册到映射map中
-	seq, err := client.registerCall(call)
-	if err != nil {
+	if _, err := client.registerCall(call); err != nil {
+		client.release()
 		call.Error = err
 		call.done()
 		return
 	}
-	// 定义请求消息的头部
-	client.header.ServiceMethod = call.ServiceMethod
-	client.header.Seq = seq
-	client.header.Error = ""
-	// 发送请求消息
-	if err := client.cc.Write(&client.header, call.Args); err != nil {
-		call := client.removeCall(seq)
-		if call != nil {
-			call.Error = err
-			call.done()
+	client.writeCall(call)
+}
+
+// writeCall 写入已经注册的 call, 失败时结束它; 已经被取消或者结束的请求不再写入, 调用方需要持有 sending
+func (client *Client) writeCall(call *Call) {
+	if !client.pending.has(call.Seq) {
+		return
+	}
+	if err := client.writeRequest(call, call.Seq, false); err != nil {
+		client.failCall(call.Seq, err)
+	}
+}
+
+// failCall 以 err 结束还没有完成的请求 seq
+func (client *Client) failCall(seq uint64, err error) {
+	if call := client.removeCall(seq); call != nil {
+		call.Error = err
+		call.done()
+	}
+}
+
+// lockSending 写入请求之前调用, 与 unlockSending 配对
+func (client *Client) lockSending() {
+	client.writers.Add(1)
+	client.sending.Lock()
+}
+
+// unlockSending 还有其他 goroutine 等待写入时把缓冲区留给它们一起发送, 最后一个写入的 goroutine 负责 Flush
+// 高并发时多个请求合并成一次系统调用; 没有并发时与每次写入之后立即发送相同
+func (client *Client) unlockSending() {
+	if client.writers.Add(-1) == 0 && client.flusher != nil {
+		if err := client.flusher.Flush(); err != nil {
+			// 数据可能只发送了一部分, receive 随之结束已经发出的请求
+			_ = client.cc.Close()
 		}
 	}
+	client.sending.Unlock()
 }
 
-// Go 异步调用函数
-func (client *Client) Go(serviceMethod string, args, reply interface{}, done chan *Call) *Call {
-	// 如果 done 没有初始化 或者 初始化容量为0
-	if done == nil {
-		done = make(chan *Call, 10)
-	} else if cap(done) == 0 {
-		log.Panic("rpc client: done is unbuffered")
+// writeRequest 以编号 seq 写入 call 的请求, 调用方需要持有 sending
+func (client *Client) writeRequest(call *Call, seq uint64, oneWay bool) error {
+	// 请求 ID 随元数据发送, 用于关联客户端和服务端的日志
+	if call.RequestID == "" {
+		call.RequestID = newRequestID()
 	}
+	// 定义请求消息的头部, 每个请求使用自己的 `Header`
+	h := &codec.Header{
+		ServiceMethod: call.ServiceMethod,
+		Seq:           seq,
+		Metadata:      withRequestID(call.Metadata, call.RequestID),
+		ContentType:   call.ContentType,
+		Timeout:       call.Timeout,
+		NoCompress:    call.NoCompress,
+		OneWay:        oneWay,
+	}
+	if !call.Deadline.IsZero() {
+		h.Expires = call.Deadline.UnixNano()
+	}
+	// 发送请求消息
+	if err := client.cc.Write(h, call.Args); err != nil {
+		return err
+	}
+	client.counters.framesWritten.Add(1)
+	if oneWay {
+		client.stats.notifications.Add(1)
+	} else {
+		client.stats.callsSent.Add(1)
+	}
+	client.dump.header("->", h)
+	if bs, ok := client.cc.(bodySizer); ok {
+		call.size.Store(int64(bs.SentBodySize()))
+	}
+	return nil
+}
+
+// Go 异步调用函数, opts 中的重试对 Go 无效
+func (client *Client) Go(serviceMethod string, args, reply interface{}, done chan *Call, opts ...CallOption) *Call {
 	call := &Call{
 		ServiceMethod: serviceMethod,
 		Args:          args,
 		Reply:         reply,
 		Done:          done,
 	}
-	client.send(call)
+	newCallOptions(opts).apply(call)
+	return client.GoCall(call)
+}
+
+// GoCall 异步发送一个构造好的 `Call`, 可以设置 ContentType, Metadata 等字段
+func (client *Client) GoCall(call *Call) *Call {
+	// 如果 done 没有初始化 或者 初始化容量为0
+	if call.Done == nil {
+		call.Done = make(chan *Call, 10)
+	} else if cap(call.Done) == 0 {
+		log.Panic("rpc client: done is unbuffered")
+	}
+	// Go 没有 ctx, 设置了 BlockOnPendingLimit 时一直等到有空闲的名额或者客户端被关闭
+	if err := client.acquire(context.Background()); err != nil {
+		call.start, call.observer = time.Now(), client.opt.Observer
+		call.Error = err
+		call.done()
+		return call
+	}
+	client.send(context.Background(), call)
 	return call
 }
 
-// Call 调用指定函数, 并等待其返回, 返回它的错误
-func (client *Client) Call(ctx context.Context, serverMethod string, args, reply interface{}) error {
-	// Go 的目的是调用函数
-	call := client.Go(serverMethod, args, reply, make(chan *Call, 1))
+// Call 调用指定函数, 并等待其返回, 返回它的错误, 设置了 Option.Interceptors 或者调用了 Use 时经过拦截器
+// opts 可以为这一次调用设置超时, 元数据, 编码方式, 压缩和重试
+func (client *Client) Call(ctx context.Context, serverMethod string, args, reply interface{}, opts ...CallOption) error {
+	o := newCallOptions(opts)
+	if o.timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, o.timeout)
+		defer cancel()
+	}
+	if o.metadata != nil {
+		ctx = AppendToOutgoingContext(ctx, o.metadata)
+	}
+	if o.retry == nil {
+		return client.intercept(ctx, serverMethod, args, reply, o)
+	}
+	return o.retry.Do(ctx, func(ctx context.Context) error {
+		return client.intercept(ctx, serverMethod, args, reply, o)
+	})
+}
+
+// intercept 经过拦截器发送一次请求
+func (client *Client) intercept(ctx context.Context, serverMethod string, args, reply interface{}, o *callOptions) error {
+	interceptors := *client.interceptors.Load()
+	if len(interceptors) == 0 {
+		return client.call(ctx, serverMethod, args, reply, o)
+	}
+	info := &CallInfo{
+		ServiceMethod: serverMethod,
+		CodecType:     client.opt.CodecType,
+		Addr:          client.addr,
+		Attempt:       AttemptFromContext(ctx),
+	}
+	return interceptCall(ctx, interceptors, info, args, reply, func(ctx context.Context) error {
+		return client.call(ctx, serverMethod, args, reply, o)
+	})
+}
+
+// call 发送请求并等待响应
+func (client *Client) call(ctx context.Context, serverMethod string, args, reply interface{}, o *callOptions) error {
+	call := &Call{ServiceMethod: serverMethod, Args: args, Reply: reply, Done: make(chan *Call, 1), ContentType: o.contentType, NoCompress: o.noCompress}
+	// NewOutgoingContext 设置的元数据随请求发送
+	if md, ok := FromOutgoingContext(ctx); ok {
+		call.Metadata = md
+	}
+	// 沿用 ctx 中的请求 ID, 服务端的方法用收到的 ctx 发起调用时 ID 会继续传递
+	if id, ok := RequestIDFromContext(ctx); ok {
+		call.RequestID = id
+	}
+	// 已经取消的请求不再发送
+	if err := ctx.Err(); err != nil {
+		return fmt.Errorf("rpc client: call failed: %w", err)
+	}
+	// 把剩余的等待时间告诉服务端, 已经超时的请求不再发送
+	if deadline, ok := ctx.Deadline(); ok {
+		call.Deadline = deadline
+		if call.Timeout = time.Until(deadline); call.Timeout <= 0 {
+			return fmt.Errorf("rpc client: call failed: %w", context.DeadlineExceeded)
+		}
+	}
+	if err := client.acquire(ctx); err != nil {
+		return err
+	}
+	client.send(ctx, call)
 	// 通过context进行超时控制
 	select {
 	case <-ctx.Done():
-		client.removeCall(call.Seq)
-		return errors.New("rpc client: call failed: " + ctx.Err().Error())
+		// 从 pending 中移除, 之后到达的响应会被丢弃; 请求已经发出时通知服务端停止处理
+		// 请求已经完成时由 done 记录, 否则在这里记录
+		if client.removeCall(call.Seq) != nil {
+			client.sendCancel(call.Seq)
+			call.observe(ctx.Err())
+		}
+		client.opt.Logger.sampledf(slog.LevelInfo, "rpc client: request %s %s: %v", call.RequestID, serverMethod, ctx.Err())
+		client.logSlowCall(call)
+		return fmt.Errorf("rpc client: call failed: %w", ctx.Err())
 	case call := <-call.Done:
+		if call.Error != nil {
+			client.opt.Logger.sampledf(slog.LevelWarn, "rpc client: request %s %s: %v", call.RequestID, serverMethod, call.Error)
+		}
+		client.logSlowCall(call)
 		return call.Error
 	}
 }
 
+// logSlowCall 记录等待时间超过 SlowCallThreshold 的请求
+func (client *Client) logSlowCall(call *Call) {
+	threshold := client.opt.SlowCallThreshold
+	if elapsed := time.Since(call.start); threshold > 0 && elapsed >= threshold {
+		client.opt.Logger.sampledf(slog.LevelWarn, "rpc client: slow call %s %s to %s: took %s, %d bytes", call.RequestID, call.ServiceMethod, client.addr, elapsed, call.size.Load())
+	}
+}
+
 type clientResult struct {
 	client *Client
 	err    error
@@ -257,14 +687,32 @@ type clientResult struct {
 
 type newClientFunc func(conn net.Conn, opt *Option) (client *Client, err error)
 
-func dialTimeout(f newClientFunc, network, address string, opts ...*Option) (client *Client, err error) {
+// dialTimeout 建立链接并调用 f 创建客户端, f 返回的客户端还没有开始接收响应
+// 设置了 Option.Reconnect 时, 客户端在链接断开之后用同样的方式重新建立链接
+func dialTimeout(f newClientFunc, network, address string, opts ...*Option) (*Client, error) {
 	// 解析配置
 	opt, err := parseOption(opts...)
 	if err != nil {
 		return nil, err
 	}
-	// 带有超时的链接
-	conn, err := net.DialTimeout(network, address, opt.ConnectTimeout)
+	client, err := dialClient(f, network, address, opt)
+	if err != nil || client == nil {
+		return client, err
+	}
+	if opt.Reconnect != nil {
+		client.redial = func() (*Client, error) {
+			return dialClient(f, network, address, opt)
+		}
+	}
+	client.start()
+	return client, nil
+}
+
+// dialClient 建立链接并创建客户端, ConnectTimeout 限制了建立链接和握手的总时间
+func dialClient(f newClientFunc, network, address string, opt *Option) (client *Client, err error) {
+	deadline := opt.connectDeadline()
+	// 带有超时的链接, 设置了 opt.Transport 时由它建立链接
+	conn, err := opt.dial(network, address, deadline)
 	if err != nil {
 		return nil, err
 	}
@@ -274,38 +722,64 @@ func dialTimeout(f newClientFunc, network, address string, opts ...*Option) (cli
 			_ = conn.Close()
 		}
 	}()
-	// ? 为什么要创建这样一个channel
-	ch := make(chan clientResult)
+	// 没有超时控制收不到数据就会一直阻塞
+	if deadline.IsZero() {
+		return f(conn, opt)
+	}
+	// 链接支持超时时, 服务端停止响应会让握手的读写直接返回错误, 否则超时之后关闭链接让 f 返回
+	_ = conn.SetDeadline(deadline)
+	ch := make(chan clientResult, 1)
 	go func() {
 		client, err := f(conn, opt)
 		ch <- clientResult{client: client, err: err}
 	}()
-	// 没有超时控制收不到数据就会一直阻塞
-	if opt.ConnectTimeout == 0 {
-		result := <-ch
-		return result.client, result.err
-	}
-	// 有超时空值,超时后会返回错误
-	// 不超时则正常返回
+	timer := time.NewTimer(time.Until(deadline))
+	defer timer.Stop()
 	select {
-	case <-time.After(opt.ConnectTimeout):
-		return nil, fmt.Errorf("rpc client: connect timeout: expect within %s", opt.ConnectTimeout)
+	case <-timer.C:
+		// 超时之后创建的客户端没有人使用, 需要关闭
+		go func() {
+			if result := <-ch; result.client != nil {
+				_ = result.client.Close()
+			}
+		}()
+		return nil, opt.connectTimeout()
 	case result := <-ch:
-		return result.client, result.err
+		if result.err != nil {
+			if isTimeout(result.err) {
+				return nil, opt.connectTimeout()
+			}
+			return nil, result.err
+		}
+		_ = conn.SetDeadline(time.Time{})
+		return result.client, nil
 	}
 }
 
 // Dial 方便传入服务器地址
 func Dial(network, address string, opts ...*Option) (client *Client, err error) {
-	return dialTimeout(NewClient, network, address, opts...)
+	return dialTimeout(newClient, network, address, opts...)
 }
 
+// NewHTTPClient 通过 HTTP CONNECT 把链接切换为 rpc 协议, 可以与其他 HTTP 服务共用端口, 也可以穿过 HTTP 代理
 func NewHTTPClient(conn net.Conn, opt *Option) (*Client, error) {
-	_, _ = io.WriteString(conn, fmt.Sprintf("CONNECT %s HTTP/1.0\n\n", defaultPRCPath))
+	client, err := newHTTPClient(conn, opt)
+	if err != nil {
+		return nil, err
+	}
+	client.start()
+	return client, nil
+}
+
+// newHTTPClient 与 NewHTTPClient 相同, 但是还没有开始接收响应
+func newHTTPClient(conn net.Conn, opt *Option) (*Client, error) {
+	if _, err := io.WriteString(conn, fmt.Sprintf("CONNECT %s HTTP/1.0\n\n", defaultPRCPath)); err != nil {
+		return nil, err
+	}
 
 	resp, err := http.ReadResponse(bufio.NewReader(conn), &http.Request{Method: "CONNECT"})
 	if err == nil && resp.Status == connected {
-		return NewClient(conn, opt)
+		return newClient(conn, opt)
 	}
 	if err == nil {
 		err = errors.New("unexpected HTTP response: " + resp.Status)
@@ -313,19 +787,25 @@ func NewHTTPClient(conn net.Conn, opt *Option) (*Client, error) {
 	return nil, err
 }
 
+// DialHTTP 连接 HandleHTTP 注册的 rpc 服务
 func DialHTTP(network, address string, opts ...*Option) (*Client, error) {
-	return dialTimeout(NewHTTPClient, network, address, opts...)
+	return dialTimeout(newHTTPClient, network, address, opts...)
 }
 
+// XDial 根据 rpcAddr 的协议前缀选择连接方式, 例如 tcp@10.0.0.1:7001, http@10.0.0.1:7001,
+// tls@10.0.0.1:7001, unix@/tmp/minirpc.sock, 只按第一个 @ 切分, 因此套接字路径中可以包含 @
 func XDial(rpcAddr string, opts ...*Option) (*Client, error) {
-	parts := strings.Split(rpcAddr, "@")
-	if len(parts) != 2 {
+	protocol, addr, ok := strings.Cut(rpcAddr, "@")
+	if !ok || protocol == "" || addr == "" {
 		return nil, fmt.Errorf("rpc client err: wrong format '%s', expect protocol@addr", rpcAddr)
 	}
-	protocol, addr := parts[0], parts[1]
 	switch protocol {
 	case "http":
 		return DialHTTP("tcp", addr, opts...)
+	case "tls":
+		return DialTLS("tcp", addr, opts...)
+	case "unix":
+		return Dial("unix", addr, opts...)
 	default:
 		return Dial(protocol, addr, opts...)
 	}
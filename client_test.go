@@ -1,13 +1,31 @@
 package minirpc
 
 import (
+	"bufio"
+	"bytes"
 	"context"
+	"encoding/json"
+	"errors"
+	"expvar"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"log/slog"
 	"net"
+	"net/http"
+	"net/http/httptest"
 	"os"
+	"reflect"
 	"runtime"
+	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
+
+	"github.com/fanyeke/minirpc/codec"
 )
 
 func TestClient_dialTimeout(t *testing.T) {
@@ -34,6 +52,34 @@ func TestClient_dialTimeout(t *testing.T) {
 	})
 }
 
+func TestClient_ConnectTimeout(t *testing.T) {
+	t.Parallel()
+
+	// 服务端接受链接但是不回复握手
+	l, _ := net.Listen("tcp", "127.0.0.1:0")
+	defer func() { _ = l.Close() }()
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			defer func() { _ = conn.Close() }()
+		}
+	}()
+	// 建立链接用掉一部分时间, 握手只能使用剩下的时间
+	slow := TransportFunc(func(network, address string) (io.ReadWriteCloser, error) {
+		time.Sleep(150 * time.Millisecond)
+		return net.Dial(network, address)
+	})
+	start := time.Now()
+	_, err := Dial("tcp", l.Addr().String(), &Option{Transport: slow, ConnectTimeout: 300 * time.Millisecond})
+	elapsed := time.Since(start)
+	_assert(errors.Is(err, ErrConnectTimeout), "expect ErrConnectTimeout, got %v", err)
+	_assert(errors.Is(err, ErrDeadlineExceeded), "expect a deadline exceeded code, got %v", err)
+	_assert(elapsed < 450*time.Millisecond, "timeout should cover dial and handshake, took %s", elapsed)
+}
+
 type Bar int
 
 func (b Bar) Timeout(argv int, reply *int) error {
@@ -58,7 +104,8 @@ func TestClient_Call(t *testing.T) {
 	time.Sleep(time.Second)
 	t.Run("client timeout", func(t *testing.T) {
 		client, _ := Dial("tcp", addr)
-		ctx, _ := context.WithTimeout(context.Background(), time.Second)
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		defer cancel()
 		var reply int
 		err := client.Call(ctx, "Bar.Timeout", 1, &reply)
 		_assert(err != nil && strings.Contains(err.Error(), ctx.Err().Error()), "expect a timeout error")
@@ -74,19 +121,2209 @@ func TestClient_Call(t *testing.T) {
 }
 func TestXDial(t *testing.T) {
 	if runtime.GOOS == "linux" {
-		ch := make(chan struct{})
 		addr := "/tmp/geerpc.sock"
-		go func() {
-			_ = os.Remove(addr)
-			l, err := net.Listen("unix", addr)
+		_ = os.Remove(addr)
+		l, err := net.Listen("unix", addr)
+		if err != nil {
+			t.Fatal("failed to listen unix socket")
+		}
+		go Accept(l)
+		_, err = XDial("unix@" + addr)
+		_assert(err == nil, "failed to connect unix socket")
+	}
+}
+
+func TestClient_JsonCodec(t *testing.T) {
+	var foo Foo
+	server := NewServer()
+	_ = server.Register(&foo)
+	l, _ := net.Listen("tcp", ":0")
+	go server.Accept(l)
+
+	client, err := Dial("tcp", l.Addr().String(), &Option{CodecType: codec.JsonType})
+	_assert(err == nil, "failed to dial with json codec")
+	defer func() { _ = client.Close() }()
+	var reply int
+	err = client.Call(context.Background(), "Foo.Sum", &Args{Num1: 1, Num2: 2}, &reply)
+	_assert(err == nil && reply == 3, "failed to call Foo.Sum with json codec")
+	err = client.Call(context.Background(), "Foo.Missing", &Args{}, &reply)
+	_assert(err != nil && strings.Contains(err.Error(), "can't find method"), "expect a method not found error")
+}
+
+func TestClient_Codecs(t *testing.T) {
+	var foo Foo
+	server := NewServer()
+	_ = server.Register(&foo)
+	l, _ := net.Listen("tcp", ":0")
+	go server.Accept(l)
+
+	for _, typ := range []codec.Type{codec.AvroType, codec.ThriftType} {
+		t.Run(string(typ), func(t *testing.T) {
+			client, err := Dial("tcp", l.Addr().String(), &Option{CodecType: typ})
+			_assert(err == nil, "failed to dial with %s codec", typ)
+			defer func() { _ = client.Close() }()
+			var reply int
+			err = client.Call(context.Background(), "Foo.Sum", &Args{Num1: 1, Num2: 2}, &reply)
+			_assert(err == nil && reply == 3, "failed to call Foo.Sum with %s codec: %v", typ, err)
+			err = client.Call(context.Background(), "Foo.Missing", &Args{}, &reply)
+			_assert(err != nil && strings.Contains(err.Error(), "can't find method"), "expect a method not found error")
+		})
+	}
+}
+
+func TestClient_MalformedBody(t *testing.T) {
+	var foo Foo
+	server := NewServer()
+	_ = server.Register(&foo)
+	l, _ := net.Listen("tcp", ":0")
+	go server.Accept(l)
+
+	client, _ := Dial("tcp", l.Addr().String())
+	defer func() { _ = client.Close() }()
+	var reply int
+	// 参数类型不匹配, 服务端无法解码这一帧, 但链接仍然可用
+	err := client.Call(context.Background(), "Foo.Sum", "not args", &reply)
+	_assert(err != nil, "expect a decode error")
+	err = client.Call(context.Background(), "Foo.Sum", &Args{Num1: 1, Num2: 2}, &reply)
+	_assert(err == nil && reply == 3, "connection should survive a malformed body")
+}
+
+func TestClient_ProtocolVersion(t *testing.T) {
+	server := NewServer()
+	l, _ := net.Listen("tcp", ":0")
+	go server.Accept(l)
+
+	t.Run("newer client", func(t *testing.T) {
+		client, err := Dial("tcp", l.Addr().String(), &Option{ProtocolVersion: CurrentProtocolVersion + 1})
+		_assert(err == nil && client.ProtocolVersion() == CurrentProtocolVersion, "expect to fall back to server version")
+		_ = client.Close()
+	})
+	t.Run("incompatible client", func(t *testing.T) {
+		_, err := Dial("tcp", l.Addr().String(), &Option{ProtocolVersion: -1})
+		_assert(err != nil && strings.Contains(err.Error(), "invalid protocol version"), "expect a version error")
+	})
+}
+
+func TestHandshake_Preamble(t *testing.T) {
+	opt := &Option{
+		MagicNumber:       MagicNumber,
+		ProtocolVersion:   CurrentProtocolVersion,
+		CodecType:         codec.JsonType,
+		Checksum:          true,
+		CompressType:      codec.GzipCompress,
+		CompressThreshold: 128,
+		MaxRecvMsgSize:    1 << 20,
+		MaxSendMsgSize:    2 << 20,
+		HandleTimeout:     time.Second,
+	}
+	var buf bytes.Buffer
+	_assert(writePreamble(&buf, opt) == nil, "failed to write preamble")
+	_assert(buf.Len() == preambleSize, "preamble should be %d bytes, got %d", preambleSize, buf.Len())
+	buf.WriteString("frame")
+	got, err := readPreamble(&buf)
+	_assert(err == nil && reflect.DeepEqual(got, opt), "preamble round trip mismatch: %+v", got)
+	_assert(buf.String() == "frame", "preamble should not consume the following frame")
+}
+
+func TestClient_HandshakeError(t *testing.T) {
+	server := NewServer()
+	l, _ := net.Listen("tcp", ":0")
+	go server.Accept(l)
+
+	t.Run("bad magic", func(t *testing.T) {
+		conn, _ := net.Dial("tcp", l.Addr().String())
+		_, err := NewClient(conn, &Option{MagicNumber: 1, ProtocolVersion: CurrentProtocolVersion, CodecType: codec.GobType})
+		_assert(err != nil && strings.Contains(err.Error(), "bad magic number"), "expect a bad magic error, got %v", err)
+	})
+	t.Run("unsupported codec", func(t *testing.T) {
+		conn, _ := net.Dial("tcp", l.Addr().String())
+		defer func() { _ = conn.Close() }()
+		var buf bytes.Buffer
+		_ = writePreamble(&buf, DefaultOption)
+		preamble := buf.Bytes()
+		preamble[5] = 0xff // 服务端没有注册的编解码编号
+		_, _ = conn.Write(preamble)
+		_, err := readHandshakeReply(conn, DefaultOption)
+		_assert(err != nil && strings.Contains(err.Error(), "unsupported codec type"), "expect an unsupported codec error, got %v", err)
+	})
+}
+
+func TestClient_Checksum(t *testing.T) {
+	var foo Foo
+	server := NewServer()
+	_ = server.Register(&foo)
+	l, _ := net.Listen("tcp", ":0")
+	go server.Accept(l)
+
+	client, err := Dial("tcp", l.Addr().String(), &Option{Checksum: true})
+	_assert(err == nil, "failed to dial with checksum")
+	defer func() { _ = client.Close() }()
+	var reply int
+	err = client.Call(context.Background(), "Foo.Sum", &Args{Num1: 1, Num2: 2}, &reply)
+	_assert(err == nil && reply == 3, "failed to call Foo.Sum with checksum")
+}
+
+func TestClient_Compress(t *testing.T) {
+	var foo Foo
+	server := NewServer()
+	_ = server.Register(&foo)
+	l, _ := net.Listen("tcp", ":0")
+	go server.Accept(l)
+
+	t.Run("gzip", func(t *testing.T) {
+		client, err := Dial("tcp", l.Addr().String(), &Option{CompressType: codec.GzipCompress})
+		_assert(err == nil && client.CompressType() == codec.GzipCompress, "expect gzip to be negotiated")
+		defer func() { _ = client.Close() }()
+		var reply int
+		err = client.Call(context.Background(), "Foo.Sum", &Args{Num1: 1, Num2: 2}, &reply)
+		_assert(err == nil && reply == 3, "failed to call Foo.Sum with gzip")
+	})
+	t.Run("unsupported", func(t *testing.T) {
+		client, err := Dial("tcp", l.Addr().String(), &Option{CompressType: "lz4"})
+		_assert(err == nil && client.CompressType() == codec.NoneCompress, "expect to fall back to no compression")
+		defer func() { _ = client.Close() }()
+		var reply int
+		err = client.Call(context.Background(), "Foo.Sum", &Args{Num1: 1, Num2: 2}, &reply)
+		_assert(err == nil && reply == 3, "failed to call Foo.Sum without compression")
+	})
+}
+
+type Echo int
+
+func (e Echo) Echo(args string, reply *string) error {
+	*reply = args
+	return nil
+}
+
+func TestClient_MaxMsgSize(t *testing.T) {
+	var echo Echo
+	server := NewServer()
+	server.MaxRecvMsgSize = 1024
+	_ = server.Register(&echo)
+	l, _ := net.Listen("tcp", ":0")
+	go server.Accept(l)
+
+	large := strings.Repeat("x", 2048)
+	t.Run("client send limit", func(t *testing.T) {
+		client, _ := Dial("tcp", l.Addr().String(), &Option{MaxSendMsgSize: 1024})
+		defer func() { _ = client.Close() }()
+		var reply string
+		err := client.Call(context.Background(), "Echo.Echo", large, &reply)
+		var tooLarge *codec.MessageTooLargeError
+		_assert(errors.As(err, &tooLarge) && tooLarge.Limit == 1024, "expect a message too large error, got %v", err)
+		err = client.Call(context.Background(), "Echo.Echo", "ok", &reply)
+		_assert(err == nil && reply == "ok", "connection should survive an oversized request")
+	})
+	t.Run("server recv limit", func(t *testing.T) {
+		client, _ := Dial("tcp", l.Addr().String())
+		defer func() { _ = client.Close() }()
+		var reply string
+		err := client.Call(context.Background(), "Echo.Echo", large, &reply)
+		_assert(err != nil && strings.Contains(err.Error(), "message too large"), "expect a message too large error, got %v", err)
+		err = client.Call(context.Background(), "Echo.Echo", "ok", &reply)
+		_assert(err == nil && reply == "ok", "connection should survive an oversized request")
+	})
+	t.Run("default limits", func(t *testing.T) {
+		server := NewServer()
+		_ = server.Register(&echo)
+		l, _ := net.Listen("tcp", ":0")
+		defer func() { _ = l.Close() }()
+		go server.Accept(l)
+		// 客户端不限制发送, 没有设置限制的服务端按 DefaultMaxMsgSize 拒绝
+		client, _ := Dial("tcp", l.Addr().String(), &Option{MaxSendMsgSize: -1})
+		defer func() { _ = client.Close() }()
+		var reply string
+		err := client.Call(context.Background(), "Echo.Echo", strings.Repeat("x", DefaultMaxMsgSize+1), &reply)
+		_assert(err != nil && strings.Contains(err.Error(), "message too large"), "expect a message too large error, got %v", err)
+		err = client.Call(context.Background(), "Echo.Echo", "ok", &reply)
+		_assert(err == nil && reply == "ok", "connection should survive an oversized request")
+	})
+	t.Run("client recv limit", func(t *testing.T) {
+		client, _ := Dial("tcp", l.Addr().String(), &Option{MaxRecvMsgSize: 512})
+		defer func() { _ = client.Close() }()
+		var reply string
+		err := client.Call(context.Background(), "Echo.Echo", strings.Repeat("x", 600), &reply)
+		_assert(err != nil && strings.Contains(err.Error(), "message too large"), "expect a message too large error, got %v", err)
+	})
+}
+
+// Evil 与 Args 字段相同, gob 默认会按字段名解码成功
+type Evil struct {
+	Num1, Num2 int
+	Padding    []string
+}
+
+func TestServer_GobSafeMode(t *testing.T) {
+	var foo Foo
+	server := NewServer()
+	server.GobSafeMode = true
+	_ = server.Register(&foo)
+	l, _ := net.Listen("tcp", ":0")
+	go server.Accept(l)
+
+	client, _ := Dial("tcp", l.Addr().String())
+	defer func() { _ = client.Close() }()
+	var reply int
+	err := client.Call(context.Background(), "Foo.Sum", &Args{Num1: 1, Num2: 2}, &reply)
+	_assert(err == nil && reply == 3, "registered argument type should be allowed")
+	err = client.Call(context.Background(), "Foo.Sum", &Evil{Num1: 1, Num2: 2}, &reply)
+	_assert(err != nil && strings.Contains(err.Error(), "not allowed"), "expect a type not allowed error, got %v", err)
+}
+
+func TestClient_ContentType(t *testing.T) {
+	var foo Foo
+	server := NewServer()
+	server.GobSafeMode = true
+	_ = server.Register(&foo)
+	l, _ := net.Listen("tcp", ":0")
+	go server.Accept(l)
+
+	client, _ := Dial("tcp", l.Addr().String(), &Option{CodecType: codec.JsonType})
+	defer func() { _ = client.Close() }()
+	call := func(contentType codec.Type, args interface{}) (int, error) {
+		var reply int
+		c := <-client.GoCall(&Call{ServiceMethod: "Foo.Sum", Args: args, Reply: &reply, ContentType: contentType}).Done
+		return reply, c.Error
+	}
+	reply, err := call(codec.GobType, &Args{Num1: 1, Num2: 2})
+	_assert(err == nil && reply == 3, "failed to call Foo.Sum with gob body over json connection: %v", err)
+	reply, err = call("", &Args{Num1: 2, Num2: 3})
+	_assert(err == nil && reply == 5, "failed to call Foo.Sum with json body: %v", err)
+	// 安全模式同样适用于按请求选择的 gob 编码
+	_, err = call(codec.GobType, &Evil{Num1: 1, Num2: 2})
+	_assert(err != nil && strings.Contains(err.Error(), "not allowed"), "expect a type not allowed error, got %v", err)
+	_, err = call("application/unknown", &Args{Num1: 1, Num2: 2})
+	_assert(err != nil && strings.Contains(err.Error(), "unsupported content type"), "expect an unsupported content type error, got %v", err)
+	reply, err = call(codec.GobType, &Args{Num1: 3, Num2: 4})
+	_assert(err == nil && reply == 7, "connection should survive an unsupported content type: %v", err)
+}
+
+func TestServer_TextHandshake(t *testing.T) {
+	var foo Foo
+	server := NewServer()
+	_ = server.Register(&foo)
+	l, _ := net.Listen("tcp", ":0")
+	go server.Accept(l)
+
+	t.Run("script", func(t *testing.T) {
+		// 模拟只有 socket 和 json 库的脚本
+		conn, _ := net.Dial("tcp", l.Addr().String())
+		defer func() { _ = conn.Close() }()
+		_, _ = io.WriteString(conn, `{"MagicNumber": 3927900}`+"\n")
+		_, _ = io.WriteString(conn, `{"ServiceMethod": "Foo.Sum", "Seq": 7}`+"\n"+`{"Num1": 1, "Num2": 2}`+"\n")
+		r := bufio.NewReader(conn)
+		var lines []string
+		for i := 0; i < 3; i++ {
+			line, err := r.ReadString('\n')
+			_assert(err == nil, "failed to read line: %v", err)
+			lines = append(lines, line)
+		}
+		_assert(strings.Contains(lines[0], `"Error":""`), "unexpected handshake reply %s", lines[0])
+		_assert(strings.Contains(lines[1], `"Seq":7`), "unexpected header %s", lines[1])
+		_assert(lines[2] == "3\n", "unexpected body %s", lines[2])
+	})
+	t.Run("go client", func(t *testing.T) {
+		client, err := Dial("tcp", l.Addr().String(), &Option{CodecType: codec.NDJSONType})
+		_assert(err == nil, "failed to dial with ndjson codec: %v", err)
+		defer func() { _ = client.Close() }()
+		var reply int
+		err = client.Call(context.Background(), "Foo.Sum", &Args{Num1: 2, Num2: 3}, &reply)
+		_assert(err == nil && reply == 5, "failed to call Foo.Sum with ndjson codec: %v", err)
+	})
+	t.Run("frame options", func(t *testing.T) {
+		_, err := Dial("tcp", l.Addr().String(), &Option{CodecType: codec.NDJSONType, Checksum: true})
+		_assert(err != nil && strings.Contains(err.Error(), "does not support frame options"), "expect a frame options error, got %v", err)
+	})
+}
+
+func TestClient_DialHTTP(t *testing.T) {
+	var foo Foo
+	server := NewServer()
+	_ = server.Register(&foo)
+	// rpc 与其他 HTTP 服务共用同一个端口
+	mux := http.NewServeMux()
+	mux.Handle(defaultPRCPath, server)
+	mux.HandleFunc("/hello", func(w http.ResponseWriter, _ *http.Request) { _, _ = io.WriteString(w, "hello") })
+	l, _ := net.Listen("tcp", ":0")
+	go func() { _ = http.Serve(l, mux) }()
+
+	client, err := DialHTTP("tcp", l.Addr().String())
+	_assert(err == nil, "failed to dial http: %v", err)
+	defer func() { _ = client.Close() }()
+	var reply int
+	err = client.Call(context.Background(), "Foo.Sum", &Args{Num1: 1, Num2: 2}, &reply)
+	_assert(err == nil && reply == 3, "failed to call Foo.Sum over http: %v", err)
+
+	resp, err := http.Get("http://" + l.Addr().String() + "/hello")
+	_assert(err == nil && resp.StatusCode == http.StatusOK, "other handlers should keep working: %v", err)
+	_ = resp.Body.Close()
+
+	// 客户端不等待 CONNECT 的响应就发送握手
+	conn, _ := net.Dial("tcp", l.Addr().String())
+	var buf bytes.Buffer
+	buf.WriteString("CONNECT " + defaultPRCPath + " HTTP/1.0\n\n")
+	_ = writePreamble(&buf, DefaultOption)
+	_, _ = conn.Write(buf.Bytes())
+	r := bufio.NewReader(conn)
+	_, err = http.ReadResponse(r, &http.Request{Method: "CONNECT"})
+	_assert(err == nil, "failed to read CONNECT response: %v", err)
+	_, err = readHandshakeReply(r, DefaultOption)
+	_assert(err == nil, "pipelined handshake should succeed: %v", err)
+	_ = conn.Close()
+}
+
+func TestServer_DebugPage(t *testing.T) {
+	var foo Foo
+	server := NewServer()
+	_ = server.Register(&foo)
+	l, _ := net.Listen("tcp", ":0")
+	go server.Accept(l)
+	client, _ := Dial("tcp", l.Addr().String())
+	defer func() { _ = client.Close() }()
+	var reply int
+	_ = client.Call(context.Background(), "Foo.Sum", &Args{Num1: 1, Num2: 2}, &reply)
+
+	rec := httptest.NewRecorder()
+	debugHTTP{server}.ServeHTTP(rec, httptest.NewRequest("GET", defaultDebugPath, nil))
+	body := rec.Body.String()
+	_assert(strings.Contains(body, "Service Foo"), "debug page should list service Foo")
+	_assert(strings.Contains(body, "Sum(minirpc.Args, *int) error"), "debug page should list method Sum with its types")
+	_assert(strings.Contains(body, "<td align=center>1</td>"), "debug page should show the call counter")
+}
+
+func TestServer_NewPipeClient(t *testing.T) {
+	client, server, err := NewPipeClientServer()
+	_assert(err == nil, "failed to create pipe client: %v", err)
+	var foo Foo
+	_ = server.Register(&foo)
+	var reply int
+	err = client.Call(context.Background(), "Foo.Sum", &Args{Num1: 1, Num2: 2}, &reply)
+	_assert(err == nil && reply == 3, "failed to call Foo.Sum over pipe: %v", err)
+	_ = client.Close()
+
+	for _, typ := range []codec.Type{codec.JsonType, codec.AvroType, codec.ThriftType, codec.NDJSONType} {
+		client, err := server.NewPipeClient(&Option{CodecType: typ, Checksum: typ != codec.NDJSONType})
+		_assert(err == nil, "failed to create %s pipe client: %v", typ, err)
+		err = client.Call(context.Background(), "Foo.Sum", &Args{Num1: 2, Num2: 3}, &reply)
+		_assert(err == nil && reply == 5, "failed to call Foo.Sum over %s pipe: %v", typ, err)
+		_ = client.Close()
+	}
+}
+
+func TestClient_Transport(t *testing.T) {
+	var foo Foo
+	server := NewServer()
+	_ = server.Register(&foo)
+	var dialed []string
+	transport := TransportFunc(func(network, address string) (io.ReadWriteCloser, error) {
+		dialed = append(dialed, network+"@"+address)
+		clientConn, serverConn := net.Pipe()
+		go server.ServerConn(serverConn)
+		// 隐藏 net.Conn 的方法, 模拟只提供 io.ReadWriteCloser 的隧道
+		return struct{ io.ReadWriteCloser }{clientConn}, nil
+	})
+
+	client, err := XDial("tcp@tunnel:7001", &Option{Transport: transport})
+	_assert(err == nil, "failed to dial through transport: %v", err)
+	defer func() { _ = client.Close() }()
+	var reply int
+	err = client.Call(context.Background(), "Foo.Sum", &Args{Num1: 1, Num2: 2}, &reply)
+	_assert(err == nil && reply == 3, "failed to call Foo.Sum through transport: %v", err)
+	_assert(len(dialed) == 1 && dialed[0] == "tcp@tunnel:7001", "unexpected dial %v", dialed)
+
+	t.Run("timeout", func(t *testing.T) {
+		block := TransportFunc(func(network, address string) (io.ReadWriteCloser, error) {
+			time.Sleep(time.Second)
+			return nil, errors.New("unreachable")
+		})
+		_, err := Dial("tcp", "tunnel:7001", &Option{Transport: block, ConnectTimeout: 100 * time.Millisecond})
+		_assert(err != nil && strings.Contains(err.Error(), "connect timeout"), "expect a connect timeout, got %v", err)
+	})
+}
+
+// Gate 的方法阻塞到 release 被关闭
+type Gate struct {
+	entered chan struct{}
+	release chan struct{}
+}
+
+func (g *Gate) Wait(argv int, reply *int) error {
+	g.entered <- struct{}{}
+	<-g.release
+	*reply = argv
+	return nil
+}
+
+func TestServer_Shutdown(t *testing.T) {
+	g := &Gate{entered: make(chan struct{}), release: make(chan struct{})}
+	server := NewServer()
+	_ = server.Register(g)
+	l, _ := net.Listen("tcp", "127.0.0.1:0")
+	go server.Accept(l)
+
+	client, err := Dial("tcp", l.Addr().String())
+	_assert(err == nil, "failed to dial: %v", err)
+	idle, err := Dial("tcp", l.Addr().String())
+	_assert(err == nil, "failed to dial: %v", err)
+
+	var reply int
+	inflight := client.Go("Gate.Wait", 7, &reply, make(chan *Call, 1))
+	<-g.entered
+
+	shutdown := make(chan error, 1)
+	go func() { shutdown <- server.Shutdown(context.Background()) }()
+	for !client.IsDraining() {
+		time.Sleep(time.Millisecond)
+	}
+	_assert(!client.IsAvailable(), "draining client should not be available")
+	err = client.Call(context.Background(), "Gate.Wait", 1, &reply)
+	_assert(errors.Is(err, ErrGoAway), "expect ErrGoAway for a new call, got %v", err)
+	_, err = Dial("tcp", l.Addr().String(), &Option{ConnectTimeout: time.Second})
+	_assert(err != nil, "listener should be closed")
+
+	close(g.release)
+	call := <-inflight.Done
+	_assert(call.Error == nil && reply == 7, "in-flight call should finish: %v", call.Error)
+	_assert(<-shutdown == nil, "shutdown should wait for clients to close")
+	_assert(!idle.IsAvailable(), "idle client should be closed")
+
+	t.Run("timeout", func(t *testing.T) {
+		server := NewServer()
+		_ = server.Register(&Gate{entered: make(chan struct{}, 1), release: make(chan struct{})})
+		client, err := server.NewPipeClient()
+		_assert(err == nil, "failed to create pipe client: %v", err)
+		go client.Call(context.Background(), "Gate.Wait", 1, &reply)
+		time.Sleep(50 * time.Millisecond)
+		ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+		defer cancel()
+		err = server.Shutdown(ctx)
+		_assert(errors.Is(err, context.DeadlineExceeded), "expect a deadline error, got %v", err)
+	})
+}
+
+func TestServer_MaxConnections(t *testing.T) {
+	var foo Foo
+	server := NewServer()
+	server.MaxConnections = 1
+	_ = server.Register(&foo)
+	l, _ := net.Listen("tcp", "127.0.0.1:0")
+	go server.Accept(l)
+
+	client, err := Dial("tcp", l.Addr().String())
+	_assert(err == nil, "failed to dial: %v", err)
+	_, err = Dial("tcp", l.Addr().String())
+	_assert(err != nil, "expect the second connection to be rejected")
+	_assert(server.ActiveConnections() == 1 && server.RejectedConnections() == 1,
+		"unexpected counters: %d active, %d rejected", server.ActiveConnections(), server.RejectedConnections())
+
+	rec := httptest.NewRecorder()
+	debugHTTP{server}.ServeHTTP(rec, httptest.NewRequest("GET", defaultDebugPath, nil))
+	_assert(strings.Contains(rec.Body.String(), "1 active, 1 rejected"), "debug page should show the connection counters")
+
+	// 链接关闭之后名额被释放
+	_ = client.Close()
+	for server.ActiveConnections() != 0 {
+		time.Sleep(time.Millisecond)
+	}
+	client, err = Dial("tcp", l.Addr().String())
+	_assert(err == nil, "failed to dial after the first client closed: %v", err)
+	_ = client.Close()
+}
+
+func TestServer_RequestLimit(t *testing.T) {
+	newServer := func(perConn, global int, reject bool) (*Gate, *Server) {
+		g := &Gate{entered: make(chan struct{}, 4), release: make(chan struct{})}
+		server := NewServer()
+		server.MaxRequestsPerConn = perConn
+		server.MaxConcurrentRequests = global
+		server.RejectWhenBusy = reject
+		_ = server.Register(g)
+		return g, server
+	}
+
+	t.Run("reject per connection", func(t *testing.T) {
+		g, server := newServer(1, 0, true)
+		client, _ := server.NewPipeClient()
+		defer func() { _ = client.Close() }()
+		var r1, r2 int
+		first := client.Go("Gate.Wait", 1, &r1, make(chan *Call, 1))
+		<-g.entered
+		err := client.Call(context.Background(), "Gate.Wait", 2, &r2)
+		_assert(err != nil && err.Error() == ErrServerBusy.Error(), "expect server busy, got %v", err)
+		// 其他链接不受影响
+		other, _ := server.NewPipeClient()
+		defer func() { _ = other.Close() }()
+		second := other.Go("Gate.Wait", 2, &r2, make(chan *Call, 1))
+		<-g.entered
+		close(g.release)
+		_assert((<-first.Done).Error == nil && (<-second.Done).Error == nil, "limited calls should still succeed")
+	})
+	t.Run("reject global", func(t *testing.T) {
+		g, server := newServer(0, 1, true)
+		c1, _ := server.NewPipeClient()
+		c2, _ := server.NewPipeClient()
+		defer func() { _ = c1.Close(); _ = c2.Close() }()
+		var reply int
+		first := c1.Go("Gate.Wait", 1, &reply, make(chan *Call, 1))
+		<-g.entered
+		err := c2.Call(context.Background(), "Gate.Wait", 2, &reply)
+		_assert(err != nil && err.Error() == ErrServerBusy.Error(), "expect server busy, got %v", err)
+		close(g.release)
+		_assert((<-first.Done).Error == nil, "first call should succeed")
+	})
+	t.Run("queue", func(t *testing.T) {
+		g, server := newServer(1, 0, false)
+		client, _ := server.NewPipeClient()
+		defer func() { _ = client.Close() }()
+		var r1, r2 int
+		first := client.Go("Gate.Wait", 1, &r1, make(chan *Call, 1))
+		second := client.Go("Gate.Wait", 2, &r2, make(chan *Call, 1))
+		<-g.entered
+		select {
+		case <-g.entered:
+			t.Fatal("second call should wait for the first one")
+		case <-time.After(50 * time.Millisecond):
+		}
+		close(g.release)
+		_assert((<-first.Done).Error == nil && (<-second.Done).Error == nil && r2 == 2, "queued call should succeed")
+	})
+}
+
+func TestServer_Workers(t *testing.T) {
+	g := &Gate{entered: make(chan struct{}, 4), release: make(chan struct{})}
+	server := NewServer()
+	server.Workers = 2
+	_ = server.Register(g)
+
+	var calls []*Call
+	for i := 0; i < 3; i++ {
+		client, err := server.NewPipeClient()
+		_assert(err == nil, "failed to create pipe client: %v", err)
+		defer func() { _ = client.Close() }()
+		calls = append(calls, client.Go("Gate.Wait", i, new(int), make(chan *Call, 1)))
+	}
+	<-g.entered
+	<-g.entered
+	select {
+	case <-g.entered:
+		t.Fatal("at most 2 methods should run at the same time")
+	case <-time.After(50 * time.Millisecond):
+	}
+	close(g.release)
+	for _, call := range calls {
+		_assert((<-call.Done).Error == nil, "call should succeed: %v", call.Error)
+	}
+	_assert(server.Shutdown(context.Background()) == nil, "failed to shut down")
+}
+
+func TestServer_DropExpired(t *testing.T) {
+	g := &Gate{entered: make(chan struct{}, 2), release: make(chan struct{})}
+	server := NewServer()
+	server.Workers = 1
+	_ = server.Register(g)
+	client, err := server.NewPipeClient()
+	_assert(err == nil, "failed to create pipe client: %v", err)
+	defer func() { _ = client.Close() }()
+
+	busy := client.Go("Gate.Wait", 1, new(int), make(chan *Call, 1))
+	<-g.entered
+	// 唯一的 worker 正忙, 这个请求在排队期间过期
+	stale := client.GoCall(&Call{ServiceMethod: "Gate.Wait", Args: 2, Reply: new(int), Done: make(chan *Call, 1),
+		Deadline: time.Now().Add(20 * time.Millisecond)})
+	time.Sleep(50 * time.Millisecond)
+	close(g.release)
+	_assert((<-busy.Done).Error == nil, "call should succeed: %v", busy.Error)
+	err = (<-stale.Done).Error
+	_assert(errors.Is(err, ErrDeadlineExceeded) && strings.Contains(err.Error(), "expired"), "expect an expired error, got %v", err)
+	select {
+	case <-g.entered:
+		t.Fatal("expired request should not reach the method")
+	default:
+	}
+
+	fresh := client.GoCall(&Call{ServiceMethod: "Gate.Wait", Args: 3, Reply: new(int), Done: make(chan *Call, 1),
+		Deadline: time.Now().Add(time.Minute)})
+	_assert((<-fresh.Done).Error == nil, "unexpired request should succeed: %v", fresh.Error)
+}
+
+// tempError 模拟 too many open files 这样的临时错误
+type tempError struct{}
+
+func (tempError) Error() string   { return "too many open files" }
+func (tempError) Timeout() bool   { return false }
+func (tempError) Temporary() bool { return true }
+
+// flakyListener 前 failures 次 Accept 返回临时错误
+type flakyListener struct {
+	net.Listener
+	failures int
+}
+
+func (l *flakyListener) Accept() (net.Conn, error) {
+	if l.failures > 0 {
+		l.failures--
+		return nil, tempError{}
+	}
+	return l.Listener.Accept()
+}
+
+func TestServer_Serve(t *testing.T) {
+	var foo Foo
+	server := NewServer()
+	_ = server.Register(&foo)
+
+	t.Run("temporary errors", func(t *testing.T) {
+		l, _ := net.Listen("tcp", "127.0.0.1:0")
+		ctx, cancel := context.WithCancel(context.Background())
+		served := make(chan error, 1)
+		go func() { served <- server.Serve(ctx, &flakyListener{Listener: l, failures: 3}) }()
+
+		client, err := Dial("tcp", l.Addr().String())
+		_assert(err == nil, "serve should survive temporary errors: %v", err)
+		var reply int
+		err = client.Call(context.Background(), "Foo.Sum", &Args{Num1: 1, Num2: 2}, &reply)
+		_assert(err == nil && reply == 3, "failed to call Foo.Sum: %v", err)
+		_ = client.Close()
+
+		cancel()
+		_assert(errors.Is(<-served, context.Canceled), "serve should stop when ctx is cancelled")
+		_, err = net.Dial("tcp", l.Addr().String())
+		_assert(err != nil, "listener should be closed")
+	})
+	t.Run("fatal error", func(t *testing.T) {
+		l, _ := net.Listen("tcp", "127.0.0.1:0")
+		_ = l.Close()
+		err := server.Serve(context.Background(), l)
+		_assert(err != nil && errors.Is(err, net.ErrClosed), "expect the listener error, got %v", err)
+	})
+	t.Run("shutdown", func(t *testing.T) {
+		l, _ := net.Listen("tcp", "127.0.0.1:0")
+		served := make(chan error, 1)
+		go func() { served <- server.Serve(context.Background(), l) }()
+		time.Sleep(10 * time.Millisecond)
+		_ = server.Shutdown(context.Background())
+		_assert(<-served == ErrServerClosed, "serve should return ErrServerClosed after shutdown")
+	})
+}
+
+func TestServer_ListenAndServeReusePort(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("SO_REUSEPORT test only runs on linux")
+	}
+	// 先占用一个端口, 再用 SO_REUSEPORT 在同一个端口上打开多个监听
+	probe, _ := net.Listen("tcp", "127.0.0.1:0")
+	addr := probe.Addr().String()
+	_ = probe.Close()
+
+	var foo Foo
+	server := NewServer()
+	server.Acceptors = 4
+	_ = server.Register(&foo)
+	served := make(chan error, 1)
+	go func() { served <- server.ListenAndServe(addr) }()
+
+	var client *Client
+	var err error
+	for i := 0; i < 100; i++ {
+		if client, err = Dial("tcp", addr); err == nil {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	_assert(err == nil, "failed to dial: %v", err)
+	var reply int
+	err = client.Call(context.Background(), "Foo.Sum", &Args{Num1: 1, Num2: 2}, &reply)
+	_assert(err == nil && reply == 3, "failed to call Foo.Sum: %v", err)
+	_ = client.Close()
+
+	server.mu.Lock()
+	n := len(server.listeners)
+	server.mu.Unlock()
+	_assert(n == 4, "expect 4 listeners, got %d", n)
+	_ = server.Shutdown(context.Background())
+	_assert(<-served == ErrServerClosed, "listen and serve should return ErrServerClosed")
+}
+
+// Deadline 的方法一直等待到 ctx 结束, 把收到的截止时间发给 seen
+type Deadline struct {
+	seen chan time.Duration
+}
+
+func (d *Deadline) Wait(ctx context.Context, argv int, reply *int) error {
+	deadline, ok := ctx.Deadline()
+	if !ok {
+		d.seen <- 0
+		return errors.New("no deadline")
+	}
+	d.seen <- time.Until(deadline)
+	<-ctx.Done()
+	return ctx.Err()
+}
+
+func TestClient_DeadlinePropagation(t *testing.T) {
+	d := &Deadline{seen: make(chan time.Duration, 1)}
+	server := NewServer()
+	_ = server.Register(d)
+
+	for _, typ := range []codec.Type{codec.GobType, codec.JsonType, codec.AvroType, codec.ThriftType, codec.NDJSONType} {
+		t.Run(string(typ), func(t *testing.T) {
+			client, err := server.NewPipeClient(&Option{CodecType: typ, HandleTimeout: time.Minute})
+			_assert(err == nil, "failed to create pipe client: %v", err)
+			defer func() { _ = client.Close() }()
+			ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+			defer cancel()
+			var reply int
+			err = client.Call(ctx, "Deadline.Wait", 1, &reply)
+			_assert(err != nil, "expect the call to time out")
+			remaining := <-d.seen
+			_assert(remaining > 0 && remaining <= 200*time.Millisecond, "server should use the client deadline, got %v", remaining)
+		})
+	}
+	t.Run("expired", func(t *testing.T) {
+		client, _ := server.NewPipeClient()
+		defer func() { _ = client.Close() }()
+		ctx, cancel := context.WithTimeout(context.Background(), -time.Second)
+		defer cancel()
+		var reply int
+		err := client.Call(ctx, "Deadline.Wait", 1, &reply)
+		_assert(err != nil && strings.Contains(err.Error(), "deadline exceeded"), "expect a deadline error, got %v", err)
+		select {
+		case <-d.seen:
+			t.Fatal("expired call should not be sent")
+		case <-time.After(50 * time.Millisecond):
+		}
+	})
+}
+
+// Canceler 的方法一直等待到 ctx 结束, 把 ctx 结束的原因发给 done
+type Canceler struct {
+	entered chan struct{}
+	done    chan error
+}
+
+func (c *Canceler) Wait(ctx context.Context, argv int, reply *int) error {
+	c.entered <- struct{}{}
+	select {
+	case <-ctx.Done():
+		c.done <- context.Cause(ctx)
+		return ctx.Err()
+	case <-time.After(5 * time.Second):
+		c.done <- nil
+		return nil
+	}
+}
+
+func TestClient_Cancel(t *testing.T) {
+	c := &Canceler{entered: make(chan struct{}, 1), done: make(chan error, 1)}
+	var foo Foo
+	server := NewServer()
+	_ = server.Register(c)
+	_ = server.Register(&foo)
+	client, err := server.NewPipeClient()
+	_assert(err == nil, "failed to create pipe client: %v", err)
+	defer func() { _ = client.Close() }()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		<-c.entered
+		cancel()
+	}()
+	var reply int
+	err = client.Call(ctx, "Canceler.Wait", 1, &reply)
+	_assert(errors.Is(err, context.Canceled), "expect a canceled error, got %v", err)
+	_assert(client.NumPending() == 0, "canceled call should be removed from pending, got %d", client.NumPending())
+	select {
+	case cause := <-c.done:
+		_assert(cause == errCanceledByClient, "expect the handler to be canceled by the client, got %v", cause)
+	case <-time.After(time.Second):
+		t.Fatal("server should cancel the handler context")
+	}
+	// 已经取消的 ctx 不会发出请求
+	err = client.Call(ctx, "Canceler.Wait", 1, &reply)
+	_assert(errors.Is(err, context.Canceled), "expect a canceled error, got %v", err)
+	select {
+	case <-c.entered:
+		t.Fatal("canceled call should not be sent")
+	case <-time.After(50 * time.Millisecond):
+	}
+	// 超时同样会清理
+	tctx, tcancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer tcancel()
+	go func() { <-c.entered }()
+	err = client.Call(tctx, "Canceler.Wait", 1, &reply)
+	// 服务端根据传递过去的剩余时间可能先超时
+	_assert(err != nil, "expect a timeout error")
+	_assert(client.NumPending() == 0, "timed out call should be removed from pending, got %d", client.NumPending())
+	<-c.done
+	// 被取消的请求不影响链接上后续的请求
+	err = client.Call(context.Background(), "Foo.Sum", &Args{Num1: 1, Num2: 2}, &reply)
+	_assert(err == nil && reply == 3, "failed to call Foo.Sum after cancel: %v", err)
+}
+
+type Failer int
+
+func (f Failer) Coded(code Code, _ *int) error {
+	return Errorf(code, "failed with %s", code)
+}
+
+func (f Failer) Plain(_ int, _ *int) error {
+	return errors.New("plain failure")
+}
+
+func (f Failer) Slow(ctx context.Context, _ int, _ *int) error {
+	<-ctx.Done()
+	return ctx.Err()
+}
+
+func TestClient_ErrorCode(t *testing.T) {
+	var f Failer
+	server := NewServer()
+	_ = server.Register(&f)
+
+	for _, typ := range []codec.Type{codec.GobType, codec.JsonType, codec.ThriftType} {
+		t.Run(string(typ), func(t *testing.T) {
+			client, err := server.NewPipeClient(&Option{CodecType: typ, HandleTimeout: 50 * time.Millisecond})
+			_assert(err == nil, "failed to create pipe client: %v", err)
+			defer func() { _ = client.Close() }()
+			var reply int
+
+			err = client.Call(context.Background(), "Failer.Coded", CodeInvalidArgument, &reply)
+			var rpcErr *Error
+			_assert(errors.As(err, &rpcErr) && rpcErr.Code == CodeInvalidArgument && rpcErr.Message == "failed with invalid argument",
+				"expect the method's error code, got %#v", err)
+			_assert(errors.Is(err, ErrInvalidArgument) && !errors.Is(err, ErrNotFound), "errors.Is should compare codes")
+
+			err = client.Call(context.Background(), "Failer.Plain", 0, &reply)
+			_assert(errors.As(err, &rpcErr) && rpcErr.Code == CodeUnknown && err.Error() == "plain failure", "expect an unknown code, got %#v", err)
+
+			err = client.Call(context.Background(), "Failer.Missing", 0, &reply)
+			_assert(errors.Is(err, ErrNotFound), "expect not found, got %#v", err)
+			err = client.Call(context.Background(), "Nobody.Missing", 0, &reply)
+			_assert(errors.Is(err, ErrNotFound), "expect not found, got %#v", err)
+
+			err = client.Call(context.Background(), "Failer.Slow", 0, &reply)
+			_assert(errors.Is(err, ErrDeadlineExceeded), "expect deadline exceeded, got %#v", err)
+		})
+	}
+}
+
+// QuotaDetails 测试用的错误详情
+type QuotaDetails struct {
+	Limit int
+	Used  int
+}
+
+type unregisteredDetails struct{ Reason string }
+
+func (f Failer) Quota(used int, _ *int) error {
+	return &Error{Code: CodeResourceExhausted, Message: "quota exceeded", Details: &QuotaDetails{Limit: 10, Used: used}}
+}
+
+func (f Failer) Unregistered(_ int, _ *int) error {
+	return &Error{Code: CodeInternal, Message: "no details", Details: unregisteredDetails{Reason: "x"}}
+}
+
+func TestClient_ErrorDetails(t *testing.T) {
+	_assert(RegisterErrorDetails("test.QuotaDetails", &QuotaDetails{}) == nil, "failed to register details")
+	_assert(RegisterErrorDetails("test.QuotaDetails", QuotaDetails{}) != nil, "expect a conflicting registration error")
+
+	var f Failer
+	server := NewServer()
+	_ = server.Register(&f)
+	for _, typ := range []codec.Type{codec.GobType, codec.JsonType, codec.ThriftType, codec.NDJSONType} {
+		t.Run(string(typ), func(t *testing.T) {
+			client, err := server.NewPipeClient(&Option{CodecType: typ})
+			_assert(err == nil, "failed to create pipe client: %v", err)
+			defer func() { _ = client.Close() }()
+			var reply int
+
+			err = client.Call(context.Background(), "Failer.Quota", 12, &reply)
+			var rpcErr *Error
+			_assert(errors.As(err, &rpcErr) && rpcErr.Code == CodeResourceExhausted, "expect a coded error, got %#v", err)
+			details, ok := rpcErr.Details.(*QuotaDetails)
+			_assert(ok && *details == QuotaDetails{Limit: 10, Used: 12}, "expect quota details, got %#v", rpcErr.Details)
+
+			err = client.Call(context.Background(), "Failer.Unregistered", 0, &reply)
+			_assert(errors.As(err, &rpcErr) && rpcErr.Message == "no details" && rpcErr.Details == nil, "expect an error without details, got %#v", err)
+
+			// 链接仍然可用
+			err = client.Call(context.Background(), "Failer.Coded", CodeNotFound, &reply)
+			_assert(errors.Is(err, ErrNotFound), "expect not found, got %#v", err)
+		})
+	}
+}
+
+// Tenant 返回请求携带的元数据
+type Tenant int
+
+func (t Tenant) Whoami(ctx context.Context, key string, reply *string) error {
+	md, ok := FromIncomingContext(ctx)
+	if !ok {
+		*reply = "<none>"
+		return nil
+	}
+	*reply = md[key]
+	return nil
+}
+
+func TestClient_Metadata(t *testing.T) {
+	var tenant Tenant
+	server := NewServer()
+	_ = server.Register(&tenant)
+
+	for _, typ := range []codec.Type{codec.GobType, codec.JsonType, codec.AvroType, codec.ThriftType, codec.NDJSONType} {
+		t.Run(string(typ), func(t *testing.T) {
+			client, err := server.NewPipeClient(&Option{CodecType: typ})
+			_assert(err == nil, "failed to create pipe client: %v", err)
+			defer func() { _ = client.Close() }()
+
+			md := map[string]string{"tenant": "acme", "locale": "zh-CN"}
+			ctx := NewOutgoingContext(context.Background(), md)
+			md["tenant"] = "changed"
+			var reply string
+			err = client.Call(ctx, "Tenant.Whoami", "tenant", &reply)
+			_assert(err == nil && reply == "acme", "expect the outgoing metadata, got %q: %v", reply, err)
+			err = client.Call(ctx, "Tenant.Whoami", "locale", &reply)
+			_assert(err == nil && reply == "zh-CN", "expect the outgoing metadata, got %q: %v", reply, err)
+
+			err = client.Call(context.Background(), "Tenant.Whoami", "tenant", &reply)
+			_assert(err == nil && reply == "", "expect no metadata, got %q: %v", reply, err)
+		})
+	}
+}
+
+func (t Tenant) Page(ctx context.Context, cursor int, reply *[]int) error {
+	_ = SetTrailer(ctx, map[string]string{"server": "test"})
+	if cursor < 0 {
+		_ = SetTrailer(ctx, map[string]string{"reason": "negative cursor"})
+		return Errorf(CodeInvalidArgument, "invalid cursor %d", cursor)
+	}
+	*reply = []int{cursor, cursor + 1}
+	return SetTrailer(ctx, map[string]string{"next": strconv.Itoa(cursor + 2)})
+}
+
+func TestClient_Trailer(t *testing.T) {
+	var tenant Tenant
+	server := NewServer()
+	_ = server.Register(&tenant)
+	_assert(SetTrailer(context.Background(), map[string]string{"k": "v"}) != nil, "expect an error outside of a handler")
+
+	for _, typ := range []codec.Type{codec.GobType, codec.JsonType, codec.AvroType, codec.ThriftType, codec.NDJSONType} {
+		t.Run(string(typ), func(t *testing.T) {
+			client, err := server.NewPipeClient(&Option{CodecType: typ})
+			_assert(err == nil, "failed to create pipe client: %v", err)
+			defer func() { _ = client.Close() }()
+
+			var reply []int
+			call := <-client.GoCall(&Call{ServiceMethod: "Tenant.Page", Args: 3, Reply: &reply, Done: make(chan *Call, 1)}).Done
+			_assert(call.Error == nil && len(reply) == 2, "failed to call Tenant.Page: %v", call.Error)
+			_assert(call.ReplyMetadata["next"] == "5" && call.ReplyMetadata["server"] == "test", "expect trailers, got %v", call.ReplyMetadata)
+
+			call = <-client.GoCall(&Call{ServiceMethod: "Tenant.Page", Args: -1, Reply: &reply, Done: make(chan *Call, 1)}).Done
+			_assert(errors.Is(call.Error, ErrInvalidArgument), "expect invalid argument, got %v", call.Error)
+			_assert(call.ReplyMetadata["reason"] == "negative cursor", "expect trailers on failure, got %v", call.ReplyMetadata)
+
+			var name string
+			call = <-client.GoCall(&Call{ServiceMethod: "Tenant.Whoami", Args: "k", Reply: &name, Done: make(chan *Call, 1)}).Done
+			_assert(call.Error == nil && call.ReplyMetadata == nil, "expect no trailers, got %v", call.ReplyMetadata)
+		})
+	}
+}
+
+func (t Tenant) RequestID(ctx context.Context, _ int, reply *string) error {
+	*reply, _ = RequestIDFromContext(ctx)
+	return nil
+}
+
+func TestClient_RequestID(t *testing.T) {
+	var tenant Tenant
+	server := NewServer()
+	_ = server.Register(&tenant)
+	client, err := server.NewPipeClient()
+	_assert(err == nil, "failed to create pipe client: %v", err)
+	defer func() { _ = client.Close() }()
+
+	var first, second string
+	_ = client.Call(context.Background(), "Tenant.RequestID", 0, &first)
+	_ = client.Call(context.Background(), "Tenant.RequestID", 0, &second)
+	_assert(len(first) == 32 && len(second) == 32 && first != second, "expect a generated id per call, got %q and %q", first, second)
+
+	ctx := NewRequestIDContext(context.Background(), "req-42")
+	err = client.Call(ctx, "Tenant.RequestID", 0, &first)
+	_assert(err == nil && first == "req-42", "expect the caller's id, got %q: %v", first, err)
+
+	call := <-client.Go("Tenant.RequestID", 0, &second, make(chan *Call, 1)).Done
+	_assert(call.Error == nil && call.RequestID != "" && call.RequestID == second, "expect the id on the call, got %q and %q", call.RequestID, second)
+}
+
+// errOutOfStock 测试用的哨兵错误
+var errOutOfStock = errors.New("out of stock")
+
+func (f Failer) Translated(kind int, _ *int) error {
+	switch kind {
+	case 0:
+		return fmt.Errorf("reserve item: %w", errOutOfStock)
+	case 1:
+		return &fs.PathError{Op: "open", Path: "/missing", Err: fs.ErrNotExist}
+	case 2:
+		return context.DeadlineExceeded
+	default:
+		return Errorf(CodeInternal, "explicit")
+	}
+}
+
+func TestServer_RegisterErrorCode(t *testing.T) {
+	var f Failer
+	server := NewServer()
+	_ = server.Register(&f)
+	_assert(server.RegisterErrorCode(errOutOfStock, CodeResourceExhausted) == nil, "failed to register error code")
+	_assert(server.RegisterErrorType(&fs.PathError{}, CodeNotFound) == nil, "failed to register error type")
+	_assert(server.RegisterErrorCode(context.DeadlineExceeded, CodeUnavailable) == nil, "failed to register error code")
+	_assert(server.RegisterErrorCode(nil, CodeInternal) != nil, "expect an error for a nil target")
+	// 显式返回的 *Error 不受影响
+	_assert(server.RegisterErrorType(&Error{}, CodeNotFound) == nil, "failed to register error type")
+	client, err := server.NewPipeClient()
+	_assert(err == nil, "failed to create pipe client: %v", err)
+	defer func() { _ = client.Close() }()
+
+	for kind, want := range []Code{CodeResourceExhausted, CodeNotFound, CodeUnavailable, CodeInternal} {
+		var reply int
+		err = client.Call(context.Background(), "Failer.Translated", kind, &reply)
+		var rpcErr *Error
+		_assert(errors.As(err, &rpcErr) && rpcErr.Code == want, "kind %d: expect code %s, got %#v", kind, want, err)
+	}
+	err = client.Call(context.Background(), "Failer.Translated", 0, new(int))
+	_assert(err.Error() == "reserve item: out of stock", "error message should be unchanged, got %q", err)
+}
+
+func TestClient_Interceptors(t *testing.T) {
+	var foo Foo
+	var order []string
+	record := func(name string) func(ctx context.Context, info *CallInfo, args, reply interface{}, invoke Invoker) error {
+		return func(ctx context.Context, info *CallInfo, args, reply interface{}, invoke Invoker) error {
+			order = append(order, name+" "+info.ServiceMethod+" "+strconv.Itoa(info.Attempt))
+			return invoke(AppendToOutgoingContext(ctx, map[string]string{name: "1"}))
+		}
+	}
+	server := NewServer()
+	_ = server.Register(&foo)
+	server.Interceptors = []ServerInterceptor{
+		func(ctx context.Context, info *CallInfo, argv, replyv interface{}, invoke Invoker) error {
+			md, _ := FromIncomingContext(ctx)
+			order = append(order, "server "+md["outer"]+md["inner"]+" "+string(info.CodecType))
+			if argv.(Args).Num1 < 0 {
+				return Errorf(CodeInvalidArgument, "rejected by interceptor")
+			}
+			err := invoke(ctx)
+			*replyv.(*int) *= 10
+			return err
+		},
+	}
+	client, err := server.NewPipeClient(&Option{Interceptors: []ClientInterceptor{record("outer"), record("inner")}})
+	_assert(err == nil, "failed to create pipe client: %v", err)
+	defer func() { _ = client.Close() }()
+
+	var reply int
+	err = client.Call(NewAttemptContext(context.Background(), 2), "Foo.Sum", Args{Num1: 1, Num2: 2}, &reply)
+	_assert(err == nil && reply == 30, "expect the server interceptor to change the reply, got %d: %v", reply, err)
+	want := []string{"outer Foo.Sum 2", "inner Foo.Sum 2", "server 11 applocation/gob"}
+	_assert(reflect.DeepEqual(order, want), "unexpected interceptor order %q", order)
+
+	err = client.Call(context.Background(), "Foo.Sum", Args{Num1: -1}, &reply)
+	_assert(errors.Is(err, ErrInvalidArgument), "expect the server interceptor's error, got %v", err)
+
+	// Use 加入的拦截器在 Option.Interceptors 之后
+	order = nil
+	client.Use(record("used"))
+	err = client.Call(context.Background(), "Foo.Sum", Args{Num1: 1, Num2: 2}, &reply)
+	want = []string{"outer Foo.Sum 0", "inner Foo.Sum 0", "used Foo.Sum 0", "server 11 applocation/gob"}
+	_assert(err == nil && reflect.DeepEqual(order, want), "unexpected interceptor order %q: %v", order, err)
+
+	// 不修改共用的 Option
+	other, err := server.NewPipeClient()
+	_assert(err == nil, "failed to create pipe client: %v", err)
+	defer func() { _ = other.Close() }()
+	other.Use(record("other"))
+	_assert(len(DefaultOption.Interceptors) == 0, "Use should not change DefaultOption")
+	order = nil
+	_ = client.Call(context.Background(), "Foo.Sum", Args{Num1: 1, Num2: 2}, &reply)
+	_assert(len(order) == 4, "Use on another client should not affect this one: %q", order)
+}
+
+func TestServer_AccessLog(t *testing.T) {
+	var foo Foo
+	var f Failer
+	var buf bytes.Buffer
+	logger := slog.New(slog.NewJSONHandler(&buf, nil))
+	server := NewServer()
+	_ = server.Register(&foo)
+	_ = server.Register(&f)
+	server.Interceptors = []ServerInterceptor{AccessLog(AccessLogConfig{Logger: logger})}
+	client, err := server.NewPipeClient()
+	_assert(err == nil, "failed to create pipe client: %v", err)
+	defer func() { _ = client.Close() }()
+
+	var reply int
+	_ = client.Call(NewRequestIDContext(context.Background(), "req-1"), "Foo.Sum", Args{Num1: 1, Num2: 2}, &reply)
+	_ = client.Call(context.Background(), "Failer.Coded", CodeNotFound, &reply)
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	_assert(len(lines) == 2, "expect one line per request, got %q", buf.String())
+
+	var entry struct {
+		Level, Method, Peer, Code, Error string
+		RequestID                        string `json:"request_id"`
+		Seq                              uint64
+		Bytes                            int
+		Duration                         int64
+	}
+	_assert(json.Unmarshal([]byte(lines[0]), &entry) == nil, "access log should be json: %s", lines[0])
+	_assert(entry.Level == "INFO" && entry.Method == "Foo.Sum" && entry.Peer == "pipe" && entry.Code == "ok" &&
+		entry.RequestID == "req-1" && entry.Seq == 1 && entry.Bytes > 0, "unexpected entry %+v", entry)
+	_assert(json.Unmarshal([]byte(lines[1]), &entry) == nil, "access log should be json: %s", lines[1])
+	_assert(entry.Level == "WARN" && entry.Code == "not found" && entry.Error != "", "unexpected entry %+v", entry)
+
+	// 成功的请求按比例采样, 失败的请求总是记录
+	buf.Reset()
+	server.Interceptors = []ServerInterceptor{AccessLog(AccessLogConfig{Logger: logger, SampleRate: 1e-9})}
+	client2, _ := server.NewPipeClient()
+	defer func() { _ = client2.Close() }()
+	_ = client2.Call(context.Background(), "Foo.Sum", Args{}, &reply)
+	_ = client2.Call(context.Background(), "Failer.Plain", 0, &reply)
+	_assert(strings.Count(buf.String(), "\n") == 1 && strings.Contains(buf.String(), "Failer.Plain"), "expect only the failure, got %q", buf.String())
+}
+
+func (f Failer) Sleep(d time.Duration, _ *int) error {
+	time.Sleep(d)
+	return nil
+}
+
+func TestServer_SlowRequestLog(t *testing.T) {
+	var buf bytes.Buffer
+	log.SetOutput(&buf)
+	defer log.SetOutput(os.Stderr)
+
+	var f Failer
+	server := NewServer()
+	server.SlowRequestThreshold = 20 * time.Millisecond
+	_ = server.Register(&f)
+	client, err := server.NewPipeClient(&Option{SlowCallThreshold: 20 * time.Millisecond})
+	_assert(err == nil, "failed to create pipe client: %v", err)
+	defer func() { _ = client.Close() }()
+
+	var reply int
+	_ = client.Call(context.Background(), "Failer.Sleep", time.Millisecond, &reply)
+	_assert(!strings.Contains(buf.String(), "slow"), "fast requests should not be logged: %s", buf.String())
+	_ = client.Call(NewRequestIDContext(context.Background(), "req-slow"), "Failer.Sleep", 30*time.Millisecond, &reply)
+	out := buf.String()
+	_assert(strings.Contains(out, "rpc server: slow request req-slow Failer.Sleep from pipe"), "expect a server slow log: %s", out)
+	_assert(strings.Contains(out, "rpc client: slow call req-slow Failer.Sleep to pipe"), "expect a client slow log: %s", out)
+}
+
+func TestServer_PublishExpvar(t *testing.T) {
+	g := &Gate{entered: make(chan struct{}, 1), release: make(chan struct{})}
+	var f Failer
+	server := NewServer()
+	server.Workers = 1
+	_ = server.Register(g)
+	_ = server.Register(&f)
+	server.PublishExpvar("test")
+	client, err := server.NewPipeClient()
+	_assert(err == nil, "failed to create pipe client: %v", err)
+	defer func() { _ = client.Close() }()
+
+	var reply int
+	_ = client.Call(context.Background(), "Failer.Plain", 0, &reply)
+	first := client.Go("Gate.Wait", 1, new(int), make(chan *Call, 1))
+	<-g.entered
+	second := client.Go("Gate.Wait", 2, new(int), make(chan *Call, 1))
+
+	var vars map[string]int
+	read := func() {
+		v := expvar.Get("minirpc").(*expvar.Map).Get("test")
+		_assert(json.Unmarshal([]byte(v.String()), &vars) == nil, "expvar should be json: %s", v)
+	}
+	// 第二个请求在等待唯一的 worker
+	for i := 0; i < 100; i++ {
+		if read(); vars["queued_requests"] == 1 {
+			break
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	_assert(vars["active_connections"] == 1 && vars["active_requests"] == 1 && vars["queued_requests"] == 1 &&
+		vars["requests"] == 2 && vars["errors"] == 1, "unexpected vars %v", vars)
+	close(g.release)
+	<-first.Done
+	<-second.Done
+	// 响应先于计数器的更新发出
+	for i := 0; i < 100; i++ {
+		if read(); vars["active_requests"] == 0 {
+			break
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	_assert(vars["active_requests"] == 0 && vars["queued_requests"] == 0 && vars["requests"] == 3, "unexpected vars %v", vars)
+}
+
+func TestClient_ConnStats(t *testing.T) {
+	var e Echo
+	server := NewServer()
+	_ = server.Register(&e)
+	client, err := server.NewPipeClient()
+	_assert(err == nil, "failed to create pipe client: %v", err)
+	defer func() { _ = client.Close() }()
+
+	var reply string
+	for i := 0; i < 3; i++ {
+		_ = client.Call(context.Background(), "Echo.Echo", strings.Repeat("x", 1000), &reply)
+	}
+	cs := client.Stats()
+	_assert(cs.FramesWritten == 3 && cs.FramesRead == 3, "unexpected client frames %+v", cs)
+	_assert(cs.BytesWritten > 3000 && cs.BytesRead > 3000, "unexpected client bytes %+v", cs)
+
+	conns := server.Connections()
+	_assert(len(conns) == 1, "expect 1 connection, got %d", len(conns))
+	ss := conns[0].ConnStats
+	// 服务端读完请求之后才会响应, 读到的字节数与客户端写入的一致
+	_assert(ss.FramesRead == 3 && ss.BytesRead == cs.BytesWritten, "unexpected server stats %+v, client %+v", ss, cs)
+}
+
+func TestClient_WireDump(t *testing.T) {
+	var e Echo
+	var buf bytes.Buffer
+	dump := &WireDump{Writer: &buf}
+	server := NewServer()
+	server.WireDump = dump
+	_ = server.Register(&e)
+	client, err := server.NewPipeClient(&Option{WireDump: dump})
+	_assert(err == nil, "failed to create pipe client: %v", err)
+	defer func() { _ = client.Close() }()
+
+	var reply string
+	_ = client.Call(context.Background(), "Echo.Echo", "hello", &reply)
+	_ = client.Call(context.Background(), "Echo.Missing", "hello", &reply)
+	dump.mu.Lock()
+	out := buf.String()
+	dump.mu.Unlock()
+	for _, want := range []string{
+		"rpc client pipe -> seq=1 method=Echo.Echo metadata=map[x-request-id:",
+		"rpc server pipe <- seq=1 method=Echo.Echo",
+		"rpc client pipe <- seq=1 method=Echo.Echo\n",
+		`rpc client pipe <- seq=2 method=Echo.Missing code=not found error="rpc server: can't find method Missing"`,
+	} {
+		_assert(strings.Contains(out, want), "expect %q in dump: %s", want, out)
+	}
+	_assert(!strings.Contains(out, "00000000"), "headers only dump should not contain bytes: %s", out)
+
+	var hexBuf bytes.Buffer
+	hexDump := &WireDump{Writer: &hexBuf, Hex: true}
+	client, err = server.NewPipeClient(&Option{WireDump: hexDump})
+	_assert(err == nil, "failed to create pipe client: %v", err)
+	defer func() { _ = client.Close() }()
+	_ = client.Call(context.Background(), "Echo.Echo", "hello", &reply)
+	hexDump.mu.Lock()
+	out = hexBuf.String()
+	hexDump.mu.Unlock()
+	_assert(strings.Contains(out, "rpc client pipe -> ") && strings.Contains(out, "00000000  "), "expect a hexdump: %s", out)
+	_assert(!strings.Contains(out, "method=Echo.Echo"), "hex only dump should not contain headers: %s", out)
+}
+
+func TestServer_Logger(t *testing.T) {
+	var f Failer
+	var buf bytes.Buffer
+	server := NewServer()
+	server.Logger = &Logger{Level: slog.LevelDebug, Output: log.New(&buf, "", 0), SampleInitial: 2, SampleThereafter: 3}
+	_ = server.Register(&f)
+	client, err := server.NewPipeClient(&Option{Logger: &Logger{Level: slog.LevelError}})
+	_assert(err == nil, "failed to create pipe client: %v", err)
+	defer func() { _ = client.Close() }()
+
+	var reply int
+	for i := 0; i < 10; i++ {
+		_ = client.Call(context.Background(), "Failer.Plain", i, &reply)
+	}
+	out := buf.String()
+	_assert(strings.Contains(out, "rpc server: register Failer.Plain\n"), "expect debug register log: %s", out)
+	// 前 2 条, 之后第 5 和第 8 条
+	n := strings.Count(out, "Failer.Plain: plain failure")
+	_assert(n == 4, "expect 4 sampled request logs, got %d: %s", n, out)
+
+	buf.Reset()
+	server.Logger.Level = slog.LevelWarn
+	_ = server.Register(new(Echo))
+	_ = client.Call(context.Background(), "Failer.Plain", 0, &reply)
+	_assert(buf.Len() == 0, "info and debug logs should be dropped: %s", buf.String())
+}
+
+type Flaky struct {
+	failures int32
+	calls    atomic.Int32
+}
+
+func (f *Flaky) Do(_ int, reply *int) error {
+	n := f.calls.Add(1)
+	if n <= f.failures {
+		return Errorf(CodeUnavailable, "try again")
+	}
+	*reply = int(n)
+	return nil
+}
+
+func TestClient_CallOptions(t *testing.T) {
+	var e Echo
+	var tenant Tenant
+	var f Failer
+	flaky := &Flaky{failures: 2}
+	server := NewServer()
+	_ = server.Register(&e)
+	_ = server.Register(&tenant)
+	_ = server.Register(&f)
+	_ = server.Register(flaky)
+	var attempts []int
+	record := func(ctx context.Context, info *CallInfo, args, reply interface{}, invoke Invoker) error {
+		attempts = append(attempts, info.Attempt)
+		return invoke(ctx)
+	}
+	client, err := server.NewPipeClient(&Option{CompressType: codec.GzipCompress, Interceptors: []ClientInterceptor{record}})
+	_assert(err == nil, "failed to create pipe client: %v", err)
+	defer func() { _ = client.Close() }()
+	ctx := context.Background()
+
+	t.Run("metadata", func(t *testing.T) {
+		mdCtx := NewOutgoingContext(ctx, map[string]string{"tenant": "a", "zone": "x"})
+		var reply string
+		err := client.Call(mdCtx, "Tenant.Whoami", "tenant", &reply, WithMetadata(map[string]string{"tenant": "b"}))
+		_assert(err == nil && reply == "b", "expect the call option to win, got %q, %v", reply, err)
+		err = client.Call(mdCtx, "Tenant.Whoami", "zone", &reply, WithMetadata(map[string]string{"tenant": "b"}))
+		_assert(err == nil && reply == "x", "expect context metadata to be kept, got %q, %v", reply, err)
+	})
+	t.Run("timeout", func(t *testing.T) {
+		var reply int
+		err := client.Call(ctx, "Failer.Slow", 0, &reply, WithTimeout(20*time.Millisecond))
+		_assert(codeOf(err) == CodeDeadlineExceeded, "expect a deadline error, got %v", err)
+	})
+	t.Run("compression", func(t *testing.T) {
+		var reply string
+		args := strings.Repeat("a", 10000)
+		before := client.Stats().BytesWritten
+		_ = client.Call(ctx, "Echo.Echo", args, &reply)
+		compressed := client.Stats().BytesWritten - before
+		before = client.Stats().BytesWritten
+		_ = client.Call(ctx, "Echo.Echo", args, &reply, WithoutCompression())
+		plain := client.Stats().BytesWritten - before
+		_assert(reply == args && compressed < 1000 && plain > 10000, "unexpected sizes: %d compressed, %d plain", compressed, plain)
+	})
+	t.Run("retry", func(t *testing.T) {
+		policy := RetryPolicy{MaxAttempts: 3, Backoff: time.Millisecond}
+		attempts = nil
+		var reply int
+		err := client.Call(ctx, "Flaky.Do", 0, &reply, WithRetry(policy))
+		_assert(err == nil && reply == 3, "expect success on the third attempt, got %d, %v", reply, err)
+		_assert(reflect.DeepEqual(attempts, []int{0, 1, 2}), "unexpected attempts %v", attempts)
+
+		flaky.calls.Store(0)
+		policy.MaxAttempts = 2
+		err = client.Call(ctx, "Flaky.Do", 0, &reply, WithRetry(policy))
+		_assert(codeOf(err) == CodeUnavailable && flaky.calls.Load() == 2, "expect 2 failed attempts, got %d, %v", flaky.calls.Load(), err)
+
+		attempts = nil
+		err = client.Call(ctx, "Failer.Plain", 0, &reply, WithRetry(policy))
+		_assert(err != nil && len(attempts) == 1, "plain errors should not be retried, got %v", attempts)
+	})
+}
+
+func TestRetryPolicy_Backoff(t *testing.T) {
+	p := RetryPolicy{Backoff: 10 * time.Millisecond, MaxBackoff: 50 * time.Millisecond}
+	for n, want := range map[int]time.Duration{1: 10 * time.Millisecond, 2: 20 * time.Millisecond, 3: 40 * time.Millisecond, 4: 50 * time.Millisecond, 10: 50 * time.Millisecond} {
+		_assert(p.backoff(n) == want, "backoff(%d) = %s, want %s", n, p.backoff(n), want)
+	}
+	p.Jitter = 0.5
+	for i := 0; i < 100; i++ {
+		d := p.backoff(1)
+		_assert(d >= 5*time.Millisecond && d <= 15*time.Millisecond, "jittered backoff %s out of range", d)
+	}
+}
+
+func TestClient_Reconnect(t *testing.T) {
+	var e Echo
+	g := &Gate{entered: make(chan struct{}, 1), release: make(chan struct{})}
+	defer close(g.release)
+	server := NewServer()
+	_ = server.Register(&e)
+	_ = server.Register(g)
+	var down atomic.Bool
+	var dials atomic.Int32
+	conns := make(chan net.Conn, 10)
+	transport := TransportFunc(func(network, address string) (io.ReadWriteCloser, error) {
+		dials.Add(1)
+		if down.Load() {
+			return nil, errors.New("connection refused")
+		}
+		clientConn, serverConn := net.Pipe()
+		conns <- serverConn
+		go server.ServerConn(serverConn)
+		return clientConn, nil
+	})
+	waitAvailable := func(client *Client) {
+		for i := 0; i < 200 && !client.IsAvailable(); i++ {
+			time.Sleep(5 * time.Millisecond)
+		}
+		_assert(client.IsAvailable(), "client should reconnect")
+	}
+
+	client, err := Dial("tcp", "tunnel:7001", &Option{Transport: transport, Reconnect: &ReconnectPolicy{Backoff: 5 * time.Millisecond, Jitter: 0.5}})
+	_assert(err == nil, "failed to dial: %v", err)
+	defer func() { _ = client.Close() }()
+	var reply string
+	_assert(client.Call(context.Background(), "Echo.Echo", "a", &reply) == nil && reply == "a", "failed to call Echo.Echo")
+
+	// 链接断开时只有已经发出的请求失败
+	down.Store(true)
+	inflight := client.Go("Gate.Wait", 1, new(int), make(chan *Call, 1))
+	<-g.entered
+	_ = (<-conns).Close()
+	call := <-inflight.Done
+	_assert(call.Error != nil, "in-flight call should fail")
+	err = client.Call(context.Background(), "Echo.Echo", "b", &reply)
+	_assert(errors.Is(err, ErrReconnecting) && codeOf(err) == CodeUnavailable, "expect a reconnecting error, got %v", err)
+
+	// 等到至少一次重连失败之后再恢复
+	for i := 0; i < 200 && dials.Load() < 2; i++ {
+		time.Sleep(5 * time.Millisecond)
+	}
+	down.Store(false)
+	waitAvailable(client)
+	_assert(client.Call(context.Background(), "Echo.Echo", "c", &reply) == nil && reply == "c", "failed to call after reconnect")
+	_assert(dials.Load() > 2, "expect failed dials while the server is down, got %d", dials.Load())
+	// 请求数在重连之后继续累计, 被拒绝的请求没有写入链接
+	stats := client.Stats()
+	_assert(stats.Reconnects == 1 && stats.CallsSent == 3 && stats.CallsReceived == 2 && stats.Pending == 0, "unexpected stats after reconnect %+v", stats)
+
+	// 关闭之后不再重连
+	_ = client.Close()
+	n := dials.Load()
+	_ = (<-conns).Close()
+	time.Sleep(30 * time.Millisecond)
+	_assert(dials.Load() == n, "closed client should not reconnect")
+
+	t.Run("give up", func(t *testing.T) {
+		client, err := Dial("tcp", "tunnel:7001", &Option{Transport: transport, Reconnect: &ReconnectPolicy{Backoff: time.Millisecond, MaxAttempts: 2}})
+		_assert(err == nil, "failed to dial: %v", err)
+		defer func() { _ = client.Close() }()
+		down.Store(true)
+		defer down.Store(false)
+		_ = (<-conns).Close()
+		for i := 0; i < 200; i++ {
+			if err = client.Call(context.Background(), "Echo.Echo", "d", &reply); errors.Is(err, ErrShutdown) {
+				break
+			}
+			time.Sleep(5 * time.Millisecond)
+		}
+		_assert(errors.Is(err, ErrShutdown), "expect the client to shut down after 2 attempts, got %v", err)
+	})
+}
+
+func TestReconnectPolicy_Delay(t *testing.T) {
+	p := ReconnectPolicy{Backoff: 10 * time.Millisecond, MaxBackoff: 50 * time.Millisecond}
+	for n, want := range map[int]time.Duration{1: 10 * time.Millisecond, 2: 20 * time.Millisecond, 3: 40 * time.Millisecond, 4: 50 * time.Millisecond} {
+		_assert(p.delay(n) == want, "delay(%d) = %s, want %s", n, p.delay(n), want)
+	}
+	p.Jitter = 0.5
+	for i := 0; i < 100; i++ {
+		d := p.delay(1)
+		_assert(d >= 5*time.Millisecond && d <= 15*time.Millisecond, "jittered delay %s out of range", d)
+	}
+	_assert((&ReconnectPolicy{}).delay(100) == 30*time.Second, "expect the default limit")
+}
+
+// frozenConn 在 frozen 被设置之后不再写出数据, 模拟失去响应的服务端
+type frozenConn struct {
+	net.Conn
+	frozen  *atomic.Bool
+	release chan struct{}
+}
+
+func (c *frozenConn) Write(p []byte) (int, error) {
+	if c.frozen.Load() {
+		<-c.release
+		return 0, io.ErrClosedPipe
+	}
+	return c.Conn.Write(p)
+}
+
+func TestClient_Keepalive(t *testing.T) {
+	g := &Gate{entered: make(chan struct{}, 1), release: make(chan struct{})}
+	defer close(g.release)
+	server := NewServer()
+	_ = server.Register(g)
+	var frozen atomic.Bool
+	release := make(chan struct{})
+	defer close(release)
+	transport := TransportFunc(func(network, address string) (io.ReadWriteCloser, error) {
+		clientConn, serverConn := net.Pipe()
+		go server.ServerConn(&frozenConn{Conn: serverConn, frozen: &frozen, release: release})
+		return clientConn, nil
+	})
+	keepalive := &KeepaliveParams{Interval: 10 * time.Millisecond, Timeout: 50 * time.Millisecond}
+	client, err := Dial("tcp", "tunnel:7001", &Option{Transport: transport, Keepalive: keepalive})
+	_assert(err == nil, "failed to dial: %v", err)
+	defer func() { _ = client.Close() }()
+
+	// 空闲的链接定期发送 ping, 服务端回复之后链接保持可用
+	time.Sleep(100 * time.Millisecond)
+	stats := client.Stats()
+	_assert(stats.FramesWritten >= 3 && stats.FramesRead >= 3, "expect pings on an idle connection, got %+v", stats)
+	_assert(client.IsAvailable(), "client should stay available")
+
+	// 服务端失去响应时, 已经发出的请求在 Timeout 之后失败, 而不是一直等待
+	inflight := client.Go("Gate.Wait", 1, new(int), make(chan *Call, 1))
+	<-g.entered
+	frozen.Store(true)
+	start := time.Now()
+	select {
+	case call := <-inflight.Done:
+		_assert(errors.Is(call.Error, ErrKeepaliveTimeout) && codeOf(call.Error) == CodeUnavailable, "expect a keepalive timeout, got %v", call.Error)
+	case <-time.After(time.Second):
+		t.Fatal("keepalive should detect the dead server")
+	}
+	_assert(time.Since(start) < 500*time.Millisecond, "dead server detected too late: %s", time.Since(start))
+	_assert(!client.IsAvailable(), "client should be unavailable after the keepalive timeout")
+}
+
+func TestClient_MaxPendingCalls(t *testing.T) {
+	g := &Gate{entered: make(chan struct{}, 4), release: make(chan struct{})}
+	server := NewServer()
+	_ = server.Register(g)
+
+	client, err := server.NewPipeClient(&Option{MaxPendingCalls: 2})
+	_assert(err == nil, "failed to create pipe client: %v", err)
+	defer func() { _ = client.Close() }()
+	calls := []*Call{client.Go("Gate.Wait", 1, new(int), nil), client.Go("Gate.Wait", 2, new(int), nil)}
+	<-g.entered
+	<-g.entered
+	// 达到上限时立即失败
+	call := <-client.Go("Gate.Wait", 3, new(int), nil).Done
+	_assert(errors.Is(call.Error, ErrTooManyPending) && codeOf(call.Error) == CodeResourceExhausted, "expect too many pending calls, got %v", call.Error)
+	err = client.Call(context.Background(), "Gate.Wait", 3, new(int))
+	_assert(errors.Is(err, ErrTooManyPending), "expect too many pending calls, got %v", err)
+	_assert(client.NumPending() == 2, "expect 2 pending calls, got %d", client.NumPending())
+
+	blocking, err := server.NewPipeClient(&Option{MaxPendingCalls: 1, BlockOnPendingLimit: true})
+	_assert(err == nil, "failed to create pipe client: %v", err)
+	defer func() { _ = blocking.Close() }()
+	first := blocking.Go("Gate.Wait", 4, new(int), nil)
+	<-g.entered
+	// 等待其他请求完成, 直到 ctx 结束
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	err = blocking.Call(ctx, "Gate.Wait", 5, new(int))
+	cancel()
+	_assert(errors.Is(err, context.DeadlineExceeded), "expect the blocked call to time out, got %v", err)
+	done := make(chan error, 1)
+	go func() {
+		var reply int
+		done <- blocking.Call(context.Background(), "Gate.Wait", 6, &reply)
+	}()
+	select {
+	case err := <-done:
+		t.Fatalf("call should block while the limit is reached, got %v", err)
+	case <-time.After(20 * time.Millisecond):
+	}
+
+	// 请求完成之后名额被归还
+	close(g.release)
+	for _, call := range append(calls, first) {
+		<-call.Done
+		_assert(call.Error == nil, "failed to call Gate.Wait: %v", call.Error)
+	}
+	_assert(<-done == nil, "blocked call should proceed once a slot is free")
+	_assert(client.Call(context.Background(), "Gate.Wait", 7, new(int)) == nil, "slots should be released")
+}
+
+func TestInvoke(t *testing.T) {
+	client, server, err := NewPipeClientServer()
+	_assert(err == nil, "failed to create pipe client: %v", err)
+	defer func() { _ = client.Close() }()
+	var foo Foo
+	_ = server.Register(&foo)
+
+	reply, err := Invoke[*Args, int](context.Background(), client, "Foo.Sum", &Args{Num1: 1, Num2: 2})
+	_assert(err == nil && reply == 3, "failed to invoke Foo.Sum: %d, %v", reply, err)
+	sum := NewStub[Args, int](client, "Foo.Sum")
+	reply, err = sum(context.Background(), Args{Num1: 3, Num2: 4}, WithTimeout(time.Second))
+	_assert(err == nil && reply == 7, "failed to call Foo.Sum through stub: %d, %v", reply, err)
+	_, err = NewStub[Args, int](client, "Foo.Missing")(context.Background(), Args{})
+	_assert(errors.Is(err, ErrNotFound), "expect not found, got %v", err)
+}
+
+func TestClient_GoFuture(t *testing.T) {
+	client, server, err := NewPipeClientServer()
+	_assert(err == nil, "failed to create pipe client: %v", err)
+	defer func() { _ = client.Close() }()
+	var foo Foo
+	_ = server.Register(&foo)
+	g := &Gate{entered: make(chan struct{}, 1), release: make(chan struct{})}
+	_ = server.Register(g)
+
+	// 串联两个请求, 第二个请求使用第一个的结果
+	var first, second int
+	f := client.GoFuture("Foo.Sum", &Args{Num1: 1, Num2: 2}, &first).Then(func(call *Call) error {
+		return client.Call(context.Background(), "Foo.Sum", &Args{Num1: first, Num2: 10}, &second)
+	})
+	_assert(f.Await(context.Background()) == nil && first == 3 && second == 13, "failed to chain calls: %d, %d", first, second)
+	_assert(f.Call() != nil && f.Call().Reply == &first, "expect the completed call")
+
+	// 失败时跳过之后的回调, 错误传递到最后
+	called := false
+	f = client.GoFuture("Foo.Missing", &Args{}, new(int)).Then(func(*Call) error {
+		called = true
+		return nil
+	})
+	err = f.Await(context.Background())
+	_assert(errors.Is(err, ErrNotFound) && !called, "expect the error to propagate, got %v", err)
+
+	// ctx 结束时只是不再等待
+	f = client.GoFuture("Gate.Wait", 1, new(int))
+	<-g.entered
+	_assert(f.Call() == nil, "call should not be completed")
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	err = f.Await(ctx)
+	_assert(errors.Is(err, context.DeadlineExceeded), "expect await to time out, got %v", err)
+	close(g.release)
+	<-f.Done()
+	_assert(f.Await(context.Background()) == nil, "call should complete after release")
+}
+
+// Sink 记录收到的单向请求
+type Sink struct{ events chan int }
+
+func (s *Sink) Record(v int, _ *int) error {
+	s.events <- v
+	return nil
+}
+
+func TestClient_Notify(t *testing.T) {
+	client, server, err := NewPipeClientServer()
+	_assert(err == nil, "failed to create pipe client: %v", err)
+	sink := &Sink{events: make(chan int, 10)}
+	_ = server.Register(sink)
+
+	before := client.Stats()
+	for i := 1; i <= 3; i++ {
+		_assert(client.Notify("Sink.Record", i) == nil, "failed to notify")
+	}
+	// 失败的单向请求也不会收到回复
+	_assert(client.Notify("Sink.Missing", 0) == nil, "failed to notify")
+	// 服务端并发处理请求, 不保证顺序
+	sum := 0
+	for i := 1; i <= 3; i++ {
+		sum += <-sink.events
+	}
+	_assert(sum == 6, "all notifications should be handled, got sum %d", sum)
+	_assert(client.NumPending() == 0, "notifications should not be pending")
+	_assert(client.Call(context.Background(), "Sink.Record", 4, new(int)) == nil && <-sink.events == 4, "failed to call after notify")
+	after := client.Stats()
+	_assert(after.FramesWritten-before.FramesWritten == 5 && after.FramesRead-before.FramesRead == 1, "expect replies only for the call, got %+v -> %+v", before, after)
+	_assert(after.Notifications-before.Notifications == 4 && after.CallsSent-before.CallsSent == 1, "notifications should be counted apart from calls, got %+v -> %+v", before, after)
+
+	_ = client.Close()
+	_assert(errors.Is(client.Notify("Sink.Record", 5), ErrShutdown), "notify on a closed client should fail")
+}
+
+func BenchmarkClient_Call(b *testing.B) {
+	client, server, err := NewPipeClientServer()
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer func() { _ = client.Close() }()
+	var foo Foo
+	_ = server.Register(&foo)
+	b.ReportAllocs()
+	b.RunParallel(func(pb *testing.PB) {
+		var reply int
+		for pb.Next() {
+			if err := client.Call(context.Background(), "Foo.Sum", &Args{Num1: 1, Num2: 2}, &reply); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
+
+// BenchmarkClient_Pending 只测量注册和移除请求, 不包括编解码和链接
+func BenchmarkClient_Pending(b *testing.B) {
+	client := newClientCodec(nil, &Option{}, new(connCounters), nil)
+	b.ReportAllocs()
+	b.RunParallel(func(pb *testing.PB) {
+		call := &Call{}
+		for pb.Next() {
+			seq, err := client.registerCall(call)
 			if err != nil {
-				t.Fatal("failed to listen unix socket")
+				b.Fatal(err)
 			}
-			ch <- struct{}{}
-			Accept(l)
-		}()
-		<-ch
-		_, err := XDial("unix@" + addr)
-		_assert(err == nil, "failed to connect unix socket")
+			client.removeCall(seq)
+		}
+	})
+}
+
+// writeCounter 统计底层链接的 Write 次数
+type writeCounter struct {
+	net.Conn
+	writes atomic.Int32
+}
+
+func (c *writeCounter) Write(p []byte) (int, error) {
+	c.writes.Add(1)
+	return c.Conn.Write(p)
+}
+
+func TestClient_CoalesceWrites(t *testing.T) {
+	var foo Foo
+	server := NewServer()
+	_ = server.Register(&foo)
+	var conn *writeCounter
+	transport := TransportFunc(func(network, address string) (io.ReadWriteCloser, error) {
+		clientConn, serverConn := net.Pipe()
+		go server.ServerConn(serverConn)
+		conn = &writeCounter{Conn: clientConn}
+		return conn, nil
+	})
+	client, err := Dial("tcp", "tunnel:7001", &Option{Transport: transport})
+	_assert(err == nil, "failed to dial: %v", err)
+	defer func() { _ = client.Close() }()
+
+	// 没有并发时每个请求立即发送
+	var reply int
+	_assert(client.Call(context.Background(), "Foo.Sum", &Args{Num1: 1, Num2: 2}, &reply) == nil && reply == 3, "failed to call Foo.Sum")
+
+	// 并发的请求在等待链接时合并发送
+	const n = 50
+	before := conn.writes.Load()
+	done := make(chan *Call, n)
+	var wg sync.WaitGroup
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			client.Go("Foo.Sum", &Args{Num1: i, Num2: i}, new(int), done)
+		}(i)
+	}
+	wg.Wait()
+	for i := 0; i < n; i++ {
+		call := <-done
+		_assert(call.Error == nil && *call.Reply.(*int) == 2*call.Args.(*Args).Num1, "failed to call Foo.Sum: %v", call.Error)
+	}
+	writes := conn.writes.Load() - before
+	_assert(writes < n, "expect concurrent requests to share writes, got %d writes for %d requests", writes, n)
+}
+
+// stallConn 在 stall 被设置之后阻塞 Write, 直到 resume 被关闭, 模拟很慢的网络
+type stallConn struct {
+	net.Conn
+	stall   atomic.Bool
+	stalled atomic.Int32 // 正在阻塞的 Write 数
+	resume  chan struct{}
+}
+
+func (c *stallConn) Write(p []byte) (int, error) {
+	if c.stall.Load() {
+		c.stalled.Add(1)
+		<-c.resume
+	}
+	return c.Conn.Write(p)
+}
+
+func TestClient_SendQueue(t *testing.T) {
+	var foo Foo
+	server := NewServer()
+	_ = server.Register(&foo)
+	dial := func(overflow QueueOverflow) (*Client, *stallConn) {
+		var conn *stallConn
+		transport := TransportFunc(func(network, address string) (io.ReadWriteCloser, error) {
+			clientConn, serverConn := net.Pipe()
+			go server.ServerConn(serverConn)
+			conn = &stallConn{Conn: clientConn, resume: make(chan struct{})}
+			return conn, nil
+		})
+		client, err := Dial("tcp", "tunnel:7001", &Option{Transport: transport, SendQueueSize: 2, SendQueueOverflow: overflow})
+		_assert(err == nil, "failed to dial: %v", err)
+		var reply int
+		_assert(client.Call(context.Background(), "Foo.Sum", &Args{Num1: 1, Num2: 2}, &reply) == nil && reply == 3, "failed to call through the send queue")
+		// 第一个请求阻塞在写入链接上, 之后的请求留在队列中
+		conn.stall.Store(true)
+		return client, conn
+	}
+	goSum := func(client *Client, i int) *Call {
+		return client.Go("Foo.Sum", &Args{Num1: i, Num2: i}, new(int), make(chan *Call, 1))
+	}
+	fill := func(client *Client, conn *stallConn) []*Call {
+		calls := []*Call{goSum(client, 1)}
+		for conn.stalled.Load() == 0 {
+			time.Sleep(time.Millisecond)
+		}
+		return append(calls, goSum(client, 2), goSum(client, 3))
+	}
+	finish := func(conn *stallConn, calls ...*Call) {
+		close(conn.resume)
+		for _, call := range calls {
+			<-call.Done
+			_assert(call.Error == nil && *call.Reply.(*int) == 2*call.Args.(*Args).Num1, "failed to call Foo.Sum: %v", call.Error)
+		}
+	}
+
+	t.Run("error", func(t *testing.T) {
+		client, conn := dial(OverflowError)
+		defer func() { _ = client.Close() }()
+		calls := fill(client, conn)
+		call := <-goSum(client, 4).Done
+		_assert(errors.Is(call.Error, ErrSendQueueFull) && codeOf(call.Error) == CodeResourceExhausted, "expect a full send queue, got %v", call.Error)
+		finish(conn, calls...)
+		_assert(client.NumPending() == 0, "expect no pending calls, got %d", client.NumPending())
+	})
+
+	t.Run("drop oldest", func(t *testing.T) {
+		client, conn := dial(OverflowDropOldest)
+		defer func() { _ = client.Close() }()
+		calls := fill(client, conn)
+		newest := goSum(client, 4)
+		call := <-calls[1].Done
+		_assert(errors.Is(call.Error, ErrSendQueueFull), "expect the oldest queued call to be dropped, got %v", call.Error)
+		finish(conn, calls[0], calls[2], newest)
+	})
+
+	t.Run("block", func(t *testing.T) {
+		client, conn := dial(OverflowBlock)
+		defer func() { _ = client.Close() }()
+		calls := fill(client, conn)
+		ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+		defer cancel()
+		err := client.Call(ctx, "Foo.Sum", &Args{Num1: 4, Num2: 4}, new(int))
+		_assert(errors.Is(err, context.DeadlineExceeded), "expect the call to wait for the queue, got %v", err)
+		finish(conn, calls...)
+		_assert(client.NumPending() == 0, "expect no pending calls, got %d", client.NumPending())
+	})
+
+	t.Run("close", func(t *testing.T) {
+		client, conn := dial(OverflowBlock)
+		calls := fill(client, conn)
+		_ = client.Close()
+		close(conn.resume)
+		for _, call := range calls {
+			<-call.Done
+			_assert(call.Error != nil, "queued calls should fail when the client is closed")
+		}
+	})
+}
+
+// Lookup 统计被调用的次数, 阻塞到 release 被关闭
+type Lookup struct {
+	calls   atomic.Int32
+	release chan struct{}
+}
+
+func (l *Lookup) Get(key string, reply *[]string) error {
+	l.calls.Add(1)
+	<-l.release
+	*reply = []string{key, strings.ToUpper(key)}
+	return nil
+}
+
+func TestSingleflightInterceptor(t *testing.T) {
+	lookup := &Lookup{release: make(chan struct{})}
+	var entered atomic.Int32
+	count := func(ctx context.Context, info *CallInfo, args, reply interface{}, invoke Invoker) error {
+		entered.Add(1)
+		return invoke(ctx)
+	}
+	client, server, err := NewPipeClientServer(&Option{Interceptors: []ClientInterceptor{count, SingleflightInterceptor()}})
+	_assert(err == nil, "failed to create pipe client: %v", err)
+	defer func() { _ = client.Close() }()
+	_ = server.Register(lookup)
+
+	const n = 20
+	replies := make([][]string, n)
+	errs := make(chan error, n+1)
+	var wg sync.WaitGroup
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			errs <- client.Call(context.Background(), "Lookup.Get", "a", &replies[i])
+		}(i)
+	}
+	// 参数不同的请求单独发送
+	var other []string
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		errs <- client.Call(context.Background(), "Lookup.Get", "b", &other)
+	}()
+	for entered.Load() < n+1 || lookup.calls.Load() < 2 {
+		time.Sleep(time.Millisecond)
+	}
+	time.Sleep(10 * time.Millisecond)
+	close(lookup.release)
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		_assert(err == nil, "failed to call Lookup.Get: %v", err)
+	}
+	_assert(lookup.calls.Load() == 2, "expect identical calls to be collapsed, got %d calls", lookup.calls.Load())
+	for i := range replies {
+		_assert(reflect.DeepEqual(replies[i], []string{"a", "A"}), "reply %d = %v", i, replies[i])
+	}
+	_assert(reflect.DeepEqual(other, []string{"b", "B"}), "reply = %v", other)
+
+	// 完成之后的请求重新发送
+	var reply []string
+	_assert(client.Call(context.Background(), "Lookup.Get", "a", &reply) == nil && lookup.calls.Load() == 3, "later calls should not reuse the finished flight")
+}
+
+func TestSingleflightInterceptor_LeaderReply(t *testing.T) {
+	lookup := &Lookup{release: make(chan struct{})}
+	var entered atomic.Int32
+	count := func(ctx context.Context, info *CallInfo, args, reply interface{}, invoke Invoker) error {
+		entered.Add(1)
+		return invoke(ctx)
+	}
+	client, server, err := NewPipeClientServer(&Option{Interceptors: []ClientInterceptor{count, SingleflightInterceptor()}})
+	_assert(err == nil, "failed to create pipe client: %v", err)
+	defer func() { _ = client.Close() }()
+	_ = server.Register(lookup)
+
+	// 每个调用方返回之后立即修改自己的 reply, 其他调用方不能读到发起请求的调用方修改之后的值
+	const n = 20
+	replies := make([][]string, n)
+	var wg sync.WaitGroup
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			err := client.Call(context.Background(), "Lookup.Get", "a", &replies[i])
+			_assert(err == nil && reflect.DeepEqual(replies[i], []string{"a", "A"}), "reply %d = %v, %v", i, replies[i], err)
+			replies[i] = []string{"modified"}
+		}(i)
+	}
+	for entered.Load() < n {
+		time.Sleep(time.Millisecond)
+	}
+	close(lookup.release)
+	wg.Wait()
+
+}
+
+func TestSingleflightInterceptor_LeaderCanceled(t *testing.T) {
+	lookup := &Lookup{release: make(chan struct{})}
+	var entered atomic.Int32
+	count := func(ctx context.Context, info *CallInfo, args, reply interface{}, invoke Invoker) error {
+		entered.Add(1)
+		return invoke(ctx)
+	}
+	client, server, err := NewPipeClientServer(&Option{Interceptors: []ClientInterceptor{count, SingleflightInterceptor()}})
+	_assert(err == nil, "failed to create pipe client: %v", err)
+	defer func() { _ = client.Close() }()
+	_ = server.Register(lookup)
+
+	// 发起请求的调用方取消之后, 等待的调用方重新发起请求
+	ctx, cancel := context.WithCancel(context.Background())
+	leaderErr := make(chan error, 1)
+	go func() {
+		var reply []string
+		leaderErr <- client.Call(ctx, "Lookup.Get", "b", &reply)
+	}()
+	for lookup.calls.Load() < 1 {
+		time.Sleep(time.Millisecond)
+	}
+	followerErr := make(chan error, 1)
+	var reply []string
+	go func() { followerErr <- client.Call(context.Background(), "Lookup.Get", "b", &reply) }()
+	for entered.Load() < 2 {
+		time.Sleep(time.Millisecond)
+	}
+	time.Sleep(10 * time.Millisecond)
+	cancel()
+	_assert(<-leaderErr != nil, "expect the canceled leader to fail")
+	for lookup.calls.Load() < 2 {
+		time.Sleep(time.Millisecond)
 	}
+	close(lookup.release)
+	err = <-followerErr
+	_assert(err == nil && reflect.DeepEqual(reply, []string{"b", "B"}), "follower should re-issue the call, got %v %v", reply, err)
+}
+
+// Config 统计被调用的次数
+type Config struct{ calls atomic.Int32 }
+
+func (c *Config) Get(key string, reply *map[string]string) error {
+	c.calls.Add(1)
+	*reply = map[string]string{"key": key, "version": strconv.Itoa(int(c.calls.Load()))}
+	return nil
+}
+
+func (c *Config) Version(_ int, reply *int) error {
+	*reply = int(c.calls.Add(1))
+	return nil
+}
+
+func TestResponseCache(t *testing.T) {
+	cache := &ResponseCache{TTL: map[string]time.Duration{"Config.Get": 50 * time.Millisecond}, MaxEntries: 2}
+	config := new(Config)
+	client, server, err := NewPipeClientServer(&Option{Interceptors: []ClientInterceptor{cache.Interceptor()}})
+	_assert(err == nil, "failed to create pipe client: %v", err)
+	defer func() { _ = client.Close() }()
+	_ = server.Register(config)
+
+	get := func(key string) map[string]string {
+		var reply map[string]string
+		_assert(client.Call(context.Background(), "Config.Get", key, &reply) == nil, "failed to call Config.Get")
+		return reply
+	}
+	first := get("a")
+	first["key"] = "modified"
+	// 命中时得到独立的副本
+	_assert(reflect.DeepEqual(get("a"), map[string]string{"key": "a", "version": "1"}) && config.calls.Load() == 1, "expect a cached reply")
+	// 没有设置 TTL 的方法不缓存
+	var version int
+	_ = client.Call(context.Background(), "Config.Version", 0, &version)
+	_ = client.Call(context.Background(), "Config.Version", 0, &version)
+	_assert(config.calls.Load() == 3, "uncached method should reach the server, got %d calls", config.calls.Load())
+
+	// 超过 MaxEntries 时淘汰最久没有使用的
+	get("b")
+	get("a")
+	get("c")
+	_assert(cache.Stats().Entries == 2, "expect 2 entries, got %+v", cache.Stats())
+	n := config.calls.Load()
+	get("a")
+	_assert(config.calls.Load() == n, "recently used entry should stay")
+	get("b")
+	_assert(config.calls.Load() == n+1, "least recently used entry should be evicted")
+
+	// 过期之后重新请求
+	time.Sleep(60 * time.Millisecond)
+	n = config.calls.Load()
+	_assert(get("a")["version"] == strconv.Itoa(int(n+1)), "expired entry should be refreshed")
+	cache.Purge()
+	get("a")
+	_assert(config.calls.Load() == n+2, "purged entry should be refreshed")
+	stats := cache.Stats()
+	_assert(stats.Hits == 3 && stats.Misses == 6, "unexpected stats %+v", stats)
+}
+
+func TestClientPool(t *testing.T) {
+	g := &Gate{entered: make(chan struct{}, 2), release: make(chan struct{})}
+	server := NewServer()
+	_ = server.Register(g)
+	var dials atomic.Int32
+	transport := TransportFunc(func(network, address string) (io.ReadWriteCloser, error) {
+		dials.Add(1)
+		clientConn, serverConn := net.Pipe()
+		go server.ServerConn(serverConn)
+		return clientConn, nil
+	})
+	pool, err := DialPool("tcp", "tunnel:7001", 2, &Option{Transport: transport})
+	_assert(err == nil && pool.Size() == 2 && dials.Load() == 2, "failed to dial pool: %v", err)
+	defer func() { _ = pool.Close() }()
+
+	// 请求轮流使用每条链接, 一个阻塞的请求不会影响另一条链接
+	a, _ := pool.Get()
+	b, _ := pool.Get()
+	_assert(a != b, "expect round-robin over connections")
+	calls := []*Call{pool.Go("Gate.Wait", 1, new(int), nil), pool.Go("Gate.Wait", 2, new(int), nil)}
+	<-g.entered
+	<-g.entered
+	_assert(a.NumPending() == 1 && b.NumPending() == 1, "expect one call per connection, got %d and %d", a.NumPending(), b.NumPending())
+	close(g.release)
+	for _, call := range calls {
+		<-call.Done
+		_assert(call.Error == nil, "failed to call Gate.Wait: %v", call.Error)
+	}
+
+	// 不可用的链接在下一次被选中时重新建立
+	_ = a.Close()
+	c, err := pool.Get()
+	_assert(err == nil && c != a && c.IsAvailable() && dials.Load() == 3, "expect the closed connection to be replaced: %v", err)
+	_assert(pool.Call(context.Background(), "Gate.Wait", 3, new(int)) == nil, "failed to call through the pool")
+
+	_ = pool.Close()
+	_, err = pool.Get()
+	_assert(errors.Is(err, ErrShutdown), "expect a closed pool, got %v", err)
+	call := <-pool.Go("Gate.Wait", 4, new(int), nil).Done
+	_assert(errors.Is(call.Error, ErrShutdown), "expect a closed pool, got %v", call.Error)
+}
+
+func TestClientPool_SlowDial(t *testing.T) {
+	server := NewServer()
+	_ = server.Register(new(Foo))
+	var dials atomic.Int32
+	entered, release := make(chan struct{}), make(chan struct{})
+	pool := NewClientPool(2, func() (*Client, error) {
+		// 第二条链接建立得很慢
+		if dials.Add(1) == 2 {
+			close(entered)
+			<-release
+		}
+		clientConn, serverConn := net.Pipe()
+		go server.ServerConn(serverConn)
+		return NewClient(clientConn, DefaultOption)
+	})
+	defer func() { _ = pool.Close() }()
+
+	a, err := pool.Get()
+	_assert(err == nil, "failed to get the first connection: %v", err)
+	type result struct {
+		client *Client
+		err    error
+	}
+	slow := make(chan result, 2)
+	go func() {
+		client, err := pool.Get()
+		slow <- result{client, err}
+	}()
+	<-entered
+
+	// 另一个位置不受正在建立的链接影响
+	done := make(chan error, 1)
+	go func() {
+		client, err := pool.Get()
+		if err == nil && client != a {
+			err = errors.New("expect the established connection")
+		}
+		if err == nil {
+			var reply int
+			err = client.Call(context.Background(), "Foo.Sum", Args{Num1: 1, Num2: 2}, &reply)
+		}
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		_assert(err == nil, "failed to call on the established connection: %v", err)
+	case <-time.After(time.Second):
+		t.Fatal("a slow dial should not block other connections")
+	}
+
+	// 同一个位置的调用方等待同一次建立链接
+	go func() {
+		client, err := pool.Get()
+		slow <- result{client, err}
+	}()
+	time.Sleep(20 * time.Millisecond)
+	close(release)
+	r1, r2 := <-slow, <-slow
+	_assert(r1.err == nil && r2.err == nil && r1.client == r2.client && r1.client != a, "expect callers of one slot to share the dial: %v %v", r1.err, r2.err)
+	_assert(dials.Load() == 2, "expect 2 dials, got %d", dials.Load())
+}
+
+func TestMultiError(t *testing.T) {
+	errs := new(MultiError)
+	errs.Add("tcp@a", 0, ErrUnavailable)
+	_assert(errs.Error() == "tcp@a: rpc: unavailable", "unexpected message %q", errs.Error())
+	errs.Add("tcp@b", 1, errors.New("boom"))
+	errs.Add("tcp@a", 2, context.DeadlineExceeded)
+	_assert(strings.HasPrefix(errs.Error(), "rpc: 3 calls failed: tcp@a: rpc: unavailable; tcp@b: boom"), "unexpected message %q", errs.Error())
+	var err error = errs
+	_assert(errors.Is(err, ErrUnavailable) && errors.Is(err, context.DeadlineExceeded), "expect errors.Is to check every error")
+	var addrErr *AddrError
+	_assert(errors.As(err, &addrErr) && addrErr.Addr == "tcp@a", "expect errors.As to find the first AddrError")
+	_assert(codeOf(err) == CodeUnavailable, "expect the code of the first *Error, got %v", codeOf(err))
+	addrs := errs.Addrs()
+	_assert(len(addrs) == 2 && addrs[0] == "tcp@a" && addrs[1] == "tcp@b", "unexpected addrs %v", addrs)
 }
@@ -0,0 +1,130 @@
+package codec
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"reflect"
+	"sync"
+)
+
+// AvroCodec 使用 Avro 二进制编码, 方便与数据平台共享 schema
+// 默认根据 Go 类型生成 schema, 也可以通过 RegisterAvroSchema 为某个方法的参数或返回值指定 schema
+type AvroCodec struct {
+	*FrameConn        // 负责读写帧, 见 frame_conn.go
+	method     string // 上一个读到的 `Header` 的 ServiceMethod, 用于查找 `Body` 的 schema
+}
+
+var _ Codec = (*AvroCodec)(nil)
+
+// NewAvroCodec 初始化函数
+func NewAvroCodec(conn io.ReadWriteCloser) Codec {
+	fc := NewFrameConn(conn)
+	fc.typ = AvroType
+	return &AvroCodec{FrameConn: fc}
+}
+
+// avroSchemaKey 同一个方法的参数和返回值通过 Go 类型区分
+type avroSchemaKey struct {
+	method string
+	typ    reflect.Type
+}
+
+// avroSchemas 注册的 schema, 没有注册的类型使用 avroSchemaOf 生成的 schema
+var avroSchemas sync.Map // map[avroSchemaKey]*avroSchema
+
+// RegisterAvroSchema 为 serviceMethod 的参数或返回值指定 schema, v 是参数或返回值的一个实例
+// 通信双方需要注册相同的 schema, 需要在建立链接之前调用
+func RegisterAvroSchema(serviceMethod string, v interface{}, schema string) error {
+	s, err := parseAvroSchema(schema)
+	if err != nil {
+		return err
+	}
+	t := reflect.TypeOf(v)
+	if t == nil {
+		return errors.New("rpc codec: avro schema needs a typed value")
+	}
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	avroSchemas.Store(avroSchemaKey{method: serviceMethod, typ: t}, s)
+	return nil
+}
+
+// avroSchemaFor 查找 serviceMethod 中类型 t 使用的 schema
+func avroSchemaFor(method string, t reflect.Type) (*avroSchema, error) {
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	if s, ok := avroSchemas.Load(avroSchemaKey{method: method, typ: t}); ok {
+		return s.(*avroSchema), nil
+	}
+	return avroSchemaOf(t)
+}
+
+// avroMarshaler 返回编码 serviceMethod 消息的 MarshalFunc
+func avroMarshaler(method string) MarshalFunc {
+	return func(buf *bytes.Buffer, v interface{}) error {
+		rv := reflect.ValueOf(v)
+		if !rv.IsValid() {
+			return errors.New("rpc codec: cannot encode nil as avro")
+		}
+		s, err := avroSchemaFor(method, rv.Type())
+		if err != nil {
+			return err
+		}
+		out, err := appendAvro(buf.AvailableBuffer(), s, rv)
+		if err != nil {
+			return err
+		}
+		buf.Write(out)
+		return nil
+	}
+}
+
+// avroUnmarshaler 返回解码 serviceMethod 消息的 UnmarshalFunc, v 必须是指针
+func avroUnmarshaler(method string) UnmarshalFunc {
+	return func(data []byte, v interface{}) error {
+		rv := reflect.ValueOf(v)
+		if rv.Kind() != reflect.Ptr || rv.IsNil() {
+			return errors.New("rpc codec: avro decode target must be a non-nil pointer")
+		}
+		s, err := avroSchemaFor(method, rv.Type())
+		if err != nil {
+			return err
+		}
+		r := &avroReader{data: data}
+		if err := r.decode(s, rv.Elem()); err != nil {
+			return err
+		}
+		if len(r.data) != 0 {
+			return errors.New("rpc codec: trailing bytes after avro message")
+		}
+		return nil
+	}
+}
+
+// ReadHeader 读取 `Header` 帧
+func (c *AvroCodec) ReadHeader(h *Header) error {
+	if err := c.ReadHeaderFrame(h, avroUnmarshaler("")); err != nil {
+		return err
+	}
+	c.method = h.ServiceMethod
+	return nil
+}
+
+// ReadBody 读取 `Body` 帧, body 为 nil 时直接丢弃这一帧
+func (c *AvroCodec) ReadBody(body interface{}) error {
+	return c.ReadBodyFrame(body, avroUnmarshaler(c.method))
+}
+
+// Write 写回相应的函数, `Header` 使用生成的 schema, `Body` 使用方法对应的 schema
+func (c *AvroCodec) Write(h *Header, body interface{}) error {
+	bodyMarshal := avroMarshaler(h.ServiceMethod)
+	return c.WriteMessage(h, body, func(buf *bytes.Buffer, v interface{}) error {
+		if v == h {
+			return avroMarshaler("")(buf, v)
+		}
+		return bodyMarshal(buf, v)
+	})
+}
@@ -0,0 +1,646 @@
+package codec
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"reflect"
+	"strings"
+	"sync"
+)
+
+// 这里实现了 Avro 二进制编码 (https://avro.apache.org/docs/current/specification/) 中 RPC 用得到的部分:
+// 基本类型, record, enum, array, map, union 和 fixed, 不包含 logical type 和读写 schema 不同时的解析规则
+// Go 的结构体字段按名称与 record 的字段对应, 可以使用 `avro:"name"` 标签指定名称, `avro:"-"` 忽略字段
+
+// avroSchema 解析之后的 Avro schema
+type avroSchema struct {
+	typ      string        // null, boolean, int, long, float, double, bytes, string, record, enum, array, map, union, fixed
+	name     string        // record, enum, fixed 的名称
+	fields   []avroField   // record 的字段
+	symbols  []string      // enum 的取值
+	items    *avroSchema   // array 的元素
+	values   *avroSchema   // map 的值
+	branches []*avroSchema // union 的分支
+	size     int           // fixed 的字节数
+}
+
+type avroField struct {
+	name   string
+	schema *avroSchema
+}
+
+// parseAvroSchema 解析 JSON 格式的 Avro schema
+func parseAvroSchema(text string) (*avroSchema, error) {
+	var v interface{}
+	if err := json.Unmarshal([]byte(text), &v); err != nil {
+		return nil, fmt.Errorf("rpc codec: invalid avro schema: %w", err)
+	}
+	return parseAvroValue(v, make(map[string]*avroSchema))
+}
+
+// parseAvroValue 解析 schema 中的一个节点, named 记录已经定义的具名类型, 用于解析引用
+func parseAvroValue(v interface{}, named map[string]*avroSchema) (*avroSchema, error) {
+	switch v := v.(type) {
+	case string:
+		switch v {
+		case "null", "boolean", "int", "long", "float", "double", "bytes", "string":
+			return &avroSchema{typ: v}, nil
+		}
+		if s, ok := named[v]; ok {
+			return s, nil
+		}
+		return nil, fmt.Errorf("rpc codec: unknown avro type %q", v)
+	case []interface{}:
+		s := &avroSchema{typ: "union"}
+		for _, b := range v {
+			branch, err := parseAvroValue(b, named)
+			if err != nil {
+				return nil, err
+			}
+			s.branches = append(s.branches, branch)
+		}
+		return s, nil
+	case map[string]interface{}:
+		return parseAvroObject(v, named)
+	}
+	return nil, fmt.Errorf("rpc codec: invalid avro schema node %v", v)
+}
+
+func parseAvroObject(v map[string]interface{}, named map[string]*avroSchema) (*avroSchema, error) {
+	typ, _ := v["type"].(string)
+	name, _ := v["name"].(string)
+	s := &avroSchema{typ: typ, name: name}
+	switch typ {
+	case "record", "error":
+		s.typ = "record"
+		named[name] = s // 先登记名称, record 可以引用自身
+		fields, _ := v["fields"].([]interface{})
+		for _, f := range fields {
+			fm, ok := f.(map[string]interface{})
+			if !ok {
+				return nil, fmt.Errorf("rpc codec: invalid field in avro record %s", name)
+			}
+			fname, _ := fm["name"].(string)
+			fs, err := parseAvroValue(fm["type"], named)
+			if err != nil {
+				return nil, err
+			}
+			s.fields = append(s.fields, avroField{name: fname, schema: fs})
+		}
+	case "enum":
+		named[name] = s
+		symbols, _ := v["symbols"].([]interface{})
+		for _, sym := range symbols {
+			str, _ := sym.(string)
+			s.symbols = append(s.symbols, str)
+		}
+	case "fixed":
+		named[name] = s
+		size, _ := v["size"].(float64)
+		s.size = int(size)
+	case "array":
+		items, err := parseAvroValue(v["items"], named)
+		if err != nil {
+			return nil, err
+		}
+		s.items = items
+	case "map":
+		values, err := parseAvroValue(v["values"], named)
+		if err != nil {
+			return nil, err
+		}
+		s.values = values
+	default:
+		// {"type": "string"} 这种写法等价于 "string"
+		return parseAvroValue(v["type"], named)
+	}
+	return s, nil
+}
+
+// avroTypeSchemas 缓存根据 Go 类型生成的 schema
+var avroTypeSchemas sync.Map // map[reflect.Type]*avroSchema
+
+// avroSchemaOf 根据 Go 类型生成 schema, 指针对应 ["null", T], 结构体对应 record
+func avroSchemaOf(t reflect.Type) (*avroSchema, error) {
+	if s, ok := avroTypeSchemas.Load(t); ok {
+		return s.(*avroSchema), nil
+	}
+	s, err := deriveAvroSchema(t, make(map[reflect.Type]*avroSchema))
+	if err != nil {
+		return nil, err
+	}
+	avroTypeSchemas.Store(t, s)
+	return s, nil
+}
+
+func deriveAvroSchema(t reflect.Type, seen map[reflect.Type]*avroSchema) (*avroSchema, error) {
+	if s, ok := seen[t]; ok {
+		return s, nil
+	}
+	switch t.Kind() {
+	case reflect.Bool:
+		return &avroSchema{typ: "boolean"}, nil
+	case reflect.Int8, reflect.Int16, reflect.Int32, reflect.Uint8, reflect.Uint16:
+		return &avroSchema{typ: "int"}, nil
+	case reflect.Int, reflect.Int64, reflect.Uint, reflect.Uint32, reflect.Uint64:
+		return &avroSchema{typ: "long"}, nil
+	case reflect.Float32:
+		return &avroSchema{typ: "float"}, nil
+	case reflect.Float64:
+		return &avroSchema{typ: "double"}, nil
+	case reflect.String:
+		return &avroSchema{typ: "string"}, nil
+	case reflect.Slice:
+		if t.Elem().Kind() == reflect.Uint8 {
+			return &avroSchema{typ: "bytes"}, nil
+		}
+		items, err := deriveAvroSchema(t.Elem(), seen)
+		return &avroSchema{typ: "array", items: items}, err
+	case reflect.Array:
+		if t.Elem().Kind() == reflect.Uint8 {
+			return &avroSchema{typ: "fixed", name: t.Name(), size: t.Len()}, nil
+		}
+		items, err := deriveAvroSchema(t.Elem(), seen)
+		return &avroSchema{typ: "array", items: items}, err
+	case reflect.Map:
+		if t.Key().Kind() != reflect.String {
+			return nil, fmt.Errorf("rpc codec: avro map key must be string, got %s", t.Key())
+		}
+		values, err := deriveAvroSchema(t.Elem(), seen)
+		return &avroSchema{typ: "map", values: values}, err
+	case reflect.Ptr:
+		elem, err := deriveAvroSchema(t.Elem(), seen)
+		return &avroSchema{typ: "union", branches: []*avroSchema{{typ: "null"}, elem}}, err
+	case reflect.Struct:
+		s := &avroSchema{typ: "record", name: t.Name()}
+		seen[t] = s
+		for i := 0; i < t.NumField(); i++ {
+			f := t.Field(i)
+			name := avroFieldName(f)
+			if name == "" {
+				continue
+			}
+			fs, err := deriveAvroSchema(f.Type, seen)
+			if err != nil {
+				return nil, err
+			}
+			s.fields = append(s.fields, avroField{name: name, schema: fs})
+		}
+		return s, nil
+	}
+	return nil, fmt.Errorf("rpc codec: unsupported avro type %s", t)
+}
+
+// avroFieldName 返回结构体字段在 record 中的名称, 未导出或者被忽略的字段返回空字符串
+func avroFieldName(f reflect.StructField) string {
+	if !f.IsExported() {
+		return ""
+	}
+	tag := f.Tag.Get("avro")
+	if tag == "-" {
+		return ""
+	}
+	if tag != "" {
+		return tag
+	}
+	return f.Name
+}
+
+// avroStructField 在结构体中找到 record 字段对应的值, 先按标签和名称精确匹配, 再忽略大小写匹配
+func avroStructField(v reflect.Value, name string) (reflect.Value, bool) {
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		if avroFieldName(t.Field(i)) == name {
+			return v.Field(i), true
+		}
+	}
+	for i := 0; i < t.NumField(); i++ {
+		if n := avroFieldName(t.Field(i)); n != "" && strings.EqualFold(n, name) {
+			return v.Field(i), true
+		}
+	}
+	return reflect.Value{}, false
+}
+
+// appendAvro 按照 schema 把 v 编码追加到 buf 之后
+func appendAvro(buf []byte, s *avroSchema, v reflect.Value) ([]byte, error) {
+	if s.typ == "union" {
+		return appendAvroUnion(buf, s, v)
+	}
+	for v.Kind() == reflect.Ptr || v.Kind() == reflect.Interface {
+		if v.IsNil() {
+			if s.typ == "null" {
+				return buf, nil
+			}
+			return nil, fmt.Errorf("rpc codec: nil value for avro type %s", s.typ)
+		}
+		v = v.Elem()
+	}
+	switch s.typ {
+	case "null":
+		return buf, nil
+	case "boolean":
+		if v.Kind() != reflect.Bool {
+			break
+		}
+		if v.Bool() {
+			return append(buf, 1), nil
+		}
+		return append(buf, 0), nil
+	case "int", "long":
+		switch v.Kind() {
+		case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+			return appendAvroLong(buf, v.Int()), nil
+		case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+			return appendAvroLong(buf, int64(v.Uint())), nil
+		}
+	case "float":
+		if v.Kind() == reflect.Float32 || v.Kind() == reflect.Float64 {
+			return binary.LittleEndian.AppendUint32(buf, math.Float32bits(float32(v.Float()))), nil
+		}
+	case "double":
+		if v.Kind() == reflect.Float32 || v.Kind() == reflect.Float64 {
+			return binary.LittleEndian.AppendUint64(buf, math.Float64bits(v.Float())), nil
+		}
+	case "string":
+		if v.Kind() == reflect.String {
+			buf = appendAvroLong(buf, int64(v.Len()))
+			return append(buf, v.String()...), nil
+		}
+	case "bytes":
+		if v.Kind() == reflect.Slice && v.Type().Elem().Kind() == reflect.Uint8 {
+			buf = appendAvroLong(buf, int64(v.Len()))
+			return append(buf, v.Bytes()...), nil
+		}
+	case "fixed":
+		if (v.Kind() == reflect.Array || v.Kind() == reflect.Slice) && v.Type().Elem().Kind() == reflect.Uint8 && v.Len() == s.size {
+			for i := 0; i < s.size; i++ {
+				buf = append(buf, byte(v.Index(i).Uint()))
+			}
+			return buf, nil
+		}
+	case "enum":
+		switch v.Kind() {
+		case reflect.String:
+			for i, sym := range s.symbols {
+				if sym == v.String() {
+					return appendAvroLong(buf, int64(i)), nil
+				}
+			}
+			return nil, fmt.Errorf("rpc codec: %q is not a symbol of avro enum %s", v.String(), s.name)
+		case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+			if v.Int() >= 0 && v.Int() < int64(len(s.symbols)) {
+				return appendAvroLong(buf, v.Int()), nil
+			}
+		}
+	case "array":
+		if v.Kind() == reflect.Slice || v.Kind() == reflect.Array {
+			if v.Len() > 0 {
+				buf = appendAvroLong(buf, int64(v.Len()))
+				for i := 0; i < v.Len(); i++ {
+					var err error
+					if buf, err = appendAvro(buf, s.items, v.Index(i)); err != nil {
+						return nil, err
+					}
+				}
+			}
+			return append(buf, 0), nil // 长度为 0 的块表示数组结束
+		}
+	case "map":
+		if v.Kind() == reflect.Map && v.Type().Key().Kind() == reflect.String {
+			if v.Len() > 0 {
+				buf = appendAvroLong(buf, int64(v.Len()))
+				iter := v.MapRange()
+				for iter.Next() {
+					buf = appendAvroLong(buf, int64(iter.Key().Len()))
+					buf = append(buf, iter.Key().String()...)
+					var err error
+					if buf, err = appendAvro(buf, s.values, iter.Value()); err != nil {
+						return nil, err
+					}
+				}
+			}
+			return append(buf, 0), nil
+		}
+	case "record":
+		if v.Kind() == reflect.Struct {
+			for _, f := range s.fields {
+				fv, ok := avroStructField(v, f.name)
+				if !ok {
+					return nil, fmt.Errorf("rpc codec: %s has no field for avro field %s.%s", v.Type(), s.name, f.name)
+				}
+				var err error
+				if buf, err = appendAvro(buf, f.schema, fv); err != nil {
+					return nil, err
+				}
+			}
+			return buf, nil
+		}
+	}
+	return nil, fmt.Errorf("rpc codec: cannot encode %s as avro %s", v.Type(), s.typ)
+}
+
+// appendAvroUnion 选择第一个能够编码 v 的分支, nil 对应 null 分支
+func appendAvroUnion(buf []byte, s *avroSchema, v reflect.Value) ([]byte, error) {
+	isNil := !v.IsValid() || ((v.Kind() == reflect.Ptr || v.Kind() == reflect.Interface) && v.IsNil())
+	for i, b := range s.branches {
+		if (b.typ == "null") != isNil {
+			continue
+		}
+		if out, err := appendAvro(appendAvroLong(buf, int64(i)), b, v); err == nil {
+			return out, nil
+		}
+	}
+	return nil, fmt.Errorf("rpc codec: no avro union branch matches %s", v.Type())
+}
+
+// appendAvroLong 使用 zigzag 和变长编码写入一个整数
+func appendAvroLong(buf []byte, n int64) []byte {
+	return binary.AppendUvarint(buf, uint64(n<<1)^uint64(n>>63))
+}
+
+var errAvroShort = errors.New("rpc codec: avro data too short")
+
+// avroReader 按照 schema 从 data 中解码
+type avroReader struct {
+	data []byte
+}
+
+func (r *avroReader) long() (int64, error) {
+	u, n := binary.Uvarint(r.data)
+	if n <= 0 {
+		return 0, errAvroShort
+	}
+	r.data = r.data[n:]
+	return int64(u>>1) ^ -int64(u&1), nil
+}
+
+func (r *avroReader) next(n int) ([]byte, error) {
+	if n < 0 || n > len(r.data) {
+		return nil, errAvroShort
+	}
+	b := r.data[:n]
+	r.data = r.data[n:]
+	return b, nil
+}
+
+// blockCount 读取 array 和 map 的块长度, 负数表示之后还有块的字节数, 这里不需要
+func (r *avroReader) blockCount() (int, error) {
+	n, err := r.long()
+	if err != nil {
+		return 0, err
+	}
+	if n < 0 {
+		n = -n
+		if _, err := r.long(); err != nil {
+			return 0, err
+		}
+	}
+	if n > int64(len(r.data)) { // 每个元素至少占一个字节 (null 除外), 防止构造超大的长度
+		return 0, errAvroShort
+	}
+	return int(n), nil
+}
+
+// decode 按照 schema 解码到 v, v 必须可以被设置
+func (r *avroReader) decode(s *avroSchema, v reflect.Value) error {
+	if v.Kind() == reflect.Interface && v.NumMethod() == 0 {
+		x, err := r.decodeAny(s)
+		if err == nil && x != nil {
+			v.Set(reflect.ValueOf(x))
+		}
+		return err
+	}
+	if s.typ == "union" {
+		i, err := r.long()
+		if err != nil {
+			return err
+		}
+		if i < 0 || i >= int64(len(s.branches)) {
+			return fmt.Errorf("rpc codec: avro union index %d out of range", i)
+		}
+		b := s.branches[i]
+		if b.typ == "null" {
+			v.Set(reflect.Zero(v.Type()))
+			return nil
+		}
+		return r.decode(b, v)
+	}
+	if v.Kind() == reflect.Ptr {
+		if s.typ == "null" {
+			v.Set(reflect.Zero(v.Type()))
+			return nil
+		}
+		if v.IsNil() {
+			v.Set(reflect.New(v.Type().Elem()))
+		}
+		return r.decode(s, v.Elem())
+	}
+	switch s.typ {
+	case "null":
+		return nil
+	case "boolean":
+		b, err := r.next(1)
+		if err != nil {
+			return err
+		}
+		if v.Kind() == reflect.Bool {
+			v.SetBool(b[0] != 0)
+			return nil
+		}
+	case "int", "long", "enum":
+		n, err := r.long()
+		if err != nil {
+			return err
+		}
+		switch v.Kind() {
+		case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+			v.SetInt(n)
+			return nil
+		case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+			v.SetUint(uint64(n))
+			return nil
+		case reflect.String:
+			if s.typ == "enum" && n >= 0 && n < int64(len(s.symbols)) {
+				v.SetString(s.symbols[n])
+				return nil
+			}
+		}
+	case "float":
+		b, err := r.next(4)
+		if err != nil {
+			return err
+		}
+		if v.Kind() == reflect.Float32 || v.Kind() == reflect.Float64 {
+			v.SetFloat(float64(math.Float32frombits(binary.LittleEndian.Uint32(b))))
+			return nil
+		}
+	case "double":
+		b, err := r.next(8)
+		if err != nil {
+			return err
+		}
+		if v.Kind() == reflect.Float32 || v.Kind() == reflect.Float64 {
+			v.SetFloat(math.Float64frombits(binary.LittleEndian.Uint64(b)))
+			return nil
+		}
+	case "string", "bytes":
+		n, err := r.long()
+		if err != nil {
+			return err
+		}
+		b, err := r.next(int(n))
+		if err != nil {
+			return err
+		}
+		if v.Kind() == reflect.String {
+			v.SetString(string(b))
+			return nil
+		}
+		if v.Kind() == reflect.Slice && v.Type().Elem().Kind() == reflect.Uint8 {
+			v.SetBytes(append([]byte(nil), b...))
+			return nil
+		}
+	case "fixed":
+		b, err := r.next(s.size)
+		if err != nil {
+			return err
+		}
+		if v.Kind() == reflect.Array && v.Type().Elem().Kind() == reflect.Uint8 && v.Len() == s.size {
+			reflect.Copy(v, reflect.ValueOf(b))
+			return nil
+		}
+		if v.Kind() == reflect.Slice && v.Type().Elem().Kind() == reflect.Uint8 {
+			v.SetBytes(append([]byte(nil), b...))
+			return nil
+		}
+	case "array":
+		if v.Kind() != reflect.Slice && v.Kind() != reflect.Array {
+			break
+		}
+		for i := 0; ; {
+			n, err := r.blockCount()
+			if err != nil {
+				return err
+			}
+			if n == 0 {
+				return nil
+			}
+			for ; n > 0; n-- {
+				if v.Kind() == reflect.Slice {
+					v.Set(reflect.Append(v, reflect.Zero(v.Type().Elem())))
+				} else if i >= v.Len() {
+					return fmt.Errorf("rpc codec: too many avro items for %s", v.Type())
+				}
+				if err := r.decode(s.items, v.Index(i)); err != nil {
+					return err
+				}
+				i++
+			}
+		}
+	case "map":
+		if v.Kind() != reflect.Map || v.Type().Key().Kind() != reflect.String {
+			break
+		}
+		for {
+			n, err := r.blockCount()
+			if err != nil {
+				return err
+			}
+			if n == 0 {
+				return nil
+			}
+			if v.IsNil() {
+				v.Set(reflect.MakeMap(v.Type()))
+			}
+			for ; n > 0; n-- {
+				kn, err := r.long()
+				if err != nil {
+					return err
+				}
+				k, err := r.next(int(kn))
+				if err != nil {
+					return err
+				}
+				elem := reflect.New(v.Type().Elem()).Elem()
+				if err := r.decode(s.values, elem); err != nil {
+					return err
+				}
+				v.SetMapIndex(reflect.ValueOf(string(k)).Convert(v.Type().Key()), elem)
+			}
+		}
+	case "record":
+		if v.Kind() != reflect.Struct {
+			break
+		}
+		for _, f := range s.fields {
+			fv, ok := avroStructField(v, f.name)
+			if !ok {
+				// Go 结构体中没有这个字段, 解码之后丢弃
+				var discard interface{}
+				if err := r.decode(f.schema, reflect.ValueOf(&discard).Elem()); err != nil {
+					return err
+				}
+				continue
+			}
+			if err := r.decode(f.schema, fv); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	return fmt.Errorf("rpc codec: cannot decode avro %s into %s", s.typ, v.Type())
+}
+
+// decodeAny 解码到 interface{}, record 和 map 对应 map[string]interface{}, array 对应 []interface{}
+func (r *avroReader) decodeAny(s *avroSchema) (interface{}, error) {
+	var v reflect.Value
+	switch s.typ {
+	case "null":
+		return nil, nil
+	case "boolean":
+		v = reflect.New(reflect.TypeOf(false)).Elem()
+	case "int", "long":
+		v = reflect.New(reflect.TypeOf(int64(0))).Elem()
+	case "float":
+		v = reflect.New(reflect.TypeOf(float32(0))).Elem()
+	case "double":
+		v = reflect.New(reflect.TypeOf(float64(0))).Elem()
+	case "string", "enum":
+		v = reflect.New(reflect.TypeOf("")).Elem()
+	case "bytes", "fixed":
+		v = reflect.New(reflect.TypeOf([]byte(nil))).Elem()
+	case "array":
+		v = reflect.New(reflect.TypeOf([]interface{}(nil))).Elem()
+	case "map":
+		v = reflect.New(reflect.TypeOf(map[string]interface{}(nil))).Elem()
+	case "union":
+		i, err := r.long()
+		if err != nil {
+			return nil, err
+		}
+		if i < 0 || i >= int64(len(s.branches)) {
+			return nil, fmt.Errorf("rpc codec: avro union index %d out of range", i)
+		}
+		return r.decodeAny(s.branches[i])
+	case "record":
+		m := make(map[string]interface{}, len(s.fields))
+		for _, f := range s.fields {
+			x, err := r.decodeAny(f.schema)
+			if err != nil {
+				return nil, err
+			}
+			m[f.name] = x
+		}
+		return m, nil
+	default:
+		return nil, fmt.Errorf("rpc codec: unknown avro type %s", s.typ)
+	}
+	if err := r.decode(s, v); err != nil {
+		return nil, err
+	}
+	return v.Interface(), nil
+}
@@ -1,6 +1,10 @@
 package codec
 
-import "io"
+import (
+	"encoding/json"
+	"io"
+	"time"
+)
 
 // 一个RPC调用: err = client.Call("Arith.Multiply", args, &reply)
 // 客户端发送的请求参数: 服务名 `Arith` 方法名 `Multiply` 参数 `args`
@@ -8,10 +12,32 @@ import "io"
 // 将请求的参数和返回值抽象为body, 剩余信息放在 `Header` 中
 
 // Header 抽象出来的 `Header`
+// 字段的 thrift 标签是 ThriftCodec 使用的字段编号, 已经发布的编号不能修改, 新的字段使用新的编号
 type Header struct {
-	ServiceMethod string // 服务名和方法, 与结构体的方法映射
-	Seq           uint64 // 请求的序号, 可认为是某个请求的ID, 用来区分不同的请求
-	Error         string // 错误信息
+	ServiceMethod string `thrift:"service_method,1"` // 服务名和方法, 与结构体的方法映射
+	Seq           uint64 `thrift:"seq,2"`            // 请求的序号, 可认为是某个请求的ID, 用来区分不同的请求
+	Error         string `thrift:"error,3"`          // 错误信息
+	Compressed    bool   `thrift:"compressed,4"`     // `Body` 是否经过压缩, 由编解码器根据压缩阈值设置
+	// Metadata 随消息一起传输的键值对, 比如鉴权令牌, 链路追踪 ID, 租户 ID, 截止时间等
+	// 不需要修改方法签名就可以在请求和响应中携带额外的信息
+	Metadata map[string]string `json:",omitempty" thrift:"metadata,5"`
+	// ContentType `Body` 的编码方式, 为空时与链接的编解码方式一致
+	// 同一条链接上的请求可以使用不同的编码方式, 服务端的响应沿用请求的编码方式
+	ContentType Type `json:",omitempty" thrift:"content_type,6"`
+	// Timeout 客户端剩余的等待时间, 来自调用方 context 的截止时间, 0 表示不限制
+	// 服务端据此设置方法的 context 和处理超时, 不再处理客户端已经放弃的请求
+	Timeout time.Duration `json:",omitempty" thrift:"timeout,7"`
+	// ErrorCode 错误的类别, 见 minirpc.Code, 客户端据此区分找不到方法, 超时和业务错误等, 0 表示没有错误码
+	ErrorCode uint32 `json:",omitempty" thrift:"error_code,8"`
+	// ErrorDetails 错误详情的类型名称, 不为空时 `Body` 是编码之后的详情, 见 minirpc.RegisterErrorDetails
+	ErrorDetails string `json:",omitempty" thrift:"error_details,9"`
+	// Expires 请求过期的绝对时间, Unix 纳秒时间戳, 0 表示不过期
+	// 服务端从队列中取出请求时已经过期则不再调用方法, 直接回复超时. 依赖双方的时钟基本一致
+	Expires int64 `json:",omitempty" thrift:"expires,10"`
+	// NoCompress 为 true 时不压缩这个请求的 `Body`, 服务端的响应沿用请求的设置
+	NoCompress bool `json:",omitempty" thrift:"no_compress,11"`
+	// OneWay 为 true 时客户端不等待响应, 服务端处理之后不回复, 包括错误
+	OneWay bool `json:",omitempty" thrift:"one_way,12"`
 }
 
 // Codec 实现编解码的接口
@@ -27,14 +53,65 @@ type NewCodecFunc func(io.ReadWriteCloser) Codec
 type Type string
 
 const (
-	GobType  Type = "applocation/gob"
-	JsonType Type = "applocation/json"
+	GobType    Type = "applocation/gob"
+	JsonType   Type = "applocation/json"
+	AvroType   Type = "applocation/avro"
+	ThriftType Type = "applocation/thrift"
+	NDJSONType Type = "applocation/ndjson"
 )
 
 // NewCodecFuncMap 根据编解码类型(Type)映射不同的函数
 var NewCodecFuncMap map[Type]NewCodecFunc
 
+// codecIDs 握手时使用一个字节的编号代替编解码类型的名称, 通信双方的编号必须一致
+var codecIDs map[Type]uint8
+
 func init() {
 	NewCodecFuncMap = make(map[Type]NewCodecFunc) // 初始化映射Map
-	NewCodecFuncMap[GobType] = NewGobCodec        // 注册编解码Gob的函数
+	codecIDs = make(map[Type]uint8)
+	RegisterCodec(GobType, 1, NewGobCodec)       // 注册编解码Gob的函数
+	RegisterCodec(JsonType, 2, NewJsonCodec)     // 注册编解码Json的函数
+	RegisterCodec(AvroType, 3, NewAvroCodec)     // 注册编解码Avro的函数
+	RegisterCodec(ThriftType, 4, NewThriftCodec) // 注册编解码Thrift的函数
+	RegisterCodec(NDJSONType, 5, NewNDJSONCodec) // 注册按行传输的Json的函数
+	RegisterContentType(GobType, gobMarshal, gobUnmarshal)
+	RegisterContentType(JsonType, jsonMarshal, json.Unmarshal)
+	RegisterContentType(AvroType, avroMarshaler(""), avroUnmarshaler(""))
+	RegisterContentType(ThriftType, thriftMarshal, thriftUnmarshal)
+}
+
+// RegisterCodec 注册一种编解码方式以及它在握手时使用的编号, 需要在建立链接之前调用
+func RegisterCodec(typ Type, id uint8, f NewCodecFunc) {
+	NewCodecFuncMap[typ] = f
+	codecIDs[typ] = id
+}
+
+// TypeID 返回编解码类型在握手时使用的编号
+func TypeID(typ Type) (uint8, bool) {
+	id, ok := codecIDs[typ]
+	return id, ok
+}
+
+// TypeByID 根据握手时的编号找到编解码类型
+func TypeByID(id uint8) (Type, bool) {
+	for typ, i := range codecIDs {
+		if i == id {
+			return typ, true
+		}
+	}
+	return "", false
+}
+
+// contentType `Body` 的编解码函数
+type contentType struct {
+	marshal   MarshalFunc
+	unmarshal UnmarshalFunc
+}
+
+// contentTypes 可以通过 Header.ContentType 按请求选择的 `Body` 编码方式
+var contentTypes = make(map[Type]contentType)
+
+// RegisterContentType 注册一种可以按请求选择的 `Body` 编码方式, 需要在建立链接之前调用
+func RegisterContentType(typ Type, marshal MarshalFunc, unmarshal UnmarshalFunc) {
+	contentTypes[typ] = contentType{marshal: marshal, unmarshal: unmarshal}
 }
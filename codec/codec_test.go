@@ -0,0 +1,441 @@
+package codec
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"reflect"
+	"runtime"
+	"strings"
+	"testing"
+)
+
+// bufferConn 使用内存缓冲模拟链接
+type bufferConn struct {
+	bytes.Buffer
+}
+
+func (c *bufferConn) Close() error { return nil }
+
+var _ io.ReadWriteCloser = (*bufferConn)(nil)
+
+func TestFrameConn_Checksum(t *testing.T) {
+	conn := new(bufferConn)
+	cc := NewGobCodec(conn)
+	cc.(FrameConfigurer).SetFrameOption(FrameOption{Checksum: true})
+	if err := cc.Write(&Header{ServiceMethod: "Foo.Sum", Seq: 1}, 42); err != nil {
+		t.Fatal(err)
+	}
+	if err := cc.Write(&Header{ServiceMethod: "Foo.Sum", Seq: 2}, 43); err != nil {
+		t.Fatal(err)
+	}
+	// 破坏第一个 `Body` 帧的最后一个字节 (校验和的一部分)
+	data := conn.Bytes()
+	headerLen := frameHeaderSize + int(data[4])
+	data[headerLen+frameHeaderSize+int(data[headerLen+4])-1] ^= 0xff
+
+	var h Header
+	var body int
+	if err := cc.ReadHeader(&h); err != nil || h.Seq != 1 {
+		t.Fatalf("read header: %v", err)
+	}
+	err := cc.ReadBody(&body)
+	var decodeErr *DecodeError
+	if !errors.Is(err, ErrChecksum) || !errors.As(err, &decodeErr) {
+		t.Fatalf("expect checksum error, got %v", err)
+	}
+	// 被破坏的帧已经被跳过, 后续的帧不受影响
+	if err := cc.ReadHeader(&h); err != nil || h.Seq != 2 {
+		t.Fatalf("read header: %v", err)
+	}
+	if err := cc.ReadBody(&body); err != nil || body != 43 {
+		t.Fatalf("read body: %v", err)
+	}
+}
+
+func TestFrameConn_CompressThreshold(t *testing.T) {
+	conn := new(bufferConn)
+	cc := NewJsonCodec(conn)
+	cc.(FrameConfigurer).SetFrameOption(FrameOption{
+		Compressor:        gzipCompressor{},
+		CompressThreshold: 64,
+	})
+	small, large := "small", strings.Repeat("large", 100)
+	for _, body := range []string{small, large} {
+		h := &Header{ServiceMethod: "Foo.Echo"}
+		if err := cc.Write(h, body); err != nil {
+			t.Fatal(err)
+		}
+		if h.Compressed != (body == large) {
+			t.Fatalf("expect compressed to be %v for %d bytes body", body == large, len(body))
+		}
+	}
+	for _, want := range []string{small, large} {
+		var h Header
+		var body string
+		if err := cc.ReadHeader(&h); err != nil {
+			t.Fatal(err)
+		}
+		if err := cc.ReadBody(&body); err != nil || body != want {
+			t.Fatalf("read body: %v", err)
+		}
+	}
+}
+
+func TestFrameConn_DecompressLimit(t *testing.T) {
+	conn := new(bufferConn)
+	cc := NewJsonCodec(conn)
+	cc.(FrameConfigurer).SetFrameOption(FrameOption{Compressor: gzipCompressor{}})
+	// 64MB 的重复数据压缩之后只有几十 KB
+	if err := cc.Write(&Header{ServiceMethod: "Foo.Echo"}, strings.Repeat("a", 64<<20)); err != nil {
+		t.Fatal(err)
+	}
+	if conn.Len() > 1<<20 {
+		t.Fatalf("expect a small compressed frame, got %d bytes", conn.Len())
+	}
+	cc.(FrameConfigurer).SetFrameOption(FrameOption{Compressor: gzipCompressor{}, MaxRecvSize: 1 << 20})
+	var h Header
+	if err := cc.ReadHeader(&h); err != nil {
+		t.Fatal(err)
+	}
+	var before, after runtime.MemStats
+	runtime.ReadMemStats(&before)
+	var body string
+	err := cc.ReadBody(&body)
+	runtime.ReadMemStats(&after)
+	var decodeErr *DecodeError
+	var tooLarge *MessageTooLargeError
+	if !errors.As(err, &decodeErr) || !errors.As(err, &tooLarge) || tooLarge.Limit != 1<<20 {
+		t.Fatalf("expect message too large, got %v", err)
+	}
+	if alloc := after.TotalAlloc - before.TotalAlloc; alloc > 16<<20 {
+		t.Fatalf("expect decompression to stop at the limit, allocated %d bytes", alloc)
+	}
+}
+
+func TestCodec_AutoFlush(t *testing.T) {
+	for typ, f := range NewCodecFuncMap {
+		conn := new(bufferConn)
+		cc := f(conn)
+		fl, ok := cc.(Flusher)
+		if !ok {
+			t.Fatalf("%s codec should support Flusher", typ)
+		}
+		fl.SetAutoFlush(false)
+		for seq := uint64(1); seq <= 2; seq++ {
+			if err := cc.Write(&Header{ServiceMethod: "Foo.Sum", Seq: seq}, 42); err != nil {
+				t.Fatalf("%s: %v", typ, err)
+			}
+		}
+		if conn.Len() != 0 {
+			t.Fatalf("%s: expect nothing sent before Flush, got %d bytes", typ, conn.Len())
+		}
+		if err := fl.Flush(); err != nil {
+			t.Fatalf("%s: %v", typ, err)
+		}
+		var h Header
+		for seq := uint64(1); seq <= 2; seq++ {
+			if err := cc.ReadHeader(&h); err != nil || h.Seq != seq {
+				t.Fatalf("%s: read header %d: %v", typ, seq, err)
+			}
+			if err := cc.ReadBody(nil); err != nil {
+				t.Fatalf("%s: read body %d: %v", typ, seq, err)
+			}
+		}
+	}
+}
+
+func TestHeader_Metadata(t *testing.T) {
+	for typ, f := range NewCodecFuncMap {
+		conn := new(bufferConn)
+		cc := f(conn)
+		md := map[string]string{"token": "secret", "trace-id": "42"}
+		if err := cc.Write(&Header{ServiceMethod: "Foo.Sum", Seq: 1, Metadata: md}, 1); err != nil {
+			t.Fatal(err)
+		}
+		var h Header
+		var body int
+		if err := cc.ReadHeader(&h); err != nil {
+			t.Fatal(err)
+		}
+		if len(h.Metadata) != 2 || h.Metadata["token"] != "secret" || h.Metadata["trace-id"] != "42" {
+			t.Fatalf("%s: metadata mismatch: %v", typ, h.Metadata)
+		}
+		if err := cc.ReadBody(&body); err != nil || body != 1 {
+			t.Fatalf("%s: read body: %v", typ, err)
+		}
+	}
+}
+
+func TestPool_GetBytes(t *testing.T) {
+	b := GetBytes(16)
+	if len(b) != 16 {
+		t.Fatalf("expect len 16, got %d", len(b))
+	}
+	PutBytes(b)
+	if b = GetBytes(8); len(b) != 8 {
+		t.Fatalf("expect len 8, got %d", len(b))
+	}
+	buf := GetBuffer()
+	buf.WriteString("dirty")
+	PutBuffer(buf)
+	if buf = GetBuffer(); buf.Len() != 0 {
+		t.Fatal("expect an empty buffer from pool")
+	}
+}
+
+func BenchmarkGobCodec_Write(b *testing.B) {
+	cc := NewGobCodec(new(discardConn))
+	h := &Header{ServiceMethod: "Foo.Sum"}
+	body := struct{ Num1, Num2 int }{1, 2}
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		h.Seq = uint64(i)
+		if err := cc.Write(h, body); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// discardConn 丢弃所有写入的数据
+type discardConn struct{}
+
+func (discardConn) Read(p []byte) (int, error)  { return 0, io.EOF }
+func (discardConn) Write(p []byte) (int, error) { return len(p), nil }
+func (discardConn) Close() error                { return nil }
+
+func TestGobTypeNames(t *testing.T) {
+	type Inner struct{ X int }
+	type Outer struct {
+		In   Inner
+		List []Inner
+	}
+	var buf bytes.Buffer
+	if err := gobMarshal(&buf, Outer{}); err != nil {
+		t.Fatal(err)
+	}
+	names, err := GobTypeNames(buf.Bytes())
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]bool{"Outer": true, "Inner": true, "[]codec.Inner": true}
+	for _, name := range names {
+		if !want[name] {
+			t.Fatalf("unexpected type name %q", name)
+		}
+	}
+	if len(names) != len(want) {
+		t.Fatalf("expect %d type names, got %v", len(want), names)
+	}
+	// 内置类型没有类型定义
+	buf.Reset()
+	_ = gobMarshal(&buf, 42)
+	if names, _ := GobTypeNames(buf.Bytes()); len(names) != 0 {
+		t.Fatalf("expect no type names for int, got %v", names)
+	}
+}
+
+type avroArgs struct {
+	Num1, Num2 int
+	Tags       []string          `avro:"tags"`
+	Extra      map[string]string `avro:"extra"`
+	Next       *avroArgs         `avro:"next"`
+}
+
+func TestAvroCodec(t *testing.T) {
+	schema := `{"type": "record", "name": "Args", "fields": [
+		{"name": "num1", "type": "long"},
+		{"name": "num2", "type": "int"}
+	]}`
+	if err := RegisterAvroSchema("Foo.Sum", avroArgs{}, schema); err != nil {
+		t.Fatal(err)
+	}
+	conn := new(bufferConn)
+	cc := NewAvroCodec(conn)
+	if err := cc.Write(&Header{ServiceMethod: "Foo.Sum", Seq: 1}, &avroArgs{Num1: 1, Num2: -2}); err != nil {
+		t.Fatal(err)
+	}
+	// 注册的 schema 只包含两个字段, 编码结果与其他语言的 Avro 实现一致: zigzag(1) = 0x02, zigzag(-2) = 0x03
+	data := conn.Bytes()
+	body := data[frameHeaderSize+int(data[4]):]
+	if !bytes.Equal(body, []byte{byte(BodyFrame), 0, 0, 0, 2, 0x02, 0x03}) {
+		t.Fatalf("unexpected avro body frame %x", body)
+	}
+	var h Header
+	var args avroArgs
+	if err := cc.ReadHeader(&h); err != nil || h.ServiceMethod != "Foo.Sum" || h.Seq != 1 {
+		t.Fatalf("read header: %v", err)
+	}
+	if err := cc.ReadBody(&args); err != nil || args.Num1 != 1 || args.Num2 != -2 {
+		t.Fatalf("read body: %v", err)
+	}
+
+	// 没有注册 schema 的方法根据 Go 类型生成 schema
+	want := avroArgs{Num1: 3, Tags: []string{"a", "b"}, Extra: map[string]string{"k": "v"}, Next: &avroArgs{Num2: 4}}
+	if err := cc.Write(&Header{ServiceMethod: "Foo.Echo", Seq: 2, Metadata: map[string]string{"token": "x"}}, &want); err != nil {
+		t.Fatal(err)
+	}
+	h, args = Header{}, avroArgs{}
+	if err := cc.ReadHeader(&h); err != nil || h.Metadata["token"] != "x" {
+		t.Fatalf("read header: %v", err)
+	}
+	if err := cc.ReadBody(&args); err != nil {
+		t.Fatalf("read body: %v", err)
+	}
+	if args.Num1 != 3 || len(args.Tags) != 2 || args.Extra["k"] != "v" || args.Next == nil || args.Next.Num2 != 4 || args.Next.Next != nil {
+		t.Fatalf("avro round trip mismatch: %+v", args)
+	}
+}
+
+func TestRegisterAvroSchema_Concurrent(t *testing.T) {
+	schema := `{"type": "record", "name": "Args", "fields": [{"name": "num1", "type": "long"}]}`
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 100; i++ {
+			_ = RegisterAvroSchema(fmt.Sprintf("Foo.Concurrent%d", i), avroArgs{}, schema)
+		}
+	}()
+	for i := 0; i < 100; i++ {
+		if _, err := avroSchemaFor(fmt.Sprintf("Foo.Concurrent%d", i), reflect.TypeOf(avroArgs{})); err != nil {
+			t.Fatal(err)
+		}
+	}
+	<-done
+}
+
+type thriftArgs struct {
+	Num1  int32            `thrift:"num1,1"`
+	Num2  int32            `thrift:"num2,3"`
+	Flag  bool             `thrift:"flag,4"`
+	Tags  []string         `thrift:"tags,5"`
+	Extra map[string]int64 `thrift:"extra,20"`
+	Next  *thriftArgs      `thrift:"next,21"`
+}
+
+func TestThriftCodec(t *testing.T) {
+	conn := new(bufferConn)
+	cc := NewThriftCodec(conn)
+	if err := cc.Write(&Header{ServiceMethod: "Foo.Sum", Seq: 1}, &thriftArgs{Num1: 1, Num2: -2, Flag: true, Tags: []string{"a"}}); err != nil {
+		t.Fatal(err)
+	}
+	// 与 thrift 生成代码使用 TCompactProtocol 编码的结果一致
+	data := conn.Bytes()
+	body := data[frameHeaderSize+int(data[4])+frameHeaderSize:]
+	want := []byte{0x15, 0x02, 0x25, 0x03, 0x11, 0x19, 0x18, 0x01, 'a', 0xfb, 0x00, 0x00}
+	if !bytes.Equal(body, want) {
+		t.Fatalf("unexpected thrift body %x, expect %x", body, want)
+	}
+	var h Header
+	var args thriftArgs
+	if err := cc.ReadHeader(&h); err != nil || h.ServiceMethod != "Foo.Sum" || h.Seq != 1 {
+		t.Fatalf("read header: %v", err)
+	}
+	if err := cc.ReadBody(&args); err != nil || args.Num1 != 1 || args.Num2 != -2 || !args.Flag || len(args.Tags) != 1 {
+		t.Fatalf("read body: %v %+v", err, args)
+	}
+
+	// 非结构体的 `Body` 包装成 0 号字段
+	if err := cc.Write(&Header{ServiceMethod: "Foo.Sum", Seq: 2}, 3); err != nil {
+		t.Fatal(err)
+	}
+	nested := &thriftArgs{Extra: map[string]int64{"k": 1}, Next: &thriftArgs{Num1: 5}}
+	if err := cc.Write(&Header{ServiceMethod: "Foo.Echo", Seq: 3}, nested); err != nil {
+		t.Fatal(err)
+	}
+	var reply int
+	if err := cc.ReadHeader(&h); err != nil {
+		t.Fatal(err)
+	}
+	if err := cc.ReadBody(&reply); err != nil || reply != 3 {
+		t.Fatalf("read wrapped body: %v", err)
+	}
+	args = thriftArgs{}
+	if err := cc.ReadHeader(&h); err != nil {
+		t.Fatal(err)
+	}
+	if err := cc.ReadBody(&args); err != nil || args.Extra["k"] != 1 || args.Next == nil || args.Next.Num1 != 5 {
+		t.Fatalf("read nested body: %v %+v", err, args)
+	}
+}
+
+func TestThriftFieldIDErrors(t *testing.T) {
+	type duplicated struct {
+		A int32 `thrift:"a,2"`
+		B int32 // 默认编号 2
+	}
+	type malformed struct {
+		A int32 `thrift:"a,abc"`
+	}
+	cc := NewThriftCodec(new(bufferConn))
+	for _, v := range []interface{}{&duplicated{}, &malformed{}} {
+		err := cc.Write(&Header{ServiceMethod: "Foo.Sum", Seq: 1}, v)
+		var encodeErr *EncodeError
+		if !errors.As(err, &encodeErr) || !strings.Contains(err.Error(), "thrift field id") {
+			t.Fatalf("expect a thrift field id error for %T, got %v", v, err)
+		}
+	}
+}
+
+func TestThriftHeaderFieldIDs(t *testing.T) {
+	typ := reflect.TypeOf(Header{})
+	fields, err := thriftFields(typ)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ids := make(map[int16]string)
+	for _, f := range fields {
+		name := typ.Field(f.index).Name
+		if typ.Field(f.index).Tag.Get("thrift") == "" {
+			t.Fatalf("Header.%s has no explicit thrift field id", name)
+		}
+		if other, ok := ids[f.id]; ok {
+			t.Fatalf("Header.%s and Header.%s share thrift field id %d", name, other, f.id)
+		}
+		ids[f.id] = name
+	}
+	// 已经发布的编号
+	for id, name := range map[int16]string{1: "ServiceMethod", 2: "Seq", 6: "ContentType", 12: "OneWay"} {
+		if ids[id] != name {
+			t.Fatalf("expect thrift field %d to be Header.%s, got %q", id, name, ids[id])
+		}
+	}
+}
+
+func TestRegisterCompressor_Concurrent(t *testing.T) {
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 100; i++ {
+			RegisterCompressor("test-gzip", 31, gzipCompressor{})
+		}
+	}()
+	for i := 0; i < 100; i++ {
+		_, _ = GetCompressor(GzipCompress)
+		_ = CompressTypes()
+		_, _ = CompressTypeByID(1)
+	}
+	<-done
+	if id, ok := CompressID("test-gzip"); !ok || id != 31 {
+		t.Fatalf("expect id 31, got %d %v", id, ok)
+	}
+	if typ, ok := CompressTypeByID(31); !ok || typ != "test-gzip" {
+		t.Fatalf("expect test-gzip, got %q %v", typ, ok)
+	}
+}
+
+func TestReadFrame_UnlimitedClaim(t *testing.T) {
+	// 对端声明了 1GB 的 payload, 只发送了几个字节
+	data := []byte{byte(BodyFrame), 0x40, 0, 0, 0, 'a', 'b', 'c'}
+	var before, after runtime.MemStats
+	runtime.ReadMemStats(&before)
+	_, _, err := ReadFrame(bytes.NewReader(data))
+	runtime.ReadMemStats(&after)
+	if !errors.Is(err, io.ErrUnexpectedEOF) {
+		t.Fatalf("expect unexpected EOF, got %v", err)
+	}
+	if alloc := after.TotalAlloc - before.TotalAlloc; alloc > 1<<20 {
+		t.Fatalf("expect no allocation for the claimed size, allocated %d bytes", alloc)
+	}
+}
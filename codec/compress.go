@@ -0,0 +1,125 @@
+package codec
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+	"sync"
+)
+
+// CompressType 压缩方式, 在握手时由双方协商
+type CompressType string
+
+const (
+	NoneCompress CompressType = ""
+	GzipCompress CompressType = "gzip"
+)
+
+// Compressor 对 `Body` 帧的 payload 进行压缩和解压
+// Decompress 解压之后的数据超过 limit 字节时需要停止解压并返回 *MessageTooLargeError, limit 为 0 表示不限制
+type Compressor interface {
+	Compress(data []byte) ([]byte, error)
+	Decompress(data []byte, limit int) ([]byte, error)
+}
+
+// compressors 根据压缩方式映射不同的实现, compressIDs 是握手时使用的压缩方式编号, 0 表示不压缩, 编号需要小于 32
+// 链接在握手时并发读取, RegisterCompressor 可能在运行时注册, 都由 compressMu 保护
+var (
+	compressMu  sync.RWMutex
+	compressors = map[CompressType]Compressor{
+		GzipCompress: gzipCompressor{},
+	}
+	compressIDs = map[CompressType]uint8{
+		NoneCompress: 0,
+		GzipCompress: 1,
+	}
+)
+
+// RegisterCompressor 注册一种压缩方式以及它在握手时使用的编号, 之后建立的链接可以协商使用
+// 内置只有 gzip; snappy 和 zstd 需要第三方库, 由调用方包装之后注册, id 需要在 2 到 31 之间, 并且通信双方注册的编号一致
+func RegisterCompressor(typ CompressType, id uint8, c Compressor) {
+	compressMu.Lock()
+	defer compressMu.Unlock()
+	compressors[typ] = c
+	compressIDs[typ] = id
+}
+
+// GetCompressor 返回注册的压缩方式的实现
+func GetCompressor(typ CompressType) (Compressor, bool) {
+	compressMu.RLock()
+	defer compressMu.RUnlock()
+	c, ok := compressors[typ]
+	return c, ok
+}
+
+// CompressTypes 返回所有注册的压缩方式
+func CompressTypes() []CompressType {
+	compressMu.RLock()
+	defer compressMu.RUnlock()
+	types := make([]CompressType, 0, len(compressors))
+	for typ := range compressors {
+		types = append(types, typ)
+	}
+	return types
+}
+
+// CompressID 返回压缩方式在握手时使用的编号
+func CompressID(typ CompressType) (uint8, bool) {
+	compressMu.RLock()
+	defer compressMu.RUnlock()
+	id, ok := compressIDs[typ]
+	return id, ok
+}
+
+// CompressTypeByID 根据握手时的编号找到压缩方式
+func CompressTypeByID(id uint8) (CompressType, bool) {
+	compressMu.RLock()
+	defer compressMu.RUnlock()
+	for typ, i := range compressIDs {
+		if i == id && (id != 0 || typ == NoneCompress) {
+			return typ, true
+		}
+	}
+	return NoneCompress, false
+}
+
+// gzipCompressor 使用标准库 compress/gzip 实现, gzip.Writer 的初始化开销较大, 放在池中复用
+type gzipCompressor struct{}
+
+var gzipWriterPool = sync.Pool{
+	New: func() interface{} { return gzip.NewWriter(nil) },
+}
+
+func (gzipCompressor) Compress(data []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	w := gzipWriterPool.Get().(*gzip.Writer)
+	defer gzipWriterPool.Put(w)
+	w.Reset(&buf)
+	if _, err := w.Write(data); err != nil {
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func (gzipCompressor) Decompress(data []byte, limit int) ([]byte, error) {
+	r, err := gzip.NewReader(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	defer func() { _ = r.Close() }()
+	if limit <= 0 {
+		return io.ReadAll(r)
+	}
+	// 最多多读一个字节, 不会因为压缩炸弹解压出大量的数据
+	out, err := io.ReadAll(io.LimitReader(r, int64(limit)+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(out) > limit {
+		return nil, &MessageTooLargeError{Size: len(out), Limit: limit}
+	}
+	return out, nil
+}
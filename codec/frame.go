@@ -0,0 +1,127 @@
+package codec
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+)
+
+// 所有编解码器都在帧之上工作, `Header` 和 `Body` 各占一帧:
+// | type (1 byte) | length (4 bytes, big endian) | payload (length bytes) |
+// 帧的长度是显式的, 因此即使 payload 无法解码, 也可以整帧跳过, 链接可以继续使用
+
+// FrameType 帧的类型
+type FrameType uint8
+
+const (
+	HeaderFrame FrameType = iota + 1 // 消息头
+	BodyFrame                        // 消息体
+)
+
+const frameHeaderSize = 5
+
+// WriteFrame 写入一帧数据
+func WriteFrame(w io.Writer, typ FrameType, payload []byte) error {
+	var head [frameHeaderSize]byte
+	head[0] = byte(typ)
+	binary.BigEndian.PutUint32(head[1:], uint32(len(payload)))
+	if _, err := w.Write(head[:]); err != nil {
+		return err
+	}
+	_, err := w.Write(payload)
+	return err
+}
+
+// ReadFrame 读取一帧数据, 返回帧的类型和 payload
+// payload 来自缓冲池, 使用完毕之后可以调用 PutBytes 放回
+func ReadFrame(r io.Reader) (FrameType, []byte, error) {
+	return readFrame(r, 0)
+}
+
+// readFrame 读取一帧数据, limit 大于 0 时拒绝超过 limit 字节的 payload
+// 超过限制的 payload 在分配内存之前就被丢弃, 返回的 *DecodeError 包装了 *MessageTooLargeError
+func readFrame(r io.Reader, limit int) (FrameType, []byte, error) {
+	var head [frameHeaderSize]byte
+	if _, err := io.ReadFull(r, head[:]); err != nil {
+		return 0, nil, err
+	}
+	typ, size := FrameType(head[0]), int64(binary.BigEndian.Uint32(head[1:]))
+	if limit > 0 && size > int64(limit) {
+		if _, err := io.CopyN(io.Discard, r, size); err != nil {
+			return 0, nil, io.ErrUnexpectedEOF
+		}
+		return typ, nil, &DecodeError{Err: &MessageTooLargeError{Size: int(size), Limit: limit}}
+	}
+	if size > maxPooledSize {
+		// 没有限制时不能按照对端声明的长度一次分配内存, 随着数据到达逐步扩大缓冲区, 对端声明了很大的长度却不发送数据时不会耗尽内存
+		var buf bytes.Buffer
+		if _, err := io.CopyN(&buf, r, size); err != nil {
+			if err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+			return 0, nil, err
+		}
+		return typ, buf.Bytes(), nil
+	}
+	payload := GetBytes(int(size))
+	if _, err := io.ReadFull(r, payload); err != nil {
+		PutBytes(payload)
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return 0, nil, err
+	}
+	return typ, payload, nil
+}
+
+// readFrameOf 读取一帧数据并检查帧的类型
+func readFrameOf(r io.Reader, want FrameType, limit int) ([]byte, error) {
+	typ, payload, err := readFrame(r, limit)
+	if typ != want && typ != 0 {
+		PutBytes(payload)
+		return nil, fmt.Errorf("rpc codec: unexpected frame type %d, expect %d", typ, want)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return payload, nil
+}
+
+// MessageTooLargeError 消息超过了 MaxRecvMsgSize 或 MaxSendMsgSize 的限制
+type MessageTooLargeError struct {
+	Size  int // 消息的字节数
+	Limit int // 允许的最大字节数
+}
+
+func (e *MessageTooLargeError) Error() string {
+	return fmt.Sprintf("rpc codec: message too large: %d bytes exceeds limit of %d bytes", e.Size, e.Limit)
+}
+
+// DecodeError 表示一帧已经被完整读取, 但是 payload 无法解码
+// 此时数据流没有错位, 链接可以继续使用
+type DecodeError struct {
+	Err error
+}
+
+func (e *DecodeError) Error() string {
+	return "rpc codec: decode error: " + e.Err.Error()
+}
+
+func (e *DecodeError) Unwrap() error {
+	return e.Err
+}
+
+// EncodeError 表示消息在写入链接之前就已经失败 (编码错误, 超过大小限制等)
+// 此时没有任何数据被写入, 链接可以继续使用
+type EncodeError struct {
+	Err error
+}
+
+func (e *EncodeError) Error() string {
+	return "rpc codec: encode error: " + e.Err.Error()
+}
+
+func (e *EncodeError) Unwrap() error {
+	return e.Err
+}
@@ -0,0 +1,258 @@
+package codec
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+)
+
+// ErrChecksum 帧的校验和不一致, 说明 payload 在传输过程中被破坏
+var ErrChecksum = errors.New("rpc codec: checksum mismatch")
+
+const checksumSize = 4
+
+// FrameOption 帧层的可选配置, 由握手时的 `Option` 决定, 通信双方必须一致
+type FrameOption struct {
+	Checksum          bool       // 每一帧的 payload 之后追加 CRC32 校验和
+	Compressor        Compressor // 不为 nil 时允许压缩 `Body` 帧的 payload
+	CompressThreshold int        // 只压缩超过这个字节数的 `Body`, 0 表示全部压缩
+	MaxRecvSize       int        // 允许读取的最大帧, 0 表示不限制
+	MaxSendSize       int        // 允许写入的最大帧, 0 表示不限制
+}
+
+// FrameConfigurer 支持帧层配置的编解码器, 嵌入 FrameConn 即可实现
+type FrameConfigurer interface {
+	SetFrameOption(opt FrameOption)
+}
+
+// MarshalFunc 和 UnmarshalFunc 负责 payload 的编解码, 由具体的编解码器提供
+// MarshalFunc 把 v 编码进 buf, buf 来自缓冲池; UnmarshalFunc 不能在返回之后继续持有 data
+type (
+	MarshalFunc   func(buf *bytes.Buffer, v interface{}) error
+	UnmarshalFunc func(data []byte, v interface{}) error
+)
+
+// FrameConn 负责在链接上读写帧, 编解码器嵌入它之后只需要提供 payload 的编解码函数
+type FrameConn struct {
+	conn        io.ReadWriteCloser // 建立socket链接的时候得到的实例
+	buf         *bufio.Writer      // 为了防止阻塞而创建的缓冲 `Writer`
+	r           *bufio.Reader      // 读取帧的缓冲 `Reader`
+	opt         FrameOption
+	typ         Type // 链接的编解码方式, 由具体的编解码器设置
+	compressed  bool // 上一个读到的 `Header` 是否声明了 `Body` 被压缩
+	contentType Type // 上一个读到的 `Header` 声明的 `Body` 编码方式
+	bodySize    int  // 上一个读到的 `Body` 帧的字节数
+	sentSize    int  // 上一个写入的 `Body` 帧的字节数
+	manualFlush bool // 为 true 时 WriteMessage 不发送缓冲区, 见 SetAutoFlush
+}
+
+// Flusher 可以把多条消息合并发送的编解码器, 嵌入 FrameConn 即可实现
+// SetAutoFlush(false) 之后 Write 只写入缓冲区, 缓冲区写满或者调用 Flush 时才发送到链接
+type Flusher interface {
+	SetAutoFlush(on bool)
+	Flush() error
+}
+
+var (
+	_ FrameConfigurer = (*FrameConn)(nil)
+	_ Flusher         = (*FrameConn)(nil)
+)
+
+// NewFrameConn 初始化函数
+func NewFrameConn(conn io.ReadWriteCloser) *FrameConn {
+	return &FrameConn{
+		conn: conn,
+		buf:  bufio.NewWriter(conn),
+		r:    bufio.NewReader(conn),
+	}
+}
+
+// SetFrameOption 设置帧层配置, 需要在读写第一帧之前调用
+func (f *FrameConn) SetFrameOption(opt FrameOption) {
+	f.opt = opt
+}
+
+// ReadFrame 读取一帧并检查帧的类型, 开启校验时会验证校验和
+// 校验失败时这一帧已经被完整读取, 返回的 *DecodeError 包装了 ErrChecksum
+// payload 来自缓冲池, 使用完毕之后可以调用 PutBytes 放回
+func (f *FrameConn) ReadFrame(want FrameType) ([]byte, error) {
+	payload, err := readFrameOf(f.r, want, f.opt.MaxRecvSize)
+	if err != nil || !f.opt.Checksum {
+		return payload, err
+	}
+	n := len(payload) - checksumSize
+	if n < 0 || crc32.ChecksumIEEE(payload[:n]) != binary.BigEndian.Uint32(payload[n:]) {
+		PutBytes(payload)
+		return nil, &DecodeError{Err: ErrChecksum}
+	}
+	return payload[:n], nil
+}
+
+// SetAutoFlush 设置 WriteMessage 是否在写入之后立即发送, 默认为 true
+func (f *FrameConn) SetAutoFlush(on bool) {
+	f.manualFlush = !on
+}
+
+// WriteFrame 写入一帧到缓冲区, 需要调用 Flush 才会真正发送
+func (f *FrameConn) WriteFrame(typ FrameType, payload []byte) error {
+	if f.opt.Checksum {
+		payload = binary.BigEndian.AppendUint32(payload, crc32.ChecksumIEEE(payload))
+	}
+	return WriteFrame(f.buf, typ, payload)
+}
+
+// ReadHeaderFrame 读取并解码 `Header` 帧, 同时记下对应的 `Body` 是否被压缩
+func (f *FrameConn) ReadHeaderFrame(h *Header, unmarshal UnmarshalFunc) error {
+	payload, err := f.ReadFrame(HeaderFrame)
+	if err != nil {
+		return err
+	}
+	defer PutBytes(payload)
+	if err := unmarshal(payload, h); err != nil {
+		return &DecodeError{Err: err}
+	}
+	f.compressed = h.Compressed
+	f.contentType = h.ContentType
+	return nil
+}
+
+// BodyType 返回上一个读到的 `Header` 对应的 `Body` 的编码方式
+func (f *FrameConn) BodyType() Type {
+	if f.contentType != "" {
+		return f.contentType
+	}
+	return f.typ
+}
+
+// BodySize 返回上一个读到的 `Body` 帧的字节数, 压缩的 `Body` 是压缩之后的大小
+func (f *FrameConn) BodySize() int {
+	return f.bodySize
+}
+
+// SentBodySize 返回上一个写入的 `Body` 帧的字节数, 压缩的 `Body` 是压缩之后的大小
+func (f *FrameConn) SentBodySize() int {
+	return f.sentSize
+}
+
+// ReadBodyFrame 读取并解码 `Body` 帧, body 为 nil 时直接丢弃这一帧
+// `Header` 声明了其他的编码方式时, 使用注册的编码方式代替 unmarshal
+func (f *FrameConn) ReadBodyFrame(body interface{}, unmarshal UnmarshalFunc) error {
+	if body != nil && f.contentType != "" && f.contentType != f.typ {
+		ct, ok := contentTypes[f.contentType]
+		if !ok {
+			// 丢弃这一帧, 保证后续的消息不会错位
+			payload, err := f.ReadFrame(BodyFrame)
+			if err != nil {
+				return err
+			}
+			PutBytes(payload)
+			return &DecodeError{Err: fmt.Errorf("unsupported content type %s", f.contentType)}
+		}
+		unmarshal = ct.unmarshal
+	}
+	return f.readBody(body, unmarshal)
+}
+
+// readBody 读取 `Body` 帧并使用 unmarshal 解码
+func (f *FrameConn) readBody(body interface{}, unmarshal UnmarshalFunc) error {
+	payload, err := f.ReadFrame(BodyFrame)
+	if err != nil {
+		return err
+	}
+	defer PutBytes(payload)
+	f.bodySize = len(payload)
+	if body == nil {
+		return nil
+	}
+	if f.compressed {
+		if f.opt.Compressor == nil {
+			return &DecodeError{Err: errors.New("compressed body without negotiated compressor")}
+		}
+		// 解压之后的大小同样受到限制, 超过限制时在解压的过程中停止
+		if payload, err = f.opt.Compressor.Decompress(payload, f.opt.MaxRecvSize); err != nil {
+			return &DecodeError{Err: err}
+		}
+	}
+	if err := unmarshal(payload, body); err != nil {
+		return &DecodeError{Err: err}
+	}
+	return nil
+}
+
+// WriteMessage 编码并写入 `Header` 和 `Body` 两帧, 然后发送到链接
+// `Body` 超过压缩阈值并且没有设置 h.NoCompress 时会被压缩, 并通过 h.Compressed 告知对端; h.ContentType 不为空时使用注册的编码方式编码 `Body`
+// 写入之前的失败返回 *EncodeError, 链接仍然可用; 写入链接失败时会关闭链接
+func (f *FrameConn) WriteMessage(h *Header, body interface{}, marshal MarshalFunc) (err error) {
+	bodyMarshal := marshal
+	if h.ContentType != "" && h.ContentType != f.typ {
+		ct, ok := contentTypes[h.ContentType]
+		if !ok {
+			return &EncodeError{Err: fmt.Errorf("unsupported content type %s", h.ContentType)}
+		}
+		bodyMarshal = ct.marshal
+	}
+	bodyBuf, headerBuf := GetBuffer(), GetBuffer()
+	defer PutBuffer(bodyBuf)
+	defer PutBuffer(headerBuf)
+	if err := bodyMarshal(bodyBuf, body); err != nil {
+		return &EncodeError{Err: err}
+	}
+	bb := bodyBuf.Bytes()
+	h.Compressed = f.opt.Compressor != nil && !h.NoCompress && len(bb) > f.opt.CompressThreshold
+	if h.Compressed {
+		if bb, err = f.opt.Compressor.Compress(bb); err != nil {
+			return &EncodeError{Err: err}
+		}
+	}
+	if err := marshal(headerBuf, h); err != nil {
+		return &EncodeError{Err: err}
+	}
+	hb := headerBuf.Bytes()
+	if err := f.checkSendSize(hb); err != nil {
+		return err
+	}
+	if err := f.checkSendSize(bb); err != nil {
+		return err
+	}
+	defer func() {
+		if err != nil {
+			_ = f.Close() // 数据可能只写入了一部分, 链接已经无法继续使用
+		}
+	}()
+	if err = f.WriteFrame(HeaderFrame, hb); err != nil {
+		return err
+	}
+	if err = f.WriteFrame(BodyFrame, bb); err != nil {
+		return err
+	}
+	f.sentSize = len(bb)
+	if !f.manualFlush {
+		err = f.Flush() // 将缓冲区的数据写回 io.Writer 中
+	}
+	return err
+}
+
+// checkSendSize 检查 payload 是否超过 MaxSendSize
+func (f *FrameConn) checkSendSize(payload []byte) error {
+	size := len(payload)
+	if f.opt.Checksum {
+		size += checksumSize
+	}
+	if f.opt.MaxSendSize > 0 && size > f.opt.MaxSendSize {
+		return &EncodeError{Err: &MessageTooLargeError{Size: size, Limit: f.opt.MaxSendSize}}
+	}
+	return nil
+}
+
+// Flush 将缓冲区的数据写回链接
+func (f *FrameConn) Flush() error {
+	return f.buf.Flush()
+}
+
+func (f *FrameConn) Close() error {
+	return f.conn.Close()
+}
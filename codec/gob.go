@@ -1,62 +1,46 @@
 package codec
 
 import (
-	"bufio"
+	"bytes"
 	"encoding/gob"
 	"io"
-	"log"
 )
 
 // GobCodec
 type GobCodec struct {
-	conn io.ReadWriteCloser // 建立socket链接的时候得到的实例
-	buf  *bufio.Writer      // 为了防止阻塞而创建的缓冲 `Writer`
-	dec  *gob.Decoder       // 解码 `Decoder`
-	enc  *gob.Encoder       // 编码 `Encoder`
+	*FrameConn // 负责读写帧, 见 frame_conn.go
 }
 
 var _ Codec = (*GobCodec)(nil) // 不报错的话就保证 `GobCodec` 实现了 `Codec` 的接口
 
 // NewGobCodec 初始化函数
 func NewGobCodec(conn io.ReadWriteCloser) Codec {
-	buf := bufio.NewWriter(conn)
-	return &GobCodec{
-		conn: conn,
-		buf:  buf,
-		dec:  gob.NewDecoder(conn),
-		enc:  gob.NewEncoder(buf),
-	}
+	fc := NewFrameConn(conn)
+	fc.typ = GobType
+	return &GobCodec{FrameConn: fc}
 }
 
-// ReadHeader 读取 `Header` 信息, 使用 dec 进行对 `Header` 进行解码即可
+// gobMarshal 每一帧都使用独立的 `Encoder` 进行编码, 保证每一帧都可以单独解码
+func gobMarshal(buf *bytes.Buffer, v interface{}) error {
+	return gob.NewEncoder(buf).Encode(v)
+}
+
+// gobUnmarshal 每一帧都使用独立的 `Decoder` 进行解码
+func gobUnmarshal(data []byte, v interface{}) error {
+	return gob.NewDecoder(bytes.NewReader(data)).Decode(v)
+}
+
+// ReadHeader 读取 `Header` 帧
 func (c *GobCodec) ReadHeader(h *Header) error {
-	return c.dec.Decode(h)
+	return c.ReadHeaderFrame(h, gobUnmarshal)
 }
 
-// ReadBody 读取 `Body` 信息, 与 ReadHeader() 类似
+// ReadBody 读取 `Body` 帧, body 为 nil 时直接丢弃这一帧
 func (c *GobCodec) ReadBody(body interface{}) error {
-	return c.dec.Decode(body)
+	return c.ReadBodyFrame(body, gobUnmarshal)
 }
 
 // Write 写回相应的函数
-func (c *GobCodec) Write(h *Header, body interface{}) (err error) {
-	defer func() {
-		_ = c.buf.Flush() // 将缓冲区的数据写回 io.Writer 中
-		if err != nil {
-			_ = c.Close() // 关闭缓冲区, 释放对应的资源
-		}
-	}()
-	// 对 `Header` 和 `Body` 信息进行编码
-	if err := c.enc.Encode(h); err != nil {
-		log.Println("rpc codec: gob error encoding header: ", err)
-		return err
-	}
-	if err := c.enc.Encode(body); err != nil {
-		log.Panicln("rpc codec: gob error encoding body:", err)
-		return nil
-	}
-	return nil
-}
-func (c *GobCodec) Close() error {
-	return c.conn.Close()
+func (c *GobCodec) Write(h *Header, body interface{}) error {
+	return c.WriteMessage(h, body, gobMarshal)
 }
@@ -0,0 +1,125 @@
+package codec
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+)
+
+// ErrTypeNotAllowed gob payload 中声明了不在白名单中的类型
+var ErrTypeNotAllowed = errors.New("rpc codec: gob type not allowed")
+
+// ReadBodyFrameAllowed 与 ReadBodyFrame 相同, 但是 gob 编码的 `Body` 在解码之前先检查 payload 中声明的类型
+// 只要有一个类型名称不被 allowed 接受, 就拒绝解码, 返回的 *DecodeError 包装了 ErrTypeNotAllowed
+// 其他编码方式的 `Body` 不会构造任意类型, 按 ReadBodyFrame 正常解码
+func (f *FrameConn) ReadBodyFrameAllowed(body interface{}, allowed func(name string) bool, unmarshal UnmarshalFunc) error {
+	if f.BodyType() != GobType {
+		return f.ReadBodyFrame(body, unmarshal)
+	}
+	return f.readBody(body, func(data []byte, v interface{}) error {
+		names, err := GobTypeNames(data)
+		if err != nil {
+			return err
+		}
+		for _, name := range names {
+			if !allowed(name) {
+				return fmt.Errorf("%w: %q", ErrTypeNotAllowed, name)
+			}
+		}
+		return gobUnmarshal(data, v)
+	})
+}
+
+// ReadBodyAllowed 见 FrameConn.ReadBodyFrameAllowed
+func (c *GobCodec) ReadBodyAllowed(body interface{}, allowed func(name string) bool) error {
+	return c.ReadBodyFrameAllowed(body, allowed, gobUnmarshal)
+}
+
+// ReadBodyAllowed 见 FrameConn.ReadBodyFrameAllowed, 请求可能通过 Header.ContentType 使用 gob 编码
+func (c *JsonCodec) ReadBodyAllowed(body interface{}, allowed func(name string) bool) error {
+	return c.ReadBodyFrameAllowed(body, allowed, json.Unmarshal)
+}
+
+// ReadBodyAllowed 见 FrameConn.ReadBodyFrameAllowed, 请求可能通过 Header.ContentType 使用 gob 编码
+func (c *AvroCodec) ReadBodyAllowed(body interface{}, allowed func(name string) bool) error {
+	return c.ReadBodyFrameAllowed(body, allowed, avroUnmarshaler(c.method))
+}
+
+// ReadBodyAllowed 见 FrameConn.ReadBodyFrameAllowed, 请求可能通过 Header.ContentType 使用 gob 编码
+func (c *ThriftCodec) ReadBodyAllowed(body interface{}, allowed func(name string) bool) error {
+	return c.ReadBodyFrameAllowed(body, allowed, thriftUnmarshal)
+}
+
+// GobTypeNames 解析一帧 gob payload 开头的类型定义, 返回其中声明的类型名称, 不会解码任何值
+// gob 的每条消息是 | length | type id | ... |, type id 为负数时表示类型定义, 之后的 wireType
+// 无论是哪一种 (struct, slice, map ...), 第一个字段都是 CommonType{Name, Id}
+func GobTypeNames(data []byte) ([]string, error) {
+	var names []string
+	for len(data) > 0 {
+		n, rest, err := gobUint(data)
+		if err != nil || n > uint64(len(rest)) {
+			return nil, errors.New("rpc codec: malformed gob message")
+		}
+		msg, next := rest[:n], rest[n:]
+		u, msg, err := gobUint(msg)
+		if err != nil {
+			return nil, err
+		}
+		// type id 使用 gob 的有符号编码, 最低位为 1 表示负数
+		if u&1 == 0 {
+			break // 类型定义之后就是值, 不需要继续解析
+		}
+		name, err := gobWireTypeName(msg)
+		if err != nil {
+			return nil, err
+		}
+		names = append(names, name)
+		data = next
+	}
+	return names, nil
+}
+
+// gobWireTypeName 从 wireType 中取出 CommonType.Name, 匿名类型返回空字符串
+func gobWireTypeName(msg []byte) (string, error) {
+	// wireType 中只有一个非空字段, 它的 delta 表示具体是哪一种类型, 这里不关心
+	_, msg, err := gobUint(msg)
+	if err != nil {
+		return "", err
+	}
+	// CommonType 是各种类型的第一个字段, Name 又是 CommonType 的第一个字段
+	// 字段为零值时不会被编码, delta 不为 1 说明 Name 为空
+	for i := 0; i < 2; i++ {
+		var delta uint64
+		if delta, msg, err = gobUint(msg); err != nil {
+			return "", err
+		}
+		if delta != 1 {
+			return "", nil
+		}
+	}
+	n, msg, err := gobUint(msg)
+	if err != nil || n > uint64(len(msg)) {
+		return "", errors.New("rpc codec: malformed gob type name")
+	}
+	return string(msg[:n]), nil
+}
+
+// gobUint 解析 gob 的无符号整数编码: 小于 128 时占一个字节, 否则第一个字节是后续字节数的相反数
+func gobUint(data []byte) (uint64, []byte, error) {
+	if len(data) == 0 {
+		return 0, nil, errors.New("rpc codec: malformed gob integer")
+	}
+	b := data[0]
+	if b < 0x80 {
+		return uint64(b), data[1:], nil
+	}
+	n := -int(int8(b))
+	if n > 8 || n >= len(data) {
+		return 0, nil, errors.New("rpc codec: malformed gob integer")
+	}
+	var x uint64
+	for _, c := range data[1 : n+1] {
+		x = x<<8 | uint64(c)
+	}
+	return x, data[n+1:], nil
+}
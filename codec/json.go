@@ -0,0 +1,45 @@
+package codec
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+)
+
+// JsonCodec 使用 JSON 进行编解码, 方便与非 Go 语言的工具互通
+type JsonCodec struct {
+	*FrameConn // 负责读写帧, 见 frame_conn.go
+}
+
+var _ Codec = (*JsonCodec)(nil) // 保证 `JsonCodec` 实现了 `Codec` 的接口
+
+// NewJsonCodec 初始化函数
+func NewJsonCodec(conn io.ReadWriteCloser) Codec {
+	fc := NewFrameConn(conn)
+	fc.typ = JsonType
+	return &JsonCodec{FrameConn: fc}
+}
+
+// jsonMarshal 与 json.Marshal 的结果一致, 但是直接写入缓冲池中的 buf
+func jsonMarshal(buf *bytes.Buffer, v interface{}) error {
+	if err := json.NewEncoder(buf).Encode(v); err != nil {
+		return err
+	}
+	buf.Truncate(buf.Len() - 1) // 去掉 Encode 追加的换行符
+	return nil
+}
+
+// ReadHeader 读取 `Header` 帧
+func (c *JsonCodec) ReadHeader(h *Header) error {
+	return c.ReadHeaderFrame(h, json.Unmarshal)
+}
+
+// ReadBody 读取 `Body` 帧, body 为 nil 时直接丢弃这一帧
+func (c *JsonCodec) ReadBody(body interface{}) error {
+	return c.ReadBodyFrame(body, json.Unmarshal)
+}
+
+// Write 写回相应的函数
+func (c *JsonCodec) Write(h *Header, body interface{}) error {
+	return c.WriteMessage(h, body, jsonMarshal)
+}
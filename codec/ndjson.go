@@ -0,0 +1,150 @@
+package codec
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"io"
+)
+
+// NDJSONCodec 每条消息占两行, 第一行是 JSON 编码的 `Header`, 第二行是 JSON 编码的 `Body`
+// 不使用帧, 其他语言只需要 socket 和 json 库就可以调用, 因此不支持校验和与压缩
+// 握手同样可以使用一行 JSON, 见 minirpc 的 handshake.go, 例如 Python:
+//
+//	s.sendall(b'{"MagicNumber": 3927900, "CodecType": "applocation/ndjson"}\n')
+//	f = s.makefile(); json.loads(f.readline())
+//	s.sendall(b'{"ServiceMethod": "Foo.Sum", "Seq": 1}\n{"Num1": 1, "Num2": 2}\n')
+//	header, body = json.loads(f.readline()), json.loads(f.readline())
+type NDJSONCodec struct {
+	conn io.ReadWriteCloser
+	r    *bufio.Reader
+	w    *bufio.Writer
+
+	bodySize    int  // 上一个读到的 `Body` 行的字节数
+	sentSize    int  // 上一个写入的 `Body` 行的字节数
+	manualFlush bool // 为 true 时 Write 不发送缓冲区, 见 SetAutoFlush
+}
+
+var (
+	_ Codec   = (*NDJSONCodec)(nil)
+	_ Flusher = (*NDJSONCodec)(nil)
+)
+
+// maxLineSize 一行允许的最大字节数, 超过时丢弃这一行
+const maxLineSize = 64 << 20
+
+// NewNDJSONCodec 初始化函数
+func NewNDJSONCodec(conn io.ReadWriteCloser) Codec {
+	return &NDJSONCodec{
+		conn: conn,
+		r:    bufio.NewReader(conn),
+		w:    bufio.NewWriter(conn),
+	}
+}
+
+// readLine 读取一行, 超过 maxLineSize 的行被整行丢弃, 返回的 *DecodeError 包装了 *MessageTooLargeError
+func (c *NDJSONCodec) readLine() ([]byte, error) {
+	var line []byte
+	size := 0
+	for {
+		chunk, err := c.r.ReadSlice('\n')
+		size += len(chunk)
+		if size <= maxLineSize {
+			line = append(line, chunk...)
+		}
+		switch {
+		case err == bufio.ErrBufferFull:
+			continue
+		case err == io.EOF && size > 0:
+			return nil, io.ErrUnexpectedEOF
+		case err != nil:
+			return nil, err
+		}
+		if size > maxLineSize {
+			return nil, &DecodeError{Err: &MessageTooLargeError{Size: size, Limit: maxLineSize}}
+		}
+		return bytes.TrimRight(line, "\r\n"), nil
+	}
+}
+
+// ReadHeader 读取 `Header` 所在的行
+func (c *NDJSONCodec) ReadHeader(h *Header) error {
+	line, err := c.readLine()
+	if err != nil {
+		return err
+	}
+	if err := json.Unmarshal(line, h); err != nil {
+		return &DecodeError{Err: err}
+	}
+	return nil
+}
+
+// ReadBody 读取 `Body` 所在的行, body 为 nil 时直接丢弃这一行
+func (c *NDJSONCodec) ReadBody(body interface{}) error {
+	line, err := c.readLine()
+	if err != nil {
+		return err
+	}
+	c.bodySize = len(line)
+	if body == nil {
+		return nil
+	}
+	if err := json.Unmarshal(line, body); err != nil {
+		return &DecodeError{Err: err}
+	}
+	return nil
+}
+
+// BodySize 返回上一个读到的 `Body` 行的字节数
+func (c *NDJSONCodec) BodySize() int {
+	return c.bodySize
+}
+
+// SentBodySize 返回上一个写入的 `Body` 行的字节数
+func (c *NDJSONCodec) SentBodySize() int {
+	return c.sentSize
+}
+
+// Write 写回相应的函数, json 会转义字符串中的换行符, 因此每条消息都恰好是两行
+func (c *NDJSONCodec) Write(h *Header, body interface{}) (err error) {
+	bodyBuf, headerBuf := GetBuffer(), GetBuffer()
+	defer PutBuffer(bodyBuf)
+	defer PutBuffer(headerBuf)
+	// json.Encoder 会在末尾追加换行符, 正好作为行的结尾
+	if err := json.NewEncoder(bodyBuf).Encode(body); err != nil {
+		return &EncodeError{Err: err}
+	}
+	if err := json.NewEncoder(headerBuf).Encode(h); err != nil {
+		return &EncodeError{Err: err}
+	}
+	defer func() {
+		if err != nil {
+			_ = c.Close()
+		}
+	}()
+	if _, err = c.w.Write(headerBuf.Bytes()); err != nil {
+		return err
+	}
+	if _, err = c.w.Write(bodyBuf.Bytes()); err != nil {
+		return err
+	}
+	c.sentSize = bodyBuf.Len()
+	if c.manualFlush {
+		return nil
+	}
+	return c.w.Flush()
+}
+
+// SetAutoFlush 设置 Write 是否在写入之后立即发送, 默认为 true
+func (c *NDJSONCodec) SetAutoFlush(on bool) {
+	c.manualFlush = !on
+}
+
+// Flush 将缓冲区的数据写回链接
+func (c *NDJSONCodec) Flush() error {
+	return c.w.Flush()
+}
+
+func (c *NDJSONCodec) Close() error {
+	return c.conn.Close()
+}
@@ -0,0 +1,52 @@
+package codec
+
+import (
+	"bytes"
+	"sync"
+)
+
+// 编解码器共享的缓冲池, 自定义的编解码器也可以直接使用, 减少高负载下的内存分配
+
+// maxPooledSize 超过这个容量的缓冲不放回池中, 避免偶尔的大消息长期占用内存
+const maxPooledSize = 1 << 20
+
+var bufferPool = sync.Pool{
+	New: func() interface{} { return new(bytes.Buffer) },
+}
+
+// GetBuffer 从池中取出一个空的 bytes.Buffer, 用于编码 payload
+func GetBuffer() *bytes.Buffer {
+	buf := bufferPool.Get().(*bytes.Buffer)
+	buf.Reset()
+	return buf
+}
+
+// PutBuffer 将 bytes.Buffer 放回池中, 之后不能再使用它以及它返回过的切片
+func PutBuffer(buf *bytes.Buffer) {
+	if buf.Cap() > maxPooledSize {
+		return
+	}
+	bufferPool.Put(buf)
+}
+
+var bytesPool = sync.Pool{
+	New: func() interface{} { return new([]byte) },
+}
+
+// GetBytes 从池中取出一个长度为 n 的切片, 用于读取帧的 payload
+func GetBytes(n int) []byte {
+	p := bytesPool.Get().(*[]byte)
+	if cap(*p) < n {
+		return make([]byte, n)
+	}
+	return (*p)[:n]
+}
+
+// PutBytes 将切片放回池中, 之后不能再使用它
+func PutBytes(b []byte) {
+	if cap(b) == 0 || cap(b) > maxPooledSize {
+		return
+	}
+	b = b[:0]
+	bytesPool.Put(&b)
+}
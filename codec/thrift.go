@@ -0,0 +1,678 @@
+package codec
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// ThriftCodec 使用 Thrift compact protocol 编码 `Header` 和 `Body`, 方便从其他语言的 Thrift 客户端迁移
+// 结构体字段的编号取自 thrift 生成代码中的 `thrift:"name,id"` 标签, 没有标签时按字段的声明顺序从 1 开始编号
+// `Header` 的字段编号见它的 thrift 标签, 不依赖字段的声明顺序
+// `Body` 是结构体时直接编码, 其他类型包装成只有 0 号字段的结构体, 与 thrift 方法返回值的 success 字段一致
+type ThriftCodec struct {
+	*FrameConn // 负责读写帧, 见 frame_conn.go
+}
+
+var _ Codec = (*ThriftCodec)(nil)
+
+// NewThriftCodec 初始化函数
+func NewThriftCodec(conn io.ReadWriteCloser) Codec {
+	fc := NewFrameConn(conn)
+	fc.typ = ThriftType
+	return &ThriftCodec{FrameConn: fc}
+}
+
+// ReadHeader 读取 `Header` 帧
+func (c *ThriftCodec) ReadHeader(h *Header) error {
+	return c.ReadHeaderFrame(h, thriftUnmarshal)
+}
+
+// ReadBody 读取 `Body` 帧, body 为 nil 时直接丢弃这一帧
+func (c *ThriftCodec) ReadBody(body interface{}) error {
+	return c.ReadBodyFrame(body, thriftUnmarshal)
+}
+
+// Write 写回相应的函数
+func (c *ThriftCodec) Write(h *Header, body interface{}) error {
+	return c.WriteMessage(h, body, thriftMarshal)
+}
+
+// compact protocol 中的类型编号
+const (
+	thriftStop      byte = 0
+	thriftTrue      byte = 1
+	thriftFalse     byte = 2
+	thriftByte      byte = 3
+	thriftI16       byte = 4
+	thriftI32       byte = 5
+	thriftI64       byte = 6
+	thriftDouble    byte = 7
+	thriftBinary    byte = 8
+	thriftList      byte = 9
+	thriftSet       byte = 10
+	thriftMap       byte = 11
+	thriftStruct    byte = 12
+	thriftMaxDepth       = 64 // 嵌套的最大深度, 防止构造的消息耗尽栈空间
+	thriftWrappedID      = 0  // 非结构体的 `Body` 包装之后使用的字段编号
+)
+
+var errThriftShort = errors.New("rpc codec: thrift data too short")
+
+// thriftField 结构体字段与 thrift 字段编号的对应关系
+type thriftField struct {
+	id    int16
+	index int
+}
+
+var thriftFieldCache sync.Map // map[reflect.Type][]thriftField
+
+// thriftFields 返回结构体导出字段的编号, 标签格式为 `thrift:"name,id[,optional]"`, 没有编号的字段使用字段序号加 1
+// 编号无法解析或者重复时返回错误, 不会静默地使用其他编号
+func thriftFields(t reflect.Type) ([]thriftField, error) {
+	if fs, ok := thriftFieldCache.Load(t); ok {
+		return fs.([]thriftField), nil
+	}
+	var fields []thriftField
+	names := make(map[int16]string)
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		tag := f.Tag.Get("thrift")
+		if !f.IsExported() || tag == "-" {
+			continue
+		}
+		id := int16(i + 1)
+		if parts := strings.Split(tag, ","); len(parts) > 1 && parts[1] != "" {
+			n, err := strconv.ParseInt(parts[1], 10, 16)
+			if err != nil {
+				return nil, fmt.Errorf("rpc codec: invalid thrift field id %q in %s.%s", parts[1], t, f.Name)
+			}
+			id = int16(n)
+		}
+		if other, ok := names[id]; ok {
+			return nil, fmt.Errorf("rpc codec: %s.%s and %s.%s share thrift field id %d", t, other, t, f.Name, id)
+		}
+		names[id] = f.Name
+		fields = append(fields, thriftField{id: id, index: i})
+	}
+	thriftFieldCache.Store(t, fields)
+	return fields, nil
+}
+
+// thriftTypeOf 返回 Go 类型在 compact protocol 中对应的类型
+func thriftTypeOf(t reflect.Type) (byte, error) {
+	switch t.Kind() {
+	case reflect.Bool:
+		return thriftTrue, nil
+	case reflect.Int8, reflect.Uint8:
+		return thriftByte, nil
+	case reflect.Int16:
+		return thriftI16, nil
+	case reflect.Int32, reflect.Uint16:
+		return thriftI32, nil
+	case reflect.Int, reflect.Int64, reflect.Uint, reflect.Uint32, reflect.Uint64:
+		return thriftI64, nil
+	case reflect.Float32, reflect.Float64:
+		return thriftDouble, nil
+	case reflect.String:
+		return thriftBinary, nil
+	case reflect.Slice, reflect.Array:
+		if t.Elem().Kind() == reflect.Uint8 {
+			return thriftBinary, nil
+		}
+		return thriftList, nil
+	case reflect.Map:
+		return thriftMap, nil
+	case reflect.Struct:
+		return thriftStruct, nil
+	case reflect.Ptr:
+		return thriftTypeOf(t.Elem())
+	}
+	return 0, fmt.Errorf("rpc codec: unsupported thrift type %s", t)
+}
+
+// thriftMarshal 把 v 编码为 compact protocol 的结构体
+func thriftMarshal(buf *bytes.Buffer, v interface{}) error {
+	rv := reflect.ValueOf(v)
+	for rv.Kind() == reflect.Ptr && !rv.IsNil() && rv.Elem().Kind() == reflect.Ptr {
+		rv = rv.Elem()
+	}
+	w := &thriftWriter{buf: buf.AvailableBuffer()}
+	var err error
+	if rv.Kind() == reflect.Ptr && !rv.IsNil() && rv.Elem().Kind() == reflect.Struct {
+		err = w.writeStruct(rv.Elem(), 0)
+	} else if rv.Kind() == reflect.Struct {
+		err = w.writeStruct(rv, 0)
+	} else {
+		err = w.writeWrapped(rv)
+	}
+	if err != nil {
+		return err
+	}
+	buf.Write(w.buf)
+	return nil
+}
+
+// thriftUnmarshal 把 compact protocol 的结构体解码到 v, v 必须是指针
+func thriftUnmarshal(data []byte, v interface{}) error {
+	rv := reflect.ValueOf(v)
+	if rv.Kind() != reflect.Ptr || rv.IsNil() {
+		return errors.New("rpc codec: thrift decode target must be a non-nil pointer")
+	}
+	for rv.Elem().Kind() == reflect.Ptr {
+		if rv.Elem().IsNil() {
+			rv.Elem().Set(reflect.New(rv.Elem().Type().Elem()))
+		}
+		rv = rv.Elem()
+	}
+	r := &thriftReader{data: data}
+	var err error
+	if rv.Elem().Kind() == reflect.Struct {
+		err = r.readStruct(rv.Elem(), 0)
+	} else {
+		err = r.readWrapped(rv.Elem())
+	}
+	if err != nil {
+		return err
+	}
+	if len(r.data) != 0 {
+		return errors.New("rpc codec: trailing bytes after thrift message")
+	}
+	return nil
+}
+
+type thriftWriter struct {
+	buf []byte
+}
+
+func (w *thriftWriter) varint(n int64) {
+	w.buf = binary.AppendUvarint(w.buf, uint64(n<<1)^uint64(n>>63))
+}
+
+func (w *thriftWriter) fieldHeader(typ byte, id, last int16) {
+	if delta := id - last; delta > 0 && delta <= 15 {
+		w.buf = append(w.buf, byte(delta)<<4|typ)
+		return
+	}
+	w.buf = append(w.buf, typ)
+	w.varint(int64(id))
+}
+
+// writeWrapped 把非结构体的值包装成只有 0 号字段的结构体
+func (w *thriftWriter) writeWrapped(v reflect.Value) error {
+	if !v.IsValid() || (v.Kind() == reflect.Ptr && v.IsNil()) {
+		w.buf = append(w.buf, thriftStop)
+		return nil
+	}
+	if err := w.writeField(v, thriftWrappedID, 0, 0); err != nil {
+		return err
+	}
+	w.buf = append(w.buf, thriftStop)
+	return nil
+}
+
+func (w *thriftWriter) writeStruct(v reflect.Value, depth int) error {
+	if depth > thriftMaxDepth {
+		return errors.New("rpc codec: thrift struct nested too deep")
+	}
+	fields, err := thriftFields(v.Type())
+	if err != nil {
+		return err
+	}
+	var last int16
+	for _, f := range fields {
+		fv := v.Field(f.index)
+		if fv.Kind() == reflect.Ptr && fv.IsNil() {
+			continue // 空指针对应 optional 字段, 不写入
+		}
+		if err := w.writeField(fv, f.id, last, depth); err != nil {
+			return err
+		}
+		last = f.id
+	}
+	w.buf = append(w.buf, thriftStop)
+	return nil
+}
+
+func (w *thriftWriter) writeField(v reflect.Value, id, last int16, depth int) error {
+	for v.Kind() == reflect.Ptr {
+		if v.IsNil() {
+			return errors.New("rpc codec: nil pointer in thrift field")
+		}
+		v = v.Elem()
+	}
+	typ, err := thriftTypeOf(v.Type())
+	if err != nil {
+		return err
+	}
+	// bool 字段的值直接放在字段头的类型中
+	if typ == thriftTrue {
+		if !v.Bool() {
+			typ = thriftFalse
+		}
+		w.fieldHeader(typ, id, last)
+		return nil
+	}
+	w.fieldHeader(typ, id, last)
+	return w.writeValue(typ, v, depth)
+}
+
+func (w *thriftWriter) writeValue(typ byte, v reflect.Value, depth int) error {
+	for v.Kind() == reflect.Ptr {
+		if v.IsNil() {
+			return errors.New("rpc codec: nil pointer in thrift container")
+		}
+		v = v.Elem()
+	}
+	switch typ {
+	case thriftTrue:
+		if v.Bool() {
+			w.buf = append(w.buf, thriftTrue)
+		} else {
+			w.buf = append(w.buf, thriftFalse)
+		}
+	case thriftByte:
+		if v.Kind() == reflect.Uint8 {
+			w.buf = append(w.buf, byte(v.Uint()))
+		} else {
+			w.buf = append(w.buf, byte(v.Int()))
+		}
+	case thriftI16, thriftI32, thriftI64:
+		if v.CanInt() {
+			w.varint(v.Int())
+		} else {
+			w.varint(int64(v.Uint()))
+		}
+	case thriftDouble:
+		w.buf = binary.LittleEndian.AppendUint64(w.buf, math.Float64bits(v.Float()))
+	case thriftBinary:
+		w.buf = binary.AppendUvarint(w.buf, uint64(v.Len()))
+		if v.Kind() == reflect.String {
+			w.buf = append(w.buf, v.String()...)
+		} else {
+			for i := 0; i < v.Len(); i++ {
+				w.buf = append(w.buf, byte(v.Index(i).Uint()))
+			}
+		}
+	case thriftList:
+		elemType, err := thriftTypeOf(v.Type().Elem())
+		if err != nil {
+			return err
+		}
+		if n := v.Len(); n < 15 {
+			w.buf = append(w.buf, byte(n)<<4|elemType)
+		} else {
+			w.buf = append(w.buf, 0xf0|elemType)
+			w.buf = binary.AppendUvarint(w.buf, uint64(n))
+		}
+		for i := 0; i < v.Len(); i++ {
+			if err := w.writeValue(elemType, v.Index(i), depth+1); err != nil {
+				return err
+			}
+		}
+	case thriftMap:
+		keyType, err := thriftTypeOf(v.Type().Key())
+		if err != nil {
+			return err
+		}
+		valueType, err := thriftTypeOf(v.Type().Elem())
+		if err != nil {
+			return err
+		}
+		if v.Len() == 0 {
+			w.buf = append(w.buf, 0)
+			return nil
+		}
+		w.buf = binary.AppendUvarint(w.buf, uint64(v.Len()))
+		w.buf = append(w.buf, keyType<<4|valueType)
+		iter := v.MapRange()
+		for iter.Next() {
+			if err := w.writeValue(keyType, iter.Key(), depth+1); err != nil {
+				return err
+			}
+			if err := w.writeValue(valueType, iter.Value(), depth+1); err != nil {
+				return err
+			}
+		}
+	case thriftStruct:
+		return w.writeStruct(v, depth+1)
+	}
+	return nil
+}
+
+type thriftReader struct {
+	data []byte
+}
+
+func (r *thriftReader) byte() (byte, error) {
+	if len(r.data) == 0 {
+		return 0, errThriftShort
+	}
+	b := r.data[0]
+	r.data = r.data[1:]
+	return b, nil
+}
+
+func (r *thriftReader) uvarint() (uint64, error) {
+	u, n := binary.Uvarint(r.data)
+	if n <= 0 {
+		return 0, errThriftShort
+	}
+	r.data = r.data[n:]
+	return u, nil
+}
+
+func (r *thriftReader) varint() (int64, error) {
+	u, err := r.uvarint()
+	return int64(u>>1) ^ -int64(u&1), err
+}
+
+func (r *thriftReader) next(n uint64) ([]byte, error) {
+	if n > uint64(len(r.data)) {
+		return nil, errThriftShort
+	}
+	b := r.data[:n]
+	r.data = r.data[n:]
+	return b, nil
+}
+
+// fieldHeader 读取字段头, 返回字段的类型和编号, 类型为 thriftStop 表示结构体结束
+func (r *thriftReader) fieldHeader(last int16) (byte, int16, error) {
+	b, err := r.byte()
+	if err != nil || b == thriftStop {
+		return thriftStop, 0, err
+	}
+	typ, delta := b&0x0f, int16(b>>4)
+	if delta != 0 {
+		return typ, last + delta, nil
+	}
+	id, err := r.varint()
+	return typ, int16(id), err
+}
+
+// readWrapped 读取只有 0 号字段的结构体, 其他字段被跳过
+func (r *thriftReader) readWrapped(v reflect.Value) error {
+	var last int16
+	for {
+		typ, id, err := r.fieldHeader(last)
+		if err != nil {
+			return err
+		}
+		if typ == thriftStop {
+			return nil
+		}
+		if id == thriftWrappedID {
+			err = r.readField(typ, v, 0)
+		} else {
+			err = r.skip(typ, 0)
+		}
+		if err != nil {
+			return err
+		}
+		last = id
+	}
+}
+
+func (r *thriftReader) readStruct(v reflect.Value, depth int) error {
+	if depth > thriftMaxDepth {
+		return errors.New("rpc codec: thrift struct nested too deep")
+	}
+	fields, err := thriftFields(v.Type())
+	if err != nil {
+		return err
+	}
+	var last int16
+	for {
+		typ, id, err := r.fieldHeader(last)
+		if err != nil {
+			return err
+		}
+		if typ == thriftStop {
+			return nil
+		}
+		index := -1
+		for _, f := range fields {
+			if f.id == id {
+				index = f.index
+				break
+			}
+		}
+		// 不认识的字段直接跳过, 兼容对端新增的字段
+		if index < 0 {
+			err = r.skip(typ, depth)
+		} else {
+			err = r.readField(typ, v.Field(index), depth)
+		}
+		if err != nil {
+			return err
+		}
+		last = id
+	}
+}
+
+// readField 读取一个字段的值, bool 字段的值已经包含在类型中
+func (r *thriftReader) readField(typ byte, v reflect.Value, depth int) error {
+	if typ == thriftTrue || typ == thriftFalse {
+		for v.Kind() == reflect.Ptr {
+			if v.IsNil() {
+				v.Set(reflect.New(v.Type().Elem()))
+			}
+			v = v.Elem()
+		}
+		if v.Kind() != reflect.Bool {
+			return fmt.Errorf("rpc codec: cannot decode thrift bool into %s", v.Type())
+		}
+		v.SetBool(typ == thriftTrue)
+		return nil
+	}
+	return r.readValue(typ, v, depth)
+}
+
+func (r *thriftReader) readValue(typ byte, v reflect.Value, depth int) error {
+	for v.Kind() == reflect.Ptr {
+		if v.IsNil() {
+			v.Set(reflect.New(v.Type().Elem()))
+		}
+		v = v.Elem()
+	}
+	want, err := thriftTypeOf(v.Type())
+	if err != nil {
+		return err
+	}
+	if want != typ && !(want == thriftList && typ == thriftSet) && !(want == thriftTrue && typ == thriftFalse) &&
+		!(isThriftInt(want) && isThriftInt(typ)) {
+		return fmt.Errorf("rpc codec: cannot decode thrift type %d into %s", typ, v.Type())
+	}
+	switch typ {
+	case thriftTrue, thriftFalse:
+		b, err := r.byte()
+		if err != nil {
+			return err
+		}
+		v.SetBool(b == thriftTrue)
+	case thriftByte, thriftI16, thriftI32, thriftI64:
+		var n int64
+		if typ == thriftByte {
+			b, err := r.byte()
+			if err != nil {
+				return err
+			}
+			n = int64(int8(b))
+		} else if n, err = r.varint(); err != nil {
+			return err
+		}
+		if v.CanInt() {
+			v.SetInt(n)
+		} else {
+			v.SetUint(uint64(n))
+		}
+	case thriftDouble:
+		b, err := r.next(8)
+		if err != nil {
+			return err
+		}
+		v.SetFloat(math.Float64frombits(binary.LittleEndian.Uint64(b)))
+	case thriftBinary:
+		n, err := r.uvarint()
+		if err != nil {
+			return err
+		}
+		b, err := r.next(n)
+		if err != nil {
+			return err
+		}
+		switch {
+		case v.Kind() == reflect.String:
+			v.SetString(string(b))
+		case v.Kind() == reflect.Slice:
+			v.SetBytes(append([]byte(nil), b...))
+		case v.Len() == len(b):
+			reflect.Copy(v, reflect.ValueOf(b))
+		default:
+			return fmt.Errorf("rpc codec: thrift binary of %d bytes does not fit %s", len(b), v.Type())
+		}
+	case thriftList, thriftSet:
+		elemType, n, err := r.listHeader()
+		if err != nil {
+			return err
+		}
+		if v.Kind() == reflect.Slice {
+			v.Set(reflect.MakeSlice(v.Type(), n, n))
+		} else if n > v.Len() {
+			return fmt.Errorf("rpc codec: too many thrift items for %s", v.Type())
+		}
+		for i := 0; i < n; i++ {
+			if err := r.readValue(elemType, v.Index(i), depth+1); err != nil {
+				return err
+			}
+		}
+	case thriftMap:
+		keyType, valueType, n, err := r.mapHeader()
+		if err != nil {
+			return err
+		}
+		if n > 0 && v.IsNil() {
+			v.Set(reflect.MakeMapWithSize(v.Type(), n))
+		}
+		for i := 0; i < n; i++ {
+			key := reflect.New(v.Type().Key()).Elem()
+			if err := r.readValue(keyType, key, depth+1); err != nil {
+				return err
+			}
+			value := reflect.New(v.Type().Elem()).Elem()
+			if err := r.readValue(valueType, value, depth+1); err != nil {
+				return err
+			}
+			v.SetMapIndex(key, value)
+		}
+	case thriftStruct:
+		return r.readStruct(v, depth+1)
+	}
+	return nil
+}
+
+func isThriftInt(typ byte) bool {
+	return typ == thriftByte || typ == thriftI16 || typ == thriftI32 || typ == thriftI64
+}
+
+// listHeader 读取 list 和 set 的元素类型和长度
+func (r *thriftReader) listHeader() (byte, int, error) {
+	b, err := r.byte()
+	if err != nil {
+		return 0, 0, err
+	}
+	n := uint64(b >> 4)
+	if n == 15 {
+		if n, err = r.uvarint(); err != nil {
+			return 0, 0, err
+		}
+	}
+	// 每个元素至少占一个字节, 防止构造超大的长度
+	if n > uint64(len(r.data)) {
+		return 0, 0, errThriftShort
+	}
+	return b & 0x0f, int(n), nil
+}
+
+// mapHeader 读取 map 的键值类型和长度
+func (r *thriftReader) mapHeader() (byte, byte, int, error) {
+	n, err := r.uvarint()
+	if err != nil || n == 0 {
+		return 0, 0, 0, err
+	}
+	if n > uint64(len(r.data)) {
+		return 0, 0, 0, errThriftShort
+	}
+	b, err := r.byte()
+	if err != nil {
+		return 0, 0, 0, err
+	}
+	return b >> 4, b & 0x0f, int(n), nil
+}
+
+// skip 跳过一个不需要的值
+func (r *thriftReader) skip(typ byte, depth int) error {
+	if depth > thriftMaxDepth {
+		return errors.New("rpc codec: thrift struct nested too deep")
+	}
+	var err error
+	switch typ {
+	case thriftTrue, thriftFalse:
+		// 字段中的 bool 没有额外的字节, 容器中的 bool 由 skipElem 处理
+	case thriftByte:
+		_, err = r.byte()
+	case thriftI16, thriftI32, thriftI64:
+		_, err = r.uvarint()
+	case thriftDouble:
+		_, err = r.next(8)
+	case thriftBinary:
+		var n uint64
+		if n, err = r.uvarint(); err == nil {
+			_, err = r.next(n)
+		}
+	case thriftList, thriftSet:
+		elemType, n, e := r.listHeader()
+		for err = e; err == nil && n > 0; n-- {
+			err = r.skipElem(elemType, depth+1)
+		}
+	case thriftMap:
+		keyType, valueType, n, e := r.mapHeader()
+		for err = e; err == nil && n > 0; n-- {
+			if err = r.skipElem(keyType, depth+1); err == nil {
+				err = r.skipElem(valueType, depth+1)
+			}
+		}
+	case thriftStruct:
+		var last int16
+		for {
+			var ft byte
+			var id int16
+			if ft, id, err = r.fieldHeader(last); err != nil || ft == thriftStop {
+				break
+			}
+			if err = r.skip(ft, depth+1); err != nil {
+				break
+			}
+			last = id
+		}
+	default:
+		err = fmt.Errorf("rpc codec: unknown thrift type %d", typ)
+	}
+	return err
+}
+
+// skipElem 跳过容器中的一个元素, 容器中的 bool 占一个字节
+func (r *thriftReader) skipElem(typ byte, depth int) error {
+	if typ == thriftTrue || typ == thriftFalse {
+		_, err := r.byte()
+		return err
+	}
+	return r.skip(typ, depth)
+}
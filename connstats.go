@@ -0,0 +1,70 @@
+package minirpc
+
+import (
+	"io"
+	"sync/atomic"
+)
+
+// ConnStats 一个链接上读写的字节数和帧数, 见 Client.Stats 和 Server.Connections
+// 字节数包括握手, 是压缩之后, TLS 加密之前的数据; 一个请求或者响应 (包括控制消息) 算作一帧
+type ConnStats struct {
+	BytesRead     uint64
+	BytesWritten  uint64
+	FramesRead    uint64
+	FramesWritten uint64
+}
+
+// ClientStats 客户端的统计, 见 Client.Stats
+// 除了 ConnStats 之外的计数从客户端创建时开始累计, 不会因为重连而清零, 调用方可以定期读取并计算差值
+type ClientStats struct {
+	ConnStats            // 当前链接读写的字节数和帧数, 重连之后从 0 开始
+	Pending       int    // 已经发出但还没有完成的请求数
+	CallsSent     uint64 // 写入链接的请求数, 不包括单向请求和控制消息
+	CallsReceived uint64 // 收到的响应数, 包括已经超时或者被取消的请求的响应
+	Notifications uint64 // 写入链接的单向请求数, 见 Client.Notify
+	Reconnects    uint64 // 链接断开之后重连成功的次数, 见 Option.Reconnect
+}
+
+// clientCounters 客户端的累计计数器, 只使用原子操作
+type clientCounters struct {
+	callsSent     atomic.Uint64
+	callsReceived atomic.Uint64
+	notifications atomic.Uint64
+	reconnects    atomic.Uint64
+}
+
+// connCounters 链接的计数器, 只使用原子操作
+type connCounters struct {
+	bytesRead     atomic.Uint64
+	bytesWritten  atomic.Uint64
+	framesRead    atomic.Uint64
+	framesWritten atomic.Uint64
+}
+
+// snapshot 返回计数器当前的值
+func (c *connCounters) snapshot() ConnStats {
+	return ConnStats{
+		BytesRead:     c.bytesRead.Load(),
+		BytesWritten:  c.bytesWritten.Load(),
+		FramesRead:    c.framesRead.Load(),
+		FramesWritten: c.framesWritten.Load(),
+	}
+}
+
+// countingConn 统计读写字节数的链接, 读写的数据原样交给底层链接
+type countingConn struct {
+	io.ReadWriteCloser
+	counters *connCounters
+}
+
+func (c *countingConn) Read(p []byte) (int, error) {
+	n, err := c.ReadWriteCloser.Read(p)
+	c.counters.bytesRead.Add(uint64(n))
+	return n, err
+}
+
+func (c *countingConn) Write(p []byte) (int, error) {
+	n, err := c.ReadWriteCloser.Write(p)
+	c.counters.bytesWritten.Add(uint64(n))
+	return n, err
+}
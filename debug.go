@@ -2,14 +2,18 @@ package minirpc
 
 import (
 	"fmt"
+	"html/template"
 	"net/http"
-	"text/template"
+	"sort"
 )
 
-const debugTest = `<html>
+// debugText 调试页面的模板, 列出链接数, 所有注册的服务, 方法的参数和返回值类型以及调用次数
+// html/template 会转义类型名称, 方法按名称排序 (template 遍历 map 时按键排序)
+const debugText = `<html>
 <body>
-<title>GeeRPC Services</title>
-{{range .}}
+<title>MiniRPC Services</title>
+Connections: {{.ActiveConns}} active, {{.RejectedConns}} rejected
+{{range .Services}}
 <hr>
 Service {{.Name}}
 <hr>
@@ -26,7 +30,7 @@ Service {{.Name}}
 </body>
 </html>`
 
-var debug = template.Must(template.New("RPC debug").Parse(debugTest))
+var debug = template.Must(template.New("RPC debug").Parse(debugText))
 
 type debugHTTP struct {
 	*Server
@@ -47,8 +51,44 @@ func (server debugHTTP) ServeHTTP(w http.ResponseWriter, req *http.Request) {
 		})
 		return true
 	})
-	err := debug.Execute(w, services)
+	// sync.Map 的遍历顺序是随机的, 按服务名排序之后每次刷新的页面保持一致
+	sort.Slice(services, func(i, j int) bool { return services[i].Name < services[j].Name })
+	err := debug.Execute(w, struct {
+		ActiveConns   int
+		RejectedConns uint64
+		Services      []debugService
+	}{server.ActiveConnections(), server.RejectedConnections(), services})
 	if err != nil {
 		_, _ = fmt.Fprintln(w, "rpc: error executing template:", err.Error())
 	}
 }
+
+// ServiceInfo 一个注册的服务, 见 Server.Services
+type ServiceInfo struct {
+	Name    string
+	Methods []MethodInfo
+}
+
+// MethodInfo 服务的一个方法和它的参数, 返回值类型
+type MethodInfo struct {
+	Name      string
+	ArgType   string
+	ReplyType string
+}
+
+// Services 返回所有注册的服务和方法, 按名称排序
+func (server *Server) Services() []ServiceInfo {
+	var services []ServiceInfo
+	server.serviceMap.Range(func(namei, svci interface{}) bool {
+		svc := svci.(*service)
+		info := ServiceInfo{Name: namei.(string)}
+		for name, m := range svc.method {
+			info.Methods = append(info.Methods, MethodInfo{Name: name, ArgType: m.ArgType.String(), ReplyType: m.ReplyType.String()})
+		}
+		sort.Slice(info.Methods, func(i, j int) bool { return info.Methods[i].Name < info.Methods[j].Name })
+		services = append(services, info)
+		return true
+	})
+	sort.Slice(services, func(i, j int) bool { return services[i].Name < services[j].Name })
+	return services
+}
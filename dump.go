@@ -0,0 +1,115 @@
+package minirpc
+
+import (
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strings"
+	"sync"
+
+	"github.com/fanyeke/minirpc/codec"
+)
+
+// WireDump 把链接上传输的数据写到 Writer, 用于排查编解码错位之类的问题, 不需要再抓包手动解码
+// 同一个 WireDump 可以被多个链接共用, 每条记录完整地写入, 不会与其他记录交错
+type WireDump struct {
+	Writer  io.Writer // 为空时使用 os.Stderr
+	Hex     bool      // 以 hexdump 的格式输出读写的原始字节, 是压缩之后, TLS 加密之前的数据
+	Headers bool      // 输出每一帧解码之后的 `Header` 摘要, Hex 和 Headers 都为 false 时也会输出
+	mu      sync.Mutex
+}
+
+// wireDumper 一个链接的 WireDump, 为 nil 时不输出
+type wireDumper struct {
+	cfg    *WireDump
+	prefix string // 记录的前缀, 包括客户端还是服务端以及对端的地址
+}
+
+// newWireDumper 返回链接 conn 的 wireDumper, cfg 为空时返回 nil
+func newWireDumper(cfg *WireDump, side string, conn io.ReadWriteCloser) *wireDumper {
+	if cfg == nil {
+		return nil
+	}
+	addr := "unknown"
+	if nc, ok := conn.(net.Conn); ok && nc.RemoteAddr() != nil {
+		addr = nc.RemoteAddr().String()
+	}
+	return &wireDumper{cfg: cfg, prefix: "rpc " + side + " " + addr}
+}
+
+// wrap 开启了 Hex 时返回输出原始字节的链接
+func (d *wireDumper) wrap(rwc io.ReadWriteCloser) io.ReadWriteCloser {
+	if d == nil || !d.cfg.Hex {
+		return rwc
+	}
+	return &dumpConn{ReadWriteCloser: rwc, d: d}
+}
+
+// write 在锁的保护下写入一条记录
+func (d *wireDumper) write(record string) {
+	d.cfg.mu.Lock()
+	defer d.cfg.mu.Unlock()
+	var w io.Writer = os.Stderr
+	if d.cfg.Writer != nil {
+		w = d.cfg.Writer
+	}
+	_, _ = io.WriteString(w, record)
+}
+
+// header 输出一帧的 `Header` 摘要, dir 为 "->" 表示写入, "<-" 表示读到
+func (d *wireDumper) header(dir string, h *codec.Header) {
+	if d == nil || (d.cfg.Hex && !d.cfg.Headers) {
+		return
+	}
+	var b strings.Builder
+	fmt.Fprintf(&b, "%s %s seq=%d method=%s", d.prefix, dir, h.Seq, h.ServiceMethod)
+	if h.ContentType != "" {
+		fmt.Fprintf(&b, " content_type=%s", h.ContentType)
+	}
+	if h.Timeout != 0 {
+		fmt.Fprintf(&b, " timeout=%s", h.Timeout)
+	}
+	if h.Expires != 0 {
+		fmt.Fprintf(&b, " expires=%d", h.Expires)
+	}
+	if len(h.Metadata) != 0 {
+		fmt.Fprintf(&b, " metadata=%v", h.Metadata)
+	}
+	if h.Error != "" {
+		fmt.Fprintf(&b, " code=%s error=%q", Code(h.ErrorCode), h.Error)
+	}
+	b.WriteByte('\n')
+	d.write(b.String())
+}
+
+// readError 输出读取 `Header` 失败的原因, 数据流错位时通常从这里开始
+func (d *wireDumper) readError(err error) {
+	if d == nil || err == io.EOF {
+		return
+	}
+	d.write(fmt.Sprintf("%s <- read header error: %v\n", d.prefix, err))
+}
+
+// dumpConn 以 hexdump 的格式输出读写的原始字节
+type dumpConn struct {
+	io.ReadWriteCloser
+	d *wireDumper
+}
+
+func (c *dumpConn) Read(p []byte) (int, error) {
+	n, err := c.ReadWriteCloser.Read(p)
+	if n > 0 {
+		c.d.write(fmt.Sprintf("%s <- %d bytes\n%s", c.d.prefix, n, hex.Dump(p[:n])))
+	}
+	return n, err
+}
+
+func (c *dumpConn) Write(p []byte) (int, error) {
+	n, err := c.ReadWriteCloser.Write(p)
+	if n > 0 {
+		c.d.write(fmt.Sprintf("%s -> %d bytes\n%s", c.d.prefix, n, hex.Dump(p[:n])))
+	}
+	return n, err
+}
@@ -0,0 +1,262 @@
+package minirpc
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"reflect"
+	"sync"
+
+	"github.com/fanyeke/minirpc/codec"
+)
+
+// Code 随响应传输的错误码, 客户端可以据此区分错误的类别, 而不需要解析错误信息
+type Code uint32
+
+const (
+	CodeOK                Code = iota // 没有错误
+	CodeUnknown                       // 方法返回的普通错误, 或者服务端没有提供错误码
+	CodeNotFound                      // 找不到服务或方法
+	CodeInvalidArgument               // 请求无法解码, 或者格式不正确
+	CodeDeadlineExceeded              // 请求处理超时
+	CodeCanceled                      // 请求被取消
+	CodeResourceExhausted             // 服务端繁忙, 或者消息超过大小限制
+	CodeUnavailable                   // 服务端正在关闭
+	CodeInternal                      // 服务端内部错误, 比如响应无法编码
+)
+
+var codeNames = []string{
+	CodeOK:                "ok",
+	CodeUnknown:           "unknown",
+	CodeNotFound:          "not found",
+	CodeInvalidArgument:   "invalid argument",
+	CodeDeadlineExceeded:  "deadline exceeded",
+	CodeCanceled:          "canceled",
+	CodeResourceExhausted: "resource exhausted",
+	CodeUnavailable:       "unavailable",
+	CodeInternal:          "internal",
+}
+
+func (c Code) String() string {
+	if int(c) < len(codeNames) {
+		return codeNames[c]
+	}
+	return fmt.Sprintf("code(%d)", uint32(c))
+}
+
+// Error 带有错误码的错误, 方法可以直接返回它来指定错误码, 客户端收到的错误也是 *Error
+// errors.Is 比较错误码, 例如 errors.Is(err, minirpc.ErrNotFound)
+type Error struct {
+	Code    Code
+	Message string
+	// Details 机器可读的错误详情, 类型需要在通信双方通过 RegisterErrorDetails 注册,
+	// 失败的响应会把它编码到 `Body` 中, 客户端收到的值与注册时的类型相同
+	Details interface{}
+}
+
+// Errorf 创建一个带有错误码的错误
+func Errorf(code Code, format string, a ...interface{}) *Error {
+	return &Error{Code: code, Message: fmt.Sprintf(format, a...)}
+}
+
+func (e *Error) Error() string {
+	return e.Message
+}
+
+// Is 错误码相同的 *Error 认为是同一个错误
+func (e *Error) Is(target error) bool {
+	t, ok := target.(*Error)
+	return ok && t.Code == e.Code
+}
+
+// 每种错误码对应的哨兵错误, 用于 errors.Is
+var (
+	ErrNotFound          = &Error{Code: CodeNotFound, Message: "rpc: not found"}
+	ErrInvalidArgument   = &Error{Code: CodeInvalidArgument, Message: "rpc: invalid argument"}
+	ErrDeadlineExceeded  = &Error{Code: CodeDeadlineExceeded, Message: "rpc: deadline exceeded"}
+	ErrCanceled          = &Error{Code: CodeCanceled, Message: "rpc: canceled"}
+	ErrResourceExhausted = &Error{Code: CodeResourceExhausted, Message: "rpc: resource exhausted"}
+	ErrUnavailable       = &Error{Code: CodeUnavailable, Message: "rpc: unavailable"}
+	ErrInternal          = &Error{Code: CodeInternal, Message: "rpc: internal error"}
+)
+
+// errorDetailTypes 和 errorDetailNames 保存注册的错误详情类型
+var (
+	errorDetailMu    sync.RWMutex
+	errorDetailTypes = make(map[string]reflect.Type)
+	errorDetailNames = make(map[reflect.Type]string)
+)
+
+// RegisterErrorDetails 以 name 注册错误详情的类型, v 是这个类型的一个实例, 可以是结构体或者结构体指针
+// name 随响应传输, 用于在客户端创建相同类型的值, 通信双方需要使用相同的名称注册
+func RegisterErrorDetails(name string, v interface{}) error {
+	t := reflect.TypeOf(v)
+	if name == "" || t == nil {
+		return errors.New("rpc: error details need a name and a typed value")
+	}
+	errorDetailMu.Lock()
+	defer errorDetailMu.Unlock()
+	if old, ok := errorDetailTypes[name]; ok && old != t {
+		return fmt.Errorf("rpc: error details %q already registered as %s", name, old)
+	}
+	errorDetailTypes[name] = t
+	errorDetailNames[t] = name
+	return nil
+}
+
+// errorDetailsName 返回 details 的类型注册的名称
+func errorDetailsName(details interface{}) (string, bool) {
+	errorDetailMu.RLock()
+	defer errorDetailMu.RUnlock()
+	name, ok := errorDetailNames[reflect.TypeOf(details)]
+	return name, ok
+}
+
+// errorDetailsType 返回以 name 注册的类型
+func errorDetailsType(name string) (reflect.Type, bool) {
+	errorDetailMu.RLock()
+	defer errorDetailMu.RUnlock()
+	t, ok := errorDetailTypes[name]
+	return t, ok
+}
+
+// errorMapping 一条错误码的映射, target 不为空时按 errors.Is 匹配, 否则按 errors.As 匹配 typ 类型
+type errorMapping struct {
+	target error
+	typ    reflect.Type
+	code   Code
+}
+
+// RegisterErrorCode 方法返回的错误满足 errors.Is(err, target) 时, 客户端收到 code 错误码,
+// 比如把 sql.ErrNoRows 映射为 CodeNotFound, 方法不需要在每个返回路径上包装错误
+// 方法直接返回的 *Error 不受影响, 多个映射都满足时使用先注册的
+func (server *Server) RegisterErrorCode(target error, code Code) error {
+	if target == nil {
+		return errors.New("rpc server: error code target is nil")
+	}
+	return server.addErrorMapping(errorMapping{target: target, code: code})
+}
+
+// RegisterErrorType 方法返回的错误链中有与 example 类型相同的错误时, 客户端收到 code 错误码,
+// 比如 RegisterErrorType(&fs.PathError{}, CodeNotFound)
+func (server *Server) RegisterErrorType(example error, code Code) error {
+	if example == nil {
+		return errors.New("rpc server: error type example is nil")
+	}
+	return server.addErrorMapping(errorMapping{typ: reflect.TypeOf(example), code: code})
+}
+
+func (server *Server) addErrorMapping(m errorMapping) error {
+	server.mu.Lock()
+	defer server.mu.Unlock()
+	server.errorCodes = append(server.errorCodes, m)
+	return nil
+}
+
+// RegisterErrorCode 在默认的 `DefaultServer` 上注册错误码
+func RegisterErrorCode(target error, code Code) error {
+	return DefaultServer.RegisterErrorCode(target, code)
+}
+
+// RegisterErrorType 在默认的 `DefaultServer` 上注册错误类型的错误码
+func RegisterErrorType(example error, code Code) error {
+	return DefaultServer.RegisterErrorType(example, code)
+}
+
+// translateError 按注册的映射为方法返回的错误设置错误码, 错误信息不变
+func (server *Server) translateError(err error) error {
+	var rpcErr *Error
+	if errors.As(err, &rpcErr) {
+		return err
+	}
+	server.mu.Lock()
+	mappings := server.errorCodes
+	server.mu.Unlock()
+	for _, m := range mappings {
+		matched := false
+		if m.target != nil {
+			matched = errors.Is(err, m.target)
+		} else {
+			matched = errors.As(err, reflect.New(m.typ).Interface())
+		}
+		if matched {
+			return &Error{Code: m.code, Message: err.Error()}
+		}
+	}
+	return err
+}
+
+// codeOf 推断 err 的错误码
+func codeOf(err error) Code {
+	var rpcErr *Error
+	var tooLarge *codec.MessageTooLargeError
+	var decodeErr *codec.DecodeError
+	var encodeErr *codec.EncodeError
+	switch {
+	case errors.As(err, &rpcErr):
+		return rpcErr.Code
+	case errors.Is(err, context.DeadlineExceeded):
+		return CodeDeadlineExceeded
+	case errors.Is(err, context.Canceled):
+		return CodeCanceled
+	case errors.As(err, &tooLarge):
+		return CodeResourceExhausted
+	case errors.As(err, &decodeErr):
+		return CodeInvalidArgument
+	case errors.As(err, &encodeErr):
+		return CodeInternal
+	default:
+		return CodeUnknown
+	}
+}
+
+// setError 把 err 和它的错误码写入响应的 `Header`
+func setError(h *codec.Header, err error) {
+	h.Error = err.Error()
+	h.ErrorCode = uint32(codeOf(err))
+}
+
+// errorBody 设置 err 并返回错误响应的 `Body`, err 带有已经注册的详情时返回详情
+func (server *Server) errorBody(h *codec.Header, err error) interface{} {
+	setError(h, err)
+	var rpcErr *Error
+	if !errors.As(err, &rpcErr) || rpcErr.Details == nil {
+		return invalidRequest
+	}
+	name, ok := errorDetailsName(rpcErr.Details)
+	if !ok {
+		server.Logger.sampledf(slog.LevelError, "rpc server: error details %T is not registered", rpcErr.Details)
+		return invalidRequest
+	}
+	h.ErrorDetails = name
+	return rpcErr.Details
+}
+
+// responseError 把响应中的错误还原为 *Error, 旧版本的服务端没有错误码, 认为是 CodeUnknown
+func responseError(h *codec.Header) *Error {
+	code := Code(h.ErrorCode)
+	if code == CodeOK {
+		code = CodeUnknown
+	}
+	return &Error{Code: code, Message: h.Error}
+}
+
+// readErrorDetails 读取错误响应的 `Body`, 其中有已经注册的详情时写入 rpcErr.Details
+// 详情无法解码时忽略, 只返回破坏了链接的错误
+func readErrorDetails(cc codec.Codec, h *codec.Header, rpcErr *Error) error {
+	t, ok := errorDetailsType(h.ErrorDetails)
+	if !ok {
+		return cc.ReadBody(nil)
+	}
+	v := reflect.New(t)
+	if err := cc.ReadBody(v.Interface()); err != nil {
+		var decodeErr *codec.DecodeError
+		if errors.As(err, &decodeErr) {
+			return nil
+		}
+		return err
+	}
+	rpcErr.Details = v.Elem().Interface()
+	return nil
+}
@@ -0,0 +1,37 @@
+package minirpc
+
+import "expvar"
+
+// expvarMap expvar 中的 "minirpc" map, 每个发布的服务端是其中的一项
+var expvarMap = expvar.NewMap("minirpc")
+
+// PublishExpvar 在 expvar 的 "minirpc" map 中以 name 发布 server 的计数器, 可以从 /debug/vars 读取:
+// 链接数, 被拒绝的链接数, 请求总数, 错误总数, 正在处理和排队的请求数. 请求数和错误数是累计值, 速率由看板计算
+// 每次读取时才计算, 同一个 name 重复发布时覆盖之前的服务端
+func (server *Server) PublishExpvar(name string) {
+	expvarMap.Set(name, expvar.Func(func() interface{} {
+		return server.expvarSnapshot()
+	}))
+}
+
+// PublishExpvar 以 "default" 发布默认的 `DefaultServer`
+func PublishExpvar() {
+	DefaultServer.PublishExpvar("default")
+}
+
+// expvarSnapshot 返回 PublishExpvar 发布的计数器
+func (server *Server) expvarSnapshot() map[string]interface{} {
+	var requests, errs uint64
+	for _, s := range server.Stats() {
+		requests += s.Calls
+		errs += s.Errors
+	}
+	return map[string]interface{}{
+		"active_connections":   server.ActiveConnections(),
+		"rejected_connections": server.RejectedConnections(),
+		"requests":             requests,
+		"errors":               errs,
+		"active_requests":      server.ActiveRequests(),
+		"queued_requests":      server.QueuedRequests(),
+	}
+}
@@ -0,0 +1,73 @@
+package minirpc
+
+import (
+	"context"
+	"fmt"
+)
+
+// CallFuture 异步调用的结果, 由 Client.GoFuture 或者 Then 创建
+// 可以被多个 goroutine 同时等待, 不需要自己创建带缓冲的 Done 和 select
+type CallFuture struct {
+	done chan struct{} // 完成时关闭
+	call *Call
+	err  error
+}
+
+// complete 记录结果并唤醒所有等待的调用方, 只能调用一次
+func (f *CallFuture) complete(call *Call, err error) {
+	f.call, f.err = call, err
+	close(f.done)
+}
+
+// GoFuture 与 Go 相同地发出请求, 返回它的 CallFuture
+func (client *Client) GoFuture(serviceMethod string, args, reply interface{}, opts ...CallOption) *CallFuture {
+	call := client.Go(serviceMethod, args, reply, make(chan *Call, 1), opts...)
+	f := &CallFuture{done: make(chan struct{})}
+	go func() {
+		call := <-call.Done
+		f.complete(call, call.Error)
+	}()
+	return f
+}
+
+// Done 返回请求完成时关闭的 channel, 用于同时等待多个 CallFuture
+func (f *CallFuture) Done() <-chan struct{} {
+	return f.done
+}
+
+// Await 等待请求完成并返回它的错误, ctx 结束时返回 ctx 的错误
+// ctx 结束只是不再等待, 请求不会被取消, 之后仍然可以再次 Await
+func (f *CallFuture) Await(ctx context.Context) error {
+	select {
+	case <-f.done:
+		return f.err
+	case <-ctx.Done():
+		return fmt.Errorf("rpc client: await failed: %w", ctx.Err())
+	}
+}
+
+// Call 返回完成的请求, 可以从中读取 Reply 和 ReplyMetadata; 还没有完成时返回 nil
+func (f *CallFuture) Call() *Call {
+	select {
+	case <-f.done:
+		return f.call
+	default:
+		return nil
+	}
+}
+
+// Then 在请求成功之后以完成的请求调用 fn, 返回的 CallFuture 在 fn 返回之后完成, 结果是 fn 的错误
+// 请求失败时不调用 fn, 错误直接传递给返回的 CallFuture, 因此串联的多个 Then 只需要在最后检查一次错误
+// fn 在单独的 goroutine 中执行, 可以在其中同步地发起下一个请求
+func (f *CallFuture) Then(fn func(call *Call) error) *CallFuture {
+	next := &CallFuture{done: make(chan struct{})}
+	go func() {
+		<-f.done
+		if f.err != nil {
+			next.complete(f.call, f.err)
+			return
+		}
+		next.complete(f.call, fn(f.call))
+	}()
+	return next
+}
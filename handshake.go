@@ -0,0 +1,284 @@
+package minirpc
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"time"
+
+	"github.com/fanyeke/minirpc/codec"
+)
+
+// 协议版本号, 之后对传输格式的修改 (元数据, 流式传输, 取消等) 都通过提升版本号来兼容老的客户端
+const (
+	MinProtocolVersion     = 1 // 服务端支持的最低版本
+	CurrentProtocolVersion = 1 // 服务端支持的最高版本
+)
+
+// 握手阶段使用固定长度的二进制格式, 双方都按长度精确读取, 不会多读属于第一帧的数据
+// 所有整数都使用大端序, 其他语言的实现只需要按照下面的布局读写即可
+//
+// 客户端发送的前导 (preamble), 共 28 字节:
+// | magic (4) | version (1) | codec id (1) | compress id (1) | flags (1) |
+// | compress threshold (4) | max recv size (4) | max send size (4) | handle timeout ns (8) |
+//
+// 服务端的回复, 共 10 字节, 之后是 error length 字节的错误信息:
+// | status (1) | version (1) | compress id (1) | reserved (1) | compressors (4) | error length (2) |
+//
+// 不方便构造二进制数据的脚本也可以发送一行 JSON 编码的 `Option` 代替前导, 服务端同样回复一行 JSON
+// 二进制前导的第一个字节是魔数的最高字节 0x00, 文本握手的第一个字节是 '{', 两者不会混淆
+const (
+	preambleSize        = 28
+	replySize           = 10
+	maxTextPreambleSize = 4096
+	textPreambleStart   = '{'
+)
+
+// preamble 中 flags 的各个比特位
+const (
+	flagChecksum uint8 = 1 << iota // 每一帧都携带 CRC32 校验和
+)
+
+// 回复中的 status
+const (
+	statusOK    uint8 = iota // 握手成功
+	statusError              // 握手失败, 错误信息跟在回复之后
+)
+
+// handshakeReply 服务端对 `Option` 的回复, 携带协商之后的结果
+type handshakeReply struct {
+	ProtocolVersion int                // 双方都支持的最高版本
+	CompressType    codec.CompressType // 最终使用的压缩方式, 服务端不支持客户端要求的方式时为空
+	Compressors     uint32             // 服务端支持的所有压缩方式, 第 n 位对应编号为 n 的压缩方式
+	Error           string             // 握手失败的原因
+}
+
+// negotiate 检查客户端的 `Option`, 选择双方都支持的协议版本和压缩方式
+func negotiate(opt *Option) handshakeReply {
+	// 如果读取到的魔数与约定的不同, 说明对端不是 rpc 客户端
+	if opt.MagicNumber != MagicNumber {
+		return handshakeReply{Error: fmt.Sprintf("rpc server: bad magic number %x", opt.MagicNumber)}
+	}
+	// 如果没有注册对应的编解码函数
+	if codec.NewCodecFuncMap[opt.CodecType] == nil {
+		return handshakeReply{Error: "rpc server: unsupported codec type"}
+	}
+	if opt.ProtocolVersion < MinProtocolVersion {
+		return handshakeReply{
+			Error: fmt.Sprintf("rpc server: unsupported protocol version %d, expect at least %d", opt.ProtocolVersion, MinProtocolVersion),
+		}
+	}
+	reply := handshakeReply{ProtocolVersion: opt.ProtocolVersion}
+	if reply.ProtocolVersion > CurrentProtocolVersion {
+		reply.ProtocolVersion = CurrentProtocolVersion
+	}
+	for _, typ := range codec.CompressTypes() {
+		if id, ok := codec.CompressID(typ); ok && id < 32 {
+			reply.Compressors |= 1 << id
+		}
+	}
+	// 不支持的压缩方式退化为不压缩, 而不是直接拒绝链接
+	if _, ok := codec.GetCompressor(opt.CompressType); ok {
+		reply.CompressType = opt.CompressType
+	}
+	return reply
+}
+
+// writePreamble 把 `Option` 编码成固定长度的前导并写入链接
+// 客户端不认识的压缩方式按不压缩发送, 与服务端不支持时的处理一致
+func writePreamble(w io.Writer, opt *Option) error {
+	if opt.ProtocolVersion < 1 || opt.ProtocolVersion > math.MaxUint8 {
+		return fmt.Errorf("rpc client: invalid protocol version %d", opt.ProtocolVersion)
+	}
+	codecID, ok := codec.TypeID(opt.CodecType)
+	if !ok {
+		return fmt.Errorf("rpc client: invalid codec type %s", opt.CodecType)
+	}
+	compressID, _ := codec.CompressID(opt.CompressType)
+	var flags uint8
+	if opt.Checksum {
+		flags |= flagChecksum
+	}
+	var buf [preambleSize]byte
+	binary.BigEndian.PutUint32(buf[0:], uint32(opt.MagicNumber))
+	buf[4] = uint8(opt.ProtocolVersion)
+	buf[5] = codecID
+	buf[6] = compressID
+	buf[7] = flags
+	binary.BigEndian.PutUint32(buf[8:], clampUint32(opt.CompressThreshold))
+	binary.BigEndian.PutUint32(buf[12:], clampUint32(msgLimit(opt.MaxRecvMsgSize)))
+	binary.BigEndian.PutUint32(buf[16:], clampUint32(msgLimit(opt.MaxSendMsgSize)))
+	binary.BigEndian.PutUint64(buf[20:], uint64(opt.HandleTimeout))
+	_, err := w.Write(buf[:])
+	return err
+}
+
+// readPreamble 精确读取客户端的前导, 还原成 `Option`
+// 编号无法识别的编解码方式还原为空, 由 negotiate 拒绝
+func readPreamble(r io.Reader) (*Option, error) {
+	var buf [preambleSize]byte
+	if _, err := io.ReadFull(r, buf[:]); err != nil {
+		return nil, err
+	}
+	codecType, _ := codec.TypeByID(buf[5])
+	compressType, _ := codec.CompressTypeByID(buf[6])
+	return &Option{
+		MagicNumber:       int(binary.BigEndian.Uint32(buf[0:])),
+		ProtocolVersion:   int(buf[4]),
+		CodecType:         codecType,
+		CompressType:      compressType,
+		Checksum:          buf[7]&flagChecksum != 0,
+		CompressThreshold: int(binary.BigEndian.Uint32(buf[8:])),
+		MaxRecvMsgSize:    int(binary.BigEndian.Uint32(buf[12:])),
+		MaxSendMsgSize:    int(binary.BigEndian.Uint32(buf[16:])),
+		HandleTimeout:     time.Duration(binary.BigEndian.Uint64(buf[20:])),
+	}, nil
+}
+
+// readHandshake 读取客户端的握手, 返回 `Option` 以及客户端是否使用了文本握手
+func readHandshake(r io.Reader) (*Option, bool, error) {
+	var first [1]byte
+	if _, err := io.ReadFull(r, first[:]); err != nil {
+		return nil, false, err
+	}
+	if first[0] != textPreambleStart {
+		opt, err := readPreamble(io.MultiReader(bytes.NewReader(first[:]), r))
+		return opt, false, err
+	}
+	opt, err := readTextPreamble(r)
+	return opt, true, err
+}
+
+// readTextPreamble 逐字节读取一行 JSON 编码的 `Option`, 不会读到这一行之后的数据
+// 没有声明的字段使用文本客户端的默认值: 当前的协议版本和按行传输的 JSON 编解码
+func readTextPreamble(r io.Reader) (*Option, error) {
+	line := []byte{textPreambleStart}
+	var b [1]byte
+	for {
+		if _, err := io.ReadFull(r, b[:]); err != nil {
+			return nil, err
+		}
+		if b[0] == '\n' {
+			break
+		}
+		if len(line) >= maxTextPreambleSize {
+			return nil, errors.New("rpc server: text handshake too long")
+		}
+		line = append(line, b[0])
+	}
+	opt := &Option{ProtocolVersion: CurrentProtocolVersion, CodecType: codec.NDJSONType}
+	if err := json.Unmarshal(line, opt); err != nil {
+		return nil, err
+	}
+	return opt, nil
+}
+
+// writeHandshakeReply 写入握手的回复, text 为 true 时回复一行 JSON
+func writeHandshakeReply(w io.Writer, reply handshakeReply, text bool) error {
+	if text {
+		data, err := json.Marshal(reply)
+		if err != nil {
+			return err
+		}
+		_, err = w.Write(append(data, '\n'))
+		return err
+	}
+	msg := reply.Error
+	if len(msg) > math.MaxUint16 {
+		msg = msg[:math.MaxUint16]
+	}
+	buf := make([]byte, replySize, replySize+len(msg))
+	if msg != "" {
+		buf[0] = statusError
+	}
+	buf[1] = uint8(reply.ProtocolVersion)
+	buf[2], _ = codec.CompressID(reply.CompressType)
+	binary.BigEndian.PutUint32(buf[4:], reply.Compressors)
+	binary.BigEndian.PutUint16(buf[8:], uint16(len(msg)))
+	_, err := w.Write(append(buf, msg...))
+	return err
+}
+
+// readHandshakeReply 读取握手的结果, 返回协商之后的 `Option` 副本
+func readHandshakeReply(r io.Reader, opt *Option) (*Option, error) {
+	var buf [replySize]byte
+	if _, err := io.ReadFull(r, buf[:]); err != nil {
+		return nil, err
+	}
+	// 握手失败时服务端会写回原因, 然后关闭链接
+	if buf[0] != statusOK {
+		msg := make([]byte, binary.BigEndian.Uint16(buf[8:]))
+		if _, err := io.ReadFull(r, msg); err != nil {
+			return nil, err
+		}
+		return nil, errors.New(string(msg))
+	}
+	version := int(buf[1])
+	if version < MinProtocolVersion || version > opt.ProtocolVersion {
+		return nil, fmt.Errorf("rpc client: server chose unsupported protocol version %d", version)
+	}
+	compressType, ok := codec.CompressTypeByID(buf[2])
+	if !ok || (compressType != codec.NoneCompress && compressType != opt.CompressType) {
+		return nil, fmt.Errorf("rpc client: server chose unexpected compress id %d", buf[2])
+	}
+	negotiated := *opt
+	negotiated.ProtocolVersion = version
+	negotiated.CompressType = compressType
+	return &negotiated, nil
+}
+
+// clampUint32 把非负的 int 限制在 uint32 的范围内, 负数按 0 处理
+func clampUint32(n int) uint32 {
+	if n < 0 {
+		return 0
+	}
+	if uint64(n) > math.MaxUint32 {
+		return math.MaxUint32
+	}
+	return uint32(n)
+}
+
+// configureCodec 根据协商之后的 `Option` 配置编解码器的帧层, maxRecv 和 maxSend 是本端的消息大小限制
+// 自定义的编解码器如果不支持帧层配置, 就不能开启需要双方配合的选项
+func configureCodec(cc codec.Codec, opt *Option, maxRecv, maxSend int) error {
+	compressor, _ := codec.GetCompressor(opt.CompressType)
+	fopt := codec.FrameOption{
+		Checksum:          opt.Checksum,
+		Compressor:        compressor,
+		CompressThreshold: opt.CompressThreshold,
+		MaxRecvSize:       maxRecv,
+		MaxSendSize:       maxSend,
+	}
+	fc, ok := cc.(codec.FrameConfigurer)
+	if !ok {
+		if fopt.Checksum || fopt.Compressor != nil {
+			return fmt.Errorf("rpc: codec %s does not support frame options", opt.CodecType)
+		}
+		return nil
+	}
+	fc.SetFrameOption(fopt)
+	return nil
+}
+
+// msgLimit 把 MaxRecvMsgSize 和 MaxSendMsgSize 的设置转换为实际的限制, 0 表示不限制
+func msgLimit(n int) int {
+	if n == 0 {
+		return DefaultMaxMsgSize
+	}
+	if n < 0 {
+		return 0
+	}
+	return n
+}
+
+// minLimit 返回两个大小限制中更严格的一个, 0 表示不限制
+func minLimit(a, b int) int {
+	if a == 0 || (b != 0 && b < a) {
+		return b
+	}
+	return a
+}
@@ -0,0 +1,65 @@
+package minirpc
+
+import (
+	"context"
+
+	"github.com/fanyeke/minirpc/codec"
+)
+
+// CallInfo 拦截器看到的请求信息
+type CallInfo struct {
+	ServiceMethod string
+	CodecType     codec.Type // 链接的编解码方式
+	Addr          string     // 对端地址, 客户端是服务端的地址, 服务端是客户端的地址, 未知时为空
+	Attempt       int        // 客户端第几次重试这个请求, 0 表示第一次, 见 NewAttemptContext
+	Seq           uint64     // 服务端收到的请求编号, 客户端为 0
+	RequestBytes  int        // 服务端收到的请求 `Body` 的字节数, 客户端或者编解码器不支持时为 0
+}
+
+// Invoker 继续处理请求: 客户端发送请求并等待响应, 服务端调用方法
+type Invoker func(ctx context.Context) error
+
+// ClientInterceptor 包装 Client.Call, 通过 Option.Interceptors 或者 Client.Use 设置
+// 可以在请求前后加入逻辑, 比如创建 span, 记录指标, 通过 AppendToOutgoingContext 注入鉴权信息
+// 调用 invoke 继续处理请求, 传给 invoke 的 ctx 用于这次请求. GoCall 发出的请求不经过拦截器
+type ClientInterceptor func(ctx context.Context, info *CallInfo, args, reply interface{}, invoke Invoker) error
+
+// ServerInterceptor 包装方法的调用, argv 和 replyv 是方法的参数和返回值, invoke 返回之后 replyv 才有值
+// 方法返回的错误经过拦截器之后才发送给客户端
+type ServerInterceptor func(ctx context.Context, info *CallInfo, argv, replyv interface{}, invoke Invoker) error
+
+// interceptCall 依次经过 interceptors 之后调用 invoke, 第一个拦截器在最外层
+func interceptCall(ctx context.Context, interceptors []ClientInterceptor, info *CallInfo, args, reply interface{}, invoke Invoker) error {
+	for i := len(interceptors) - 1; i >= 0; i-- {
+		next, interceptor := invoke, interceptors[i]
+		invoke = func(ctx context.Context) error {
+			return interceptor(ctx, info, args, reply, next)
+		}
+	}
+	return invoke(ctx)
+}
+
+// interceptHandle 与 interceptCall 相同, 用于服务端
+func interceptHandle(ctx context.Context, interceptors []ServerInterceptor, info *CallInfo, argv, replyv interface{}, invoke Invoker) error {
+	for i := len(interceptors) - 1; i >= 0; i-- {
+		next, interceptor := invoke, interceptors[i]
+		invoke = func(ctx context.Context) error {
+			return interceptor(ctx, info, argv, replyv, next)
+		}
+	}
+	return invoke(ctx)
+}
+
+// attemptKey 是重试次数在 context 中的键
+type attemptKey struct{}
+
+// NewAttemptContext 返回记录了重试次数的 ctx, 重试请求的一方 (比如 XClient) 设置, 拦截器从 CallInfo.Attempt 读取
+func NewAttemptContext(ctx context.Context, attempt int) context.Context {
+	return context.WithValue(ctx, attemptKey{}, attempt)
+}
+
+// AttemptFromContext 返回 NewAttemptContext 设置的重试次数, 没有设置时返回 0
+func AttemptFromContext(ctx context.Context) int {
+	attempt, _ := ctx.Value(attemptKey{}).(int)
+	return attempt
+}
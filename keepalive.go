@@ -0,0 +1,104 @@
+package minirpc
+
+import (
+	"log/slog"
+	"time"
+
+	"github.com/fanyeke/minirpc/codec"
+)
+
+// pingMethod 客户端检测链接是否存活的控制消息, Seq 为 0, 服务端原样回复
+// 不认识它的旧版本服务端会回复找不到服务的错误, 同样说明链接是通的
+const pingMethod = "MiniRPC.Ping"
+
+// defaultKeepaliveTimeout KeepaliveParams.Timeout 为 0 时等待回复的时间
+const defaultKeepaliveTimeout = 20 * time.Second
+
+// KeepaliveParams 客户端的保活设置, 见 Option.Keepalive
+// 链接空闲超过 Interval 时发送 ping, 让 NAT 和负载均衡不会因为空闲而断开链接;
+// Timeout 之内没有收到任何数据则认为服务端已经不可用, 关闭链接, 已经发出的请求返回 ErrKeepaliveTimeout
+type KeepaliveParams struct {
+	Interval time.Duration // 发送 ping 的间隔, 小于等于 0 时不发送
+	Timeout  time.Duration // 等待回复的时间, 0 表示 20s
+}
+
+// ErrKeepaliveTimeout 没有按时收到 ping 的回复, 链接被关闭时请求返回的错误
+var ErrKeepaliveTimeout = &Error{Code: CodeUnavailable, Message: "rpc client: keepalive timeout"}
+
+// keepalive 定期检查链接, 直到客户端关闭; 设置了 Option.Reconnect 时重连之后继续检查新的链接
+func (client *Client) keepalive(p *KeepaliveParams) {
+	timeout := p.Timeout
+	if timeout <= 0 {
+		timeout = defaultKeepaliveTimeout
+	}
+	ticker := time.NewTicker(p.Interval)
+	defer ticker.Stop()
+	var pingAt time.Time // 还没有收到回复的 ping 的发送时间
+	for {
+		select {
+		case <-ticker.C:
+		case <-client.closed:
+			return
+		}
+		lastRead := time.Unix(0, client.lastRead.Load())
+		if !pingAt.IsZero() {
+			if !lastRead.Before(pingAt) {
+				pingAt = time.Time{}
+			} else if time.Since(pingAt) >= timeout {
+				client.opt.Logger.logf(slog.LevelWarn, "rpc client: no response from %s within %s, closing connection", client.addr, timeout)
+				client.dropConn()
+				pingAt = time.Time{}
+				continue
+			} else {
+				continue
+			}
+		}
+		// 最近收到过数据, 链接是通的
+		if time.Since(lastRead) < p.Interval {
+			continue
+		}
+		now := time.Now()
+		if client.sendPing() {
+			pingAt = now
+		} else if client.terminated() {
+			return
+		}
+	}
+}
+
+// sendPing 发送 ping, 链接不可用时返回 false
+func (client *Client) sendPing() bool {
+	client.lockSending()
+	defer client.unlockSending()
+	client.mu.Lock()
+	usable := !client.closing && !client.shutdown && !client.reconnecting
+	client.mu.Unlock()
+	if !usable {
+		return false
+	}
+	h := &codec.Header{ServiceMethod: pingMethod}
+	if err := client.cc.Write(h, invalidRequest); err != nil {
+		return false
+	}
+	client.counters.framesWritten.Add(1)
+	client.dump.header("->", h)
+	return true
+}
+
+// terminated 返回客户端是否已经不可能再使用
+func (client *Client) terminated() bool {
+	client.mu.Lock()
+	defer client.mu.Unlock()
+	return client.closing || client.shutdown
+}
+
+// dropConn 关闭没有响应的链接, receive 随之结束已经发出的请求, 设置了 Option.Reconnect 时开始重连
+func (client *Client) dropConn() {
+	client.mu.Lock()
+	defer client.mu.Unlock()
+	if client.closing || client.shutdown || client.reconnecting {
+		return
+	}
+	client.keepaliveExpired.Store(true)
+	_ = client.cc.Close()
+}
@@ -0,0 +1,83 @@
+package minirpc
+
+import (
+	"fmt"
+	"log"
+	"log/slog"
+	"sync"
+	"time"
+)
+
+// Logger 服务端和客户端输出日志的方式, 见 Server.Logger 和 Option.Logger
+// 为 nil 时使用 log 包默认的 Logger, 输出 Info 及以上级别的日志, 不进行采样
+// 同一个 Logger 可以被多个服务端和客户端共用, 采样的计数也是共用的
+type Logger struct {
+	// Level 低于这个级别的日志不输出, 零值为 slog.LevelInfo; 注册服务等启动时的信息是 Debug 级别
+	Level slog.Level
+	// Output 输出日志的 Logger, 为空时使用 log 包默认的 Logger
+	Output *log.Logger
+	// SampleInitial 大于 0 时对高频的日志 (每个请求的错误, 读写链接的错误, 慢请求) 进行采样:
+	// 同一种日志每秒输出前 SampleInitial 条, 之后每 SampleThereafter 条输出一条, SampleThereafter 为 0 时全部丢弃
+	SampleInitial    int
+	SampleThereafter int
+
+	mu     sync.Mutex
+	counts map[string]*sampleCount // 按格式字符串区分日志的种类
+}
+
+// sampleCount 一种日志在当前这一秒内的条数
+type sampleCount struct {
+	start time.Time
+	n     int
+}
+
+// enabled 返回 level 级别的日志是否需要输出
+func (l *Logger) enabled(level slog.Level) bool {
+	if l == nil {
+		return level >= slog.LevelInfo
+	}
+	return level >= l.Level
+}
+
+// logf 输出一条日志
+func (l *Logger) logf(level slog.Level, format string, v ...interface{}) {
+	if !l.enabled(level) {
+		return
+	}
+	if l == nil || l.Output == nil {
+		_ = log.Output(2, fmt.Sprintf(format, v...))
+		return
+	}
+	_ = l.Output.Output(2, fmt.Sprintf(format, v...))
+}
+
+// sampledf 输出一条高频的日志, 按 format 区分种类进行采样
+func (l *Logger) sampledf(level slog.Level, format string, v ...interface{}) {
+	if !l.enabled(level) || !l.sample(format) {
+		return
+	}
+	l.logf(level, format, v...)
+}
+
+// sample 返回这一条日志是否需要输出
+func (l *Logger) sample(key string) bool {
+	if l == nil || l.SampleInitial <= 0 {
+		return true
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	now := time.Now()
+	c := l.counts[key]
+	if c == nil || now.Sub(c.start) >= time.Second {
+		if l.counts == nil {
+			l.counts = make(map[string]*sampleCount)
+		}
+		c = &sampleCount{start: now}
+		l.counts[key] = c
+	}
+	c.n++
+	if c.n <= l.SampleInitial {
+		return true
+	}
+	return l.SampleThereafter > 0 && (c.n-l.SampleInitial)%l.SampleThereafter == 0
+}
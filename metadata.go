@@ -0,0 +1,96 @@
+package minirpc
+
+import (
+	"context"
+	"errors"
+	"sync"
+)
+
+// outgoingMDKey 和 incomingMDKey 是元数据在 context 中的键
+type (
+	outgoingMDKey struct{}
+	incomingMDKey struct{}
+	trailerKey    struct{}
+)
+
+// NewOutgoingContext 返回携带 md 的 ctx, 使用它调用 Client.Call 时 md 随请求的 `Header` 发送
+// 适合传递认证信息, 语言, 租户 ID 等与参数无关的数据. md 会被复制, 之后修改它不影响 ctx
+func NewOutgoingContext(ctx context.Context, md map[string]string) context.Context {
+	return context.WithValue(ctx, outgoingMDKey{}, copyMetadata(md))
+}
+
+// AppendToOutgoingContext 在 ctx 已有的元数据上加入 md 并返回新的 ctx, 相同的键以 md 为准, 不修改原来的元数据
+// 拦截器可以用它注入链路追踪等信息
+func AppendToOutgoingContext(ctx context.Context, md map[string]string) context.Context {
+	old, _ := FromOutgoingContext(ctx)
+	merged := make(map[string]string, len(old)+len(md))
+	for k, v := range old {
+		merged[k] = v
+	}
+	for k, v := range md {
+		merged[k] = v
+	}
+	return context.WithValue(ctx, outgoingMDKey{}, merged)
+}
+
+// FromOutgoingContext 返回 NewOutgoingContext 设置的元数据
+func FromOutgoingContext(ctx context.Context) (map[string]string, bool) {
+	md, ok := ctx.Value(outgoingMDKey{}).(map[string]string)
+	return md, ok
+}
+
+// FromIncomingContext 在服务端的方法中返回客户端随请求发送的元数据, 方法需要接收 context.Context 参数
+// 请求没有携带元数据时返回 false, 返回的 map 属于这一次请求, 不要在方法返回后继续使用
+func FromIncomingContext(ctx context.Context) (map[string]string, bool) {
+	md, ok := ctx.Value(incomingMDKey{}).(map[string]string)
+	return md, ok
+}
+
+// trailer 方法在处理请求期间设置的响应元数据
+type trailer struct {
+	mu sync.Mutex
+	md map[string]string
+}
+
+// errNoTrailer ctx 不是服务端传给方法的 context
+var errNoTrailer = errors.New("rpc server: SetTrailer called outside of a handler")
+
+// SetTrailer 在服务端的方法中设置响应携带的元数据, 比如耗时, 服务端版本, 分页游标等, 多次调用时合并
+// 元数据随响应的 `Header` 发送, 不论方法是否返回错误, 客户端从完成的 Call.ReplyMetadata 中读取
+// 方法需要接收 context.Context 参数, 在方法返回之后调用没有效果
+func SetTrailer(ctx context.Context, md map[string]string) error {
+	tr, ok := ctx.Value(trailerKey{}).(*trailer)
+	if !ok {
+		return errNoTrailer
+	}
+	tr.mu.Lock()
+	defer tr.mu.Unlock()
+	if tr.md == nil {
+		tr.md = make(map[string]string, len(md))
+	}
+	for k, v := range md {
+		tr.md[k] = v
+	}
+	return nil
+}
+
+// metadata 返回设置的元数据, 之后的 SetTrailer 不再影响返回值
+func (tr *trailer) metadata() map[string]string {
+	tr.mu.Lock()
+	defer tr.mu.Unlock()
+	md := tr.md
+	tr.md = nil
+	return md
+}
+
+// copyMetadata 复制 md, md 为空时返回 nil
+func copyMetadata(md map[string]string) map[string]string {
+	if len(md) == 0 {
+		return nil
+	}
+	out := make(map[string]string, len(md))
+	for k, v := range md {
+		out[k] = v
+	}
+	return out
+}
@@ -0,0 +1,219 @@
+// Package metrics 收集 minirpc 服务端和客户端的监控指标, 以 Prometheus 文本格式导出
+//
+// Collector 实现了 minirpc.RequestObserver, 记录每个 ServiceMethod 的请求数 (按错误码区分) 和耗时分布,
+// 再加上链接数, 未完成的请求数这样的瞬时值. Collector 本身是一个 http.Handler, 可以直接交给 Prometheus 抓取:
+//
+//	m := metrics.ForServer(server)
+//	http.Handle("/metrics", m)
+//
+// 客户端的 Observer 需要在建立链接之前设置:
+//
+//	m := metrics.NewCollector("client")
+//	client, _ := minirpc.Dial("tcp", addr, &minirpc.Option{Observer: m})
+//	m.AddGauge("pending_calls", "Calls waiting for a response.", func() float64 { return float64(client.NumPending()) })
+package metrics
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/fanyeke/minirpc"
+)
+
+// DefaultBuckets 耗时直方图默认的桶, 单位是秒, 与 Prometheus 客户端的默认值相同
+var DefaultBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+// Collector 收集请求的监控指标, 所有方法都可以并发调用
+type Collector struct {
+	prefix  string
+	buckets []float64
+
+	mu      sync.Mutex
+	methods map[string]*methodMetrics
+	gauges  []gauge
+}
+
+// methodMetrics 一个 ServiceMethod 的指标
+type methodMetrics struct {
+	codes  map[minirpc.Code]uint64 // 每种错误码的请求数
+	counts []uint64                // 每个桶的请求数, 不累加
+	count  uint64
+	sum    float64 // 耗时之和, 单位是秒
+}
+
+// gauge 导出时才读取的瞬时值
+type gauge struct {
+	name, help string
+	fn         func() float64
+}
+
+var _ minirpc.RequestObserver = (*Collector)(nil)
+
+// NewCollector 创建 Collector, 指标名称以 minirpc_<subsystem>_ 开头, 例如 minirpc_server_requests_total
+func NewCollector(subsystem string) *Collector {
+	return &Collector{
+		prefix:  "minirpc_" + subsystem + "_",
+		buckets: DefaultBuckets,
+		methods: make(map[string]*methodMetrics),
+	}
+}
+
+// ForServer 创建 Collector 并设置为 server 的 Observer, 同时导出正在服务的链接数和被拒绝的链接数
+func ForServer(server *minirpc.Server) *Collector {
+	c := NewCollector("server")
+	server.Observer = c
+	c.AddGauge("active_connections", "Connections currently being served.", func() float64 {
+		return float64(server.ActiveConnections())
+	})
+	c.AddGauge("rejected_connections", "Connections rejected because of MaxConnections.", func() float64 {
+		return float64(server.RejectedConnections())
+	})
+	return c
+}
+
+// SetBuckets 设置耗时直方图的桶, 单位是秒, 已经记录的请求会被清空
+func (c *Collector) SetBuckets(buckets []float64) {
+	b := append([]float64(nil), buckets...)
+	sort.Float64s(b)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.buckets = b
+	c.methods = make(map[string]*methodMetrics)
+}
+
+// AddGauge 导出 fn 返回的瞬时值, 例如客户端未完成的请求数, name 不包含前缀
+func (c *Collector) AddGauge(name, help string, fn func() float64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.gauges = append(c.gauges, gauge{name: name, help: help, fn: fn})
+}
+
+// ObserveRequest 实现了 minirpc.RequestObserver
+func (c *Collector) ObserveRequest(serviceMethod string, code minirpc.Code, latency time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	m, ok := c.methods[serviceMethod]
+	if !ok {
+		m = &methodMetrics{codes: make(map[minirpc.Code]uint64), counts: make([]uint64, len(c.buckets))}
+		c.methods[serviceMethod] = m
+	}
+	m.codes[code]++
+	seconds := latency.Seconds()
+	if i := sort.SearchFloat64s(c.buckets, seconds); i < len(c.buckets) {
+		m.counts[i]++
+	}
+	m.count++
+	m.sum += seconds
+}
+
+// WriteTo 以 Prometheus 文本格式写出所有指标
+func (c *Collector) WriteTo(w io.Writer) (int64, error) {
+	c.mu.Lock()
+	gauges := append([]gauge(nil), c.gauges...)
+	c.mu.Unlock()
+	// 瞬时值可能需要加锁读取, 不能在持有 c.mu 时调用
+	values := make([]float64, len(gauges))
+	for i, g := range gauges {
+		values[i] = g.fn()
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	cw := &countingWriter{w: bufio.NewWriter(w)}
+	names := make([]string, 0, len(c.methods))
+	for name := range c.methods {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	requests := c.prefix + "requests_total"
+	fmt.Fprintf(cw, "# HELP %s Requests completed, by method and code.\n# TYPE %s counter\n", requests, requests)
+	for _, name := range names {
+		m := c.methods[name]
+		codes := make([]minirpc.Code, 0, len(m.codes))
+		for code := range m.codes {
+			codes = append(codes, code)
+		}
+		sort.Slice(codes, func(i, j int) bool { return codes[i] < codes[j] })
+		for _, code := range codes {
+			fmt.Fprintf(cw, "%s{method=%s,code=%s} %d\n", requests, quote(name), quote(code.String()), m.codes[code])
+		}
+	}
+
+	errs := c.prefix + "errors_total"
+	fmt.Fprintf(cw, "# HELP %s Requests completed with an error, by method.\n# TYPE %s counter\n", errs, errs)
+	for _, name := range names {
+		m := c.methods[name]
+		fmt.Fprintf(cw, "%s{method=%s} %d\n", errs, quote(name), m.count-m.codes[minirpc.CodeOK])
+	}
+
+	duration := c.prefix + "request_duration_seconds"
+	fmt.Fprintf(cw, "# HELP %s Request latency, by method.\n# TYPE %s histogram\n", duration, duration)
+	for _, name := range names {
+		m := c.methods[name]
+		var cumulative uint64
+		for i, le := range c.buckets {
+			cumulative += m.counts[i]
+			fmt.Fprintf(cw, "%s_bucket{method=%s,le=%s} %d\n", duration, quote(name), quote(formatFloat(le)), cumulative)
+		}
+		fmt.Fprintf(cw, "%s_bucket{method=%s,le=\"+Inf\"} %d\n", duration, quote(name), m.count)
+		fmt.Fprintf(cw, "%s_sum{method=%s} %s\n", duration, quote(name), formatFloat(m.sum))
+		fmt.Fprintf(cw, "%s_count{method=%s} %d\n", duration, quote(name), m.count)
+	}
+
+	for i, g := range gauges {
+		name := c.prefix + g.name
+		fmt.Fprintf(cw, "# HELP %s %s\n# TYPE %s gauge\n%s %s\n", name, g.help, name, name, formatFloat(values[i]))
+	}
+	if cw.err == nil {
+		cw.err = cw.w.Flush()
+	}
+	return cw.n, cw.err
+}
+
+// ServeHTTP 实现了 http.Handler, 返回 Prometheus 文本格式的指标
+func (c *Collector) ServeHTTP(w http.ResponseWriter, _ *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	_, _ = c.WriteTo(w)
+}
+
+// quote 按 Prometheus 文本格式转义标签的值
+func quote(s string) string {
+	r := strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+	return `"` + r.Replace(s) + `"`
+}
+
+func formatFloat(f float64) string {
+	switch {
+	case math.IsInf(f, 1):
+		return "+Inf"
+	case math.IsInf(f, -1):
+		return "-Inf"
+	}
+	return strconv.FormatFloat(f, 'g', -1, 64)
+}
+
+// countingWriter 记录写出的字节数和第一个错误
+type countingWriter struct {
+	w   *bufio.Writer
+	n   int64
+	err error
+}
+
+func (cw *countingWriter) Write(p []byte) (int, error) {
+	if cw.err != nil {
+		return 0, cw.err
+	}
+	n, err := cw.w.Write(p)
+	cw.n += int64(n)
+	cw.err = err
+	return n, err
+}
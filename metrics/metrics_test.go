@@ -0,0 +1,85 @@
+package metrics
+
+import (
+	"context"
+	"errors"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/fanyeke/minirpc"
+)
+
+type Arith int
+
+func (a Arith) Double(n int, reply *int) error {
+	if n < 0 {
+		return minirpc.Errorf(minirpc.CodeInvalidArgument, "negative")
+	}
+	*reply = n * 2
+	return nil
+}
+
+func TestCollector(t *testing.T) {
+	var a Arith
+	server := minirpc.NewServer()
+	_ = server.Register(&a)
+	sm := ForServer(server)
+	cm := NewCollector("client")
+	cm.SetBuckets([]float64{1, 0.001})
+	client, err := server.NewPipeClient(&minirpc.Option{Observer: cm})
+	if err != nil {
+		t.Fatalf("failed to create pipe client: %v", err)
+	}
+	defer func() { _ = client.Close() }()
+	cm.AddGauge("pending_calls", "Calls waiting for a response.", func() float64 { return float64(client.NumPending()) })
+
+	var reply int
+	for _, n := range []int{1, 2, -1} {
+		_ = client.Call(context.Background(), "Arith.Double", n, &reply)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+	err = client.Call(ctx, "Arith.Missing", 1, &reply)
+	if !errors.Is(err, minirpc.ErrNotFound) {
+		t.Fatalf("expect not found, got %v", err)
+	}
+
+	rec := httptest.NewRecorder()
+	sm.ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+	serverOut := rec.Body.String()
+	for _, want := range []string{
+		`minirpc_server_requests_total{method="Arith.Double",code="ok"} 2`,
+		`minirpc_server_requests_total{method="Arith.Double",code="invalid argument"} 1`,
+		`minirpc_server_errors_total{method="Arith.Double"} 1`,
+		`minirpc_server_request_duration_seconds_bucket{method="Arith.Double",le="+Inf"} 3`,
+		`minirpc_server_request_duration_seconds_count{method="Arith.Double"} 3`,
+		"# TYPE minirpc_server_request_duration_seconds histogram",
+		"minirpc_server_active_connections 1",
+	} {
+		if !strings.Contains(serverOut, want) {
+			t.Errorf("server metrics missing %q:\n%s", want, serverOut)
+		}
+	}
+	// 找不到的方法不会在服务端记录
+	if strings.Contains(serverOut, "Arith.Missing") {
+		t.Errorf("server should not record unknown methods:\n%s", serverOut)
+	}
+
+	var sb strings.Builder
+	if _, err := cm.WriteTo(&sb); err != nil {
+		t.Fatalf("failed to write metrics: %v", err)
+	}
+	clientOut := sb.String()
+	for _, want := range []string{
+		`minirpc_client_requests_total{method="Arith.Missing",code="not found"} 1`,
+		`minirpc_client_request_duration_seconds_bucket{method="Arith.Double",le="0.001"}`,
+		`minirpc_client_request_duration_seconds_bucket{method="Arith.Double",le="1"} 3`,
+		"minirpc_client_pending_calls 0",
+	} {
+		if !strings.Contains(clientOut, want) {
+			t.Errorf("client metrics missing %q:\n%s", want, clientOut)
+		}
+	}
+}
@@ -0,0 +1,65 @@
+package minirpc
+
+import (
+	"fmt"
+	"strings"
+)
+
+// AddrError 一个实例上一次调用的错误, 见 MultiError
+type AddrError struct {
+	Addr    string // 为空时错误发生在选择实例的时候
+	Attempt int    // 重试的次数, 第一次调用是 0, 见 AttemptFromContext
+	Err     error
+}
+
+func (e *AddrError) Error() string {
+	if e.Addr == "" {
+		return e.Err.Error()
+	}
+	return e.Addr + ": " + e.Err.Error()
+}
+
+func (e *AddrError) Unwrap() error { return e.Err }
+
+// MultiError 多个实例或者多次尝试的错误, 按发生的顺序排列, 由 XClient 的广播和重试返回, 可以看到每个失败的实例
+// errors.Is 和 errors.As 依次检查每个错误, 例如任何一个实例返回 CodeUnavailable 时 errors.Is(err, ErrUnavailable) 为 true
+type MultiError struct {
+	Errors []*AddrError
+}
+
+func (e *MultiError) Error() string {
+	if len(e.Errors) == 1 {
+		return e.Errors[0].Error()
+	}
+	msgs := make([]string, len(e.Errors))
+	for i, err := range e.Errors {
+		msgs[i] = err.Error()
+	}
+	return fmt.Sprintf("rpc: %d calls failed: %s", len(e.Errors), strings.Join(msgs, "; "))
+}
+
+func (e *MultiError) Unwrap() []error {
+	errs := make([]error, len(e.Errors))
+	for i, err := range e.Errors {
+		errs[i] = err
+	}
+	return errs
+}
+
+// Add 记录 addr 上第 attempt 次调用的错误
+func (e *MultiError) Add(addr string, attempt int, err error) {
+	e.Errors = append(e.Errors, &AddrError{Addr: addr, Attempt: attempt, Err: err})
+}
+
+// Addrs 返回失败的实例, 同一个实例只出现一次
+func (e *MultiError) Addrs() []string {
+	var addrs []string
+	seen := make(map[string]bool)
+	for _, err := range e.Errors {
+		if !seen[err.Addr] {
+			seen[err.Addr] = true
+			addrs = append(addrs, err.Addr)
+		}
+	}
+	return addrs
+}
@@ -0,0 +1,341 @@
+// Package mux 在一条链接上复用多个逻辑流, 每个流都是一个 net.Conn, 有自己的流量控制
+// 一个流上很大的传输不会阻塞其他的流, 多个 minirpc 客户端可以共用一条 TCP 链接:
+//
+//	server.Accept(mux.Listen(lis, nil))
+//	client, err := minirpc.Dial("tcp", addr, &minirpc.Option{Transport: mux.NewDialer(nil)})
+package mux
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+)
+
+// 帧的类型
+const (
+	typeOpen   uint8 = iota // 打开一个流
+	typeData                // 流上的数据
+	typeWindow              // 增加对端的发送窗口, 长度字段是增加的字节数
+	typeClose               // 关闭一个流, 对端读完已经收到的数据之后返回 io.EOF
+)
+
+// headerSize 帧头的字节数: 类型 1 字节, 流 ID 4 字节, 长度 4 字节
+const headerSize = 9
+
+// initialWindow 每个流开始时的发送窗口, 接收窗口更大的一方在流建立之后通过 typeWindow 告诉对端
+const initialWindow = 256 << 10
+
+// maxPendingControl 等待发送的控制帧的数量上限, 对端一直不读取时关闭会话, 避免队列无限增长
+const maxPendingControl = 4096
+
+var (
+	// ErrSessionClosed 会话已经关闭
+	ErrSessionClosed = errors.New("mux: session closed")
+	// ErrStreamClosed 流已经被关闭
+	ErrStreamClosed = errors.New("mux: stream closed")
+)
+
+// Config 会话的设置, 通信双方可以不同
+type Config struct {
+	Window        int // 每个流的接收窗口, 对端最多发送这么多还没有被读取的数据, 小于 256KB 时为 256KB
+	MaxFrameSize  int // 一个数据帧的最大字节数, 大的写入被拆成多帧与其他流交替发送, 0 表示 16KB
+	AcceptBacklog int // 还没有被 Accept 的流的数量上限, 超过时新的流被关闭, 0 表示 256
+}
+
+func (c *Config) window() uint32 {
+	if c == nil || c.Window <= initialWindow {
+		return initialWindow
+	}
+	return uint32(c.Window)
+}
+
+func (c *Config) maxFrameSize() int {
+	if c == nil || c.MaxFrameSize <= 0 {
+		return 16 << 10
+	}
+	return c.MaxFrameSize
+}
+
+func (c *Config) acceptBacklog() int {
+	if c == nil || c.AcceptBacklog <= 0 {
+		return 256
+	}
+	return c.AcceptBacklog
+}
+
+// Session 一条链接上的多个流, 实现了 net.Listener, Accept 返回对端打开的流
+type Session struct {
+	conn   io.ReadWriteCloser
+	cfg    *Config
+	wmu    sync.Mutex // 保证每一帧完整地写入
+	mu     sync.Mutex
+	nextID uint32 // 客户端打开的流使用奇数, 服务端使用偶数
+	// streams 还没有被本端关闭的流
+	streams map[uint32]*Stream
+	accept  chan *Stream
+	// control 等待 sendLoop 发送的控制帧, recvLoop 不直接写链接, 双方同时写满链接时不会互相等待
+	control      [][]byte
+	controlReady chan struct{}
+	done         chan struct{} // 会话关闭时关闭
+	err          error         // 会话关闭的原因
+}
+
+var _ net.Listener = (*Session)(nil)
+
+// Client 返回 conn 客户端一侧的会话, cfg 可以为 nil
+func Client(conn io.ReadWriteCloser, cfg *Config) *Session {
+	return newSession(conn, cfg, 1)
+}
+
+// Server 返回 conn 服务端一侧的会话, cfg 可以为 nil
+func Server(conn io.ReadWriteCloser, cfg *Config) *Session {
+	return newSession(conn, cfg, 2)
+}
+
+func newSession(conn io.ReadWriteCloser, cfg *Config, firstID uint32) *Session {
+	s := &Session{
+		conn:         conn,
+		cfg:          cfg,
+		nextID:       firstID,
+		streams:      make(map[uint32]*Stream),
+		accept:       make(chan *Stream, cfg.acceptBacklog()),
+		controlReady: make(chan struct{}, 1),
+		done:         make(chan struct{}),
+	}
+	go s.recvLoop()
+	go s.sendLoop()
+	return s
+}
+
+// Open 打开一个新的流, 不需要等待对端确认, 写入的数据在对端 Accept 之前由接收窗口缓冲
+func (s *Session) Open() (*Stream, error) {
+	s.mu.Lock()
+	if s.err != nil {
+		s.mu.Unlock()
+		return nil, s.err
+	}
+	id := s.nextID
+	s.nextID += 2
+	st := newStream(s, id)
+	s.streams[id] = st
+	s.mu.Unlock()
+	if err := s.writeFrame(typeOpen, id, 0, nil); err != nil {
+		s.removeStream(id)
+		return nil, err
+	}
+	if err := st.advertiseWindow(); err != nil {
+		return nil, err
+	}
+	return st, nil
+}
+
+// Accept 等待对端打开的流, 实现 net.Listener
+func (s *Session) Accept() (net.Conn, error) {
+	select {
+	case st := <-s.accept:
+		return st, nil
+	case <-s.done:
+		return nil, s.err
+	}
+}
+
+// Addr 返回底层链接的本端地址, 实现 net.Listener
+func (s *Session) Addr() net.Addr {
+	if conn, ok := s.conn.(net.Conn); ok {
+		return conn.LocalAddr()
+	}
+	return addr{}
+}
+
+// Close 关闭会话和其中所有的流
+func (s *Session) Close() error {
+	s.close(ErrSessionClosed)
+	return nil
+}
+
+// Done 返回会话关闭时关闭的 channel
+func (s *Session) Done() <-chan struct{} {
+	return s.done
+}
+
+// NumStreams 返回还没有被本端关闭的流的数量
+func (s *Session) NumStreams() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.streams)
+}
+
+// close 以 err 关闭会话, 只有第一次调用有效
+func (s *Session) close(err error) {
+	s.mu.Lock()
+	if s.err != nil {
+		s.mu.Unlock()
+		return
+	}
+	s.err = err
+	streams := s.streams
+	s.streams = make(map[uint32]*Stream)
+	close(s.done)
+	s.mu.Unlock()
+	_ = s.conn.Close()
+	for _, st := range streams {
+		st.wake()
+	}
+}
+
+// removeStream 本端关闭流之后调用, 之后收到的数据被丢弃
+func (s *Session) removeStream(id uint32) {
+	s.mu.Lock()
+	delete(s.streams, id)
+	s.mu.Unlock()
+}
+
+// encodeFrame 编码一帧
+func encodeFrame(typ uint8, id, length uint32, payload []byte) []byte {
+	buf := make([]byte, headerSize+len(payload))
+	buf[0] = typ
+	binary.BigEndian.PutUint32(buf[1:5], id)
+	binary.BigEndian.PutUint32(buf[5:9], length)
+	copy(buf[headerSize:], payload)
+	return buf
+}
+
+// writeFrame 写入一帧, 失败时关闭会话
+func (s *Session) writeFrame(typ uint8, id, length uint32, payload []byte) error {
+	return s.write(encodeFrame(typ, id, length, payload))
+}
+
+func (s *Session) write(buf []byte) error {
+	s.wmu.Lock()
+	defer s.wmu.Unlock()
+	select {
+	case <-s.done:
+		return s.err
+	default:
+	}
+	if _, err := s.conn.Write(buf); err != nil {
+		s.close(err)
+		return err
+	}
+	return nil
+}
+
+// queueFrame 把没有数据的控制帧交给 sendLoop 发送, 不会阻塞
+func (s *Session) queueFrame(typ uint8, id, length uint32) error {
+	s.mu.Lock()
+	if s.err != nil {
+		s.mu.Unlock()
+		return s.err
+	}
+	if len(s.control) >= maxPendingControl {
+		s.mu.Unlock()
+		return errors.New("mux: too many pending control frames")
+	}
+	s.control = append(s.control, encodeFrame(typ, id, length, nil))
+	s.mu.Unlock()
+	notify(s.controlReady)
+	return nil
+}
+
+// sendLoop 发送 queueFrame 排队的控制帧, 会话关闭时退出
+func (s *Session) sendLoop() {
+	for {
+		select {
+		case <-s.controlReady:
+		case <-s.done:
+			return
+		}
+		s.mu.Lock()
+		frames := s.control
+		s.control = nil
+		s.mu.Unlock()
+		for _, buf := range frames {
+			if s.write(buf) != nil {
+				return
+			}
+		}
+	}
+}
+
+// recvLoop 读取对端的帧, 分发给对应的流, 链接出错时关闭会话
+func (s *Session) recvLoop() {
+	s.close(s.recv())
+}
+
+func (s *Session) recv() error {
+	var header [headerSize]byte
+	for {
+		if _, err := io.ReadFull(s.conn, header[:]); err != nil {
+			if err == io.EOF {
+				return ErrSessionClosed
+			}
+			return err
+		}
+		typ, id, length := header[0], binary.BigEndian.Uint32(header[1:5]), binary.BigEndian.Uint32(header[5:9])
+		s.mu.Lock()
+		st := s.streams[id]
+		s.mu.Unlock()
+		switch typ {
+		case typeOpen:
+			if st != nil {
+				return fmt.Errorf("mux: stream %d opened twice", id)
+			}
+			if err := s.accepted(id); err != nil {
+				return err
+			}
+		case typeData:
+			if length > s.cfg.window() {
+				return fmt.Errorf("mux: frame of %d bytes exceeds the window", length)
+			}
+			payload := make([]byte, length)
+			if _, err := io.ReadFull(s.conn, payload); err != nil {
+				return err
+			}
+			// 本端已经关闭的流的数据直接丢弃
+			if st != nil {
+				if err := st.push(payload); err != nil {
+					return err
+				}
+			}
+		case typeWindow:
+			if st != nil {
+				st.grow(length)
+			}
+		case typeClose:
+			if st != nil {
+				st.remoteClose()
+			}
+		default:
+			return fmt.Errorf("mux: unknown frame type %d", typ)
+		}
+	}
+}
+
+// accepted 处理对端打开的流, 积压太多时直接关闭它
+// 对端只能使用与本端奇偶性不同的编号, 否则会与本端打开的流冲突
+func (s *Session) accepted(id uint32) error {
+	st := newStream(s, id)
+	s.mu.Lock()
+	if id == 0 || id%2 == s.nextID%2 {
+		s.mu.Unlock()
+		return fmt.Errorf("mux: peer opened stream %d with the wrong parity", id)
+	}
+	s.streams[id] = st
+	s.mu.Unlock()
+	select {
+	case s.accept <- st:
+		return st.advertiseWindow()
+	default:
+		s.removeStream(id)
+		return s.queueFrame(typeClose, id, 0)
+	}
+}
+
+// addr 底层链接不是 net.Conn 时使用的地址
+type addr struct{}
+
+func (addr) Network() string { return "mux" }
+func (addr) String() string  { return "mux" }
@@ -0,0 +1,304 @@
+package mux
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/fanyeke/minirpc"
+)
+
+// pair 返回通过 net.Pipe 连接的客户端和服务端会话
+func pair(t *testing.T, cfg *Config) (*Session, *Session) {
+	c, s := net.Pipe()
+	client, server := Client(c, cfg), Server(s, cfg)
+	t.Cleanup(func() {
+		_ = client.Close()
+		_ = server.Close()
+	})
+	return client, server
+}
+
+func TestSession_Streams(t *testing.T) {
+	client, server := pair(t, nil)
+	go func() {
+		for {
+			conn, err := server.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				_, _ = io.Copy(conn, conn)
+				_ = conn.Close()
+			}()
+		}
+	}()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			st, err := client.Open()
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			defer func() { _ = st.Close() }()
+			msg := bytes.Repeat([]byte{byte(i)}, 1000*(i+1))
+			if _, err := st.Write(msg); err != nil {
+				t.Error(err)
+				return
+			}
+			got := make([]byte, len(msg))
+			if _, err := io.ReadFull(st, got); err != nil || !bytes.Equal(got, msg) {
+				t.Errorf("stream %d: unexpected echo: %v", st.ID(), err)
+			}
+		}(i)
+	}
+	wg.Wait()
+}
+
+func TestSession_FlowControl(t *testing.T) {
+	client, server := pair(t, nil)
+	big, err := client.Open()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// 对端不读取 big, 写满窗口之后 Write 阻塞在本端
+	written := make(chan int, 1)
+	go func() {
+		n, _ := big.Write(make([]byte, 4*initialWindow))
+		written <- n
+	}()
+	bigPeer, _ := server.Accept()
+
+	small, _ := client.Open()
+	smallPeer, _ := server.Accept()
+	if _, err := small.Write([]byte("ping")); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 4)
+	_ = smallPeer.SetReadDeadline(time.Now().Add(time.Second))
+	if _, err := io.ReadFull(smallPeer, buf); err != nil || string(buf) != "ping" {
+		t.Fatalf("small stream is blocked by the big one: %q %v", buf, err)
+	}
+
+	select {
+	case n := <-written:
+		t.Fatalf("write of %d bytes did not respect the window", n)
+	case <-time.After(50 * time.Millisecond):
+	}
+	n, err := io.CopyN(io.Discard, bigPeer, 4*initialWindow)
+	if err != nil || n != 4*initialWindow {
+		t.Fatalf("expect to read %d bytes, got %d: %v", 4*initialWindow, n, err)
+	}
+	if n := <-written; n != 4*initialWindow {
+		t.Fatalf("expect to write %d bytes, got %d", 4*initialWindow, n)
+	}
+}
+
+func TestSession_LargeWindow(t *testing.T) {
+	client, server := pair(t, &Config{Window: 1 << 20})
+	st, _ := client.Open()
+	peer, _ := server.Accept()
+	// 对端通告了更大的窗口, 不需要读取也可以写入 1MB
+	done := make(chan error, 1)
+	go func() {
+		_, err := st.Write(make([]byte, 1<<20))
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("write blocked although the window is large enough")
+	}
+	_ = peer.Close()
+}
+
+func TestSession_ControlFramesNoDeadlock(t *testing.T) {
+	// net.Pipe 没有缓冲, 双方的 recvLoop 同时写入窗口或者关闭帧时会互相等待
+	client, server := pair(t, &Config{Window: 1 << 20, AcceptBacklog: 1})
+	var wg sync.WaitGroup
+	for _, s := range []*Session{client, server} {
+		for i := 0; i < 32; i++ {
+			wg.Add(1)
+			go func(s *Session) {
+				defer wg.Done()
+				if _, err := s.Open(); err != nil {
+					t.Error(err)
+				}
+			}(s)
+		}
+	}
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("sessions deadlocked writing control frames")
+	}
+}
+
+func TestSession_WrongParity(t *testing.T) {
+	c, s := net.Pipe()
+	server := Server(s, nil)
+	defer func() { _ = server.Close() }()
+	// 服务端打开的流使用偶数编号, 客户端不能使用
+	go func() { _, _ = c.Write(encodeFrame(typeOpen, 2, 0, nil)) }()
+	select {
+	case <-server.Done():
+	case <-time.After(time.Second):
+		t.Fatal("expect the session to be closed")
+	}
+	if server.err == nil || !strings.Contains(server.err.Error(), "wrong parity") {
+		t.Fatalf("expect a wrong parity error, got %v", server.err)
+	}
+}
+
+func TestStream_Close(t *testing.T) {
+	client, server := pair(t, nil)
+	st, _ := client.Open()
+	peer, _ := server.Accept()
+	go func() {
+		_, _ = st.Write([]byte("bye"))
+		_ = st.Close()
+	}()
+	data, err := io.ReadAll(peer)
+	if err != nil || string(data) != "bye" {
+		t.Fatalf("expect bye before EOF, got %q %v", data, err)
+	}
+	if _, err := peer.Write([]byte("x")); !errors.Is(err, ErrStreamClosed) {
+		t.Fatalf("expect ErrStreamClosed, got %v", err)
+	}
+	_ = peer.Close()
+
+	_ = client.Close()
+	if _, err := client.Open(); !errors.Is(err, ErrSessionClosed) {
+		t.Fatalf("expect ErrSessionClosed, got %v", err)
+	}
+}
+
+func TestStream_ReadDeadline(t *testing.T) {
+	client, server := pair(t, nil)
+	st, _ := client.Open()
+	_, _ = server.Accept()
+	_ = st.SetReadDeadline(time.Now().Add(20 * time.Millisecond))
+	if _, err := st.Read(make([]byte, 1)); !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Fatalf("expect os.ErrDeadlineExceeded, got %v", err)
+	}
+}
+
+type Echo int
+
+func (Echo) Say(s string, reply *string) error {
+	*reply = s
+	return nil
+}
+
+func TestMinirpc(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// 记录底层链接的数量
+	var mu sync.Mutex
+	var conns int
+	lis := Listen(countListener{l, func() { mu.Lock(); conns++; mu.Unlock() }}, nil)
+	defer func() { _ = lis.Close() }()
+	server := minirpc.NewServer()
+	_ = server.Register(new(Echo))
+	go server.Accept(lis)
+
+	d := NewDialer(nil)
+	defer func() { _ = d.Close() }()
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		client, err := minirpc.Dial("tcp", l.Addr().String(), &minirpc.Option{Transport: d})
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer func() { _ = client.Close() }()
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			var reply string
+			if err := client.Call(context.Background(), "Echo.Say", "hi", &reply); err != nil || reply != "hi" {
+				t.Errorf("expect hi, got %q %v", reply, err)
+			}
+		}()
+	}
+	wg.Wait()
+	mu.Lock()
+	defer mu.Unlock()
+	if conns != 1 {
+		t.Fatalf("expect clients to share 1 connection, got %d", conns)
+	}
+}
+
+func TestDialer_SlowDial(t *testing.T) {
+	release := make(chan struct{})
+	d := NewDialer(nil)
+	defer func() { _ = d.Close() }()
+	d.DialConn = func(network, address string) (net.Conn, error) {
+		c, s := net.Pipe()
+		if address == "slow" {
+			<-release
+		}
+		go func() {
+			server := Server(s, nil)
+			_, _ = server.Accept()
+		}()
+		return c, nil
+	}
+	slow := make(chan error, 1)
+	go func() {
+		_, err := d.Dial("tcp", "slow")
+		slow <- err
+	}()
+	// 一个地址建立链接很慢不会阻塞其他地址
+	fast := make(chan error, 1)
+	go func() {
+		_, err := d.Dial("tcp", "fast")
+		fast <- err
+	}()
+	select {
+	case err := <-fast:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("dial to fast blocked by a slow dial")
+	}
+	close(release)
+	if err := <-slow; err != nil {
+		t.Fatal(err)
+	}
+}
+
+// countListener 每接受一条链接调用一次 accepted
+type countListener struct {
+	net.Listener
+	accepted func()
+}
+
+func (l countListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err == nil {
+		l.accepted()
+	}
+	return conn, err
+}
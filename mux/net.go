@@ -0,0 +1,196 @@
+package mux
+
+import (
+	"io"
+	"net"
+	"sync"
+)
+
+// Listener 接受底层链接并在每条链接上建立服务端会话, Accept 返回所有会话中对端打开的流
+// 可以直接传给 minirpc.Server.Accept, 每个流都是一个独立的 rpc 链接
+type Listener struct {
+	lis      net.Listener
+	cfg      *Config
+	streams  chan net.Conn
+	mu       sync.Mutex
+	sessions map[*Session]struct{}
+	done     chan struct{}
+	once     sync.Once
+	err      error // 底层 Listener 的错误
+}
+
+var _ net.Listener = (*Listener)(nil)
+
+// Listen 返回在 lis 接受的链接上复用流的 Listener, cfg 可以为 nil
+func Listen(lis net.Listener, cfg *Config) *Listener {
+	l := &Listener{
+		lis:      lis,
+		cfg:      cfg,
+		streams:  make(chan net.Conn),
+		sessions: make(map[*Session]struct{}),
+		done:     make(chan struct{}),
+	}
+	go l.acceptLoop()
+	return l
+}
+
+// acceptLoop 接受底层链接, 为每条链接建立会话
+func (l *Listener) acceptLoop() {
+	for {
+		conn, err := l.lis.Accept()
+		if err != nil {
+			l.close(err)
+			return
+		}
+		s := Server(conn, l.cfg)
+		l.mu.Lock()
+		l.sessions[s] = struct{}{}
+		l.mu.Unlock()
+		go l.serveSession(s)
+	}
+}
+
+// serveSession 把会话中的流转交给 Accept, 会话关闭之后移除
+func (l *Listener) serveSession(s *Session) {
+	defer func() {
+		l.mu.Lock()
+		delete(l.sessions, s)
+		l.mu.Unlock()
+	}()
+	for {
+		st, err := s.Accept()
+		if err != nil {
+			return
+		}
+		select {
+		case l.streams <- st:
+		case <-l.done:
+			_ = st.Close()
+			return
+		}
+	}
+}
+
+// Accept 返回下一个流
+func (l *Listener) Accept() (net.Conn, error) {
+	select {
+	case st := <-l.streams:
+		return st, nil
+	case <-l.done:
+		if l.err != nil {
+			return nil, l.err
+		}
+		return nil, net.ErrClosed
+	}
+}
+
+// Addr 返回底层 Listener 的地址
+func (l *Listener) Addr() net.Addr {
+	return l.lis.Addr()
+}
+
+// Close 关闭底层 Listener 和所有的会话
+func (l *Listener) Close() error {
+	l.close(nil)
+	return nil
+}
+
+// close 关闭 Listener, err 是底层 Listener 的错误, 只有第一次调用有效
+func (l *Listener) close(err error) {
+	l.once.Do(func() {
+		l.err = err
+		close(l.done)
+		_ = l.lis.Close()
+		l.mu.Lock()
+		for s := range l.sessions {
+			_ = s.Close()
+		}
+		l.mu.Unlock()
+	})
+}
+
+// Dialer 对每个地址只建立一条底层链接, 每次 Dial 在上面打开一个新的流
+// 实现了 minirpc.Transport, 设置为 Option.Transport 之后多个客户端共用同一条链接
+type Dialer struct {
+	cfg *Config
+	// DialConn 建立底层链接, 为空时使用 net.Dial
+	DialConn func(network, address string) (net.Conn, error)
+
+	mu       sync.Mutex
+	sessions map[string]*Session
+	dialing  map[string]*sessionDial // 正在建立的底层链接
+}
+
+// sessionDial 一次正在进行的建立链接, 同一个地址的其他调用方等待它的结果
+type sessionDial struct {
+	done    chan struct{}
+	session *Session
+	err     error
+}
+
+// NewDialer 返回 Dialer, cfg 可以为 nil
+func NewDialer(cfg *Config) *Dialer {
+	return &Dialer{cfg: cfg, sessions: make(map[string]*Session), dialing: make(map[string]*sessionDial)}
+}
+
+// Dial 在到 address 的会话上打开一个流, 会话不存在或者已经关闭时重新建立链接
+// 返回值是 *Stream, 声明为 io.ReadWriteCloser 以满足 minirpc.Transport
+func (d *Dialer) Dial(network, address string) (io.ReadWriteCloser, error) {
+	s, err := d.session(network, address)
+	if err != nil {
+		return nil, err
+	}
+	return s.Open()
+}
+
+// session 返回到 address 的会话
+// 建立链接时不持有锁, 一个地址建立链接很慢不会阻塞其他地址; 同一个地址的调用方等待同一次建立链接的结果
+func (d *Dialer) session(network, address string) (*Session, error) {
+	key := network + "@" + address
+	d.mu.Lock()
+	if s, ok := d.sessions[key]; ok {
+		select {
+		case <-s.Done():
+		default:
+			d.mu.Unlock()
+			return s, nil
+		}
+	}
+	if sd, ok := d.dialing[key]; ok {
+		d.mu.Unlock()
+		<-sd.done
+		return sd.session, sd.err
+	}
+	sd := &sessionDial{done: make(chan struct{})}
+	d.dialing[key] = sd
+	d.mu.Unlock()
+
+	dial := d.DialConn
+	if dial == nil {
+		dial = net.Dial
+	}
+	conn, err := dial(network, address)
+	if err == nil {
+		sd.session = Client(conn, d.cfg)
+	}
+	sd.err = err
+	d.mu.Lock()
+	delete(d.dialing, key)
+	if err == nil {
+		d.sessions[key] = sd.session
+	}
+	d.mu.Unlock()
+	close(sd.done)
+	return sd.session, sd.err
+}
+
+// Close 关闭所有的会话
+func (d *Dialer) Close() error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	for key, s := range d.sessions {
+		_ = s.Close()
+		delete(d.sessions, key)
+	}
+	return nil
+}
@@ -0,0 +1,270 @@
+package mux
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+// Stream 会话中的一个流, 实现了 net.Conn
+type Stream struct {
+	s  *Session
+	id uint32
+
+	mu           sync.Mutex
+	buf          bytes.Buffer // 收到但还没有被读取的数据
+	recvWindow   uint32       // 对端还可以发送的字节数
+	consumed     uint32       // 读取之后还没有通知对端的字节数
+	sendWindow   uint32       // 本端还可以发送的字节数
+	localClosed  bool
+	remoteClosed bool
+	readDeadline time.Time
+	// writeDeadline 写入等待窗口的截止时间
+	writeDeadline time.Time
+	readable      chan struct{} // 收到数据或者状态改变时通知 Read
+	writable      chan struct{} // 窗口增加或者状态改变时通知 Write
+}
+
+var _ net.Conn = (*Stream)(nil)
+
+func newStream(s *Session, id uint32) *Stream {
+	w := s.cfg.window()
+	return &Stream{
+		s:          s,
+		id:         id,
+		recvWindow: w,
+		sendWindow: initialWindow,
+		readable:   make(chan struct{}, 1),
+		writable:   make(chan struct{}, 1),
+	}
+}
+
+// advertiseWindow 接收窗口大于 initialWindow 时告诉对端, recvLoop 中也会调用, 因此交给 sendLoop 发送
+func (st *Stream) advertiseWindow() error {
+	if extra := st.s.cfg.window() - initialWindow; extra > 0 {
+		return st.s.queueFrame(typeWindow, st.id, extra)
+	}
+	return nil
+}
+
+// ID 返回流的编号
+func (st *Stream) ID() uint32 {
+	return st.id
+}
+
+// Read 读取收到的数据, 对端关闭之后读完已经收到的数据返回 io.EOF
+func (st *Stream) Read(p []byte) (int, error) {
+	for {
+		st.mu.Lock()
+		if st.buf.Len() > 0 {
+			n, _ := st.buf.Read(p)
+			st.consumed += uint32(n)
+			// 读取了一半窗口之后再通知对端, 避免每次读取都发送一帧
+			var update uint32
+			if st.consumed >= st.s.cfg.window()/2 {
+				update, st.consumed = st.consumed, 0
+				st.recvWindow += update
+			}
+			st.mu.Unlock()
+			if update > 0 && !st.isRemoteClosed() {
+				_ = st.s.writeFrame(typeWindow, st.id, update, nil)
+			}
+			return n, nil
+		}
+		err := st.closedErr(true)
+		deadline := st.readDeadline
+		st.mu.Unlock()
+		if err != nil {
+			return 0, err
+		}
+		if err := st.wait(st.readable, deadline); err != nil {
+			return 0, err
+		}
+	}
+}
+
+// Write 写入数据, 对端的接收窗口用完时等待对端读取
+func (st *Stream) Write(p []byte) (int, error) {
+	written := 0
+	for len(p) > 0 {
+		st.mu.Lock()
+		if err := st.closedErr(false); err != nil {
+			st.mu.Unlock()
+			return written, err
+		}
+		if st.sendWindow == 0 {
+			deadline := st.writeDeadline
+			st.mu.Unlock()
+			if err := st.wait(st.writable, deadline); err != nil {
+				return written, err
+			}
+			continue
+		}
+		n := len(p)
+		if max := st.s.cfg.maxFrameSize(); n > max {
+			n = max
+		}
+		if uint32(n) > st.sendWindow {
+			n = int(st.sendWindow)
+		}
+		st.sendWindow -= uint32(n)
+		st.mu.Unlock()
+		if err := st.s.writeFrame(typeData, st.id, uint32(n), p[:n]); err != nil {
+			return written, err
+		}
+		written += n
+		p = p[n:]
+	}
+	return written, nil
+}
+
+// Close 关闭流, 对端读完已经收到的数据之后返回 io.EOF
+func (st *Stream) Close() error {
+	st.mu.Lock()
+	if st.localClosed {
+		st.mu.Unlock()
+		return nil
+	}
+	st.localClosed = true
+	st.mu.Unlock()
+	st.wake()
+	st.s.removeStream(st.id)
+	select {
+	case <-st.s.done:
+		return nil
+	default:
+	}
+	return st.s.writeFrame(typeClose, st.id, 0, nil)
+}
+
+// closedErr 返回流已经不能读或者写的原因, 调用方需要持有 mu
+// 读取时对端关闭返回 io.EOF, 写入时返回 ErrStreamClosed
+func (st *Stream) closedErr(read bool) error {
+	switch {
+	case st.localClosed:
+		return ErrStreamClosed
+	case st.remoteClosed && read:
+		return io.EOF
+	case st.remoteClosed:
+		return ErrStreamClosed
+	}
+	select {
+	case <-st.s.done:
+		if read {
+			return io.EOF
+		}
+		return st.s.err
+	default:
+		return nil
+	}
+}
+
+func (st *Stream) isRemoteClosed() bool {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	return st.remoteClosed
+}
+
+// wait 等待 ch 的通知, 超过 deadline 时返回 os.ErrDeadlineExceeded
+func (st *Stream) wait(ch chan struct{}, deadline time.Time) error {
+	var timeout <-chan time.Time
+	if !deadline.IsZero() {
+		d := time.Until(deadline)
+		if d <= 0 {
+			return os.ErrDeadlineExceeded
+		}
+		timer := time.NewTimer(d)
+		defer timer.Stop()
+		timeout = timer.C
+	}
+	select {
+	case <-ch:
+	case <-st.s.done:
+	case <-timeout:
+		return os.ErrDeadlineExceeded
+	}
+	return nil
+}
+
+// wake 唤醒等待的 Read 和 Write, 让它们重新检查状态
+func (st *Stream) wake() {
+	notify(st.readable)
+	notify(st.writable)
+}
+
+func notify(ch chan struct{}) {
+	select {
+	case ch <- struct{}{}:
+	default:
+	}
+}
+
+// push 收到对端的数据, 超过接收窗口说明对端没有遵守流量控制
+func (st *Stream) push(payload []byte) error {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	if uint32(len(payload)) > st.recvWindow {
+		return fmt.Errorf("mux: stream %d received %d bytes beyond the window", st.id, len(payload))
+	}
+	st.recvWindow -= uint32(len(payload))
+	st.buf.Write(payload)
+	notify(st.readable)
+	return nil
+}
+
+// grow 对端读取了数据, 增加发送窗口
+func (st *Stream) grow(n uint32) {
+	st.mu.Lock()
+	st.sendWindow += n
+	st.mu.Unlock()
+	notify(st.writable)
+}
+
+// remoteClose 对端关闭了流
+func (st *Stream) remoteClose() {
+	st.mu.Lock()
+	st.remoteClosed = true
+	st.mu.Unlock()
+	st.wake()
+}
+
+// LocalAddr 返回底层链接的本端地址
+func (st *Stream) LocalAddr() net.Addr {
+	return st.s.Addr()
+}
+
+// RemoteAddr 返回底层链接的对端地址
+func (st *Stream) RemoteAddr() net.Addr {
+	if conn, ok := st.s.conn.(net.Conn); ok {
+		return conn.RemoteAddr()
+	}
+	return addr{}
+}
+
+func (st *Stream) SetDeadline(t time.Time) error {
+	st.mu.Lock()
+	st.readDeadline, st.writeDeadline = t, t
+	st.mu.Unlock()
+	st.wake()
+	return nil
+}
+
+func (st *Stream) SetReadDeadline(t time.Time) error {
+	st.mu.Lock()
+	st.readDeadline = t
+	st.mu.Unlock()
+	notify(st.readable)
+	return nil
+}
+
+func (st *Stream) SetWriteDeadline(t time.Time) error {
+	st.mu.Lock()
+	st.writeDeadline = t
+	st.mu.Unlock()
+	notify(st.writable)
+	return nil
+}
@@ -0,0 +1,16 @@
+package minirpc
+
+// Notify 发送单向请求, 写入链接之后立即返回, 不等待服务端处理, 也不会收到方法的返回值和错误
+// 适合大量的上报类请求; 返回的错误只表示请求没有发出, opts 中的重试对 Notify 无效, 也不受 MaxPendingCalls 限制
+// 服务端与普通请求一样并发处理单向请求, 不保证按发送的顺序处理
+func (client *Client) Notify(serviceMethod string, args interface{}, opts ...CallOption) error {
+	call := &Call{ServiceMethod: serviceMethod, Args: args}
+	newCallOptions(opts).apply(call)
+	client.lockSending()
+	defer client.unlockSending()
+	seq, err := client.nextSeq()
+	if err != nil {
+		return err
+	}
+	return client.writeRequest(call, seq, true)
+}
@@ -0,0 +1,48 @@
+package minirpc
+
+import (
+	"sync"
+	"time"
+)
+
+// RequestObserver 在每个请求完成时被调用, 用于导出请求数, 错误数和耗时等监控指标, 见 metrics 包
+// 服务端通过 Server.Observer 设置, 客户端通过 Option.Observer 设置, 实现需要支持并发调用
+type RequestObserver interface {
+	ObserveRequest(serviceMethod string, code Code, latency time.Duration)
+}
+
+// observeCode 返回 err 对应的错误码, nil 对应 CodeOK
+func observeCode(err error) Code {
+	if err == nil {
+		return CodeOK
+	}
+	return codeOf(err)
+}
+
+// observe 记录客户端请求的结果
+func (call *Call) observe(err error) {
+	if call.observer != nil {
+		call.observer.ObserveRequest(call.ServiceMethod, observeCode(err), time.Since(call.start))
+	}
+}
+
+// requestObservation 保证服务端的一个请求只记录一次, 方法超时之后仍然会返回
+type requestObservation struct {
+	once   sync.Once
+	server *Server
+	method string
+	start  time.Time
+}
+
+func (server *Server) startObservation(serviceMethod string) *requestObservation {
+	return &requestObservation{server: server, method: serviceMethod, start: time.Now()}
+}
+
+func (o *requestObservation) done(code Code) {
+	if o.server.Observer == nil {
+		return
+	}
+	o.once.Do(func() {
+		o.server.Observer.ObserveRequest(o.method, code, time.Since(o.start))
+	})
+}
@@ -0,0 +1,47 @@
+package minirpc
+
+import (
+	"context"
+	"crypto/tls"
+	"io"
+	"net"
+
+	"github.com/fanyeke/minirpc/codec"
+)
+
+// PeerInfo 请求所在链接的信息, 方法可以据此记录审计日志, 或者按客户端地址区别处理
+type PeerInfo struct {
+	Addr         net.Addr             // 客户端地址, 链接不是 net.Conn 时为 nil
+	LocalAddr    net.Addr             // 服务端地址
+	TLS          *tls.ConnectionState // TLS 链接的状态, 不是 TLS 链接时为 nil
+	CodecType    codec.Type           // 握手时协商的编解码方式
+	CompressType codec.CompressType   // 握手时协商的压缩方式
+}
+
+// peerKey 链接 context 中保存 *PeerInfo 的键
+type peerKey struct{}
+
+// Peer 返回请求所在链接的信息, ctx 是传给 `func (t *T) Method(ctx context.Context, args, reply) error` 的参数
+func Peer(ctx context.Context) (*PeerInfo, bool) {
+	p, ok := ctx.Value(peerKey{}).(*PeerInfo)
+	return p, ok
+}
+
+// connContext 返回链接对应的 context, 方法可以从中获取链接的信息, 比如客户端地址和 TLS 客户端的身份
+func connContext(conn io.ReadWriteCloser, opt *Option) context.Context {
+	ctx := context.Background()
+	p := &PeerInfo{CodecType: opt.CodecType, CompressType: opt.CompressType}
+	// 通过 HTTP CONNECT 建立的链接需要取出原始的链接
+	if hc, ok := conn.(*hijackedConn); ok {
+		conn = hc.Conn
+	}
+	if nc, ok := conn.(net.Conn); ok {
+		p.Addr, p.LocalAddr = nc.RemoteAddr(), nc.LocalAddr()
+	}
+	if tc, ok := conn.(*tls.Conn); ok {
+		state := tc.ConnectionState()
+		p.TLS = &state
+		ctx = context.WithValue(ctx, tlsStateKey{}, state)
+	}
+	return context.WithValue(ctx, peerKey{}, p)
+}
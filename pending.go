@@ -0,0 +1,124 @@
+package minirpc
+
+import (
+	"context"
+	"fmt"
+	"sync"
+)
+
+// ErrTooManyPending 未完成的请求达到 Option.MaxPendingCalls 并且没有设置 BlockOnPendingLimit 时, 新的请求返回这个错误
+var ErrTooManyPending = &Error{Code: CodeResourceExhausted, Message: "rpc client: too many pending calls"}
+
+// acquire 占用一个未完成请求的名额, 没有设置 Option.MaxPendingCalls 时直接返回
+// 设置了 BlockOnPendingLimit 时等待其他请求完成, 直到 ctx 结束或者客户端被关闭, 否则立即返回 ErrTooManyPending
+func (client *Client) acquire(ctx context.Context) error {
+	if client.slots == nil {
+		return nil
+	}
+	select {
+	case client.slots <- struct{}{}:
+		return nil
+	default:
+	}
+	if !client.opt.BlockOnPendingLimit {
+		return ErrTooManyPending
+	}
+	select {
+	case client.slots <- struct{}{}:
+		return nil
+	case <-ctx.Done():
+		return fmt.Errorf("rpc client: call failed: %w", ctx.Err())
+	case <-client.closed:
+		return ErrShutdown
+	}
+}
+
+// release 归还一个名额, 请求从 pending 中移除, 或者没有注册成功时调用
+func (client *Client) release() {
+	if client.slots == nil {
+		return
+	}
+	select {
+	case <-client.slots:
+	default:
+	}
+}
+
+// pendingShards pendingMap 的分片数, 需要是 2 的幂
+const pendingShards = 32
+
+// pendingMap 按请求编号分片的未完成请求, 并发的请求注册和完成时不会争用同一把锁
+type pendingMap struct {
+	shards [pendingShards]pendingShard
+}
+
+type pendingShard struct {
+	mu    sync.Mutex
+	calls map[uint64]*Call
+	_     [48]byte // 补齐到 64 字节, 避免相邻的分片位于同一个缓存行
+}
+
+func newPendingMap() *pendingMap {
+	p := new(pendingMap)
+	for i := range p.shards {
+		p.shards[i].calls = make(map[uint64]*Call)
+	}
+	return p
+}
+
+func (p *pendingMap) shard(seq uint64) *pendingShard {
+	return &p.shards[seq&(pendingShards-1)]
+}
+
+func (p *pendingMap) store(seq uint64, call *Call) {
+	s := p.shard(seq)
+	s.mu.Lock()
+	s.calls[seq] = call
+	s.mu.Unlock()
+}
+
+// remove 移除并返回 seq 对应的请求, 不存在时返回 nil
+func (p *pendingMap) remove(seq uint64) *Call {
+	s := p.shard(seq)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	call := s.calls[seq]
+	if call != nil {
+		delete(s.calls, seq)
+	}
+	return call
+}
+
+// has 返回 seq 是否还没有完成
+func (p *pendingMap) has(seq uint64) bool {
+	s := p.shard(seq)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.calls[seq] != nil
+}
+
+// len 返回未完成的请求数, 与并发的注册和移除同时进行时只是一个近似值
+func (p *pendingMap) len() int {
+	n := 0
+	for i := range p.shards {
+		s := &p.shards[i]
+		s.mu.Lock()
+		n += len(s.calls)
+		s.mu.Unlock()
+	}
+	return n
+}
+
+// removeAll 移除所有的请求, 依次以它们调用 fn
+func (p *pendingMap) removeAll(fn func(call *Call)) {
+	for i := range p.shards {
+		s := &p.shards[i]
+		s.mu.Lock()
+		calls := s.calls
+		s.calls = make(map[uint64]*Call)
+		s.mu.Unlock()
+		for _, call := range calls {
+			fn(call)
+		}
+	}
+}
@@ -0,0 +1,25 @@
+package minirpc
+
+import "net"
+
+// NewPipeClient 通过 net.Pipe 把客户端直接连接到 server, 不需要监听端口, 适合在测试中使用
+// 客户端关闭时服务端这一侧的链接也随之关闭
+func (server *Server) NewPipeClient(opts ...*Option) (*Client, error) {
+	opt, err := parseOption(opts...)
+	if err != nil {
+		return nil, err
+	}
+	clientConn, serverConn := net.Pipe()
+	go server.ServerConn(serverConn)
+	return NewClient(clientConn, opt)
+}
+
+// NewPipeClientServer 创建一个新的服务端和连接到它的客户端, 服务可以在创建之后再注册
+func NewPipeClientServer(opts ...*Option) (*Client, *Server, error) {
+	server := NewServer()
+	client, err := server.NewPipeClient(opts...)
+	if err != nil {
+		return nil, nil, err
+	}
+	return client, server, nil
+}
@@ -0,0 +1,156 @@
+package minirpc
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// ClientPool 同一个地址的多条链接, 请求轮流使用它们, 一个很大的响应不会阻塞其他链接上的请求
+// 不可用的链接在下一次被选中时重新建立, 正在关闭的链接等已经发出的请求完成后自己关闭
+type ClientPool struct {
+	dial    func() (*Client, error)
+	next    atomic.Uint64
+	mu      sync.Mutex
+	clients []*Client   // 为 nil 的位置还没有建立链接
+	dialing []*poolDial // 不为 nil 的位置正在建立链接
+	closed  bool
+}
+
+// poolDial 一次正在进行的建立链接, 同一个位置的其他调用方等待它的结果
+type poolDial struct {
+	done   chan struct{}
+	client *Client
+	err    error
+}
+
+// NewClientPool 返回最多 size 条链接的 ClientPool, 链接在第一次使用时通过 dial 建立, size 小于 1 时为 1
+func NewClientPool(size int, dial func() (*Client, error)) *ClientPool {
+	if size < 1 {
+		size = 1
+	}
+	return &ClientPool{dial: dial, clients: make([]*Client, size), dialing: make([]*poolDial, size)}
+}
+
+// DialPool 与 Dial 相同地建立 size 条链接, 任何一条失败时关闭已经建立的链接并返回错误
+func DialPool(network, address string, size int, opts ...*Option) (*ClientPool, error) {
+	return dialPool(size, func() (*Client, error) { return Dial(network, address, opts...) })
+}
+
+// XDialPool 与 XDial 相同地建立 size 条链接
+func XDialPool(rpcAddr string, size int, opts ...*Option) (*ClientPool, error) {
+	return dialPool(size, func() (*Client, error) { return XDial(rpcAddr, opts...) })
+}
+
+// dialPool 创建 ClientPool 并立即建立所有的链接
+func dialPool(size int, dial func() (*Client, error)) (*ClientPool, error) {
+	pool := NewClientPool(size, dial)
+	for i := range pool.clients {
+		client, err := dial()
+		if err != nil {
+			_ = pool.Close()
+			return nil, err
+		}
+		pool.clients[i] = client
+	}
+	return pool, nil
+}
+
+// Size 返回链接数
+func (p *ClientPool) Size() int {
+	return len(p.clients)
+}
+
+// Clients 返回已经建立的链接, 包括已经不可用但还没有被替换的链接
+func (p *ClientPool) Clients() []*Client {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	var clients []*Client
+	for _, client := range p.clients {
+		if client != nil {
+			clients = append(clients, client)
+		}
+	}
+	return clients
+}
+
+// Get 轮流返回一条可用的链接, 需要时重新建立
+// 建立链接时不持有锁, 一个位置建立链接很慢不会阻塞其他位置; 同一个位置的调用方等待同一次建立链接的结果
+func (p *ClientPool) Get() (*Client, error) {
+	i := int((p.next.Add(1) - 1) % uint64(len(p.clients)))
+	p.mu.Lock()
+	if p.closed {
+		p.mu.Unlock()
+		return nil, ErrShutdown
+	}
+	client := p.clients[i]
+	if client != nil && client.IsAvailable() {
+		p.mu.Unlock()
+		return client, nil
+	}
+	if d := p.dialing[i]; d != nil {
+		p.mu.Unlock()
+		<-d.done
+		return d.client, d.err
+	}
+	if client != nil && !client.IsDraining() {
+		_ = client.Close()
+	}
+	p.clients[i] = nil
+	d := &poolDial{done: make(chan struct{})}
+	p.dialing[i] = d
+	p.mu.Unlock()
+
+	d.client, d.err = p.dial()
+	p.mu.Lock()
+	p.dialing[i] = nil
+	if d.err == nil && p.closed {
+		// 建立链接期间 pool 被关闭了
+		_ = d.client.Close()
+		d.client, d.err = nil, ErrShutdown
+	}
+	if d.err == nil {
+		p.clients[i] = d.client
+	}
+	p.mu.Unlock()
+	close(d.done)
+	return d.client, d.err
+}
+
+// Call 在下一条链接上调用, 见 Client.Call
+func (p *ClientPool) Call(ctx context.Context, serviceMethod string, args, reply interface{}, opts ...CallOption) error {
+	client, err := p.Get()
+	if err != nil {
+		return err
+	}
+	return client.Call(ctx, serviceMethod, args, reply, opts...)
+}
+
+// Go 在下一条链接上异步调用, 见 Client.Go; 没有可用的链接时返回的 Call 已经以错误结束
+func (p *ClientPool) Go(serviceMethod string, args, reply interface{}, done chan *Call, opts ...CallOption) *Call {
+	client, err := p.Get()
+	if err == nil {
+		return client.Go(serviceMethod, args, reply, done, opts...)
+	}
+	if done == nil {
+		done = make(chan *Call, 1)
+	}
+	call := &Call{ServiceMethod: serviceMethod, Args: args, Reply: reply, Done: done, Error: err, start: time.Now()}
+	call.done()
+	return call
+}
+
+// Close 关闭所有的链接, 之后 Get 返回 ErrShutdown
+func (p *ClientPool) Close() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.closed = true
+	for i, client := range p.clients {
+		if client != nil {
+			_ = client.Close()
+			p.clients[i] = nil
+		}
+	}
+	return nil
+}
@@ -0,0 +1,223 @@
+package minirpc
+
+import (
+	"bufio"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+// ProxyFunc 返回连接 address 时使用的代理, 返回 nil 表示直接连接
+// 支持 http://[user:password@]host:port 和 socks5://[user:password@]host:port 两种代理
+type ProxyFunc func(address string) (*url.URL, error)
+
+// ProxyURL 返回总是使用 u 的 ProxyFunc
+func ProxyURL(u *url.URL) ProxyFunc {
+	return func(string) (*url.URL, error) {
+		return u, nil
+	}
+}
+
+// ProxyFromEnvironment 与 http.ProxyFromEnvironment 相同, 根据 HTTPS_PROXY 和 NO_PROXY 环境变量选择代理
+// 连接 localhost 和回环地址时不使用代理
+func ProxyFromEnvironment(address string) (*url.URL, error) {
+	return http.ProxyFromEnvironment(&http.Request{URL: &url.URL{Scheme: "https", Host: address}})
+}
+
+// dialProxy 连接 proxy, 再通过它建立到 address 的隧道, deadline 同时限制了与代理握手的时间
+func (opt *Option) dialProxy(proxy *url.URL, network, address string, deadline time.Time) (net.Conn, error) {
+	var port string
+	switch proxy.Scheme {
+	case "http":
+		port = "80"
+	case "socks5", "socks5h":
+		port = "1080"
+	default:
+		return nil, fmt.Errorf("rpc client: unsupported proxy scheme %q", proxy.Scheme)
+	}
+	proxyAddr := proxy.Host
+	if proxy.Port() == "" {
+		proxyAddr = net.JoinHostPort(proxy.Hostname(), port)
+	}
+	conn, err := opt.dialDirect(network, proxyAddr, deadline)
+	if err != nil {
+		return nil, err
+	}
+	// Transport 返回的链接可能不支持超时, 此时忽略
+	_ = conn.SetDeadline(deadline)
+	tunnel := conn
+	if proxy.Scheme == "http" {
+		tunnel, err = httpConnect(conn, proxy, address)
+	} else {
+		err = socks5Connect(conn, proxy, address)
+	}
+	if err != nil {
+		_ = conn.Close()
+		if !deadline.IsZero() && isTimeout(err) {
+			return nil, opt.connectTimeout()
+		}
+		return nil, err
+	}
+	_ = conn.SetDeadline(time.Time{})
+	return tunnel, nil
+}
+
+// httpConnect 发送 CONNECT 请求, 代理返回 200 之后链接就是到 address 的隧道
+func httpConnect(conn net.Conn, proxy *url.URL, address string) (net.Conn, error) {
+	req := &http.Request{
+		Method: "CONNECT",
+		URL:    &url.URL{Opaque: address},
+		Host:   address,
+		Header: make(http.Header),
+	}
+	if u := proxy.User; u != nil {
+		password, _ := u.Password()
+		auth := base64.StdEncoding.EncodeToString([]byte(u.Username() + ":" + password))
+		req.Header.Set("Proxy-Authorization", "Basic "+auth)
+	}
+	if err := req.Write(conn); err != nil {
+		return nil, err
+	}
+	r := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(r, req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, errors.New("rpc client: proxy refused CONNECT: " + resp.Status)
+	}
+	if r.Buffered() > 0 {
+		return &hijackedConn{Conn: conn, r: r}, nil
+	}
+	return conn, nil
+}
+
+// socks5 协议中用到的常量, 见 RFC 1928 和 RFC 1929
+const (
+	socks5Version      = 5
+	socks5NoAuth       = 0
+	socks5UserPass     = 2
+	socks5NoAcceptable = 0xff
+	socks5CmdConnect   = 1
+	socks5IPv4         = 1
+	socks5Domain       = 3
+	socks5IPv6         = 4
+)
+
+// socks5Errors 代理回复的错误码
+var socks5Errors = []string{
+	1: "general SOCKS server failure",
+	2: "connection not allowed by ruleset",
+	3: "network unreachable",
+	4: "host unreachable",
+	5: "connection refused",
+	6: "TTL expired",
+	7: "command not supported",
+	8: "address type not supported",
+}
+
+// socks5Connect 通过 socks5 代理连接 address, 主机名交给代理解析
+func socks5Connect(conn net.Conn, proxy *url.URL, address string) error {
+	host, portStr, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	port, err := strconv.ParseUint(portStr, 10, 16)
+	if err != nil {
+		return fmt.Errorf("rpc client: invalid port %q", portStr)
+	}
+
+	// 协商认证方式
+	method := byte(socks5NoAuth)
+	if proxy.User != nil {
+		method = socks5UserPass
+	}
+	if _, err := conn.Write([]byte{socks5Version, 1, method}); err != nil {
+		return err
+	}
+	var buf [2]byte
+	if _, err := io.ReadFull(conn, buf[:]); err != nil {
+		return err
+	}
+	if buf[0] != socks5Version {
+		return fmt.Errorf("rpc client: unexpected socks version %d", buf[0])
+	}
+	if buf[1] == socks5NoAcceptable || buf[1] != method {
+		return errors.New("rpc client: socks5 proxy requires an unsupported authentication method")
+	}
+	if method == socks5UserPass {
+		username := proxy.User.Username()
+		password, _ := proxy.User.Password()
+		if len(username) > 255 || len(password) > 255 {
+			return errors.New("rpc client: socks5 username or password too long")
+		}
+		req := []byte{1, byte(len(username))}
+		req = append(req, username...)
+		req = append(req, byte(len(password)))
+		req = append(req, password...)
+		if _, err := conn.Write(req); err != nil {
+			return err
+		}
+		if _, err := io.ReadFull(conn, buf[:]); err != nil {
+			return err
+		}
+		if buf[1] != 0 {
+			return errors.New("rpc client: socks5 authentication failed")
+		}
+	}
+
+	// 发送 CONNECT 请求
+	req := []byte{socks5Version, socks5CmdConnect, 0}
+	if ip := net.ParseIP(host); ip == nil {
+		if len(host) > 255 {
+			return errors.New("rpc client: socks5 host name too long")
+		}
+		req = append(req, socks5Domain, byte(len(host)))
+		req = append(req, host...)
+	} else if ip4 := ip.To4(); ip4 != nil {
+		req = append(req, socks5IPv4)
+		req = append(req, ip4...)
+	} else {
+		req = append(req, socks5IPv6)
+		req = append(req, ip...)
+	}
+	req = binary.BigEndian.AppendUint16(req, uint16(port))
+	if _, err := conn.Write(req); err != nil {
+		return err
+	}
+
+	// 读取回复, 其中绑定的地址没有用处, 直接丢弃
+	var reply [4]byte
+	if _, err := io.ReadFull(conn, reply[:]); err != nil {
+		return err
+	}
+	if reply[1] != 0 {
+		if int(reply[1]) < len(socks5Errors) {
+			return errors.New("rpc client: socks5 connect failed: " + socks5Errors[reply[1]])
+		}
+		return fmt.Errorf("rpc client: socks5 connect failed: code %d", reply[1])
+	}
+	var skip int
+	switch reply[3] {
+	case socks5IPv4:
+		skip = net.IPv4len
+	case socks5IPv6:
+		skip = net.IPv6len
+	case socks5Domain:
+		if _, err := io.ReadFull(conn, buf[:1]); err != nil {
+			return err
+		}
+		skip = int(buf[0])
+	default:
+		return fmt.Errorf("rpc client: unknown socks5 address type %d", reply[3])
+	}
+	_, err = io.CopyN(io.Discard, conn, int64(skip+2))
+	return err
+}
@@ -0,0 +1,137 @@
+package minirpc
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// startProxy 在本地启动代理, 每个链接由 handle 完成握手并返回目标地址, 之后双向转发数据
+func startProxy(t *testing.T, handle func(conn net.Conn, r *bufio.Reader) string) string {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	_assert(err == nil, "failed to listen: %v", err)
+	t.Cleanup(func() { _ = l.Close() })
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer func() { _ = conn.Close() }()
+				r := bufio.NewReader(conn)
+				target := handle(conn, r)
+				if target == "" {
+					return
+				}
+				backend, err := net.Dial("tcp", target)
+				if err != nil {
+					return
+				}
+				defer func() { _ = backend.Close() }()
+				go func() { _, _ = io.Copy(backend, r) }()
+				_, _ = io.Copy(conn, backend)
+			}()
+		}
+	}()
+	return l.Addr().String()
+}
+
+// httpProxy 只接受带有正确认证的 CONNECT 请求
+func httpProxy(conn net.Conn, r *bufio.Reader) string {
+	req, err := http.ReadRequest(r)
+	if err != nil {
+		return ""
+	}
+	if user, pass, ok := parseProxyAuth(req.Header.Get("Proxy-Authorization")); req.Method != "CONNECT" || !ok || user != "alice" || pass != "secret" {
+		_, _ = io.WriteString(conn, "HTTP/1.1 407 Proxy Authentication Required\r\n\r\n")
+		return ""
+	}
+	_, _ = io.WriteString(conn, "HTTP/1.1 200 Connection established\r\n\r\n")
+	return req.Host
+}
+
+func parseProxyAuth(auth string) (string, string, bool) {
+	req := &http.Request{Header: http.Header{"Authorization": {auth}}}
+	return req.BasicAuth()
+}
+
+// socks5Proxy 只支持无认证的 CONNECT 和域名或 IPv4 地址
+func socks5Proxy(conn net.Conn, r *bufio.Reader) string {
+	buf := make([]byte, 2)
+	if _, err := io.ReadFull(r, buf); err != nil || buf[0] != 5 {
+		return ""
+	}
+	if _, err := io.ReadFull(r, make([]byte, buf[1])); err != nil {
+		return ""
+	}
+	_, _ = conn.Write([]byte{5, 0})
+	head := make([]byte, 4)
+	if _, err := io.ReadFull(r, head); err != nil || head[1] != 1 {
+		return ""
+	}
+	var host string
+	switch head[3] {
+	case 1:
+		ip := make([]byte, 4)
+		_, _ = io.ReadFull(r, ip)
+		host = net.IP(ip).String()
+	case 3:
+		n, _ := r.ReadByte()
+		name := make([]byte, n)
+		_, _ = io.ReadFull(r, name)
+		host = string(name)
+	default:
+		return ""
+	}
+	port := make([]byte, 2)
+	_, _ = io.ReadFull(r, port)
+	_, _ = conn.Write([]byte{5, 0, 0, 1, 0, 0, 0, 0, 0, 0})
+	return net.JoinHostPort(host, strconv.Itoa(int(binary.BigEndian.Uint16(port))))
+}
+
+func TestClient_Proxy(t *testing.T) {
+	var foo Foo
+	server := NewServer()
+	_ = server.Register(&foo)
+	l, _ := net.Listen("tcp", "127.0.0.1:0")
+	go server.Accept(l)
+	_, port, _ := net.SplitHostPort(l.Addr().String())
+	target := net.JoinHostPort("localhost", port)
+
+	call := func(t *testing.T, proxy *url.URL) error {
+		client, err := XDial("tcp@"+target, &Option{Proxy: ProxyURL(proxy)})
+		if err != nil {
+			return err
+		}
+		defer func() { _ = client.Close() }()
+		var reply int
+		err = client.Call(context.Background(), "Foo.Sum", &Args{Num1: 1, Num2: 2}, &reply)
+		_assert(err == nil && reply == 3, "failed to call Foo.Sum through proxy: %v", err)
+		return nil
+	}
+
+	t.Run("http", func(t *testing.T) {
+		addr := startProxy(t, httpProxy)
+		err := call(t, &url.URL{Scheme: "http", Host: addr, User: url.UserPassword("alice", "secret")})
+		_assert(err == nil, "failed to dial through http proxy: %v", err)
+		err = call(t, &url.URL{Scheme: "http", Host: addr})
+		_assert(err != nil && strings.Contains(err.Error(), "407"), "expect the proxy to require authentication, got %v", err)
+	})
+	t.Run("socks5", func(t *testing.T) {
+		addr := startProxy(t, socks5Proxy)
+		err := call(t, &url.URL{Scheme: "socks5", Host: addr})
+		_assert(err == nil, "failed to dial through socks5 proxy: %v", err)
+	})
+	t.Run("unsupported", func(t *testing.T) {
+		err := call(t, &url.URL{Scheme: "ftp", Host: "127.0.0.1:21"})
+		_assert(err != nil && strings.Contains(err.Error(), "unsupported proxy scheme"), "expect unsupported scheme, got %v", err)
+	})
+}
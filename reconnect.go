@@ -0,0 +1,106 @@
+package minirpc
+
+import (
+	"log/slog"
+	"math/rand"
+	"time"
+)
+
+// ReconnectPolicy 链接断开之后自动重连的策略, 见 Option.Reconnect
+// 断开时已经发出的请求返回链接的错误, 重连期间发出的请求返回 ErrReconnecting, 重连成功之后客户端继续可用
+// 只对 Dial, DialTLS, DialHTTP 和 XDial 创建的客户端有效, 用户主动 Close 或者服务端通知关闭时不会重连
+type ReconnectPolicy struct {
+	Backoff    time.Duration // 第一次重连之前的等待时间, 之后每次翻倍, 0 表示 100ms
+	MaxBackoff time.Duration // 等待时间的上限, 0 表示 30s
+	// Jitter 在等待时间上随机增减的比例, 取值 [0, 1], 避免大量客户端在服务端重启之后同时重连
+	Jitter float64
+	// MaxAttempts 连续失败这么多次之后放弃, 客户端随之关闭, 0 表示一直重试直到 Close
+	MaxAttempts int
+}
+
+// ErrReconnecting 正在重连时发出的请求返回这个错误, 可以通过 WithRetry 重试
+var ErrReconnecting = &Error{Code: CodeUnavailable, Message: "rpc client: reconnecting"}
+
+// delay 返回第 n 次重连之前的等待时间
+func (p *ReconnectPolicy) delay(n int) time.Duration {
+	d, limit := p.Backoff, p.MaxBackoff
+	if d <= 0 {
+		d = 100 * time.Millisecond
+	}
+	if limit <= 0 {
+		limit = 30 * time.Second
+	}
+	for i := 1; i < n && d < limit; i++ {
+		d *= 2
+	}
+	if d > limit {
+		d = limit
+	}
+	if p.Jitter > 0 {
+		d += time.Duration(p.Jitter * (2*rand.Float64() - 1) * float64(d))
+	}
+	return d
+}
+
+// startReconnect 链接断开之后调用, 以 err 结束已经发出的请求并进入重连状态
+// 客户端已经被关闭或者服务端通知过关闭时返回 false, 不需要重连
+func (client *Client) startReconnect(err error) bool {
+	client.sending.Lock()
+	defer client.sending.Unlock()
+	client.mu.Lock()
+	defer client.mu.Unlock()
+	if client.closing || client.draining {
+		return false
+	}
+	client.reconnecting = true
+	client.updateRefusal()
+	client.pending.removeAll(func(call *Call) {
+		client.release()
+		call.Error = err
+		call.done()
+	})
+	_ = client.cc.Close()
+	return true
+}
+
+// reconnect 按 Option.Reconnect 重新建立链接, 成功时返回 true; 客户端被关闭或者重试次数用完时返回 false
+func (client *Client) reconnect() bool {
+	policy := client.opt.Reconnect
+	for n := 1; policy.MaxAttempts <= 0 || n <= policy.MaxAttempts; n++ {
+		select {
+		case <-time.After(policy.delay(n)):
+		case <-client.closed:
+			return false
+		}
+		fresh, err := client.redial()
+		if err != nil {
+			client.opt.Logger.sampledf(slog.LevelWarn, "rpc client: reconnect to %s: %v", client.addr, err)
+			continue
+		}
+		if !client.adopt(fresh) {
+			_ = fresh.cc.Close()
+			return false
+		}
+		client.opt.Logger.logf(slog.LevelInfo, "rpc client: reconnected to %s after %d attempts", client.addr, n)
+		return true
+	}
+	return false
+}
+
+// adopt 换用 fresh 的链接, 客户端在重连期间被关闭时返回 false
+func (client *Client) adopt(fresh *Client) bool {
+	client.sending.Lock()
+	defer client.sending.Unlock()
+	client.mu.Lock()
+	defer client.mu.Unlock()
+	if client.closing {
+		return false
+	}
+	client.cc, client.counters, client.dump, client.flusher = fresh.cc, fresh.counters, fresh.dump, fresh.flusher
+	client.version, client.compress = fresh.version, fresh.compress
+	client.reconnecting = false
+	client.updateRefusal()
+	client.lastRead.Store(time.Now().UnixNano())
+	client.stats.reconnects.Add(1)
+	return true
+}
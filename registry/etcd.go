@@ -0,0 +1,129 @@
+package registry
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// EtcdHeartbeat 把 addr 注册到 etcd 的 prefix 下, 键是 prefix 加上 addr, 值是 md 编码成的 JSON 对象, 客户端通过 xclient.EtcdDiscovery 读取
+// 键绑定在 ttl 的租约上, 后台每 ttl/3 续约一次; 进程退出之后租约过期, 键被 etcd 删除, 租约意外过期时重新注册
+// 返回的 stop 撤销租约并停止续约, 服务正常关闭时调用, 客户端立即就能看到实例下线
+func EtcdHeartbeat(endpoint, prefix, addr string, md map[string]string, ttl time.Duration) (stop func(), err error) {
+	if ttl < 3*time.Second {
+		ttl = 3 * time.Second
+	}
+	r := &etcdRegistration{
+		endpoint: strings.TrimRight(endpoint, "/"),
+		key:      prefix + addr,
+		ttl:      ttl,
+		client:   &http.Client{Timeout: ttl / 3},
+	}
+	if md != nil {
+		value, err := json.Marshal(md)
+		if err != nil {
+			return nil, err
+		}
+		r.value = string(value)
+	}
+	if err := r.register(); err != nil {
+		return nil, err
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		t := time.NewTicker(ttl / 3)
+		defer t.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-t.C:
+			}
+			if err := r.keepalive(); err != nil {
+				log.Println("rpc server: etcd keepalive err:", err)
+			}
+		}
+	}()
+	return func() {
+		cancel()
+		<-done
+		if err := r.post("/v3/lease/revoke", map[string]string{"ID": r.lease}, nil); err != nil {
+			log.Println("rpc server: etcd revoke err:", err)
+		}
+	}, nil
+}
+
+type etcdRegistration struct {
+	endpoint string
+	key      string
+	value    string
+	ttl      time.Duration
+	client   *http.Client
+	lease    string // 网关把 int64 编码成字符串
+}
+
+// register 申请新的租约并写入键
+func (r *etcdRegistration) register() error {
+	var grant struct {
+		ID string `json:"ID"`
+	}
+	ttl := strconv.Itoa(int(r.ttl / time.Second))
+	if err := r.post("/v3/lease/grant", map[string]string{"TTL": ttl}, &grant); err != nil {
+		return err
+	}
+	if grant.ID == "" {
+		return fmt.Errorf("rpc registry: etcd lease grant returned no ID")
+	}
+	r.lease = grant.ID
+	put := map[string]string{
+		"key":   base64.StdEncoding.EncodeToString([]byte(r.key)),
+		"value": base64.StdEncoding.EncodeToString([]byte(r.value)),
+		"lease": r.lease,
+	}
+	return r.post("/v3/kv/put", put, nil)
+}
+
+// keepalive 续约一次, 租约已经过期时重新注册
+func (r *etcdRegistration) keepalive() error {
+	var resp struct {
+		Result struct {
+			TTL string `json:"TTL"`
+		} `json:"result"`
+	}
+	if err := r.post("/v3/lease/keepalive", map[string]string{"ID": r.lease}, &resp); err != nil {
+		return err
+	}
+	if ttl, _ := strconv.Atoi(resp.Result.TTL); ttl <= 0 {
+		log.Println("rpc server: etcd lease expired, register again:", r.key)
+		return r.register()
+	}
+	return nil
+}
+
+func (r *etcdRegistration) post(path string, req, resp interface{}) error {
+	body, err := json.Marshal(req)
+	if err != nil {
+		return err
+	}
+	httpResp, err := r.client.Post(r.endpoint+path, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	defer func() { _ = httpResp.Body.Close() }()
+	if httpResp.StatusCode != http.StatusOK {
+		return fmt.Errorf("rpc registry: etcd %s: %s", path, httpResp.Status)
+	}
+	if resp == nil {
+		return nil
+	}
+	return json.NewDecoder(httpResp.Body).Decode(resp)
+}
@@ -0,0 +1,167 @@
+package registry
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// nacosDefaultBeat Nacos 客户端默认的心跳间隔, 服务端 15 秒没有收到心跳标记为不健康, 30 秒删除实例
+const nacosDefaultBeat = 5 * time.Second
+
+// nacosNotFound 心跳时实例不存在 (例如被服务端删除) 返回的 code
+const nacosNotFound = 20404
+
+// NacosHeartbeat 把 addr 作为临时实例注册到 Nacos 的 service 下, 并在后台每 duration 发送一次心跳, duration 为 0 时使用 5 秒
+// server 是 Nacos 的地址, 例如 http://127.0.0.1:8848, 可以带上 namespaceId 等查询参数; service 可以写成 "<group>@@<service>"
+// addr 的格式与 Server.Accept 相同, 例如 tcp@10.0.0.1:7001, 协议写入元数据的 protocol, 客户端通过 xclient.NacosDiscovery 读取
+// md 中的 weight 同时作为 Nacos 的权重; 心跳发现实例已经被删除时重新注册; 返回的 stop 停止心跳并注销实例, 服务正常关闭时调用
+func NacosHeartbeat(server, service, addr string, md map[string]string, duration time.Duration) (stop func(), err error) {
+	u, err := url.Parse(server)
+	if err != nil {
+		return nil, err
+	}
+	protocol, hostport, ok := strings.Cut(addr, "@")
+	if !ok {
+		protocol, hostport = "tcp", addr
+	}
+	host, port, err := net.SplitHostPort(hostport)
+	if err != nil {
+		return nil, fmt.Errorf("rpc registry: nacos needs an ip:port address, got %s: %v", addr, err)
+	}
+	if duration == 0 {
+		duration = nacosDefaultBeat
+	}
+	metadata := map[string]string{"protocol": protocol}
+	for k, v := range md {
+		metadata[k] = v
+	}
+	r := &nacosRegistration{
+		server:   u,
+		service:  service,
+		ip:       host,
+		port:     port,
+		metadata: metadata,
+		client:   &http.Client{Timeout: duration},
+	}
+	if err := r.register(); err != nil {
+		return nil, err
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		t := time.NewTicker(duration)
+		defer t.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-t.C:
+			}
+			if err := r.beat(); err != nil {
+				log.Println("rpc server: nacos heart beat err:", err)
+			}
+		}
+	}()
+	return func() {
+		cancel()
+		<-done
+		if _, err := r.do(http.MethodDelete, "/nacos/v1/ns/instance", r.instance()); err != nil {
+			log.Println("rpc server: nacos deregister err:", err)
+		}
+	}, nil
+}
+
+type nacosRegistration struct {
+	server   *url.URL
+	service  string
+	ip       string
+	port     string
+	metadata map[string]string
+	client   *http.Client
+}
+
+// instance 返回注册和注销使用的参数
+func (r *nacosRegistration) instance() url.Values {
+	q := url.Values{}
+	q.Set("serviceName", r.service)
+	q.Set("ip", r.ip)
+	q.Set("port", r.port)
+	q.Set("ephemeral", "true")
+	if w, err := strconv.ParseFloat(r.metadata["weight"], 64); err == nil {
+		q.Set("weight", strconv.FormatFloat(w, 'f', -1, 64))
+	}
+	return q
+}
+
+func (r *nacosRegistration) register() error {
+	q := r.instance()
+	md, _ := json.Marshal(r.metadata)
+	q.Set("metadata", string(md))
+	_, err := r.do(http.MethodPost, "/nacos/v1/ns/instance", q)
+	return err
+}
+
+// beat 发送一次心跳, 实例不存在时重新注册
+func (r *nacosRegistration) beat() error {
+	port, _ := strconv.Atoi(r.port)
+	beat, _ := json.Marshal(map[string]interface{}{
+		"serviceName": r.service,
+		"ip":          r.ip,
+		"port":        port,
+		"metadata":    r.metadata,
+		"scheduled":   true,
+	})
+	q := r.instance()
+	q.Set("beat", string(beat))
+	body, err := r.do(http.MethodPut, "/nacos/v1/ns/instance/beat", q)
+	if err != nil {
+		return err
+	}
+	var resp struct {
+		Code int `json:"code"`
+	}
+	if json.Unmarshal(body, &resp) == nil && resp.Code == nacosNotFound {
+		log.Println("rpc server: nacos instance not found, register again:", net.JoinHostPort(r.ip, r.port))
+		return r.register()
+	}
+	return nil
+}
+
+// do 发送请求, server 中的查询参数 (例如 namespaceId) 合并到 q 中
+func (r *nacosRegistration) do(method, path string, q url.Values) ([]byte, error) {
+	u := *r.server
+	u.Path = path
+	for k, vs := range r.server.Query() {
+		for _, v := range vs {
+			q.Add(k, v)
+		}
+	}
+	u.RawQuery = q.Encode()
+	req, err := http.NewRequest(method, u.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := r.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer func() { _ = resp.Body.Close() }()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("rpc registry: nacos %s %s: %s %s", method, path, resp.Status, body)
+	}
+	return body, nil
+}
@@ -4,6 +4,7 @@ import (
 	"log"
 	"net/http"
 	"sort"
+	"strconv"
 	"strings"
 	"sync"
 	"time"
@@ -16,8 +17,10 @@ type MiniRegister struct {
 }
 
 type ServerItem struct {
-	Addr  string
-	start time.Time
+	Addr string
+	// Metadata 心跳中携带的元数据, 例如 weight 和 partition, 见 HeartbeatWithMetadata
+	Metadata map[string]string
+	start    time.Time
 }
 
 const (
@@ -34,48 +37,79 @@ func New(timeout time.Duration) *MiniRegister {
 
 var DefaultMiniRegister = New(defaultTimeout)
 
-func (r *MiniRegister) putServer(addr string) {
+func (r *MiniRegister) putServer(addr string, md map[string]string) {
 	r.mu.Lock()
 	defer r.mu.Unlock()
 
 	s := r.servers[addr]
 	if s == nil {
 		r.servers[addr] = &ServerItem{
-			Addr:  addr,
-			start: time.Now(),
+			Addr:     addr,
+			Metadata: md,
+			start:    time.Now(),
 		}
 	} else {
+		s.Metadata = md
 		s.start = time.Now()
 	}
 }
 
-func (r *MiniRegister) aliveServers() []string {
+func (r *MiniRegister) aliveServers() []ServerItem {
 	r.mu.Lock()
 	defer r.mu.Unlock()
 
-	var alive []string
+	var alive []ServerItem
 	for addr, s := range r.servers {
 		if r.timeout == 0 || s.start.Add(r.timeout).After(time.Now()) {
-			alive = append(alive, addr)
+			alive = append(alive, *s)
 		} else {
 			delete(r.servers, addr)
 		}
 	}
-	sort.Strings(alive)
+	sort.Slice(alive, func(i, j int) bool { return alive[i].Addr < alive[j].Addr })
 	return alive
 }
 
+// addrEscaper 转义地址中的逗号, 客户端见 xclient.MiniRegisterDiscovery
+var addrEscaper = strings.NewReplacer("%", "%25", ",", "%2C")
+
 func (r *MiniRegister) ServeHTTP(w http.ResponseWriter, req *http.Request) {
 	switch req.Method {
 	case "GET":
-		w.Header().Set("X-Minirpc-Servers", strings.Join(r.aliveServers(), ","))
+		// 所有的地址用逗号连接放在一个值中, unix@ 地址的路径中可能包含逗号, 需要转义, 没有逗号的地址保持不变
+		alive := r.aliveServers()
+		addrs := make([]string, 0, len(alive))
+		for _, s := range alive {
+			addrs = append(addrs, addrEscaper.Replace(s.Addr))
+		}
+		w.Header().Set("X-Minirpc-Servers", strings.Join(addrs, ","))
+		for _, s := range alive {
+			// 元数据放在单独的头部, 每项一个值, 格式为 "<key>=<value> <addr>", 旧的客户端不受影响
+			keys := make([]string, 0, len(s.Metadata))
+			for k := range s.Metadata {
+				keys = append(keys, k)
+			}
+			sort.Strings(keys)
+			for _, k := range keys {
+				w.Header().Add("X-Minirpc-Metadata", k+"="+s.Metadata[k]+" "+s.Addr)
+			}
+		}
 	case "POST":
 		addr := req.Header.Get("X-Minirpc-Server")
 		if addr == "" {
 			w.WriteHeader(http.StatusInternalServerError)
 			return
 		}
-		r.putServer(addr)
+		var md map[string]string
+		for _, kv := range req.Header.Values("X-Minirpc-Metadata") {
+			if k, v, ok := strings.Cut(kv, "="); ok && k != "" && !strings.ContainsAny(k+v, " ") {
+				if md == nil {
+					md = make(map[string]string)
+				}
+				md[k] = v
+			}
+		}
+		r.putServer(addr, md)
 	default:
 		w.WriteHeader(http.StatusMethodNotAllowed)
 	}
@@ -91,25 +125,44 @@ func HandleHTTP() {
 }
 
 func Heartbeat(registry, addr string, duration time.Duration) {
+	HeartbeatWithMetadata(registry, addr, nil, duration)
+}
+
+// HeartbeatWithWeight 与 Heartbeat 相同, 同时把实例的权重告诉注册中心, 用于 xclient.WeightedRandomSelect
+// 逐步调整金丝雀实例的权重就可以逐步切换流量, weight 为 0 表示不设置, 客户端按权重 1 处理
+func HeartbeatWithWeight(registry, addr string, weight int, duration time.Duration) {
+	var md map[string]string
+	if weight > 0 {
+		md = map[string]string{"weight": strconv.Itoa(weight)}
+	}
+	HeartbeatWithMetadata(registry, addr, md, duration)
+}
+
+// HeartbeatWithMetadata 与 Heartbeat 相同, 同时把实例的元数据告诉注册中心, 客户端通过 xclient.MiniRegisterDiscovery 读取
+// 例如 weight 是 WeightedRandomSelect 使用的权重, partition 是分片路由使用的分片编号; 键和值都不能包含空格
+func HeartbeatWithMetadata(registry, addr string, md map[string]string, duration time.Duration) {
 	if duration == 0 {
 		duration = defaultTimeout - time.Duration(1)*time.Minute
 	}
 	var err error
-	err = sendHeartbeat(registry, addr)
+	err = sendHeartbeat(registry, addr, md)
 	go func() {
 		t := time.NewTicker(duration)
 		for err == nil {
 			<-t.C
-			err = sendHeartbeat(registry, addr)
+			err = sendHeartbeat(registry, addr, md)
 		}
 	}()
 }
 
-func sendHeartbeat(registry, addr string) error {
+func sendHeartbeat(registry, addr string, md map[string]string) error {
 	log.Println(addr, "send heart beat to register", registry)
 	httpClient := &http.Client{}
 	req, _ := http.NewRequest("POST", registry, nil)
 	req.Header.Set("X-Minirpc-Server", addr)
+	for k, v := range md {
+		req.Header.Add("X-Minirpc-Metadata", k+"="+v)
+	}
 	if _, err := httpClient.Do(req); err != nil {
 		log.Println("rpc server: heart beat err: ", err)
 		return err
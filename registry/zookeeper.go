@@ -0,0 +1,82 @@
+package registry
+
+import (
+	"encoding/json"
+	"log"
+	"net/url"
+	"time"
+)
+
+// ZKConn ZKRegister 和 xclient.ZKDiscovery 使用的 ZooKeeper 操作
+// 子模块 github.com/fanyeke/minirpc/zookeeper 基于 go-zookeeper/zk 实现了这个接口, 也可以包装其他的客户端
+type ZKConn interface {
+	// ChildrenW 返回 path 的子节点, 以及子节点变化时关闭的 channel (一次性的 watch); path 不存在时没有子节点
+	ChildrenW(path string) ([]string, <-chan struct{}, error)
+	// Get 返回节点的数据, 节点不存在时返回错误
+	Get(path string) ([]byte, error)
+	// CreateEphemeral 创建临时节点, 不存在的父节点作为持久节点一并创建
+	CreateEphemeral(path string, data []byte) error
+	// ExistsW 返回节点是否存在, 以及节点创建, 删除或者修改时关闭的 channel (一次性的 watch)
+	ExistsW(path string) (bool, <-chan struct{}, error)
+	Delete(path string) error
+}
+
+// zkRetry 操作失败之后重试之前等待的时间
+const zkRetry = time.Second
+
+// ZKRegister 在 path 下为 addr 创建临时节点, 节点名是转义后的地址, 数据是 md 编码成的 JSON 对象, 客户端通过 xclient.ZKDiscovery 读取
+// 进程退出之后会话过期, 节点被 ZooKeeper 删除; 后台 watch 自己的节点, 会话过期重连之后节点被删除时重新创建
+// 返回的 unregister 停止 watch 并删除节点, 服务正常关闭时调用
+func ZKRegister(conn ZKConn, path, addr string, md map[string]string) (unregister func() error, err error) {
+	var data []byte
+	if md != nil {
+		if data, err = json.Marshal(md); err != nil {
+			return nil, err
+		}
+	}
+	node := path + "/" + url.PathEscape(addr)
+	watch, err := zkEnsure(conn, node, data)
+	if err != nil {
+		return nil, err
+	}
+	stop, done := make(chan struct{}), make(chan struct{})
+	go func() {
+		defer close(done)
+		var err error
+		for {
+			select {
+			case <-watch:
+			case <-stop:
+				return
+			}
+			for watch, err = zkEnsure(conn, node, data); err != nil; watch, err = zkEnsure(conn, node, data) {
+				log.Println("rpc server: zookeeper register err:", err)
+				select {
+				case <-time.After(zkRetry):
+				case <-stop:
+					return
+				}
+			}
+		}
+	}()
+	return func() error {
+		close(stop)
+		<-done
+		return conn.Delete(node)
+	}, nil
+}
+
+// zkEnsure 节点不存在时创建节点, 返回节点的 watch
+func zkEnsure(conn ZKConn, node string, data []byte) (<-chan struct{}, error) {
+	exists, watch, err := conn.ExistsW(node)
+	if err != nil {
+		return nil, err
+	}
+	if !exists {
+		if err := conn.CreateEphemeral(node, data); err != nil {
+			return nil, err
+		}
+	}
+	// 节点可能是上一个会话留下的, 过期删除之后 watch 触发, 再重新创建
+	return watch, nil
+}
@@ -0,0 +1,42 @@
+package minirpc
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+)
+
+// RequestIDKey 请求 ID 在元数据中的键
+const RequestIDKey = "x-request-id"
+
+// requestIDKey 是请求 ID 在 context 中的键
+type requestIDKey struct{}
+
+// NewRequestIDContext 返回携带请求 ID 的 ctx, 使用它发出的请求沿用这个 ID, 否则客户端为每次调用生成新的 ID
+func NewRequestIDContext(ctx context.Context, id string) context.Context {
+	return context.WithValue(ctx, requestIDKey{}, id)
+}
+
+// RequestIDFromContext 返回 ctx 携带的请求 ID. 在服务端的方法中返回客户端发送的 ID,
+// 方法直接用这个 ctx 调用其他服务时 ID 会继续传递下去
+func RequestIDFromContext(ctx context.Context) (string, bool) {
+	id, ok := ctx.Value(requestIDKey{}).(string)
+	return id, ok && id != ""
+}
+
+// newRequestID 生成 16 字节的随机 ID
+func newRequestID() string {
+	var b [16]byte
+	_, _ = rand.Read(b[:])
+	return hex.EncodeToString(b[:])
+}
+
+// withRequestID 返回加入了请求 ID 的元数据, 不修改 md
+func withRequestID(md map[string]string, id string) map[string]string {
+	out := make(map[string]string, len(md)+1)
+	for k, v := range md {
+		out[k] = v
+	}
+	out[RequestIDKey] = id
+	return out
+}
@@ -0,0 +1,6 @@
+//go:build linux && !mips && !mipsle && !mips64 && !mips64le && !sparc64
+
+package minirpc
+
+// soReusePort syscall 包在 linux 上没有定义 SO_REUSEPORT, mips 和 sparc 以外的架构都是 15
+const soReusePort = 0xf
@@ -0,0 +1,13 @@
+//go:build !((linux && !mips && !mipsle && !mips64 && !mips64le && !sparc64) || darwin || dragonfly || freebsd || netbsd || openbsd)
+
+package minirpc
+
+import (
+	"errors"
+	"syscall"
+)
+
+// reusePortControl 当前平台不支持 SO_REUSEPORT
+func reusePortControl(network, address string, c syscall.RawConn) error {
+	return errors.New("rpc server: SO_REUSEPORT is not supported on this platform")
+}
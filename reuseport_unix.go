@@ -0,0 +1,16 @@
+//go:build (linux && !mips && !mipsle && !mips64 && !mips64le && !sparc64) || darwin || dragonfly || freebsd || netbsd || openbsd
+
+package minirpc
+
+import "syscall"
+
+// reusePortControl 在 bind 之前设置 SO_REUSEPORT, 多个监听可以绑定同一个地址, 由内核分配新的链接
+func reusePortControl(network, address string, c syscall.RawConn) error {
+	var err error
+	if cerr := c.Control(func(fd uintptr) {
+		err = syscall.SetsockoptInt(int(fd), syscall.SOL_SOCKET, soReusePort, 1)
+	}); cerr != nil {
+		return cerr
+	}
+	return err
+}
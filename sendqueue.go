@@ -0,0 +1,102 @@
+package minirpc
+
+import (
+	"context"
+	"fmt"
+	"sync"
+)
+
+// QueueOverflow 发送队列满时的处理方式, 见 Option.SendQueueOverflow
+type QueueOverflow int
+
+const (
+	OverflowBlock      QueueOverflow = iota // 等待队列有空位, Call 最多等到 ctx 结束, Go 等到客户端关闭
+	OverflowDropOldest                      // 丢弃队列中最早的请求, 它返回 ErrSendQueueFull
+	OverflowError                           // 新的请求立即返回 ErrSendQueueFull
+)
+
+// ErrSendQueueFull 发送队列满时被拒绝或者被丢弃的请求返回这个错误
+var ErrSendQueueFull = &Error{Code: CodeResourceExhausted, Message: "rpc client: send queue is full"}
+
+// sendQueue 已经注册但还没有写入链接的请求, 由 run 依次写入
+type sendQueue struct {
+	client   *Client
+	calls    chan *Call
+	overflow QueueOverflow
+	done     chan struct{} // stop 时关闭, 结束 run 和阻塞的 push
+	once     sync.Once
+}
+
+func newSendQueue(client *Client, size int, overflow QueueOverflow) *sendQueue {
+	return &sendQueue{client: client, calls: make(chan *Call, size), overflow: overflow, done: make(chan struct{})}
+}
+
+// push 把已经注册的 call 放入队列, 失败时结束它
+// 队列中的请求仍然在 pending 中, 客户端关闭时由 terminateCalls 结束, 不需要在这里处理
+func (q *sendQueue) push(ctx context.Context, call *Call) {
+	switch q.overflow {
+	case OverflowError:
+		select {
+		case q.calls <- call:
+		default:
+			q.client.failCall(call.Seq, ErrSendQueueFull)
+		}
+	case OverflowDropOldest:
+		for {
+			select {
+			case q.calls <- call:
+				return
+			default:
+			}
+			select {
+			case old := <-q.calls:
+				q.client.failCall(old.Seq, ErrSendQueueFull)
+			default:
+			}
+		}
+	default:
+		select {
+		case q.calls <- call:
+		case <-ctx.Done():
+			q.client.failCall(call.Seq, fmt.Errorf("rpc client: call failed: %w", ctx.Err()))
+		case <-q.done:
+			q.client.failCall(call.Seq, ErrShutdown)
+		}
+	}
+}
+
+// run 把队列中的请求写入链接, 一次取出当前所有的请求, 合并到一次 Flush 中发送
+func (q *sendQueue) run() {
+	for {
+		select {
+		case call := <-q.calls:
+			q.write(call)
+		case <-q.done:
+			return
+		}
+	}
+}
+
+// write 写入 call 以及队列中已有的请求, 最多写入队列的容量, 避免一直占用 sending
+func (q *sendQueue) write(call *Call) {
+	client := q.client
+	client.lockSending()
+	defer client.unlockSending()
+	client.writeCall(call)
+	for n := 1; n < cap(q.calls); n++ {
+		select {
+		case call := <-q.calls:
+			client.writeCall(call)
+		default:
+			return
+		}
+	}
+}
+
+// stop 结束 run, 客户端关闭时调用, 可以重复调用; q 为 nil 时直接返回
+func (q *sendQueue) stop() {
+	if q == nil {
+		return
+	}
+	q.once.Do(func() { close(q.done) })
+}
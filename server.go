@@ -1,16 +1,20 @@
 package minirpc
 
 import (
-	"encoding/json"
+	"bufio"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
 	"errors"
 	"fmt"
 	"io"
-	"log"
+	"log/slog"
 	"net"
 	"net/http"
 	"reflect"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/fanyeke/minirpc/codec"
@@ -23,36 +27,140 @@ const (
 )
 
 // | Option{MagicNumber: xxx, CodecType: xxx} | Header{ServiceMethod ...} | Body interface{} |
-// | <------      固定 JSON 编码      ------>  | <-------   编码方式由 CodeType 决定   ------->|
+// | <-----    固定长度的二进制前导    ----->  | <-------   编码方式由 CodeType 决定   ------->|
 // 传输实例:
 // | Option | Header1 | Body1 | Header2 | Body2 | ...
+// 其中每个 `Header` 和 `Body` 都是一个带长度前缀的帧, 见 codec.WriteFrame
 
 const MagicNumber = 0x3bef5c
 
-// Option 固定 JSON 编码, 用于定义之后的传输编码方式
+// Option 握手时编码成固定长度的二进制前导, 用于定义之后的传输编码方式, 见 handshake.go
 type Option struct {
-	MagicNumber    int           // 标记是否为 rpc 请求
-	CodecType      codec.Type    // 编解码方式
-	ConnectTimeout time.Duration // 建立链接超时
-	HandleTimeout  time.Duration // 请求处理超时
+	MagicNumber       int                 // 标记是否为 rpc 请求
+	ProtocolVersion   int                 // 客户端支持的最高协议版本, 服务端会回复协商之后的版本
+	CodecType         codec.Type          // 编解码方式
+	Checksum          bool                // 每一帧都携带 CRC32 校验和
+	CompressType      codec.CompressType  // 期望的压缩方式, 服务端不支持时退化为不压缩
+	CompressThreshold int                 // 只压缩超过这个字节数的 `Body`, 0 表示全部压缩
+	MaxRecvMsgSize    int                 // 客户端允许接收的最大消息, 服务端不会发送超过这个大小的响应, 0 表示 DefaultMaxMsgSize, 小于 0 表示不限制
+	MaxSendMsgSize    int                 // 客户端允许发送的最大消息, 0 表示 DefaultMaxMsgSize, 小于 0 表示不限制
+	ConnectTimeout    time.Duration       // 建立链接超时
+	HandleTimeout     time.Duration       // 请求处理超时
+	TLSConfig         *tls.Config         `json:"-"` // DialTLS 使用的 TLS 配置, 为空时使用默认配置, 不参与握手
+	Transport         Transport           `json:"-"` // 客户端建立底层链接的方式, 为空时使用 net.DialTimeout, 不参与握手
+	Proxy             ProxyFunc           `json:"-"` // 客户端使用的 HTTP CONNECT 或 socks5 代理, 例如 ProxyFromEnvironment, 不参与握手
+	Observer          RequestObserver     `json:"-"` // 客户端每个请求完成后调用, 用于导出监控指标, 不参与握手
+	Interceptors      []ClientInterceptor `json:"-"` // 依次包装 Client.Call, 第一个在最外层, Client.Use 加入的在它们之后, 不参与握手
+	SlowCallThreshold time.Duration       `json:"-"` // 大于 0 时, Client.Call 等待超过这个时间的请求会被记录到日志, 不参与握手
+	Logger            *Logger             `json:"-"` // 客户端输出日志的级别和采样, 为空时输出 Info 及以上级别的日志, 不参与握手
+	WireDump          *WireDump           `json:"-"` // 不为空时输出链接上传输的数据, 用于调试, 不参与握手
+	Reconnect         *ReconnectPolicy    `json:"-"` // 不为空时 Dial 等函数创建的客户端在链接断开之后自动重连, 不参与握手
+	Keepalive         *KeepaliveParams    `json:"-"` // 不为空时客户端在链接空闲时发送 ping, 并检测服务端是否存活, 不参与握手
+	// MaxPendingCalls 客户端同时未完成的请求数的上限, 0 表示不限制, 服务端失去响应时避免 pending 无限增长, 不参与握手
+	// 达到上限时新的请求返回 ErrTooManyPending, 设置了 BlockOnPendingLimit 时等待其他请求完成, Call 最多等到 ctx 结束
+	MaxPendingCalls     int  `json:"-"`
+	BlockOnPendingLimit bool `json:"-"`
+	// SendQueueSize 大于 0 时请求先放入这个大小的队列, 由单独的 goroutine 写入链接, 网络慢时调用方不会阻塞在写入上, 不参与握手
+	// 队列满时按 SendQueueOverflow 处理; Notify 和取消请求等控制消息不经过队列
+	SendQueueSize     int           `json:"-"`
+	SendQueueOverflow QueueOverflow `json:"-"`
+	// ConnsPerAddr XClient 与每个服务实例建立的链接数, 请求轮流使用它们, 0 表示 1, 见 ClientPool, 不参与握手
+	ConnsPerAddr int `json:"-"`
 }
 
+// DefaultMaxMsgSize 没有设置 MaxRecvMsgSize 和 MaxSendMsgSize 时的消息大小限制, 对端声明的超长消息在分配内存之前就被拒绝
+const DefaultMaxMsgSize = 4 << 20
+
 // DefaultOption 默认编码方式
 var DefaultOption = &Option{
-	MagicNumber:    MagicNumber,
-	CodecType:      codec.GobType,
-	ConnectTimeout: 10 * time.Second, // 连接超时设置为10s
+	MagicNumber:     MagicNumber,
+	ProtocolVersion: CurrentProtocolVersion,
+	CodecType:       codec.GobType,
+	ConnectTimeout:  10 * time.Second, // 连接超时设置为10s
 }
 
 type Server struct {
-	serviceMap sync.Map
+	serviceMap     sync.Map
+	MaxRecvMsgSize int // 服务端允许接收的最大消息, 0 表示 DefaultMaxMsgSize, 小于 0 表示不限制, 与客户端声明的限制取较小值
+	MaxSendMsgSize int // 服务端允许发送的最大消息, 0 表示 DefaultMaxMsgSize, 小于 0 表示不限制, 与客户端声明的限制取较小值
+	// GobSafeMode 开启后, gob 编码的请求参数在解码之前会先检查其中声明的类型,
+	// 只接受目标方法的参数类型及其字段用到的类型, 防止对端构造任意类型消耗内存
+	GobSafeMode bool
+	// TLSConfig ServeTLS 使用的 TLS 配置, 为空时使用默认配置
+	TLSConfig *tls.Config
+	// ClientCAs 不为空时开启双向认证, ServeTLS 只接受由其中的 CA 签发的客户端证书
+	// 方法可以通过 ClientIdentity 获取客户端证书, 用于鉴权
+	ClientCAs *x509.CertPool
+	// MaxConnections 同时服务的最大链接数, 0 表示不限制
+	// 超过时新的链接在握手之前就被关闭, 并计入 RejectedConnections
+	MaxConnections int
+	// MaxConcurrentRequests 所有链接同时处理的最大请求数, MaxRequestsPerConn 每个链接同时处理的最大请求数, 0 表示不限制
+	// 达到限制时默认停止读取这个链接上的请求, 直到有请求处理完成; RejectWhenBusy 为 true 时直接回复 ErrServerBusy
+	MaxConcurrentRequests int
+	MaxRequestsPerConn    int
+	RejectWhenBusy        bool
+	// Workers 大于 0 时使用固定数量的 goroutine 处理所有链接的请求, 同时执行的方法不会超过这个数量,
+	// 所有 worker 都在忙时停止读取新的请求; 0 表示每个请求使用一个新的 goroutine
+	// 注意设置了 HandleTimeout 时, 超时的方法会在 worker 之外继续执行
+	Workers int
+	// Acceptors 大于 1 时 ListenAndServe 使用 SO_REUSEPORT 打开多个监听同一个地址的 socket,
+	// 每个 socket 由单独的 goroutine 接受链接, 由内核在它们之间分配新的链接; 不支持的平台上返回错误
+	Acceptors int
+	// Observer 不为空时, 每个交给方法处理的请求完成后调用 Observer.ObserveRequest, 用于导出监控指标
+	// 找不到方法和无法解码的请求不会被记录, 避免客户端发送任意的 ServiceMethod 导致指标无限增长
+	Observer RequestObserver
+	// Interceptors 依次包装每一次方法调用, 第一个在最外层, 用于链路追踪, 鉴权, 日志等, 需要在开始服务之前设置
+	Interceptors []ServerInterceptor
+	// SlowRequestThreshold 大于 0 时, 方法执行超过这个时间的请求会被记录到日志, 包括方法, 请求大小, 耗时和客户端地址
+	SlowRequestThreshold time.Duration
+	// Logger 服务端输出日志的级别和采样, 为空时输出 Info 及以上级别的日志, 需要在开始服务之前设置
+	Logger *Logger
+	// WireDump 不为空时输出每个链接上传输的原始字节或者 `Header` 摘要, 用于排查编解码的问题, 会明显降低性能
+	WireDump *WireDump
+
+	activeConns   atomic.Int64  // 正在服务的链接数
+	rejectedConns atomic.Uint64 // 因为超过 MaxConnections 被拒绝的链接数
+	queuedReqs    atomic.Int64  // 已经读取但是还在等待名额或者 worker 的请求数
+	activeReqs    atomic.Int64  // 正在处理的请求数
+
+	mu         sync.Mutex // 保护下面的字段
+	listeners  map[net.Listener]struct{}
+	conns      map[*serverConn]struct{}
+	inShutdown bool           // 已经调用了 Shutdown
+	requests   chan struct{}  // MaxConcurrentRequests 对应的信号量, 第一次使用时创建
+	jobs       chan func()    // 交给 worker 执行的请求, 第一次使用时启动 worker
+	done       chan struct{}  // Shutdown 完成时关闭, worker 随之退出
+	errorCodes []errorMapping // RegisterErrorCode 和 RegisterErrorType 注册的错误码
 }
 
 func (server *Server) Register(rcvr interface{}) error {
-	s := newService(rcvr)
+	return server.register(rcvr, "")
+}
+
+// RegisterName 与 Register 相同, 但是使用 name 作为服务名, 而不是结构体的名称
+// 同一个结构体的多个实例, 或者同一个服务的不同版本, 可以用不同的名称注册
+func (server *Server) RegisterName(name string, rcvr interface{}) error {
+	if name == "" {
+		return errors.New("rpc server: service name is empty")
+	}
+	return server.register(rcvr, name)
+}
+
+// register name 为空时使用结构体的名称
+func (server *Server) register(rcvr interface{}, name string) error {
+	s := newNamedService(rcvr, name)
+	// RPCMethods 中的名称写错或者签名不符合要求时尽早报错
+	for allowed := range s.exposedMethods() {
+		if s.method[allowed] == nil {
+			return fmt.Errorf("rpc server: %s.%s is not a valid method", s.name, allowed)
+		}
+	}
 	if _, dup := server.serviceMap.LoadOrStore(s.name, s); dup {
 		return errors.New("rpc: service already defined: " + s.name)
 	}
+	for name := range s.method {
+		server.Logger.logf(slog.LevelDebug, "rpc server: register %s.%s", s.name, name)
+	}
 	return nil
 }
 
@@ -60,17 +168,103 @@ func Register(rcvr interface{}) error {
 	return DefaultServer.Register(rcvr)
 }
 
+// RegisterNamespace 在命名空间 namespace 下注册服务, 服务名为 namespace.结构体名称, 例如 v2.Foo
+// 客户端使用 v2.Foo.Sum 调用, 命名空间可以包含多级, 例如 billing.v2
+func (server *Server) RegisterNamespace(namespace string, rcvr interface{}) error {
+	if namespace == "" {
+		return errors.New("rpc server: namespace is empty")
+	}
+	return server.register(rcvr, namespace+"."+reflect.Indirect(reflect.ValueOf(rcvr)).Type().Name())
+}
+
+// RegisterFunc 把函数 fn 注册为 serviceMethod, 例如 RegisterFunc("Math.Sum", func(args Args, reply *int) error)
+// fn 的签名与方法相同, 只是没有接收者, 可以是捕获了依赖的闭包
+// 服务不存在时自动创建, 也可以为已经注册的服务添加方法, 但是不能与已有的方法重名
+func (server *Server) RegisterFunc(serviceMethod string, fn interface{}) error {
+	dot := strings.LastIndex(serviceMethod, ".")
+	if dot <= 0 || dot == len(serviceMethod)-1 {
+		return errors.New("rpc server: service/method ill-formed: " + serviceMethod)
+	}
+	serviceName, methodName := serviceMethod[:dot], serviceMethod[dot+1:]
+	fv := reflect.ValueOf(fn)
+	if fv.Kind() != reflect.Func {
+		return fmt.Errorf("rpc server: %s is not a function", serviceMethod)
+	}
+	mt := newMethodType(fv.Type(), 0)
+	if mt == nil {
+		return fmt.Errorf("rpc server: %s has an unsupported signature %s", serviceMethod, fv.Type())
+	}
+	mt.fn = fv
+	// 复制一份服务再替换, 正在读取方法表的请求不受影响
+	for {
+		old, loaded := server.serviceMap.Load(serviceName)
+		s := &service{name: serviceName, method: make(map[string]*methodType)}
+		if loaded {
+			*s = *old.(*service)
+			s.method = make(map[string]*methodType, len(s.method)+1)
+			for name, m := range old.(*service).method {
+				s.method[name] = m
+			}
+		}
+		if _, dup := s.method[methodName]; dup {
+			return errors.New("rpc: method already defined: " + serviceMethod)
+		}
+		s.method[methodName] = mt
+		stored := false
+		if loaded {
+			stored = server.serviceMap.CompareAndSwap(serviceName, old, s)
+		} else {
+			_, dup := server.serviceMap.LoadOrStore(serviceName, s)
+			stored = !dup
+		}
+		if stored {
+			server.Logger.logf(slog.LevelDebug, "rpc server: register %s", serviceMethod)
+			return nil
+		}
+		// 其他 goroutine 同时修改了这个服务, 重试
+	}
+}
+
+// RegisterNamespace 在默认的 `DefaultServer` 上注册带命名空间的服务
+func RegisterNamespace(namespace string, rcvr interface{}) error {
+	return DefaultServer.RegisterNamespace(namespace, rcvr)
+}
+
+// RegisterFunc 在默认的 `DefaultServer` 上注册函数
+func RegisterFunc(serviceMethod string, fn interface{}) error {
+	return DefaultServer.RegisterFunc(serviceMethod, fn)
+}
+
+// Unregister 移除名为 name 的服务, 之后的请求返回 can't find service 错误, 正在处理的请求不受影响
+// 移除之后可以用同样的名称注册新的实例
+func (server *Server) Unregister(name string) error {
+	if _, ok := server.serviceMap.LoadAndDelete(name); !ok {
+		return errors.New("rpc server: can't find service " + name)
+	}
+	return nil
+}
+
+// Unregister 从默认的 `DefaultServer` 移除服务
+func Unregister(name string) error {
+	return DefaultServer.Unregister(name)
+}
+
+// RegisterName 在默认的 `DefaultServer` 上使用 name 注册服务
+func RegisterName(name string, rcvr interface{}) error {
+	return DefaultServer.RegisterName(name, rcvr)
+}
+
 func (server *Server) findService(serviceMethod string) (svc *service, mtype *methodType, err error) {
 	dot := strings.LastIndex(serviceMethod, ".") // 获得函数的名称下标
 	if dot < 0 {                                 // 如果传入serviceMethod不合法写回错误
-		err = errors.New("rpc server: service/method request ill-formed: " + serviceMethod)
+		err = Errorf(CodeInvalidArgument, "rpc server: service/method request ill-formed: %s", serviceMethod)
 		return
 	}
 	// 记录请求函数的 包名 和 方法名
 	serviceName, methodName := serviceMethod[:dot], serviceMethod[dot+1:]
-	svci, ok := server.serviceMap.Load(serviceName) // 获得 `serviceMap` 中存储的值
+	svci, ok := server.lookupService(serviceName) // 获得 `serviceMap` 中存储的值
 	if !ok {
-		err = errors.New("rpc server: can't find service " + serviceName)
+		err = Errorf(CodeNotFound, "rpc server: can't find service %s", serviceName)
 		return
 	}
 	// 断言为 service 类型
@@ -78,11 +272,26 @@ func (server *Server) findService(serviceMethod string) (svc *service, mtype *me
 	// 从 service 中获取到方法
 	mtype = svc.method[methodName]
 	if mtype == nil {
-		err = errors.New("rpc server: can't find method " + methodName)
+		err = Errorf(CodeNotFound, "rpc server: can't find method %s", methodName)
 	}
 	return
 }
 
+// lookupService 查找最具体的服务: v2.Foo 没有注册时依次去掉最前面的命名空间, 回退到 Foo
+// 迁移期间 v1.Foo 和 v2.Foo 可以同时存在, 没有单独注册版本的服务也可以用带版本的名称调用
+func (server *Server) lookupService(name string) (interface{}, bool) {
+	for {
+		if svci, ok := server.serviceMap.Load(name); ok {
+			return svci, true
+		}
+		dot := strings.Index(name, ".")
+		if dot < 0 {
+			return nil, false
+		}
+		name = name[dot+1:]
+	}
+}
+
 func NewServer() *Server {
 	return &Server{}
 }
@@ -90,18 +299,119 @@ func NewServer() *Server {
 // DefaultServer 默认的 `Server`
 var DefaultServer = NewServer()
 
-// Accept 接受一个 `lis` 监听端口
+// Accept 接受一个 `lis` 监听端口, 临时错误会等待一段时间后重试
+// 调用 Shutdown 之后 lis 会被关闭, Accept 随之返回
 func (server *Server) Accept(lis net.Listener) {
+	if err := server.Serve(context.Background(), lis); err != ErrServerClosed {
+		server.Logger.logf(slog.LevelError, "rpc server: accept error: %v", err)
+	}
+}
+
+// ErrServerClosed 调用 Shutdown 之后 Serve 返回的错误
+var ErrServerClosed = errors.New("rpc server: server closed")
+
+// maxAcceptDelay 临时错误之后重试的最长等待时间
+const maxAcceptDelay = time.Second
+
+// Serve 接受 lis 上的链接, 直到 ctx 结束 (返回 ctx.Err()), 调用了 Shutdown (返回 ErrServerClosed)
+// 或者发生不可恢复的错误. 返回之前会关闭 lis
+// 临时错误 (比如 too many open files) 不会终止服务, 等待时间从 5ms 开始翻倍, 最长 1s
+// ctx 只控制是否继续接受新的链接, 已经建立的链接需要通过 Shutdown 关闭
+func (server *Server) Serve(ctx context.Context, lis net.Listener) error {
+	if !server.trackListener(lis, true) {
+		_ = lis.Close()
+		return ErrServerClosed
+	}
+	defer server.trackListener(lis, false)
+	defer func() { _ = lis.Close() }()
+	stop := context.AfterFunc(ctx, func() { _ = lis.Close() })
+	defer stop()
+
+	var delay time.Duration
 	for {
 		conn, err := lis.Accept()
 		if err != nil {
-			log.Println("rpc server: accept error:", err)
-			return
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			if server.ShuttingDown() {
+				return ErrServerClosed
+			}
+			var ne net.Error
+			if errors.As(err, &ne) && ne.Temporary() {
+				if delay == 0 {
+					delay = 5 * time.Millisecond
+				} else if delay *= 2; delay > maxAcceptDelay {
+					delay = maxAcceptDelay
+				}
+				server.Logger.sampledf(slog.LevelWarn, "rpc server: accept error: %v; retrying in %v", err, delay)
+				select {
+				case <-time.After(delay):
+				case <-ctx.Done():
+					return ctx.Err()
+				}
+				continue
+			}
+			return err
 		}
+		delay = 0
 		go server.ServerConn(conn)
 	}
 }
 
+// ListenAndServe 监听 TCP 地址 addr 并接受链接, 设置了 Acceptors 时同时运行多个接受链接的循环
+// 任意一个循环出错时关闭所有监听, 返回第一个错误; 调用 Shutdown 之后返回 ErrServerClosed
+func (server *Server) ListenAndServe(addr string) error {
+	n := server.Acceptors
+	if n <= 1 {
+		lis, err := net.Listen("tcp", addr)
+		if err != nil {
+			return err
+		}
+		return server.Serve(context.Background(), lis)
+	}
+	lc := net.ListenConfig{Control: reusePortControl}
+	listeners := make([]net.Listener, 0, n)
+	for i := 0; i < n; i++ {
+		lis, err := lc.Listen(context.Background(), "tcp", addr)
+		if err != nil {
+			for _, l := range listeners {
+				_ = l.Close()
+			}
+			return err
+		}
+		// 端口为 0 时后面的监听使用第一个监听分配到的端口
+		addr = lis.Addr().String()
+		listeners = append(listeners, lis)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	errs := make(chan error, n)
+	for _, lis := range listeners {
+		go func(lis net.Listener) {
+			err := server.Serve(ctx, lis)
+			cancel()
+			errs <- err
+		}(lis)
+	}
+	err := <-errs
+	for i := 1; i < n; i++ {
+		<-errs
+	}
+	return err
+}
+
+// ListenAndServe 使用默认的 `DefaultServer` 监听 addr
+func ListenAndServe(addr string) error {
+	return DefaultServer.ListenAndServe(addr)
+}
+
+// Serve 使用默认的 `DefaultServer` 接受链接, 见 Server.Serve
+func Serve(ctx context.Context, lis net.Listener) error {
+	return DefaultServer.Serve(ctx, lis)
+}
+
 // Accept 使用默认的 `DefaultServer` 去监听
 func Accept(lis net.Listener) {
 	DefaultServer.Accept(lis)
@@ -112,58 +422,202 @@ func (server *Server) ServerConn(conn io.ReadWriteCloser) {
 	defer func() {
 		_ = conn.Close()
 	}()
-
-	var opt Option
-	// json.NewDecoder 函数创建一个新的 JSON 解码器，
-	// 并使用 Decode 方法将从 conn 读取的 JSON 数据解码到 opt 变量中
-
-	// json.NewDecoder().Decode() 是从一个 io.Reader 中逐步读取数据，
-	// 然后解析这些数据。这意味着它不需要一次性在内存中存储整个 JSON 数据，
-	// 而是可以逐步处理数据。这在处理大型流式 JSON 数据时，可以更有效地管理内存。
-	if err := json.NewDecoder(conn).Decode(&opt); err != nil {
-		log.Println("rpc server: options error: ", opt.MagicNumber)
+	if !server.acquireConn() {
+		server.Logger.sampledf(slog.LevelWarn, "rpc server: too many connections, limit %d", server.MaxConnections)
+		return
+	}
+	defer server.activeConns.Add(-1)
+
+	// 统计链接读写的字节数, 握手也计算在内; connContext 仍然使用原始的链接
+	counters := new(connCounters)
+	dump := newWireDumper(server.WireDump, "server", conn)
+	rwc := dump.wrap(&countingConn{ReadWriteCloser: conn, counters: counters})
+	// 二进制前导按长度精确读取, 文本握手逐字节读到换行为止, 都不会读到属于第一帧的数据
+	opt, text, err := readHandshake(rwc)
+	if err != nil {
+		server.Logger.sampledf(slog.LevelWarn, "rpc server: options error: %v", err)
 		return
 	}
 
-	// 如果读取到的编码方式与默认编码方式不同
-	if opt.MagicNumber != MagicNumber {
-		log.Printf("rpc server: invalid magic number %x", opt.MagicNumber)
+	// 协商协议版本和压缩方式, 失败时把原因写回客户端之后再关闭链接
+	reply := negotiate(opt)
+	var cc codec.Codec
+	if reply.Error == "" {
+		opt.ProtocolVersion = reply.ProtocolVersion
+		opt.CompressType = reply.CompressType
+		cc = codec.NewCodecFuncMap[opt.CodecType](rwc)
+		// 客户端声明的发送限制就是服务端的接收限制, 反之亦然
+		maxRecv := minLimit(msgLimit(server.MaxRecvMsgSize), opt.MaxSendMsgSize)
+		maxSend := minLimit(msgLimit(server.MaxSendMsgSize), opt.MaxRecvMsgSize)
+		if err := configureCodec(cc, opt, maxRecv, maxSend); err != nil {
+			reply = handshakeReply{Error: err.Error()}
+		}
+	}
+	if err := writeHandshakeReply(rwc, reply, text); err != nil {
+		server.Logger.sampledf(slog.LevelWarn, "rpc server: handshake error: %v", err)
 		return
 	}
-	// 获取编解码注册的相应函数
-	f := codec.NewCodecFuncMap[opt.CodecType]
-	// 如果没有注册对应的函数
-	if f == nil {
-		log.Printf("rpc server: invalid codec type %s", opt.CodecType)
+	if reply.Error != "" {
+		server.Logger.sampledf(slog.LevelWarn, "%s", reply.Error)
 		return
 	}
+	server.serverCodec(connContext(conn, opt), cc, opt, counters, dump)
+}
+
+// acquireConn 占用一个链接名额, 超过 MaxConnections 时返回 false
+func (server *Server) acquireConn() bool {
+	n := server.activeConns.Add(1)
+	if server.MaxConnections > 0 && n > int64(server.MaxConnections) {
+		server.activeConns.Add(-1)
+		server.rejectedConns.Add(1)
+		return false
+	}
+	return true
+}
+
+// ErrServerBusy 请求数达到限制并且开启了 RejectWhenBusy 时, 客户端收到的错误
+var ErrServerBusy = &Error{Code: CodeResourceExhausted, Message: "rpc server: server busy"}
+
+// requestSem 返回 MaxConcurrentRequests 对应的信号量, 不限制时返回 nil
+func (server *Server) requestSem() chan struct{} {
+	if server.MaxConcurrentRequests <= 0 {
+		return nil
+	}
+	server.mu.Lock()
+	defer server.mu.Unlock()
+	if server.requests == nil {
+		server.requests = make(chan struct{}, server.MaxConcurrentRequests)
+	}
+	return server.requests
+}
 
-	server.serverCodec(f(conn), &opt)
+// acquire 占用信号量 sem 的一个名额, reject 为 true 时不等待, 没有名额时返回 false
+func acquire(sem chan struct{}, reject bool) bool {
+	if sem == nil {
+		return true
+	}
+	if !reject {
+		sem <- struct{}{}
+		return true
+	}
+	select {
+	case sem <- struct{}{}:
+		return true
+	default:
+		return false
+	}
+}
+
+// release 释放 acquire 占用的名额
+func release(sem chan struct{}) {
+	if sem != nil {
+		<-sem
+	}
+}
+
+// acquireRequest 同时占用链接和全局的请求名额, 失败时不占用任何名额
+func (server *Server) acquireRequest(connSem chan struct{}) bool {
+	if !acquire(connSem, server.RejectWhenBusy) {
+		return false
+	}
+	if !acquire(server.requestSem(), server.RejectWhenBusy) {
+		release(connSem)
+		return false
+	}
+	return true
+}
+
+// releaseRequest 释放 acquireRequest 占用的名额
+func (server *Server) releaseRequest(connSem chan struct{}) {
+	release(server.requestSem())
+	release(connSem)
+}
+
+// ActiveConnections 返回正在服务的链接数
+func (server *Server) ActiveConnections() int {
+	return int(server.activeConns.Load())
+}
+
+// RejectedConnections 返回因为超过 MaxConnections 被拒绝的链接总数
+func (server *Server) RejectedConnections() uint64 {
+	return server.rejectedConns.Load()
+}
+
+// QueuedRequests 返回已经读取但是还在等待请求名额或者 worker 的请求数
+func (server *Server) QueuedRequests() int {
+	return int(server.queuedReqs.Load())
+}
+
+// ActiveRequests 返回正在处理的请求数
+func (server *Server) ActiveRequests() int {
+	return int(server.activeReqs.Load())
 }
 
 // invalidRequest 是发生错误时响应 argv 的占位符
 var invalidRequest = struct{}{}
 
-// serverCodec
-func (server *Server) serverCodec(cc codec.Codec, opt *Option) {
-	sending := new(sync.Mutex) // 确保完整回复
+// serverCodec ctx 是链接对应的 context, 会传给每一个请求
+func (server *Server) serverCodec(ctx context.Context, cc codec.Codec, opt *Option, counters *connCounters, dump *wireDumper) {
 	wg := new(sync.WaitGroup)
+	// sending 确保完整回复
+	sc := &serverConn{cc: cc, sending: new(sync.Mutex), counters: counters, dump: dump, since: time.Now()}
+	sc.peer, _ = Peer(ctx)
+	if !server.trackConn(sc, true) {
+		// 握手期间开始关闭, 立即通知客户端
+		server.goAway(sc)
+	}
+	defer server.trackConn(sc, false)
+	var connSem chan struct{}
+	if server.MaxRequestsPerConn > 0 {
+		connSem = make(chan struct{}, server.MaxRequestsPerConn)
+	}
 	for {
 		// 从 `socket` 链接实例中获取请求
-		req, err := server.readRequest(cc)
+		req, err := server.readRequest(sc)
 		if err != nil {
 			// 请求为空, 忽略并跳过此次轮询
 			if req == nil {
 				break
 			}
-			req.h.Error = err.Error()
+			server.Logger.sampledf(slog.LevelWarn, "rpc server: request %s %s: %v", req.md[RequestIDKey], req.h.ServiceMethod, err)
+			setError(req.h, err)
+			// 错误响应的 `Body` 会被丢弃, 使用链接的编码方式, 避免请求声明的编码方式无法使用
+			req.h.ContentType = ""
 			// 将错误写回响应, 不进行处理
-			server.sendResponse(cc, req.h, invalidRequest, sending)
+			server.sendResponse(sc, req.h, invalidRequest)
+			continue
+		}
+		if req.h.ServiceMethod == cancelMethod {
+			sc.cancel(req.h.Seq)
+			continue
+		}
+		// 原样回复 ping
+		if req.h.ServiceMethod == pingMethod {
+			server.sendResponse(sc, req.h, invalidRequest)
+			continue
+		}
+		server.queuedReqs.Add(1)
+		// 达到请求数限制时等待其他请求完成, 或者直接拒绝
+		if !server.acquireRequest(connSem) {
+			server.queuedReqs.Add(-1)
+			server.Logger.sampledf(slog.LevelWarn, "rpc server: request %s %s: %v", req.md[RequestIDKey], req.h.ServiceMethod, ErrServerBusy)
+			server.startObservation(req.h.ServiceMethod).done(CodeResourceExhausted)
+			setError(req.h, ErrServerBusy)
+			req.h.ContentType = ""
+			server.sendResponse(sc, req.h, invalidRequest)
 			continue
 		}
 		wg.Add(1)
-		// 处理请求
-		go server.handleRequest(cc, req, sending, wg, opt.HandleTimeout)
+		// 处理请求, 客户端可以通过 cancelMethod 取消
+		reqCtx := sc.track(ctx, req.h.Seq)
+		server.dispatch(func() {
+			server.queuedReqs.Add(-1)
+			server.activeReqs.Add(1)
+			defer server.activeReqs.Add(-1)
+			defer server.releaseRequest(connSem)
+			defer sc.untrack(req.h.Seq)
+			server.handleRequest(reqCtx, sc, req, wg, opt.HandleTimeout)
+		})
 	}
 	wg.Wait()
 	_ = cc.Close()
@@ -171,32 +625,54 @@ func (server *Server) serverCodec(cc codec.Codec, opt *Option) {
 
 type request struct {
 	h            *codec.Header
+	md           map[string]string // 请求携带的元数据
+	timeout      time.Duration     // 客户端剩余的等待时间, 0 表示不限制
+	expires      time.Time         // 请求过期的时间, 零值表示不过期
+	size         int               // 请求 `Body` 的字节数, 编解码器不支持时为 0
 	argv, replyv reflect.Value
 	mtype        *methodType
 	svc          *service
 }
 
 // readRequestHeader 读取请求 `Header`
-func (server *Server) readRequestHeader(cc codec.Codec) (*codec.Header, error) {
+func (server *Server) readRequestHeader(sc *serverConn) (*codec.Header, error) {
 	var h codec.Header
-	if err := cc.ReadHeader(&h); err != nil {
+	if err := sc.cc.ReadHeader(&h); err != nil {
 		if err != io.EOF && err != io.ErrUnexpectedEOF {
-			log.Println("rpc server: read header error: ", err)
+			server.Logger.sampledf(slog.LevelWarn, "rpc server: read header error: %v", err)
 		}
+		sc.dump.readError(err)
 		return nil, err
 	}
+	sc.counters.framesRead.Add(1)
+	sc.dump.header("<-", &h)
 	return &h, nil
 }
 
 // readRequest 读取请求
-func (server *Server) readRequest(cc codec.Codec) (*request, error) {
-	h, err := server.readRequestHeader(cc)
+func (server *Server) readRequest(sc *serverConn) (*request, error) {
+	cc := sc.cc
+	h, err := server.readRequestHeader(sc)
 	if err != nil {
 		return nil, err
 	}
-	req := &request{h: h}
+	// 取消请求和 ping 的控制消息只有 `Header` 有意义
+	if h.ServiceMethod == cancelMethod || h.ServiceMethod == pingMethod {
+		if err := cc.ReadBody(nil); err != nil {
+			return nil, err
+		}
+		return &request{h: h}, nil
+	}
+	// 响应复用请求的 `Header`, 请求的元数据和剩余时间不需要原样发回
+	req := &request{h: h, md: h.Metadata, timeout: h.Timeout}
+	if h.Expires != 0 {
+		req.expires = time.Unix(0, h.Expires)
+	}
+	h.Metadata, h.Timeout, h.Expires = nil, 0, 0
 	req.svc, req.mtype, err = server.findService(h.ServiceMethod)
 	if err != nil {
+		// 丢弃这个请求的 `Body` 帧, 保证后续的请求不会错位
+		_ = cc.ReadBody(nil)
 		return req, err
 	}
 	// 使用之前要先初始化, 创建出入参实例
@@ -206,45 +682,133 @@ func (server *Server) readRequest(cc codec.Codec) (*request, error) {
 	if req.argv.Type().Kind() != reflect.Ptr {
 		argvi = req.argv.Addr().Interface()
 	}
-	if err = cc.ReadBody(argvi); err != nil {
-		log.Println("rpc server: read argv err: ", err)
+	if err = server.readArgv(cc, req.mtype, argvi); err != nil {
+		server.Logger.sampledf(slog.LevelWarn, "rpc server: read argv err: %v", err)
 		return req, err
 	}
+	if bs, ok := cc.(bodySizer); ok {
+		req.size = bs.BodySize()
+	}
 	return req, nil
 }
 
+// allowedBodyReader 支持 gob 安全模式的编解码器, 见 codec.GobCodec.ReadBodyAllowed
+type allowedBodyReader interface {
+	ReadBodyAllowed(body interface{}, allowed func(name string) bool) error
+}
+
+// bodySizer 可以返回上一个读到和写入的 `Body` 的字节数的编解码器, 见 codec.FrameConn.BodySize
+type bodySizer interface {
+	BodySize() int
+	SentBodySize() int
+}
+
+// readArgv 读取请求参数, 安全模式下 gob 编码的参数只允许目标方法用到的类型
+func (server *Server) readArgv(cc codec.Codec, mtype *methodType, argvi interface{}) error {
+	if ac, ok := cc.(allowedBodyReader); ok && server.GobSafeMode {
+		return ac.ReadBodyAllowed(argvi, mtype.allowsGobType)
+	}
+	return cc.ReadBody(argvi)
+}
+
 // sendRespense 写回响应
-func (server *Server) sendResponse(cc codec.Codec, h *codec.Header, body interface{}, sending *sync.Mutex) {
-	sending.Lock()
-	defer sending.Unlock()
+func (server *Server) sendResponse(sc *serverConn, h *codec.Header, body interface{}) {
+	// 单向请求不需要回复, 错误已经记录在日志中
+	if h.OneWay {
+		return
+	}
+	sc.sending.Lock()
+	defer sc.sending.Unlock()
 
+	cc := sc.cc
 	if err := cc.Write(h, body); err != nil {
-		log.Println("rpc server: write response error:", err)
+		server.Logger.sampledf(slog.LevelError, "rpc server: write response error: %v", err)
+		// 响应在写入之前就失败了 (比如超过大小限制), 链接仍然可用, 把错误告诉客户端
+		var encodeErr *codec.EncodeError
+		switch {
+		case !errors.As(err, &encodeErr):
+		case h.Error == "":
+			setError(h, err)
+			err = cc.Write(h, invalidRequest)
+		case h.ErrorDetails != "":
+			// 错误详情无法编码, 只发送错误信息
+			h.ErrorDetails = ""
+			err = cc.Write(h, invalidRequest)
+		}
+		if err != nil {
+			return
+		}
 	}
+	sc.counters.framesWritten.Add(1)
+	sc.dump.header("->", h)
 }
 
 // handleRequest 处理请求
-func (server *Server) handleRequest(cc codec.Codec, req *request, sending *sync.Mutex, wg *sync.WaitGroup, timeout time.Duration) {
-
+func (server *Server) handleRequest(ctx context.Context, sc *serverConn, req *request, wg *sync.WaitGroup, timeout time.Duration) {
 	defer wg.Done()
+	obs := server.startObservation(req.h.ServiceMethod)
+	// 客户端剩余的时间比 HandleTimeout 更短时以客户端为准, 方法可以通过 ctx 感知超时
+	if req.timeout > 0 && (timeout == 0 || req.timeout < timeout) {
+		timeout = req.timeout
+	}
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+	// 客户端发送的元数据通过 FromIncomingContext 读取
+	if req.md != nil {
+		ctx = context.WithValue(ctx, incomingMDKey{}, req.md)
+	}
+	// 方法通过 RequestIDFromContext 读取请求 ID
+	requestID := req.md[RequestIDKey]
+	if requestID != "" {
+		ctx = NewRequestIDContext(ctx, requestID)
+	}
+	// 方法通过 SetTrailer 设置响应的元数据
+	tr := &trailer{}
+	ctx = context.WithValue(ctx, trailerKey{}, tr)
+	// 在排队期间已经被客户端取消的请求不再处理
+	if canceledByClient(ctx) {
+		obs.done(CodeCanceled)
+		return
+	}
+	// 在排队期间已经过期的请求不再调用方法, 避免过载时做无用功
+	if !req.expires.IsZero() && time.Now().After(req.expires) {
+		setError(req.h, Errorf(CodeDeadlineExceeded, "rpc server: request expired before handling"))
+		server.Logger.sampledf(slog.LevelWarn, "rpc server: request %s %s: %s", requestID, req.h.ServiceMethod, req.h.Error)
+		obs.done(CodeDeadlineExceeded)
+		server.sendResponse(sc, req.h, invalidRequest)
+		return
+	}
 	// struct{}{} 类型的 channel 很明显就是为了传输信号
 	called := make(chan struct{})
 	sent := make(chan struct{})
 	go func() {
-		// 调用包含在请求字段的方法
-		err := req.svc.call(req.mtype, req.argv, req.replyv)
+		// 调用包含在请求字段的方法, 设置了拦截器时经过拦截器
+		err := server.invoke(ctx, req)
+		server.logSlowRequest(ctx, req, requestID, time.Since(obs.start))
 		// 方法调用完毕, 通知 called
 		called <- struct{}{}
+		// 客户端已经取消了请求, 不需要响应
+		if canceledByClient(ctx) {
+			obs.done(CodeCanceled)
+			sent <- struct{}{}
+			return
+		}
+		req.h.Metadata = tr.metadata()
 		if err != nil {
+			server.Logger.sampledf(slog.LevelInfo, "rpc server: request %s %s: %v", requestID, req.h.ServiceMethod, err)
 			// 出错误了, 把错误携带上
-			req.h.Error = err.Error()
-			// 响应请求
-			server.sendResponse(cc, req.h, invalidRequest, sending)
+			// 响应请求, 错误带有详情时一起发送
+			obs.done(codeOf(err))
+			server.sendResponse(sc, req.h, server.errorBody(req.h, err))
 			// 响应已经发送
 			sent <- struct{}{}
 			return
 		}
-		server.sendResponse(cc, req.h, req.replyv.Interface(), sending)
+		obs.done(CodeOK)
+		server.sendResponse(sc, req.h, req.replyv.Interface())
 		sent <- struct{}{}
 	}()
 	// 没有超时控制则一直阻塞等待, 直到请求处理完毕并且发送了响应
@@ -256,39 +820,89 @@ func (server *Server) handleRequest(cc codec.Codec, req *request, sending *sync.
 	// 有超时控制
 	select {
 	case <-time.After(timeout):
-		req.h.Error = fmt.Sprintf("rpc server: request timeout: expect within %s", timeout)
-		server.sendResponse(cc, req.h, invalidRequest, sending)
+		if canceledByClient(ctx) {
+			obs.done(CodeCanceled)
+			return
+		}
+		setError(req.h, Errorf(CodeDeadlineExceeded, "rpc server: request handle timeout: expect within %s", timeout))
+		server.Logger.sampledf(slog.LevelWarn, "rpc server: request %s %s: %s", requestID, req.h.ServiceMethod, req.h.Error)
+		obs.done(CodeDeadlineExceeded)
+		server.sendResponse(sc, req.h, invalidRequest)
 	case <-called:
 		<-sent
 	}
 }
 
+// logSlowRequest 记录执行时间超过 SlowRequestThreshold 的请求
+func (server *Server) logSlowRequest(ctx context.Context, req *request, requestID string, elapsed time.Duration) {
+	if server.SlowRequestThreshold <= 0 || elapsed < server.SlowRequestThreshold {
+		return
+	}
+	peer := "unknown"
+	if p, ok := Peer(ctx); ok && p.Addr != nil {
+		peer = p.Addr.String()
+	}
+	server.Logger.sampledf(slog.LevelWarn, "rpc server: slow request %s %s from %s: took %s, %d bytes", requestID, req.h.ServiceMethod, peer, elapsed, req.size)
+}
+
+// invoke 经过 Interceptors 调用请求的方法, 方法返回的错误先按 RegisterErrorCode 设置错误码, 拦截器看到的是转换之后的错误
+func (server *Server) invoke(ctx context.Context, req *request) error {
+	call := func(ctx context.Context) error {
+		if err := req.svc.call(ctx, req.mtype, req.argv, req.replyv); err != nil {
+			return server.translateError(err)
+		}
+		return nil
+	}
+	if len(server.Interceptors) == 0 {
+		return call(ctx)
+	}
+	info := &CallInfo{ServiceMethod: req.h.ServiceMethod, Seq: req.h.Seq, RequestBytes: req.size}
+	if p, ok := Peer(ctx); ok {
+		info.CodecType = p.CodecType
+		if p.Addr != nil {
+			info.Addr = p.Addr.String()
+		}
+	}
+	return interceptHandle(ctx, server.Interceptors, info, req.argv.Interface(), req.replyv.Interface(), call)
+}
+
 // ServeHTTP 实现了一个 http.Handler，用于响应 RPC 请求
 func (server *Server) ServeHTTP(w http.ResponseWriter, req *http.Request) {
 	// minirpc http请求响应不需要很大的拓展性, rpc通信开始的时候执行, 只需要支持 "CONNECT" 即可
 	if req.Method != "CONNECT" {
 		// 向响应的头部加入指定的字符串
-		w.Header().Set("Connect-Type", "text/plain; charset=utf-8")
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
 		w.WriteHeader(http.StatusMethodNotAllowed)
 		_, _ = io.WriteString(w, "405 must CONNECT\n")
 		return
 	}
 	// Hijack 允许调用者接管连接
-	conn, _, err := w.(http.Hijacker).Hijack()
+	conn, buf, err := w.(http.Hijacker).Hijack()
 	if err != nil {
-		log.Print("rpc hijacking", req.RemoteAddr, ": ", err.Error())
+		server.Logger.sampledf(slog.LevelWarn, "rpc hijacking %s: %v", req.RemoteAddr, err)
 		return
 	}
 	// 写入信息
 	_, _ = io.WriteString(conn, "HTTP/1.0 "+connected+"\n\n")
-	server.ServerConn(conn)
+	// 客户端可能没有等待响应就发送了握手, 这部分数据已经被读进了 buf
+	server.ServerConn(&hijackedConn{Conn: conn, r: buf.Reader})
+}
+
+// hijackedConn 优先读取 Hijack 时已经缓冲的数据, 写和关闭仍然使用原始链接
+type hijackedConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func (c *hijackedConn) Read(p []byte) (int, error) {
+	return c.r.Read(p)
 }
 
 // HandleHTTP 为 rpcPath 上的 RPC 消息注册 HTTP 处理程序
 func (server *Server) HandleHTTP() {
 	http.Handle(defaultPRCPath, server)
 	http.Handle(defaultDebugPath, debugHTTP{server})
-	log.Println("rpc server debug path:", defaultDebugPath)
+	server.Logger.logf(slog.LevelDebug, "rpc server debug path: %s", defaultDebugPath)
 }
 
 func HandleHTTP() {
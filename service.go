@@ -1,10 +1,12 @@
 package minirpc
 
 import (
+	"context"
 	"go/ast"
 	"log"
 	"reflect"
 	"sync/atomic"
+	"time"
 )
 
 type methodType struct {
@@ -12,6 +14,12 @@ type methodType struct {
 	ArgType   reflect.Type
 	ReplyType reflect.Type
 	numCalls  uint64
+	gobTypes  map[string]bool // 参数可能用到的所有类型在 gob 中的名称, 用于安全模式
+	withCtx   bool            // 方法的第一个参数是 context.Context
+	fn        reflect.Value   // 通过 RegisterFunc 注册的函数, 不需要接收者, 此时 method 为空
+	// returnsReply 方法的形式是 func (args) (reply, error), 调用时不传入 reply, 返回的结果写入 replyv
+	returnsReply bool
+	stats        methodStats // 错误次数和耗时分布, 见 Server.Stats
 }
 
 func (m *methodType) NumCalls() uint64 {
@@ -49,55 +57,143 @@ type service struct {
 	method map[string]*methodType // 存储映射的结构体符合条件的所有方法
 }
 
-// newService 初始化
+// newService 初始化, 使用结构体的名称作为服务名
 func newService(rcvr interface{}) *service {
+	return newNamedService(rcvr, "")
+}
+
+// newNamedService 使用 name 作为服务名, name 为空时使用结构体的名称
+func newNamedService(rcvr interface{}, name string) *service {
 	s := new(service)
-	s.rcvr = reflect.ValueOf(rcvr)                  // 将rcvr设置为它的内容
-	s.name = reflect.Indirect(s.rcvr).Type().Name() // 设置为它的名称
-	s.typ = reflect.TypeOf(rcvr)                    // 设置为它的类型
+	s.rcvr = reflect.ValueOf(rcvr) // 将rcvr设置为它的内容
+	s.name = name
+	s.typ = reflect.TypeOf(rcvr) // 设置为它的类型
 
-	// 如果名称不是大写开头, 说明是不可导出类型, 不可能调用到, 直接报错
-	if !ast.IsExported(s.name) {
-		log.Fatalf("rpc server: %s is not a valid service name", s.name)
+	if s.name == "" {
+		s.name = reflect.Indirect(s.rcvr).Type().Name() // 设置为它的名称
+		// 如果名称不是大写开头, 说明是不可导出类型, 不可能调用到, 直接报错
+		if !ast.IsExported(s.name) {
+			log.Fatalf("rpc server: %s is not a valid service name", s.name)
+		}
 	}
 	s.registerMethods()
 	return s
 }
 
+// MethodExposer 由服务实现, 只有 RPCMethods 返回的方法会被注册, 其余签名恰好符合要求的辅助方法不会暴露给客户端
+// 没有实现这个接口的服务注册所有符合要求的方法
+type MethodExposer interface {
+	RPCMethods() []string
+}
+
+// exposedMethods 返回允许注册的方法, 为 nil 时不限制
+func (s *service) exposedMethods() map[string]bool {
+	exposer, ok := s.rcvr.Interface().(MethodExposer)
+	if !ok {
+		return nil
+	}
+	allowed := make(map[string]bool)
+	for _, name := range exposer.RPCMethods() {
+		allowed[name] = true
+	}
+	return allowed
+}
+
 // registerMethods 注册方法
 func (s *service) registerMethods() {
 	// 初始化映射map
 	s.method = make(map[string]*methodType)
+	allowed := s.exposedMethods()
 	// 遍历结构体中的所有方法
 	for i := 0; i < s.typ.NumMethod(); i++ {
 		method := s.typ.Method(i) // 获得方法
-		mType := method.Type      // 获得方法的类型
-		// NumIn 获得入参数量 NumOut 获得出参数量
-		// * 规定返回入参必须是三个, 出参必须是一个
-		if mType.NumIn() != 3 || mType.NumOut() != 1 {
-			continue
-		}
-		// Out 返回第i个参数的类型
-		// * 规定这唯一的出参必须是error类型
-		if mType.Out(0) != reflect.TypeOf((*error)(nil)).Elem() {
+		if allowed != nil && !allowed[method.Name] {
 			continue
 		}
-		// 获得入参的第二三个的参数的类型
-		argType, replyType := mType.In(1), mType.In(2)
-		// 鉴别两个参数类型是否合法
-		if !isExportedOrBuiltinType(argType) || !isExportedOrBuiltinType(replyType) {
+		// 第 0 个参数是接收者
+		mt := newMethodType(method.Type, 1)
+		if mt == nil {
 			continue
 		}
+		mt.method = method
 		// 以上都合法, 将这个方法进行注册
-		s.method[method.Name] = &methodType{
-			method:    method,
-			ArgType:   argType,
-			ReplyType: replyType,
+		s.method[method.Name] = mt
+	}
+
+}
+
+// newMethodType 检查方法或函数的签名是否可以注册, first 是除接收者之外第一个参数的下标
+// NumIn 获得入参数量 NumOut 获得出参数量, 支持两种形式:
+// * func (args T1, reply *T2) error, reply 由服务端创建, 方法把结果写入其中
+// * func (args T1) (T2, error), 服务端把返回的结果作为响应
+// 两种形式都可以在参数之前多接受一个 context.Context, 用于获取链接和请求的信息
+func newMethodType(mType reflect.Type, first int) *methodType {
+	in := mType.NumIn() - first
+	withCtx := in > 0 && mType.In(first) == typeOfContext
+	if withCtx {
+		in--
+	}
+	var argType, replyType, resultType reflect.Type
+	switch {
+	case in == 2 && mType.NumOut() == 1 && mType.Out(0) == typeOfError:
+		argType, replyType = mType.In(mType.NumIn()-2), mType.In(mType.NumIn()-1)
+	case in == 1 && mType.NumOut() == 2 && mType.Out(1) == typeOfError:
+		// ReplyType 仍然使用指针, 与第一种形式共用创建和发送响应的逻辑
+		argType, resultType = mType.In(mType.NumIn()-1), mType.Out(0)
+		replyType = reflect.PointerTo(resultType)
+		if !isExportedOrBuiltinType(resultType) {
+			return nil
 		}
-		//fmt.Println(s.method[method.Name])
-		log.Printf("rpc server: register %s.%s\n", s.name, method.Name)
+	default:
+		return nil
 	}
+	// 鉴别两个参数类型是否合法
+	if !isExportedOrBuiltinType(argType) || !isExportedOrBuiltinType(replyType) {
+		return nil
+	}
+	return &methodType{
+		ArgType:      argType,
+		ReplyType:    replyType,
+		gobTypes:     collectGobTypes(argType, make(map[string]bool)),
+		withCtx:      withCtx,
+		returnsReply: resultType != nil,
+	}
+}
+
+// allowsGobType 安全模式下判断 gob payload 中声明的类型是否属于这个方法的参数
+func (m *methodType) allowsGobType(name string) bool {
+	return m.gobTypes[name]
+}
 
+// collectGobTypes 收集从 t 出发可以到达的所有类型在 gob 中的名称
+// gob 对具名类型使用 Name(), 对匿名的切片和数组使用空字符串, 对其他匿名类型 (例如 map) 使用去掉指针之后的 String()
+func collectGobTypes(t reflect.Type, names map[string]bool) map[string]bool {
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	if names[t.String()] {
+		return names // 已经访问过, 避免递归类型死循环
+	}
+	names[t.String()] = true
+	if t.Name() != "" {
+		names[t.Name()] = true
+	} else if t.Kind() == reflect.Slice || t.Kind() == reflect.Array {
+		names[""] = true
+	}
+	switch t.Kind() {
+	case reflect.Struct:
+		for i := 0; i < t.NumField(); i++ {
+			if f := t.Field(i); f.IsExported() {
+				collectGobTypes(f.Type, names)
+			}
+		}
+	case reflect.Slice, reflect.Array:
+		collectGobTypes(t.Elem(), names)
+	case reflect.Map:
+		collectGobTypes(t.Key(), names)
+		collectGobTypes(t.Elem(), names)
+	}
+	return names
 }
 
 func isExportedOrBuiltinType(t reflect.Type) bool {
@@ -105,15 +201,36 @@ func isExportedOrBuiltinType(t reflect.Type) bool {
 	return ast.IsExported(t.Name()) || t.PkgPath() == ""
 }
 
-// call 调用指定方法
-func (s *service) call(m *methodType, argv, replyv reflect.Value) error {
+var typeOfContext = reflect.TypeOf((*context.Context)(nil)).Elem()
+var typeOfError = reflect.TypeOf((*error)(nil)).Elem()
+
+// call 调用指定方法, 方法接受 context.Context 时传入 ctx
+func (s *service) call(ctx context.Context, m *methodType, argv, replyv reflect.Value) error {
 	// ? 调用次数+1
 	atomic.AddUint64(&m.numCalls, 1)
-	f := m.method.Func                                            // 取出这个方法
-	returnValues := f.Call([]reflect.Value{s.rcvr, argv, replyv}) // 执行这个方法
-	// 因为能够注册的函数第一个参数就是error类型, 因此这里的returnValues[0]就是error类型
-	if errInter := returnValues[0].Interface(); errInter != nil {
+	f := m.method.Func // 取出这个方法
+	in := []reflect.Value{s.rcvr}
+	// 注册的函数没有接收者
+	if m.fn.IsValid() {
+		f, in = m.fn, nil
+	}
+	if m.withCtx {
+		in = append(in, reflect.ValueOf(ctx))
+	}
+	in = append(in, argv)
+	if !m.returnsReply {
+		in = append(in, replyv)
+	}
+	start := time.Now()
+	returnValues := f.Call(in) // 执行这个方法
+	// 能够注册的函数最后一个返回值就是error类型
+	errInter := returnValues[len(returnValues)-1].Interface()
+	m.stats.record(time.Since(start), errInter != nil)
+	if errInter != nil {
 		return errInter.(error)
 	}
+	if m.returnsReply {
+		replyv.Elem().Set(returnValues[0])
+	}
 	return nil
 }
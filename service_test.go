@@ -1,9 +1,12 @@
 package minirpc
 
 import (
+	"context"
 	"fmt"
 	"reflect"
+	"strings"
 	"testing"
+	"time"
 )
 
 type Foo int
@@ -47,6 +50,257 @@ func TestMethodType_Call(t *testing.T) {
 	argv := mType.newArgv()
 	replyv := mType.newReplyv()
 	argv.Set(reflect.ValueOf(Args{Num1: 1, Num2: 3}))
-	err := s.call(mType, argv, replyv)
+	err := s.call(context.Background(), mType, argv, replyv)
 	_assert(err == nil && *replyv.Interface().(*int) == 4 && mType.NumCalls() == 1, "faild to call Foo.Sum")
 }
+
+func TestCollectGobTypes(t *testing.T) {
+	names := collectGobTypes(reflect.TypeOf(Args{}), make(map[string]bool))
+	_assert(names["Args"] && !names[""], "unexpected gob types %v", names)
+
+	type Batch struct {
+		Items []*Args
+		Index map[string]Args
+	}
+	names = collectGobTypes(reflect.TypeOf(&Batch{}), make(map[string]bool))
+	// 匿名的切片在 gob 中没有名称, 元素类型和 map 仍然需要在列表中
+	_assert(names["Batch"] && names[""] && names["Args"] && names["map[string]minirpc.Args"], "unexpected gob types %v", names)
+}
+
+type Brand struct{ name string }
+
+func (b *Brand) Name(_ int, reply *string) error {
+	*reply = b.name
+	return nil
+}
+
+func TestServer_RegisterName(t *testing.T) {
+	server := NewServer()
+	_assert(server.RegisterName("Red", &Brand{name: "red"}) == nil, "failed to register Red")
+	_assert(server.RegisterName("Blue", &Brand{name: "blue"}) == nil, "failed to register Blue")
+	_assert(server.RegisterName("Red", &Brand{}) != nil, "expect a duplicate service error")
+	_assert(server.RegisterName("", &Brand{}) != nil, "expect an empty name error")
+
+	client, err := server.NewPipeClient()
+	_assert(err == nil, "failed to create pipe client: %v", err)
+	defer func() { _ = client.Close() }()
+	for _, name := range []string{"Red", "Blue"} {
+		var reply string
+		err := client.Call(context.Background(), name+".Name", 0, &reply)
+		_assert(err == nil && reply == strings.ToLower(name), "failed to call %s.Name: %v %q", name, err, reply)
+	}
+	var reply string
+	err = client.Call(context.Background(), "Brand.Name", 0, &reply)
+	_assert(err != nil, "the type name should not be registered")
+}
+
+func TestServer_Unregister(t *testing.T) {
+	server := NewServer()
+	_ = server.RegisterName("Brand", &Brand{name: "old"})
+	client, err := server.NewPipeClient()
+	_assert(err == nil, "failed to create pipe client: %v", err)
+	defer func() { _ = client.Close() }()
+
+	var reply string
+	_assert(server.Unregister("Brand") == nil, "failed to unregister Brand")
+	_assert(server.Unregister("Brand") != nil, "expect an error when unregistering twice")
+	err = client.Call(context.Background(), "Brand.Name", 0, &reply)
+	_assert(err != nil && strings.Contains(err.Error(), "can't find service"), "expect service not found, got %v", err)
+
+	// 移除之后可以注册新的实例
+	_ = server.RegisterName("Brand", &Brand{name: "new"})
+	err = client.Call(context.Background(), "Brand.Name", 0, &reply)
+	_assert(err == nil && reply == "new", "expect the new instance, got %q %v", reply, err)
+}
+
+func TestServer_RegisterFunc(t *testing.T) {
+	server := NewServer()
+	offset := 10
+	err := server.RegisterFunc("Math.Sum", func(args Args, reply *int) error {
+		*reply = args.Num1 + args.Num2 + offset
+		return nil
+	})
+	_assert(err == nil, "failed to register Math.Sum: %v", err)
+	err = server.RegisterFunc("Math.Deadline", func(ctx context.Context, _ int, reply *bool) error {
+		_, *reply = ctx.Deadline()
+		return nil
+	})
+	_assert(err == nil, "failed to register Math.Deadline: %v", err)
+	// 为结构体注册的服务添加函数
+	_ = server.RegisterName("Brand", &Brand{name: "red"})
+	err = server.RegisterFunc("Brand.Upper", func(s string, reply *string) error {
+		*reply = strings.ToUpper(s)
+		return nil
+	})
+	_assert(err == nil, "failed to add a function to Brand: %v", err)
+
+	_assert(server.RegisterFunc("Math.Sum", func(Args, *int) error { return nil }) != nil, "expect a duplicate method error")
+	_assert(server.RegisterFunc("Sum", func(Args, *int) error { return nil }) != nil, "expect an ill-formed name error")
+	_assert(server.RegisterFunc("Math.Bad", func(Args) error { return nil }) != nil, "expect a signature error")
+	_assert(server.RegisterFunc("Math.Int", 1) != nil, "expect a not a function error")
+
+	client, err := server.NewPipeClient()
+	_assert(err == nil, "failed to create pipe client: %v", err)
+	defer func() { _ = client.Close() }()
+	var sum int
+	err = client.Call(context.Background(), "Math.Sum", &Args{Num1: 1, Num2: 2}, &sum)
+	_assert(err == nil && sum == 13, "failed to call Math.Sum: %v %d", err, sum)
+	var hasDeadline bool
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	err = client.Call(ctx, "Math.Deadline", 0, &hasDeadline)
+	_assert(err == nil && hasDeadline, "function should receive the request context: %v", err)
+	var s string
+	err = client.Call(context.Background(), "Brand.Upper", "abc", &s)
+	_assert(err == nil && s == "ABC", "failed to call Brand.Upper: %v", err)
+	err = client.Call(context.Background(), "Brand.Name", 0, &s)
+	_assert(err == nil && s == "red", "existing methods should still work: %v", err)
+}
+
+type Calc int
+
+func (c Calc) Add(args Args) (int, error) {
+	return args.Num1 + args.Num2, nil
+}
+
+func (c Calc) Div(ctx context.Context, args Args) (float64, error) {
+	if args.Num2 == 0 {
+		return 0, fmt.Errorf("divide by zero")
+	}
+	return float64(args.Num1) / float64(args.Num2), nil
+}
+
+func (c Calc) Pair(args Args) (*Args, error) {
+	return &Args{Num1: args.Num2, Num2: args.Num1}, nil
+}
+
+func TestServer_ResultMethods(t *testing.T) {
+	var c Calc
+	s := newService(&c)
+	_assert(len(s.method) == 3, "expect 3 methods, got %d", len(s.method))
+
+	server := NewServer()
+	_ = server.Register(&c)
+	_ = server.RegisterFunc("Str.Upper", func(s string) (string, error) { return strings.ToUpper(s), nil })
+	client, err := server.NewPipeClient()
+	_assert(err == nil, "failed to create pipe client: %v", err)
+	defer func() { _ = client.Close() }()
+
+	var sum int
+	err = client.Call(context.Background(), "Calc.Add", Args{Num1: 1, Num2: 2}, &sum)
+	_assert(err == nil && sum == 3, "failed to call Calc.Add: %v", err)
+	var q float64
+	err = client.Call(context.Background(), "Calc.Div", Args{Num1: 3, Num2: 2}, &q)
+	_assert(err == nil && q == 1.5, "failed to call Calc.Div: %v", err)
+	err = client.Call(context.Background(), "Calc.Div", Args{Num1: 3}, &q)
+	_assert(err != nil && strings.Contains(err.Error(), "divide by zero"), "expect the method error, got %v", err)
+	var pair Args
+	err = client.Call(context.Background(), "Calc.Pair", Args{Num1: 1, Num2: 2}, &pair)
+	_assert(err == nil && pair == Args{Num1: 2, Num2: 1}, "failed to call Calc.Pair: %v %+v", err, pair)
+	var upper string
+	err = client.Call(context.Background(), "Str.Upper", "abc", &upper)
+	_assert(err == nil && upper == "ABC", "failed to call Str.Upper: %v", err)
+}
+
+// Account 只暴露 Balance, Reset 的签名虽然符合要求但只供内部使用
+type Account struct{ balance int }
+
+func (a *Account) RPCMethods() []string { return []string{"Balance"} }
+
+func (a *Account) Balance(_ int, reply *int) error {
+	*reply = a.balance
+	return nil
+}
+
+func (a *Account) Reset(_ int, reply *int) error {
+	a.balance = 0
+	return nil
+}
+
+// BadAccount 在 RPCMethods 中列出了不存在的方法
+type BadAccount struct{ Account }
+
+func (a *BadAccount) RPCMethods() []string { return []string{"Balance", "Missing"} }
+
+func TestServer_MethodExposer(t *testing.T) {
+	s := newService(&Account{})
+	_assert(len(s.method) == 1 && s.method["Balance"] != nil, "only Balance should be registered, got %v", s.method)
+
+	server := NewServer()
+	_assert(server.Register(&Account{balance: 5}) == nil, "failed to register Account")
+	err := server.Register(&BadAccount{})
+	_assert(err != nil && strings.Contains(err.Error(), "Missing"), "expect an invalid method error, got %v", err)
+
+	client, _ := server.NewPipeClient()
+	defer func() { _ = client.Close() }()
+	var reply int
+	err = client.Call(context.Background(), "Account.Reset", 0, &reply)
+	_assert(err != nil && strings.Contains(err.Error(), "can't find method"), "Reset should not be exposed, got %v", err)
+	err = client.Call(context.Background(), "Account.Balance", 0, &reply)
+	_assert(err == nil && reply == 5, "failed to call Account.Balance: %v", err)
+}
+
+func TestServer_Namespace(t *testing.T) {
+	server := NewServer()
+	_ = server.Register(&Brand{name: "unversioned"})
+	_assert(server.RegisterNamespace("v1", &Brand{name: "v1"}) == nil, "failed to register v1.Brand")
+	_assert(server.RegisterNamespace("billing.v2", &Brand{name: "v2"}) == nil, "failed to register billing.v2.Brand")
+	_assert(server.RegisterNamespace("", &Brand{}) != nil, "expect an empty namespace error")
+
+	client, _ := server.NewPipeClient()
+	defer func() { _ = client.Close() }()
+	for method, want := range map[string]string{
+		"Brand.Name":            "unversioned",
+		"v1.Brand.Name":         "v1",
+		"billing.v2.Brand.Name": "v2",
+		"v3.Brand.Name":         "unversioned", // 没有注册 v3 时回退到最具体的匹配
+		"billing.v3.Brand.Name": "unversioned",
+	} {
+		var reply string
+		err := client.Call(context.Background(), method, 0, &reply)
+		_assert(err == nil && reply == want, "%s: expect %q, got %q %v", method, want, reply, err)
+	}
+	var reply string
+	err := client.Call(context.Background(), "v1.Missing.Name", 0, &reply)
+	_assert(err != nil && strings.Contains(err.Error(), "can't find service v1.Missing"), "expect service not found, got %v", err)
+}
+
+func TestServer_Stats(t *testing.T) {
+	var foo Foo
+	var f Failer
+	server := NewServer()
+	_ = server.Register(&foo)
+	_ = server.Register(&f)
+	client, err := server.NewPipeClient()
+	_assert(err == nil, "failed to create pipe client: %v", err)
+	defer func() { _ = client.Close() }()
+
+	var reply int
+	for i := 0; i < 3; i++ {
+		_ = client.Call(context.Background(), "Foo.Sum", Args{Num1: i}, &reply)
+	}
+	_ = client.Call(context.Background(), "Failer.Plain", 0, &reply)
+	stats := server.Stats()
+	byName := make(map[string]MethodStats)
+	for _, s := range stats {
+		byName[s.ServiceMethod] = s
+	}
+	_assert(stats[0].ServiceMethod < stats[len(stats)-1].ServiceMethod, "stats should be sorted")
+	sum := byName["Foo.Sum"]
+	_assert(sum.Calls == 3 && sum.Errors == 0 && sum.P50 > 0 && sum.P50 <= sum.P99, "unexpected Foo.Sum stats %+v", sum)
+	plain := byName["Failer.Plain"]
+	_assert(plain.Calls == 1 && plain.Errors == 1, "unexpected Failer.Plain stats %+v", plain)
+	_assert(byName["Failer.Quota"].Calls == 0 && byName["Failer.Quota"].P99 == 0, "unused methods should have empty stats")
+}
+
+func TestQuantile(t *testing.T) {
+	var counts [statsBuckets]uint64
+	// 100 次调用落在 [512us, 1024us), 1 次落在 [2^19us, 2^20us)
+	counts[10] = 100
+	counts[20] = 1
+	p50 := quantile(&counts, 0.5)
+	_assert(p50 >= 512*time.Microsecond && p50 < 1024*time.Microsecond, "unexpected p50 %v", p50)
+	p999 := quantile(&counts, 0.999)
+	_assert(p999 >= time.Duration(1<<19)*time.Microsecond, "unexpected p99.9 %v", p999)
+	_assert(quantile(new([statsBuckets]uint64), 0.5) == 0, "expect 0 without calls")
+}
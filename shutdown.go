@@ -0,0 +1,160 @@
+package minirpc
+
+import (
+	"context"
+	"net"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/fanyeke/minirpc/codec"
+)
+
+// goAwayMethod 服务端通知客户端即将关闭链接的控制消息, 它的 Seq 为 0, 不对应任何请求
+// 客户端收到之后不再在这个链接上发送新的请求, 等已经发出的请求全部完成后关闭链接
+const goAwayMethod = "MiniRPC.GoAway"
+
+// shutdownPollInterval Shutdown 检查链接是否全部关闭的间隔
+const shutdownPollInterval = 10 * time.Millisecond
+
+// serverConn 一个已经完成握手的链接, Shutdown 通过它发送 goAwayMethod
+type serverConn struct {
+	cc       codec.Codec
+	sending  *sync.Mutex
+	counters *connCounters // 链接读写的字节数和帧数
+	dump     *wireDumper   // 为 nil 时不输出, 见 Server.WireDump
+	peer     *PeerInfo     // 链接的信息, 见 Connections
+	since    time.Time     // 完成握手的时间
+
+	mu       sync.Mutex                         // 保护 inflight
+	inflight map[uint64]context.CancelCauseFunc // 正在处理的请求, 用于响应客户端的取消, 见 cancel.go
+}
+
+// goAway 通知客户端链接即将关闭
+func (server *Server) goAway(c *serverConn) {
+	server.sendResponse(c, &codec.Header{ServiceMethod: goAwayMethod}, invalidRequest)
+}
+
+// trackListener 记录正在监听的 lis, Shutdown 时关闭, 已经开始关闭时返回 false
+func (server *Server) trackListener(lis net.Listener, add bool) bool {
+	server.mu.Lock()
+	defer server.mu.Unlock()
+	if !add {
+		delete(server.listeners, lis)
+		return true
+	}
+	if server.inShutdown {
+		return false
+	}
+	if server.listeners == nil {
+		server.listeners = make(map[net.Listener]struct{})
+	}
+	server.listeners[lis] = struct{}{}
+	return true
+}
+
+// trackConn 记录链接, 已经开始关闭时返回 false, 调用方需要立即通知客户端
+func (server *Server) trackConn(c *serverConn, add bool) bool {
+	server.mu.Lock()
+	defer server.mu.Unlock()
+	if !add {
+		delete(server.conns, c)
+		return true
+	}
+	if server.conns == nil {
+		server.conns = make(map[*serverConn]struct{})
+	}
+	server.conns[c] = struct{}{}
+	return !server.inShutdown
+}
+
+// ShuttingDown 返回是否已经调用了 Shutdown, 可以用于健康检查
+func (server *Server) ShuttingDown() bool {
+	server.mu.Lock()
+	defer server.mu.Unlock()
+	return server.inShutdown
+}
+
+// Shutdown 优雅地关闭服务端: 关闭所有监听, 通知每个链接的客户端不再发送新的请求,
+// 然后等待客户端处理完已经发出的请求并关闭链接. ctx 结束时强制关闭剩余的链接并返回 ctx.Err()
+// 不认识 goAwayMethod 的客户端 (比如手写的 NDJSON 客户端) 不会主动关闭, 只能等到 ctx 结束
+func (server *Server) Shutdown(ctx context.Context) error {
+	server.mu.Lock()
+	server.inShutdown = true
+	for lis := range server.listeners {
+		_ = lis.Close()
+	}
+	conns := make([]*serverConn, 0, len(server.conns))
+	for c := range server.conns {
+		conns = append(conns, c)
+	}
+	server.mu.Unlock()
+
+	for _, c := range conns {
+		go server.goAway(c)
+	}
+
+	ticker := time.NewTicker(shutdownPollInterval)
+	defer ticker.Stop()
+	for {
+		server.mu.Lock()
+		n := len(server.conns)
+		server.mu.Unlock()
+		if n == 0 {
+			server.stopWorkers()
+			return nil
+		}
+		select {
+		case <-ctx.Done():
+			server.mu.Lock()
+			for c := range server.conns {
+				_ = c.cc.Close()
+			}
+			server.mu.Unlock()
+			server.stopWorkers()
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+}
+
+// ConnInfo 一个正在服务的链接, 见 Server.Connections
+type ConnInfo struct {
+	RemoteAddr string
+	CodecType  codec.Type
+	TLS        bool
+	Since      time.Time // 完成握手的时间
+	Inflight   int       // 正在处理的请求数
+	ConnStats            // 链接上读写的字节数和帧数, 可以据此找出请求频繁或者数据量大的客户端
+}
+
+// Connections 返回所有已经完成握手的链接, 按建立的时间排序
+func (server *Server) Connections() []ConnInfo {
+	server.mu.Lock()
+	conns := make([]*serverConn, 0, len(server.conns))
+	for c := range server.conns {
+		conns = append(conns, c)
+	}
+	server.mu.Unlock()
+	infos := make([]ConnInfo, 0, len(conns))
+	for _, c := range conns {
+		info := ConnInfo{Since: c.since, ConnStats: c.counters.snapshot()}
+		if c.peer != nil {
+			info.CodecType, info.TLS = c.peer.CodecType, c.peer.TLS != nil
+			if c.peer.Addr != nil {
+				info.RemoteAddr = c.peer.Addr.String()
+			}
+		}
+		c.mu.Lock()
+		info.Inflight = len(c.inflight)
+		c.mu.Unlock()
+		infos = append(infos, info)
+	}
+	sort.Slice(infos, func(i, j int) bool { return infos[i].Since.Before(infos[j].Since) })
+	return infos
+}
+
+// Shutdown 关闭默认的 `DefaultServer`
+func Shutdown(ctx context.Context) error {
+	return DefaultServer.Shutdown(ctx)
+}
@@ -0,0 +1,90 @@
+package minirpc
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"sync"
+)
+
+// flight 正在进行的一次共享请求
+type flight struct {
+	done      chan struct{} // 请求完成时关闭
+	reply     interface{}   // 请求成功时 reply 的快照, 与所有调用方的 reply 都不共享, 完成之后复制给其他调用方
+	err       error
+	abandoned bool // 发起请求的调用方的 ctx 结束导致请求失败, 其他调用方重新发起请求
+}
+
+// SingleflightInterceptor 返回合并相同请求的拦截器: 方法, 参数, 元数据和返回值类型都相同的并发请求只发送一次,
+// 其他调用方等待它完成, 得到相同的错误和复制的返回值. 适合大量相同的只读查询, 比如缓存失效时的回源
+// 返回值是浅复制, 其中的 map, slice 和指针在调用方之间共享, 不能修改; 参数无法编码为 json 时不合并
+// 共享的请求使用发起它的调用方的 ctx, 这个 ctx 结束时其他还在等待的调用方重新选出一个发起请求; 其他调用方的 ctx 结束时只是不再等待
+func SingleflightInterceptor() ClientInterceptor {
+	var mu sync.Mutex
+	flights := make(map[string]*flight)
+	return func(ctx context.Context, info *CallInfo, args, reply interface{}, invoke Invoker) error {
+		key, ok := requestKey(ctx, info.ServiceMethod, args, reply)
+		if !ok {
+			return invoke(ctx)
+		}
+		for {
+			mu.Lock()
+			if f, ok := flights[key]; ok {
+				mu.Unlock()
+				select {
+				case <-f.done:
+				case <-ctx.Done():
+					return fmt.Errorf("rpc client: call failed: %w", ctx.Err())
+				}
+				if f.abandoned {
+					continue
+				}
+				if f.err == nil {
+					reflect.ValueOf(reply).Elem().Set(reflect.ValueOf(f.reply).Elem())
+				}
+				return f.err
+			}
+			f := &flight{done: make(chan struct{})}
+			flights[key] = f
+			mu.Unlock()
+
+			err := invoke(ctx)
+			if err == nil {
+				// 返回之后调用方可能修改 reply, 其他调用方从快照复制
+				rv := reflect.ValueOf(reply)
+				snapshot := reflect.New(rv.Type().Elem())
+				snapshot.Elem().Set(rv.Elem())
+				f.reply = snapshot.Interface()
+			}
+			f.err, f.abandoned = err, err != nil && ctx.Err() != nil
+			mu.Lock()
+			delete(flights, key)
+			mu.Unlock()
+			close(f.done)
+			return err
+		}
+	}
+}
+
+// requestKey 返回区分相同请求的键, 是方法, 返回值类型, 参数和元数据的 sha256; reply 不是指针或者参数无法编码时返回 false
+func requestKey(ctx context.Context, method string, args, reply interface{}) (string, bool) {
+	rt := reflect.TypeOf(reply)
+	if rt == nil || rt.Kind() != reflect.Pointer {
+		return "", false
+	}
+	// 元数据可能包含鉴权信息, 不同的调用方可能得到不同的结果; json 编码 map 时按键排序
+	md, _ := FromOutgoingContext(ctx)
+	b, err := json.Marshal(struct {
+		Args     interface{}
+		Metadata map[string]string
+	}{args, md})
+	if err != nil {
+		return "", false
+	}
+	h := sha256.New()
+	h.Write([]byte(method + "\x00" + rt.String() + "\x00"))
+	h.Write(b)
+	return string(h.Sum(nil)), true
+}
@@ -0,0 +1,96 @@
+package minirpc
+
+import (
+	"math/bits"
+	"sort"
+	"sync/atomic"
+	"time"
+)
+
+// statsBuckets 耗时直方图的桶数, 第 i 个桶记录 [2^(i-1), 2^i) 微秒的调用, 最后一个桶记录更长的调用
+const statsBuckets = 32
+
+// methodStats 方法的调用统计, 只使用原子操作, 不会增加调用的锁竞争
+type methodStats struct {
+	errors  atomic.Uint64
+	buckets [statsBuckets]atomic.Uint64
+}
+
+// record 记录一次调用的耗时和是否出错
+func (s *methodStats) record(d time.Duration, failed bool) {
+	if failed {
+		s.errors.Add(1)
+	}
+	i := bits.Len64(uint64(d / time.Microsecond))
+	if i >= statsBuckets {
+		i = statsBuckets - 1
+	}
+	s.buckets[i].Add(1)
+}
+
+// MethodStats 一个方法的调用统计, 见 Server.Stats
+type MethodStats struct {
+	ServiceMethod string
+	Calls         uint64 // 开始的调用次数, 包括正在执行的调用
+	Errors        uint64 // 返回错误的调用次数
+	// P50, P90, P99 已经完成的调用的耗时分位数, 由直方图估算, 误差在所在桶的范围之内
+	P50, P90, P99 time.Duration
+}
+
+// Stats 返回每个方法的调用次数, 错误次数和耗时分位数, 按 ServiceMethod 排序
+// 统计从注册时开始累计, 调用方可以定期读取并计算差值; 读取时不加锁, 可以频繁调用
+func (server *Server) Stats() []MethodStats {
+	var stats []MethodStats
+	server.serviceMap.Range(func(namei, svci interface{}) bool {
+		svc := svci.(*service)
+		for name, m := range svc.method {
+			var counts [statsBuckets]uint64
+			for i := range counts {
+				counts[i] = m.stats.buckets[i].Load()
+			}
+			stats = append(stats, MethodStats{
+				ServiceMethod: namei.(string) + "." + name,
+				Calls:         m.NumCalls(),
+				Errors:        m.stats.errors.Load(),
+				P50:           quantile(&counts, 0.5),
+				P90:           quantile(&counts, 0.9),
+				P99:           quantile(&counts, 0.99),
+			})
+		}
+		return true
+	})
+	sort.Slice(stats, func(i, j int) bool { return stats[i].ServiceMethod < stats[j].ServiceMethod })
+	return stats
+}
+
+// Stats 返回默认的 `DefaultServer` 的调用统计
+func Stats() []MethodStats {
+	return DefaultServer.Stats()
+}
+
+// quantile 在直方图中估算分位数 q, 在所在的桶内线性插值, 没有调用时返回 0
+func quantile(counts *[statsBuckets]uint64, q float64) time.Duration {
+	var total uint64
+	for _, c := range counts {
+		total += c
+	}
+	if total == 0 {
+		return 0
+	}
+	rank := q * float64(total)
+	var seen uint64
+	for i, c := range counts {
+		if c == 0 || float64(seen+c) < rank {
+			seen += c
+			continue
+		}
+		var lower float64
+		if i > 0 {
+			lower = float64(uint64(1) << (i - 1))
+		}
+		upper := float64(uint64(1) << i)
+		micros := lower + (upper-lower)*(rank-float64(seen))/float64(c)
+		return time.Duration(micros * float64(time.Microsecond))
+	}
+	return time.Duration(uint64(1)<<(statsBuckets-1)) * time.Microsecond
+}
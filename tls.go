@@ -0,0 +1,100 @@
+package minirpc
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"net"
+)
+
+// ServeTLS 在 lis 上接受 TLS 链接, 证书从 certFile 和 keyFile 加载
+// 如果 server.TLSConfig 中已经配置了证书, certFile 和 keyFile 可以为空; 设置了 server.ClientCAs 时要求客户端证书
+// 调用 Shutdown 之后返回 ErrServerClosed
+func (server *Server) ServeTLS(lis net.Listener, certFile, keyFile string) error {
+	config := &tls.Config{}
+	if server.TLSConfig != nil {
+		config = server.TLSConfig.Clone()
+	}
+	if certFile != "" || keyFile != "" {
+		cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			return err
+		}
+		config.Certificates = append(config.Certificates, cert)
+	}
+	if server.ClientCAs != nil {
+		config.ClientCAs = server.ClientCAs
+		config.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	return server.Serve(context.Background(), tls.NewListener(lis, config))
+}
+
+// ListenAndServeTLS 监听 addr 并接受 TLS 链接, 见 ServeTLS
+func (server *Server) ListenAndServeTLS(addr, certFile, keyFile string) error {
+	lis, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = lis.Close() }()
+	return server.ServeTLS(lis, certFile, keyFile)
+}
+
+// ListenAndServeTLS 使用默认的 `DefaultServer` 接受 TLS 链接
+func ListenAndServeTLS(addr, certFile, keyFile string) error {
+	return DefaultServer.ListenAndServeTLS(addr, certFile, keyFile)
+}
+
+// NewTLSClient 在 conn 上完成 TLS 握手之后创建客户端
+// opt.TLSConfig 没有指定 ServerName 时使用链接的远端主机名, 用于校验证书
+func NewTLSClient(conn net.Conn, opt *Option, address string) (*Client, error) {
+	client, err := newTLSClient(conn, opt, address)
+	if err != nil {
+		return nil, err
+	}
+	client.start()
+	return client, nil
+}
+
+// newTLSClient 与 NewTLSClient 相同, 但是还没有开始接收响应
+func newTLSClient(conn net.Conn, opt *Option, address string) (*Client, error) {
+	config := &tls.Config{}
+	if opt.TLSConfig != nil {
+		config = opt.TLSConfig.Clone()
+	}
+	if config.ServerName == "" {
+		if host, _, err := net.SplitHostPort(address); err == nil {
+			config.ServerName = host
+		}
+	}
+	tconn := tls.Client(conn, config)
+	if err := tconn.Handshake(); err != nil {
+		return nil, err
+	}
+	return newClient(tconn, opt)
+}
+
+// DialTLS 使用 TLS 连接服务端, ConnectTimeout 同时限制了 TLS 握手的时间
+func DialTLS(network, address string, opts ...*Option) (*Client, error) {
+	return dialTimeout(func(conn net.Conn, opt *Option) (*Client, error) {
+		return newTLSClient(conn, opt, address)
+	}, network, address, opts...)
+}
+
+// tlsStateKey 链接 context 中保存 tls.ConnectionState 的键
+type tlsStateKey struct{}
+
+// TLSStateFromContext 返回请求所在的 TLS 链接的状态, 不是 TLS 链接时返回 false
+// ctx 是传给 `func (t *T) Method(ctx context.Context, args, reply) error` 的参数
+func TLSStateFromContext(ctx context.Context) (tls.ConnectionState, bool) {
+	state, ok := ctx.Value(tlsStateKey{}).(tls.ConnectionState)
+	return state, ok
+}
+
+// ClientIdentity 返回经过校验的客户端证书, 只有开启了双向认证的链接才会有
+func ClientIdentity(ctx context.Context) (*x509.Certificate, bool) {
+	state, ok := TLSStateFromContext(ctx)
+	if !ok || len(state.VerifiedChains) == 0 || len(state.VerifiedChains[0]) == 0 {
+		return nil, false
+	}
+	return state.VerifiedChains[0][0], true
+}
@@ -0,0 +1,174 @@
+package minirpc
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"errors"
+	"math/big"
+	"net"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/fanyeke/minirpc/codec"
+)
+
+// testCA 测试用的证书颁发机构
+type testCA struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+	pool *x509.CertPool
+}
+
+func newTestCA(t *testing.T) *testCA {
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "minirpc test ca"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	_assert(err == nil, "failed to create ca: %v", err)
+	cert, _ := x509.ParseCertificate(der)
+	pool := x509.NewCertPool()
+	pool.AddCert(cert)
+	return &testCA{cert: cert, key: key, pool: pool}
+}
+
+// issue 签发一张证书, client 为 true 时用于客户端认证, 否则用于 127.0.0.1 上的服务端
+func (ca *testCA) issue(t *testing.T, commonName string, client bool) tls.Certificate {
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: commonName},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+	}
+	if client {
+		tmpl.ExtKeyUsage = []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth}
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, ca.cert, &key.PublicKey, ca.key)
+	_assert(err == nil, "failed to issue certificate: %v", err)
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+}
+
+func TestServer_ServeTLS(t *testing.T) {
+	ca := newTestCA(t)
+	var foo Foo
+	server := NewServer()
+	server.TLSConfig = &tls.Config{Certificates: []tls.Certificate{ca.issue(t, "server", false)}}
+	_ = server.Register(&foo)
+	l, _ := net.Listen("tcp", "127.0.0.1:0")
+	go func() { _ = server.ServeTLS(l, "", "") }()
+
+	t.Run("trusted", func(t *testing.T) {
+		client, err := DialTLS("tcp", l.Addr().String(), &Option{TLSConfig: &tls.Config{RootCAs: ca.pool}})
+		_assert(err == nil, "failed to dial tls: %v", err)
+		defer func() { _ = client.Close() }()
+		var reply int
+		err = client.Call(context.Background(), "Foo.Sum", &Args{Num1: 1, Num2: 2}, &reply)
+		_assert(err == nil && reply == 3, "failed to call Foo.Sum over tls: %v", err)
+	})
+	t.Run("xdial", func(t *testing.T) {
+		client, err := XDial("tls@"+l.Addr().String(), &Option{TLSConfig: &tls.Config{RootCAs: ca.pool}})
+		_assert(err == nil, "failed to xdial tls: %v", err)
+		_ = client.Close()
+	})
+	t.Run("untrusted", func(t *testing.T) {
+		_, err := DialTLS("tcp", l.Addr().String())
+		_assert(err != nil && strings.Contains(err.Error(), "certificate"), "expect a certificate error, got %v", err)
+	})
+}
+
+type Whoami int
+
+func (w Whoami) Name(ctx context.Context, _ int, reply *string) error {
+	cert, ok := ClientIdentity(ctx)
+	if !ok {
+		return errors.New("anonymous")
+	}
+	*reply = cert.Subject.CommonName
+	return nil
+}
+
+func TestServer_MutualTLS(t *testing.T) {
+	ca := newTestCA(t)
+	var w Whoami
+	server := NewServer()
+	server.TLSConfig = &tls.Config{Certificates: []tls.Certificate{ca.issue(t, "server", false)}}
+	server.ClientCAs = ca.pool
+	_ = server.Register(&w)
+	l, _ := net.Listen("tcp", "127.0.0.1:0")
+	go func() { _ = server.ServeTLS(l, "", "") }()
+
+	t.Run("verified client", func(t *testing.T) {
+		client, err := DialTLS("tcp", l.Addr().String(), &Option{TLSConfig: &tls.Config{
+			RootCAs:      ca.pool,
+			Certificates: []tls.Certificate{ca.issue(t, "alice", true)},
+		}})
+		_assert(err == nil, "failed to dial mtls: %v", err)
+		defer func() { _ = client.Close() }()
+		var reply string
+		err = client.Call(context.Background(), "Whoami.Name", 0, &reply)
+		_assert(err == nil && reply == "alice", "expect the verified identity, got %q %v", reply, err)
+	})
+	t.Run("client without certificate", func(t *testing.T) {
+		client, err := DialTLS("tcp", l.Addr().String(), &Option{TLSConfig: &tls.Config{RootCAs: ca.pool}})
+		if err == nil {
+			// TLS 1.3 中服务端在客户端完成握手之后才校验证书, 错误在第一次读写时出现
+			var reply string
+			err = client.Call(context.Background(), "Whoami.Name", 0, &reply)
+			_ = client.Close()
+		}
+		_assert(err != nil, "expect the server to reject a client without certificate")
+	})
+}
+
+// Peer 返回客户端地址, 是否是 TLS 链接和编解码方式
+func (w Whoami) Peer(ctx context.Context, _ int, reply *string) error {
+	p, ok := Peer(ctx)
+	if !ok || p.Addr == nil {
+		return errors.New("no peer")
+	}
+	host, _, _ := net.SplitHostPort(p.Addr.String())
+	*reply = host + " " + strconv.FormatBool(p.TLS != nil) + " " + string(p.CodecType)
+	return nil
+}
+
+func TestServer_Peer(t *testing.T) {
+	ca := newTestCA(t)
+	var w Whoami
+	server := NewServer()
+	server.TLSConfig = &tls.Config{Certificates: []tls.Certificate{ca.issue(t, "server", false)}}
+	_ = server.Register(&w)
+	tl, _ := net.Listen("tcp", "127.0.0.1:0")
+	go func() { _ = server.ServeTLS(tl, "", "") }()
+	l, _ := net.Listen("tcp", "127.0.0.1:0")
+	go server.Accept(l)
+
+	client, err := DialTLS("tcp", tl.Addr().String(), &Option{TLSConfig: &tls.Config{RootCAs: ca.pool}})
+	_assert(err == nil, "failed to dial tls: %v", err)
+	defer func() { _ = client.Close() }()
+	var reply string
+	err = client.Call(context.Background(), "Whoami.Peer", 0, &reply)
+	_assert(err == nil && reply == "127.0.0.1 true applocation/gob", "unexpected peer over tls: %q %v", reply, err)
+
+	client, err = Dial("tcp", l.Addr().String(), &Option{CodecType: codec.JsonType})
+	_assert(err == nil, "failed to dial: %v", err)
+	defer func() { _ = client.Close() }()
+	err = client.Call(context.Background(), "Whoami.Peer", 0, &reply)
+	_assert(err == nil && reply == "127.0.0.1 false applocation/json", "unexpected peer over tcp: %q %v", reply, err)
+}
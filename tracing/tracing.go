@@ -0,0 +1,199 @@
+// Package tracing 为 minirpc 提供链路追踪: 客户端和服务端的拦截器为每个请求创建一个 span,
+// 通过请求元数据中的 W3C traceparent 传递追踪上下文, 与使用 OpenTelemetry 等实现的服务可以互通
+//
+// span 结束时交给 Exporter, 可以把它转换成 OpenTelemetry, Jaeger 或者日志:
+//
+//	server.Interceptors = append(server.Interceptors, tracing.ServerInterceptor(exporter))
+//	client, _ := minirpc.Dial("tcp", addr, &minirpc.Option{Interceptors: []minirpc.ClientInterceptor{tracing.ClientInterceptor(exporter)}})
+//
+// 服务端的方法用收到的 ctx 调用其他服务时, 新的请求自动成为服务端 span 的子 span
+package tracing
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"strconv"
+	"time"
+
+	"github.com/fanyeke/minirpc"
+)
+
+// TraceParentKey 追踪上下文在请求元数据中的键, 格式见 https://www.w3.org/TR/trace-context/
+const TraceParentKey = "traceparent"
+
+// Kind span 的类型
+type Kind string
+
+const (
+	KindClient Kind = "client"
+	KindServer Kind = "server"
+)
+
+// 常用的 span 属性
+const (
+	AttrSystem  = "rpc.system"
+	AttrMethod  = "rpc.method"
+	AttrCodec   = "rpc.codec"
+	AttrAttempt = "rpc.attempt"
+	AttrPeer    = "net.peer.addr"
+	AttrCode    = "rpc.code"
+)
+
+// TraceID 和 SpanID 是 W3C trace context 中的标识
+type (
+	TraceID [16]byte
+	SpanID  [8]byte
+)
+
+func (id TraceID) String() string { return hex.EncodeToString(id[:]) }
+func (id SpanID) String() string  { return hex.EncodeToString(id[:]) }
+
+// SpanContext 跨进程传递的追踪上下文
+type SpanContext struct {
+	TraceID TraceID
+	SpanID  SpanID
+	Sampled bool
+}
+
+// IsValid trace ID 和 span ID 都不能全为 0
+func (sc SpanContext) IsValid() bool {
+	return sc.TraceID != TraceID{} && sc.SpanID != SpanID{}
+}
+
+// TraceParent 返回 traceparent 格式的字符串
+func (sc SpanContext) TraceParent() string {
+	flags := "00"
+	if sc.Sampled {
+		flags = "01"
+	}
+	return "00-" + sc.TraceID.String() + "-" + sc.SpanID.String() + "-" + flags
+}
+
+// errInvalidTraceParent traceparent 格式不正确
+var errInvalidTraceParent = errors.New("tracing: invalid traceparent")
+
+// ParseTraceParent 解析 traceparent, 只接受版本 00 的格式
+func ParseTraceParent(s string) (SpanContext, error) {
+	var sc SpanContext
+	if len(s) != 55 || s[:3] != "00-" || s[35] != '-' || s[52] != '-' {
+		return sc, errInvalidTraceParent
+	}
+	if _, err := hex.Decode(sc.TraceID[:], []byte(s[3:35])); err != nil {
+		return sc, errInvalidTraceParent
+	}
+	if _, err := hex.Decode(sc.SpanID[:], []byte(s[36:52])); err != nil {
+		return sc, errInvalidTraceParent
+	}
+	flags, err := strconv.ParseUint(s[53:], 16, 8)
+	if err != nil || !sc.IsValid() {
+		return sc, errInvalidTraceParent
+	}
+	sc.Sampled = flags&1 == 1
+	return sc, nil
+}
+
+// Span 一次请求在客户端或者服务端的记录
+type Span struct {
+	Name       string // ServiceMethod
+	Kind       Kind
+	Context    SpanContext
+	Parent     SpanID // 父 span, 全为 0 表示这是根 span
+	Start, End time.Time
+	Attributes map[string]string
+	Err        error // 请求返回的错误
+}
+
+// Exporter 接收结束的 span, 需要支持并发调用
+type Exporter interface {
+	ExportSpan(span *Span)
+}
+
+// ExporterFunc 把普通函数适配为 Exporter
+type ExporterFunc func(span *Span)
+
+// ExportSpan 调用 f(span)
+func (f ExporterFunc) ExportSpan(span *Span) {
+	f(span)
+}
+
+// spanKey 当前 span 在 context 中的键
+type spanKey struct{}
+
+// SpanFromContext 返回 ctx 中当前的 span, 服务端的方法可以用它读取追踪上下文或者添加属性
+func SpanFromContext(ctx context.Context) (*Span, bool) {
+	span, ok := ctx.Value(spanKey{}).(*Span)
+	return span, ok
+}
+
+// startSpan 创建 parent 的子 span, parent 无效时开始新的链路
+func startSpan(name string, kind Kind, parent SpanContext) *Span {
+	span := &Span{Name: name, Kind: kind, Start: time.Now(), Attributes: map[string]string{AttrSystem: "minirpc"}}
+	if parent.IsValid() {
+		span.Context.TraceID, span.Context.Sampled, span.Parent = parent.TraceID, parent.Sampled, parent.SpanID
+	} else {
+		_, _ = rand.Read(span.Context.TraceID[:])
+		span.Context.Sampled = true
+	}
+	_, _ = rand.Read(span.Context.SpanID[:])
+	return span
+}
+
+// finish 记录结果并交给 exporter
+func (s *Span) finish(exporter Exporter, err error) {
+	s.End, s.Err = time.Now(), err
+	code := minirpc.CodeOK
+	var rpcErr *minirpc.Error
+	switch {
+	case errors.As(err, &rpcErr):
+		code = rpcErr.Code
+	case err != nil:
+		code = minirpc.CodeUnknown
+	}
+	s.Attributes[AttrCode] = code.String()
+	exporter.ExportSpan(s)
+}
+
+// annotate 记录请求的信息
+func (s *Span) annotate(info *minirpc.CallInfo) {
+	s.Attributes[AttrMethod] = info.ServiceMethod
+	s.Attributes[AttrCodec] = string(info.CodecType)
+	if info.Addr != "" {
+		s.Attributes[AttrPeer] = info.Addr
+	}
+}
+
+// ClientInterceptor 为每个请求创建客户端 span, 并把追踪上下文写入请求的元数据
+// ctx 中已经有 span (比如在服务端的方法中发起调用) 时, 新的 span 是它的子 span
+func ClientInterceptor(exporter Exporter) minirpc.ClientInterceptor {
+	return func(ctx context.Context, info *minirpc.CallInfo, args, reply interface{}, invoke minirpc.Invoker) error {
+		var parent SpanContext
+		if p, ok := SpanFromContext(ctx); ok {
+			parent = p.Context
+		}
+		span := startSpan(info.ServiceMethod, KindClient, parent)
+		span.annotate(info)
+		span.Attributes[AttrAttempt] = strconv.Itoa(info.Attempt)
+		ctx = context.WithValue(ctx, spanKey{}, span)
+		ctx = minirpc.AppendToOutgoingContext(ctx, map[string]string{TraceParentKey: span.Context.TraceParent()})
+		err := invoke(ctx)
+		span.finish(exporter, err)
+		return err
+	}
+}
+
+// ServerInterceptor 为每个请求创建服务端 span, 请求携带了 traceparent 时沿用客户端的链路
+func ServerInterceptor(exporter Exporter) minirpc.ServerInterceptor {
+	return func(ctx context.Context, info *minirpc.CallInfo, argv, replyv interface{}, invoke minirpc.Invoker) error {
+		var parent SpanContext
+		if md, ok := minirpc.FromIncomingContext(ctx); ok {
+			parent, _ = ParseTraceParent(md[TraceParentKey])
+		}
+		span := startSpan(info.ServiceMethod, KindServer, parent)
+		span.annotate(info)
+		err := invoke(context.WithValue(ctx, spanKey{}, span))
+		span.finish(exporter, err)
+		return err
+	}
+}
@@ -0,0 +1,115 @@
+package tracing
+
+import (
+	"context"
+	"sync"
+	"testing"
+
+	"github.com/fanyeke/minirpc"
+)
+
+// recorder 记录所有结束的 span
+type recorder struct {
+	mu    sync.Mutex
+	spans []*Span
+}
+
+func (r *recorder) ExportSpan(span *Span) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.spans = append(r.spans, span)
+}
+
+func (r *recorder) find(name string, kind Kind) *Span {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, s := range r.spans {
+		if s.Name == name && s.Kind == kind {
+			return s
+		}
+	}
+	return nil
+}
+
+type Backend int
+
+func (b Backend) Echo(n int, reply *int) error {
+	*reply = n
+	return nil
+}
+
+// Frontend 用收到的 ctx 调用 Backend
+type Frontend struct {
+	backend *minirpc.Client
+}
+
+func (f *Frontend) Echo(ctx context.Context, n int, reply *int) error {
+	return f.backend.Call(ctx, "Backend.Echo", n, reply)
+}
+
+func TestInterceptors(t *testing.T) {
+	rec := &recorder{}
+	clientOpt := &minirpc.Option{Interceptors: []minirpc.ClientInterceptor{ClientInterceptor(rec)}}
+
+	var b Backend
+	backendServer := minirpc.NewServer()
+	backendServer.Interceptors = []minirpc.ServerInterceptor{ServerInterceptor(rec)}
+	_ = backendServer.Register(&b)
+	backend, err := backendServer.NewPipeClient(clientOpt)
+	if err != nil {
+		t.Fatalf("failed to create backend client: %v", err)
+	}
+	defer func() { _ = backend.Close() }()
+
+	frontendServer := minirpc.NewServer()
+	frontendServer.Interceptors = []minirpc.ServerInterceptor{ServerInterceptor(rec)}
+	_ = frontendServer.Register(&Frontend{backend: backend})
+	client, err := frontendServer.NewPipeClient(clientOpt)
+	if err != nil {
+		t.Fatalf("failed to create frontend client: %v", err)
+	}
+	defer func() { _ = client.Close() }()
+
+	var reply int
+	if err := client.Call(context.Background(), "Frontend.Echo", 7, &reply); err != nil || reply != 7 {
+		t.Fatalf("failed to call Frontend.Echo: %v", err)
+	}
+
+	root := rec.find("Frontend.Echo", KindClient)
+	frontend := rec.find("Frontend.Echo", KindServer)
+	hop := rec.find("Backend.Echo", KindClient)
+	leaf := rec.find("Backend.Echo", KindServer)
+	if root == nil || frontend == nil || hop == nil || leaf == nil {
+		t.Fatalf("expect four spans, got %d", len(rec.spans))
+	}
+	if root.Parent != (SpanID{}) || frontend.Parent != root.Context.SpanID || hop.Parent != frontend.Context.SpanID || leaf.Parent != hop.Context.SpanID {
+		t.Fatal("spans should form a single chain")
+	}
+	for _, s := range []*Span{frontend, hop, leaf} {
+		if s.Context.TraceID != root.Context.TraceID {
+			t.Fatalf("span %s %s is not in the root trace", s.Kind, s.Name)
+		}
+	}
+	if root.Attributes[AttrCodec] != string(minirpc.DefaultOption.CodecType) || root.Attributes[AttrAttempt] != "0" ||
+		root.Attributes[AttrPeer] == "" || root.Attributes[AttrCode] != "ok" {
+		t.Fatalf("unexpected client span attributes: %v", root.Attributes)
+	}
+}
+
+func TestParseTraceParent(t *testing.T) {
+	const valid = "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"
+	sc, err := ParseTraceParent(valid)
+	if err != nil || !sc.Sampled || sc.TraceParent() != valid {
+		t.Fatalf("failed to round trip %q: %v", valid, err)
+	}
+	for _, s := range []string{
+		"",
+		"01-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01",
+		"00-00000000000000000000000000000000-00f067aa0ba902b7-01",
+		"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902bz-01",
+	} {
+		if _, err := ParseTraceParent(s); err == nil {
+			t.Errorf("expect %q to be invalid", s)
+		}
+	}
+}
@@ -0,0 +1,130 @@
+package minirpc
+
+import (
+	"errors"
+	"io"
+	"net"
+	"time"
+)
+
+// Transport 建立到服务端的底层链接, 通过 Option.Transport 注入, 可以经过自定义隧道, SSH 或者测试用的假链接
+// 为空时使用 net.DialTimeout
+type Transport interface {
+	Dial(network, address string) (io.ReadWriteCloser, error)
+}
+
+// TransportFunc 把普通函数适配为 Transport
+type TransportFunc func(network, address string) (io.ReadWriteCloser, error)
+
+// Dial 调用 f(network, address)
+func (f TransportFunc) Dial(network, address string) (io.ReadWriteCloser, error) {
+	return f(network, address)
+}
+
+// ErrConnectTimeout 建立链接和握手没有在 Option.ConnectTimeout 之内完成, 错误码是 CodeDeadlineExceeded
+var ErrConnectTimeout = &Error{Code: CodeDeadlineExceeded, Message: "rpc client: connect timeout"}
+
+// connectTimeout 返回带有超时时间的 ErrConnectTimeout
+func (opt *Option) connectTimeout() error {
+	return Errorf(CodeDeadlineExceeded, "rpc client: connect timeout: expect within %s", opt.ConnectTimeout)
+}
+
+// connectDeadline 返回建立链接和握手的截止时间, 没有设置 ConnectTimeout 时为零值
+func (opt *Option) connectDeadline() time.Time {
+	if opt.ConnectTimeout <= 0 {
+		return time.Time{}
+	}
+	return time.Now().Add(opt.ConnectTimeout)
+}
+
+// isTimeout 判断 err 是否是链接读写或者建立链接超时
+func isTimeout(err error) bool {
+	var ne net.Error
+	return errors.As(err, &ne) && ne.Timeout()
+}
+
+// dial 在 deadline 之前建立到 address 的链接, 设置了 opt.Proxy 时经过代理, deadline 为零值表示不限制
+func (opt *Option) dial(network, address string, deadline time.Time) (net.Conn, error) {
+	if opt.Proxy != nil && (network == "tcp" || network == "tcp4" || network == "tcp6") {
+		proxy, err := opt.Proxy(address)
+		if err != nil {
+			return nil, err
+		}
+		if proxy != nil {
+			return opt.dialProxy(proxy, network, address, deadline)
+		}
+	}
+	return opt.dialDirect(network, address, deadline)
+}
+
+// dialDirect 使用 opt.Transport 建立链接, deadline 同样限制 Transport.Dial 的时间
+func (opt *Option) dialDirect(network, address string, deadline time.Time) (net.Conn, error) {
+	if opt.Transport == nil {
+		conn, err := (&net.Dialer{Deadline: deadline}).Dial(network, address)
+		if err != nil && !deadline.IsZero() && isTimeout(err) {
+			return nil, opt.connectTimeout()
+		}
+		return conn, err
+	}
+	type dialResult struct {
+		rwc io.ReadWriteCloser
+		err error
+	}
+	ch := make(chan dialResult, 1)
+	go func() {
+		rwc, err := opt.Transport.Dial(network, address)
+		ch <- dialResult{rwc: rwc, err: err}
+	}()
+	var timeout <-chan time.Time
+	if !deadline.IsZero() {
+		timer := time.NewTimer(time.Until(deadline))
+		defer timer.Stop()
+		timeout = timer.C
+	}
+	select {
+	case <-timeout:
+		// 超时之后建立的链接没有人使用, 需要关闭
+		go func() {
+			if result := <-ch; result.err == nil {
+				_ = result.rwc.Close()
+			}
+		}()
+		return nil, opt.connectTimeout()
+	case result := <-ch:
+		if result.err != nil {
+			return nil, result.err
+		}
+		return transportConn(result.rwc, network, address), nil
+	}
+}
+
+// transportConn 把 Transport 返回的链接适配为 net.Conn, 本身就是 net.Conn 时直接返回
+func transportConn(rwc io.ReadWriteCloser, network, address string) net.Conn {
+	if conn, ok := rwc.(net.Conn); ok {
+		return conn
+	}
+	return &rwcConn{ReadWriteCloser: rwc, addr: transportAddr{network: network, address: address}}
+}
+
+// errNoDeadline 不是 net.Conn 的链接不支持设置超时
+var errNoDeadline = errors.New("rpc client: transport connection does not support deadlines")
+
+// rwcConn 没有地址和超时的 net.Conn
+type rwcConn struct {
+	io.ReadWriteCloser
+	addr transportAddr
+}
+
+func (c *rwcConn) LocalAddr() net.Addr                { return c.addr }
+func (c *rwcConn) RemoteAddr() net.Addr               { return c.addr }
+func (c *rwcConn) SetDeadline(t time.Time) error      { return errNoDeadline }
+func (c *rwcConn) SetReadDeadline(t time.Time) error  { return errNoDeadline }
+func (c *rwcConn) SetWriteDeadline(t time.Time) error { return errNoDeadline }
+
+// transportAddr 传给 Transport.Dial 的地址
+type transportAddr struct {
+	network, address string
+}
+
+func (a transportAddr) Network() string { return a.network }
+func (a transportAddr) String() string  { return a.address }
@@ -0,0 +1,27 @@
+package minirpc
+
+import "context"
+
+// Invoke 以确定的参数和返回值类型调用 method, 编译时检查类型, 不需要传入 interface{} 和返回值的指针
+// Reply 是返回值本身的类型, 例如 int 而不是 *int, 失败时返回 Reply 的零值
+func Invoke[Args, Reply any](ctx context.Context, c *Client, method string, args Args, opts ...CallOption) (Reply, error) {
+	var reply Reply
+	if err := c.Call(ctx, method, args, &reply, opts...); err != nil {
+		var zero Reply
+		return zero, err
+	}
+	return reply, nil
+}
+
+// Stub 绑定了客户端和方法名的调用函数, 由 NewStub 创建
+type Stub[Args, Reply any] func(ctx context.Context, args Args, opts ...CallOption) (Reply, error)
+
+// NewStub 返回调用 c 上 method 的 Stub, 例如
+//
+//	sum := minirpc.NewStub[Args, int](client, "Foo.Sum")
+//	reply, err := sum(ctx, Args{Num1: 1, Num2: 2})
+func NewStub[Args, Reply any](c *Client, method string) Stub[Args, Reply] {
+	return func(ctx context.Context, args Args, opts ...CallOption) (Reply, error) {
+		return Invoke[Args, Reply](ctx, c, method, args, opts...)
+	}
+}
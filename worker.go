@@ -0,0 +1,62 @@
+package minirpc
+
+// workerPool 返回 worker 使用的任务队列和退出信号, 没有设置 Workers 时返回 nil
+func (server *Server) workerPool() (chan func(), chan struct{}) {
+	if server.Workers <= 0 {
+		return nil, nil
+	}
+	server.mu.Lock()
+	defer server.mu.Unlock()
+	if server.done == nil {
+		server.done = make(chan struct{})
+	}
+	if server.jobs == nil {
+		// 队列没有缓冲, 所有 worker 都在忙时读取请求的 goroutine 会阻塞
+		server.jobs = make(chan func())
+		for i := 0; i < server.Workers; i++ {
+			go server.worker(server.jobs, server.done)
+		}
+	}
+	return server.jobs, server.done
+}
+
+// worker 依次执行 jobs 中的请求, 直到 done 被关闭
+func (server *Server) worker(jobs chan func(), done chan struct{}) {
+	for {
+		select {
+		case job := <-jobs:
+			job()
+		case <-done:
+			return
+		}
+	}
+}
+
+// dispatch 处理一个请求, 设置了 Workers 时交给 worker, 否则使用新的 goroutine
+func (server *Server) dispatch(job func()) {
+	jobs, done := server.workerPool()
+	if jobs == nil {
+		go job()
+		return
+	}
+	select {
+	case jobs <- job:
+	case <-done:
+		// Shutdown 之后 worker 已经退出, 仍然需要处理剩下的请求
+		go job()
+	}
+}
+
+// stopWorkers 让 worker 退出, Shutdown 完成时调用
+func (server *Server) stopWorkers() {
+	server.mu.Lock()
+	defer server.mu.Unlock()
+	if server.done == nil {
+		server.done = make(chan struct{})
+	}
+	select {
+	case <-server.done:
+	default:
+		close(server.done)
+	}
+}
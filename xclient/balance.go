@@ -0,0 +1,190 @@
+package xclient
+
+import (
+	"context"
+	"errors"
+	"math"
+	"math/rand"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// ewmaDecay 调用统计的衰减时间, 空闲一段时间之后旧的统计影响变小
+	ewmaDecay = 10 * time.Second
+	// ewmaMinWeight 新的一次调用至少占的权重, 调用密集时平均值也能及时跟上变化
+	ewmaMinWeight = 0.1
+	// failurePenalty 错误率为 1 的实例在代价上相当于多出的延迟
+	failurePenalty = time.Second
+)
+
+// endpoint 一个服务实例的调用状态, 用于根据调用情况选择实例的负载均衡
+type endpoint struct {
+	inflight atomic.Int64  // 已经发出但还没有完成的请求数
+	calls    atomic.Uint64 // 完成的请求数, 见 XClient.Stats
+	failures atomic.Uint64 // 失败的请求数
+	breaker  breaker       // 见 XClient.SetBreaker
+
+	mu      sync.Mutex
+	latency float64   // 延迟的指数加权平均, 变慢时直接取最近的延迟, 单位是纳秒, 见 P2CSelect
+	mean    float64   // 延迟的指数加权平均, 不受单次慢调用的影响, 见 OutlierConfig
+	errRate float64   // 错误率的指数加权平均, 在 0 到 1 之间
+	updated time.Time // 最近一次记录的时间, 零值表示还没有完成的调用
+	samples int       // 记录的调用次数, 实例被重新接纳时清零
+	// ejectedUntil 实例作为异常实例被摘除到这个时间, ejections 连续被摘除的次数, 见 OutlierConfig
+	ejectedUntil time.Time
+	ejections    int
+}
+
+// observe 记录一次完成的调用, 延迟超过平均值时直接取这次的延迟, 实例变慢时立刻避开它
+func (ep *endpoint) observe(d time.Duration, failed bool) {
+	var e float64
+	if failed {
+		e = 1
+	}
+	now := time.Now()
+	ep.calls.Add(1)
+	if failed {
+		ep.failures.Add(1)
+	}
+	ep.mu.Lock()
+	defer ep.mu.Unlock()
+	ep.samples++
+	if ep.updated.IsZero() {
+		ep.latency, ep.mean, ep.errRate, ep.updated = float64(d), float64(d), e, now
+		return
+	}
+	w := math.Max(1-math.Exp(-float64(now.Sub(ep.updated))/float64(ewmaDecay)), ewmaMinWeight)
+	ep.mean = ep.mean*(1-w) + float64(d)*w
+	ep.latency = math.Max(ep.latency*(1-w)+float64(d)*w, float64(d))
+	ep.errRate = ep.errRate*(1-w) + e*w
+	ep.updated = now
+}
+
+// cost 选择实例的代价, 平均延迟加上错误的惩罚, 再乘以排队的请求数; 还没有调用的实例代价为 0, 会被优先尝试
+func (ep *endpoint) cost() float64 {
+	ep.mu.Lock()
+	latency := ep.latency + ep.errRate*float64(failurePenalty)
+	ep.mu.Unlock()
+	return latency * float64(ep.inflight.Load()+1)
+}
+
+// endpoint 返回 rpcAddr 的调用状态, 不存在时创建
+func (xc *XClient) endpoint(rpcAddr string) *endpoint {
+	xc.mu.Lock()
+	defer xc.mu.Unlock()
+	ep, ok := xc.endpoints[rpcAddr]
+	if !ok {
+		ep = new(endpoint)
+		xc.endpoints[rpcAddr] = ep
+	}
+	return ep
+}
+
+// pick 为调用选择一个服务实例
+// 没有匹配的路由规则和分片路由时, 不需要调用状态的模式直接交给 Discovery, 否则由 XClient 在候选的实例中选择
+func (xc *XClient) pick(ctx context.Context, serviceMethod string, args interface{}) (string, error) {
+	mode, explicit := xc.selectMode(ctx)
+	xc.mu.Lock()
+	simple := xc.sharding == nil && xc.breaker == nil && xc.outlier == nil && xc.canary == nil &&
+		(xc.customSelect == nil || explicit) && xcallOptionsFrom(ctx).affinity == ""
+	xc.mu.Unlock()
+	if simple && xc.route(serviceMethod) == nil && mode != LeastConnSelect && mode != P2CSelect {
+		return xc.d.Get(mode)
+	}
+	servers, err := xc.eligible(ctx, serviceMethod, args)
+	if err != nil {
+		return "", err
+	}
+	return xc.selectAdmitted(ctx, xc.healthy(servers))
+}
+
+// eligible 返回这个调用可以使用的实例, 依次经过路由规则, 分片路由, 金丝雀路由和 WithAffinityKey
+func (xc *XClient) eligible(ctx context.Context, serviceMethod string, args interface{}) ([]string, error) {
+	servers, err := xc.candidates(serviceMethod)
+	if err != nil {
+		return nil, err
+	}
+	if servers, err = xc.shard(ctx, serviceMethod, args, servers); err != nil {
+		return nil, err
+	}
+	return affinity(ctx, xc.splitCanary(ctx, servers)), nil
+}
+
+// selectFrom 按这次调用的 SelectMode 在 servers 中选择一个实例, 见 WithSelectMode
+func (xc *XClient) selectFrom(ctx context.Context, servers []string) (string, error) {
+	if len(servers) == 0 {
+		return "", errors.New("rpc discovery: no available servers")
+	}
+	mode, explicit := xc.selectMode(ctx)
+	if s := xc.selector(); s != nil && !explicit {
+		now := time.Now()
+		stats := make([]EndpointStats, len(servers))
+		for i, rpcAddr := range servers {
+			stats[i] = xc.endpointStats(rpcAddr, now)
+		}
+		return s(stats), nil
+	}
+	switch mode {
+	case RandomSelect:
+		return servers[rand.Intn(len(servers))], nil
+	case RoundRobinSelect:
+		return servers[(xc.index.Add(1)-1)%uint64(len(servers))], nil
+	case LeastConnSelect:
+		return xc.leastConn(servers), nil
+	case P2CSelect:
+		return xc.p2c(servers), nil
+	case WeightedRandomSelect:
+		// Discovery 没有提供权重时所有实例的权重都是 1
+		weight := func(string) int { return 1 }
+		if w, ok := xc.d.(interface{ Weight(addr string) int }); ok {
+			weight = w.Weight
+		}
+		if s, ok := weightedPick(servers, weight, rand.Intn); ok {
+			return s, nil
+		}
+		return "", errors.New("rpc discovery: no available servers")
+	default:
+		return "", errors.New("rpc discovery: not supported select mode")
+	}
+}
+
+// p2c 随机选择两个不同的实例, 返回代价较小的一个
+// 只比较两个实例就能避开慢的实例, 又不会让所有的请求同时涌向统计上最快的那一个
+func (xc *XClient) p2c(servers []string) string {
+	n := len(servers)
+	if n == 1 {
+		return servers[0]
+	}
+	i := rand.Intn(n)
+	j := rand.Intn(n - 1)
+	if j >= i {
+		j++
+	}
+	a, b := servers[i], servers[j]
+	if xc.endpoint(b).cost() < xc.endpoint(a).cost() {
+		return b
+	}
+	return a
+}
+
+// leastConn 返回未完成的请求最少的实例, 有多个时随机选择一个, 避免请求都落到排在前面的实例
+func (xc *XClient) leastConn(servers []string) string {
+	var best string
+	min, ties := int64(-1), 0
+	for _, rpcAddr := range servers {
+		n := xc.endpoint(rpcAddr).inflight.Load()
+		switch {
+		case min < 0 || n < min:
+			best, min, ties = rpcAddr, n, 1
+		case n == min:
+			// 蓄水池抽样, 每个并列的实例被选中的概率相同
+			ties++
+			if rand.Intn(ties) == 0 {
+				best = rpcAddr
+			}
+		}
+	}
+	return best
+}
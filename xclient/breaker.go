@@ -0,0 +1,243 @@
+package xclient
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	. "github.com/fanyeke/minirpc"
+)
+
+// ErrBreakerOpen 所有候选实例的熔断器都处于打开状态
+var ErrBreakerOpen = &Error{Code: CodeUnavailable, Message: "rpc xclient: circuit breaker is open"}
+
+// BreakerConfig 每个实例的熔断器设置, 见 XClient.SetBreaker
+// 连续失败或者窗口内的错误率达到阈值时打开熔断器, 冷却期间不再选择这个实例;
+// 冷却之后进入半开状态, 只放行少量试探请求, 成功则关闭熔断器, 失败则重新打开
+type BreakerConfig struct {
+	ConsecutiveFailures int           // 连续失败这么多次之后打开, 0 表示 5
+	ErrorRate           float64       // 窗口内的错误率达到这个值时打开, 0 表示只按连续失败判断
+	MinRequests         int           // 按错误率判断时窗口内至少需要的请求数, 0 表示 20
+	Window              time.Duration // 统计错误率的窗口, 0 表示 10s
+	CoolDown            time.Duration // 打开之后多久进入半开状态, 0 表示 5s
+	HalfOpenProbes      int           // 半开状态允许的试探请求数, 0 表示 1
+	// IsFailure 返回 err 是否说明实例有问题, 为空时建立链接失败, 超时, 链接断开以及
+	// CodeUnavailable, CodeResourceExhausted, CodeInternal 算作失败, 方法返回的普通错误不算
+	IsFailure func(err error) bool
+}
+
+func (c *BreakerConfig) consecutiveFailures() int {
+	if c.ConsecutiveFailures <= 0 {
+		return 5
+	}
+	return c.ConsecutiveFailures
+}
+
+func (c *BreakerConfig) minRequests() int {
+	if c.MinRequests <= 0 {
+		return 20
+	}
+	return c.MinRequests
+}
+
+func (c *BreakerConfig) window() time.Duration {
+	if c.Window <= 0 {
+		return 10 * time.Second
+	}
+	return c.Window
+}
+
+func (c *BreakerConfig) coolDown() time.Duration {
+	if c.CoolDown <= 0 {
+		return 5 * time.Second
+	}
+	return c.CoolDown
+}
+
+func (c *BreakerConfig) halfOpenProbes() int {
+	if c.HalfOpenProbes <= 0 {
+		return 1
+	}
+	return c.HalfOpenProbes
+}
+
+func (c *BreakerConfig) isFailure(err error) bool {
+	if c.IsFailure != nil {
+		return c.IsFailure(err)
+	}
+	if isConnectError(err) || errors.Is(err, context.DeadlineExceeded) {
+		return true
+	}
+	var rpcErr *Error
+	if errors.As(err, &rpcErr) {
+		switch rpcErr.Code {
+		case CodeUnavailable, CodeResourceExhausted, CodeInternal, CodeDeadlineExceeded:
+			return true
+		}
+		return false
+	}
+	// 其他的错误来自链接本身, 比如链接断开
+	return true
+}
+
+// breakerState 熔断器的状态
+type breakerState int
+
+const (
+	breakerClosed breakerState = iota
+	breakerOpen
+	breakerHalfOpen
+)
+
+func (s breakerState) String() string {
+	switch s {
+	case breakerOpen:
+		return "open"
+	case breakerHalfOpen:
+		return "half-open"
+	}
+	return "closed"
+}
+
+// breaker 一个实例的熔断器, 零值是关闭状态
+type breaker struct {
+	mu          sync.Mutex
+	state       breakerState
+	consecutive int       // 连续失败的次数
+	windowStart time.Time // 当前窗口开始的时间
+	requests    int       // 当前窗口的请求数
+	failures    int       // 当前窗口的失败数
+	openedAt    time.Time // 打开或者开始放行一批试探请求的时间
+	probes      int       // 半开状态已经放行的试探请求数
+}
+
+// ready 返回现在是否可能放行请求, 不改变状态
+func (b *breaker) ready(cfg *BreakerConfig, now time.Time) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	switch b.state {
+	case breakerOpen:
+		return now.Sub(b.openedAt) >= cfg.coolDown()
+	case breakerHalfOpen:
+		return b.probes < cfg.halfOpenProbes() || now.Sub(b.openedAt) >= cfg.coolDown()
+	}
+	return true
+}
+
+// admit 放行一个请求, 冷却结束时进入半开状态并占用一个试探的名额
+func (b *breaker) admit(cfg *BreakerConfig, now time.Time) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.state == breakerOpen {
+		if now.Sub(b.openedAt) < cfg.coolDown() {
+			return false
+		}
+		b.state, b.probes, b.openedAt = breakerHalfOpen, 0, now
+	}
+	if b.state == breakerHalfOpen {
+		// 试探请求被选中之后没有发出, 或者一直没有结果时, 过了冷却时间再放行一批
+		if now.Sub(b.openedAt) >= cfg.coolDown() {
+			b.probes, b.openedAt = 0, now
+		}
+		if b.probes >= cfg.halfOpenProbes() {
+			return false
+		}
+		b.probes++
+	}
+	return true
+}
+
+// record 记录一次完成的请求
+func (b *breaker) record(cfg *BreakerConfig, now time.Time, failed bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	switch b.state {
+	case breakerOpen:
+		// 打开之前发出的请求, 结果不影响状态
+		return
+	case breakerHalfOpen:
+		if failed {
+			b.trip(now)
+		} else {
+			b.reset(now)
+		}
+		return
+	}
+	if now.Sub(b.windowStart) >= cfg.window() {
+		b.windowStart, b.requests, b.failures = now, 0, 0
+	}
+	b.requests++
+	if !failed {
+		b.consecutive = 0
+		return
+	}
+	b.failures++
+	b.consecutive++
+	if b.consecutive >= cfg.consecutiveFailures() ||
+		(cfg.ErrorRate > 0 && b.requests >= cfg.minRequests() && float64(b.failures) >= cfg.ErrorRate*float64(b.requests)) {
+		b.trip(now)
+	}
+}
+
+// trip 打开熔断器
+func (b *breaker) trip(now time.Time) {
+	b.state, b.openedAt = breakerOpen, now
+}
+
+// reset 关闭熔断器, 重新开始统计
+func (b *breaker) reset(now time.Time) {
+	b.state, b.consecutive, b.probes = breakerClosed, 0, 0
+	b.windowStart, b.requests, b.failures = now, 0, 0
+}
+
+// SetBreaker 为每个实例设置熔断器, 选择实例时跳过熔断器打开的实例, cfg 为 nil 时取消熔断
+func (xc *XClient) SetBreaker(cfg *BreakerConfig) {
+	xc.mu.Lock()
+	defer xc.mu.Unlock()
+	if cfg == nil {
+		xc.breaker = nil
+		return
+	}
+	c := *cfg
+	xc.breaker = &c
+}
+
+// breakerConfig 返回熔断器的设置, 没有设置时返回 nil
+func (xc *XClient) breakerConfig() *BreakerConfig {
+	xc.mu.Lock()
+	defer xc.mu.Unlock()
+	return xc.breaker
+}
+
+// selectAdmitted 在熔断器放行的实例中选择一个, 没有设置熔断器时与 selectFrom 相同
+func (xc *XClient) selectAdmitted(ctx context.Context, servers []string) (string, error) {
+	cfg := xc.breakerConfig()
+	if cfg == nil || len(servers) == 0 {
+		return xc.selectFrom(ctx, servers)
+	}
+	now := time.Now()
+	var ready []string
+	for _, rpcAddr := range servers {
+		if xc.endpoint(rpcAddr).breaker.ready(cfg, now) {
+			ready = append(ready, rpcAddr)
+		}
+	}
+	for len(ready) > 0 {
+		rpcAddr, err := xc.selectFrom(ctx, ready)
+		if err != nil {
+			return "", err
+		}
+		// 并发的请求可能已经占用了半开状态的试探名额
+		if xc.endpoint(rpcAddr).breaker.admit(cfg, now) {
+			return rpcAddr, nil
+		}
+		for i, s := range ready {
+			if s == rpcAddr {
+				ready = append(ready[:i], ready[i+1:]...)
+				break
+			}
+		}
+	}
+	return "", ErrBreakerOpen
+}
@@ -0,0 +1,176 @@
+package xclient
+
+import (
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// budgetBuckets 重试预算的统计窗口分成的桶数, 每个桶 1 秒
+const budgetBuckets = 10
+
+// RetryBudget 重试预算, 限制重试在正常请求之外增加的负载, 避免部分实例故障时所有的请求一起重试, 把故障扩大到整个集群
+// 最近 10 秒内的重试 (包括 Failbackup 和对冲请求发出的第二个请求) 不能超过请求数的 ratio 倍加上每秒 minPerSecond 次;
+// 超出预算时不再重试, 直接返回上一次的错误. 多个 XClient 可以共用一个 RetryBudget, 作为进程全局的预算
+type RetryBudget struct {
+	ratio        float64
+	minPerSecond int
+
+	mu      sync.Mutex
+	buckets [budgetBuckets]budgetBucket
+
+	throttled atomic.Uint64
+}
+
+// budgetBucket 一秒内的请求数和重试数
+type budgetBucket struct {
+	second   int64
+	requests uint64
+	retries  uint64
+}
+
+// RetryBudgetStats 重试预算的状态, 见 RetryBudget.Stats
+type RetryBudgetStats struct {
+	Requests  uint64 // 最近 10 秒的请求数, 不包括重试
+	Retries   uint64 // 最近 10 秒的重试数
+	Available int    // 现在还可以重试的次数
+	Throttled uint64 // 因为超出预算而放弃的重试数, 从创建时开始累计
+}
+
+// NewRetryBudget 创建重试预算, ratio 为 0.1 时重试最多增加 10% 的负载; minPerSecond 保证请求很少时也可以重试
+func NewRetryBudget(ratio float64, minPerSecond int) *RetryBudget {
+	return &RetryBudget{ratio: ratio, minPerSecond: minPerSecond}
+}
+
+// bucket 返回当前这一秒的桶, 需要持有 b.mu
+func (b *RetryBudget) bucket(now time.Time) *budgetBucket {
+	second := now.Unix()
+	bucket := &b.buckets[second%budgetBuckets]
+	if bucket.second != second {
+		*bucket = budgetBucket{second: second}
+	}
+	return bucket
+}
+
+// sums 返回最近 10 秒的请求数和重试数, 需要持有 b.mu
+func (b *RetryBudget) sums(now time.Time) (requests, retries uint64) {
+	second := now.Unix()
+	for i := range b.buckets {
+		if second-b.buckets[i].second < budgetBuckets {
+			requests += b.buckets[i].requests
+			retries += b.buckets[i].retries
+		}
+	}
+	return requests, retries
+}
+
+// available 返回还可以重试的次数, 需要持有 b.mu
+func (b *RetryBudget) available(now time.Time) int {
+	requests, retries := b.sums(now)
+	return int(b.ratio*float64(requests)) + b.minPerSecond*budgetBuckets - int(retries)
+}
+
+// deposit 记录一个请求
+func (b *RetryBudget) deposit() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.bucket(time.Now()).requests++
+}
+
+// withdraw 在预算之内时记录一次重试并返回 true, 否则返回 false
+func (b *RetryBudget) withdraw() bool {
+	now := time.Now()
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.available(now) <= 0 {
+		b.throttled.Add(1)
+		return false
+	}
+	b.bucket(now).retries++
+	return true
+}
+
+// Stats 返回重试预算现在的状态
+func (b *RetryBudget) Stats() RetryBudgetStats {
+	now := time.Now()
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	requests, retries := b.sums(now)
+	return RetryBudgetStats{
+		Requests:  requests,
+		Retries:   retries,
+		Available: max(b.available(now), 0),
+		Throttled: b.throttled.Load(),
+	}
+}
+
+// XClientStats XClient 的统计, 见 XClient.Stats
+type XClientStats struct {
+	Calls     uint64 // Call 的调用次数
+	Retries   uint64 // 重试发出的请求数, 包括 Failbackup 和对冲请求发出的第二个请求
+	Throttled uint64 // 因为超出重试预算而放弃的重试数
+	Rejected  uint64 // 因为达到 Bulkhead.MaxConcurrent 而失败的调用数
+	// RetryBudget 重试预算的状态, 没有设置时为 nil; 共用的预算包括其他 XClient 的请求
+	RetryBudget *RetryBudgetStats
+	// Endpoints 每个调用过的实例的调用统计, 按地址排序
+	Endpoints []EndpointStats
+}
+
+// xclientCounters XClient 的累计计数器, 只使用原子操作
+type xclientCounters struct {
+	calls     atomic.Uint64
+	retries   atomic.Uint64
+	throttled atomic.Uint64
+	rejected  atomic.Uint64
+}
+
+// SetRetryBudget 设置重试预算, b 为 nil 时不限制重试; 多个 XClient 可以使用同一个 b
+func (xc *XClient) SetRetryBudget(b *RetryBudget) {
+	xc.mu.Lock()
+	defer xc.mu.Unlock()
+	xc.budget = b
+}
+
+// retryBudget 返回设置的重试预算
+func (xc *XClient) retryBudget() *RetryBudget {
+	xc.mu.Lock()
+	defer xc.mu.Unlock()
+	return xc.budget
+}
+
+// allowRetry 返回是否可以再发出一个请求, 超出重试预算时返回 false
+func (xc *XClient) allowRetry() bool {
+	if b := xc.retryBudget(); b != nil && !b.withdraw() {
+		xc.stats.throttled.Add(1)
+		return false
+	}
+	xc.stats.retries.Add(1)
+	return true
+}
+
+// Stats 返回调用次数, 重试次数, 重试预算的状态和每个实例的调用统计
+func (xc *XClient) Stats() XClientStats {
+	stats := XClientStats{
+		Calls:     xc.stats.calls.Load(),
+		Retries:   xc.stats.retries.Load(),
+		Throttled: xc.stats.throttled.Load(),
+		Rejected:  xc.stats.rejected.Load(),
+	}
+	if b := xc.retryBudget(); b != nil {
+		budget := b.Stats()
+		stats.RetryBudget = &budget
+	}
+	xc.mu.Lock()
+	addrs := make([]string, 0, len(xc.endpoints))
+	for rpcAddr := range xc.endpoints {
+		addrs = append(addrs, rpcAddr)
+	}
+	xc.mu.Unlock()
+	sort.Strings(addrs)
+	now := time.Now()
+	for _, rpcAddr := range addrs {
+		stats.Endpoints = append(stats.Endpoints, xc.endpointStats(rpcAddr, now))
+	}
+	return stats
+}
@@ -0,0 +1,77 @@
+package xclient
+
+import (
+	"context"
+	"fmt"
+	"path"
+
+	. "github.com/fanyeke/minirpc"
+)
+
+// ErrBulkheadFull 请求的方法同时进行的调用达到 Bulkhead.MaxConcurrent, 并且没有设置 Wait 时返回这个错误
+var ErrBulkheadFull = &Error{Code: CodeResourceExhausted, Message: "rpc xclient: bulkhead is full"}
+
+// Bulkhead 一组方法同时进行的调用的上限, 一个慢的服务最多占用 MaxConcurrent 个调用, 不会拖慢共用 XClient 的其他服务
+type Bulkhead struct {
+	// Method ServiceMethod 的模式, 语法与 path.Match 相同, "Report.*" 限制整个服务, "Foo.Sum" 只限制一个方法
+	Method        string
+	MaxConcurrent int
+	// Wait 为 true 时达到上限的请求等待其他调用完成, 最多等到 ctx 结束; 否则立即返回 ErrBulkheadFull
+	Wait bool
+}
+
+// bulkhead 加入 XClient 的 Bulkhead, 每个调用在整个过程 (包括重试) 中占用 slots 的一个位置
+type bulkhead struct {
+	Bulkhead
+	slots chan struct{}
+}
+
+// AddBulkhead 在已有的隔离规则之后加入 bulkheads, 请求使用第一条匹配的规则, 没有匹配的规则时不限制
+func (xc *XClient) AddBulkhead(bulkheads ...Bulkhead) error {
+	added := make([]*bulkhead, 0, len(bulkheads))
+	for _, b := range bulkheads {
+		if _, err := path.Match(b.Method, ""); err != nil {
+			return fmt.Errorf("rpc xclient: invalid bulkhead pattern %q: %w", b.Method, err)
+		}
+		if b.MaxConcurrent <= 0 {
+			return fmt.Errorf("rpc xclient: bulkhead %q needs a positive MaxConcurrent", b.Method)
+		}
+		added = append(added, &bulkhead{Bulkhead: b, slots: make(chan struct{}, b.MaxConcurrent)})
+	}
+	xc.mu.Lock()
+	defer xc.mu.Unlock()
+	xc.bulkheads = append(xc.bulkheads, added...)
+	return nil
+}
+
+// enterBulkhead 占用 serviceMethod 匹配的隔离规则的一个位置, 返回归还位置的函数
+func (xc *XClient) enterBulkhead(ctx context.Context, serviceMethod string) (func(), error) {
+	xc.mu.Lock()
+	var b *bulkhead
+	for _, bh := range xc.bulkheads {
+		if ok, _ := path.Match(bh.Method, serviceMethod); ok {
+			b = bh
+			break
+		}
+	}
+	xc.mu.Unlock()
+	if b == nil {
+		return func() {}, nil
+	}
+	select {
+	case b.slots <- struct{}{}:
+		return func() { <-b.slots }, nil
+	default:
+	}
+	if !b.Wait {
+		xc.stats.rejected.Add(1)
+		return nil, ErrBulkheadFull
+	}
+	select {
+	case b.slots <- struct{}{}:
+		return func() { <-b.slots }, nil
+	case <-ctx.Done():
+		xc.stats.rejected.Add(1)
+		return nil, fmt.Errorf("rpc xclient: call failed: %w", ctx.Err())
+	}
+}
@@ -0,0 +1,134 @@
+package xclient
+
+import (
+	"time"
+
+	. "github.com/fanyeke/minirpc"
+)
+
+// ClientCache XClient 缓存的链接的清理设置, 见 XClient.SetClientCache
+// 没有设置时每个用过的实例的链接一直保留到 XClient.Close, 实例经常变化时链接会越来越多
+type ClientCache struct {
+	IdleTimeout time.Duration // 超过这个时间没有使用的链接被关闭, 0 表示不因为空闲而关闭
+	// MaxAddrs 最多保留的链接池数, 超过时关闭最久没有使用的链接池, 0 表示不限制
+	// 每个实例一个链接池, 用 SetServiceOption 单独设置了 Option 的服务在每个实例上另外使用一个
+	MaxAddrs int
+	// Interval 清理的间隔, 0 表示 IdleTimeout 的一半, 没有设置 IdleTimeout 时为 30s
+	// 每次清理还会关闭已经不在 Discovery.GetAll 中的实例的链接, 并删除它们的调用状态
+	Interval time.Duration
+}
+
+func (c *ClientCache) interval() time.Duration {
+	switch {
+	case c.Interval > 0:
+		return c.Interval
+	case c.IdleTimeout > 0:
+		return c.IdleTimeout / 2
+	}
+	return 30 * time.Second
+}
+
+// SetClientCache 设置链接的清理, 启动定期清理的 goroutine, 它在 Close 时退出; c 为 nil 时不再清理
+// 有未完成的请求的实例不会被清理, 下一次清理时再检查
+func (xc *XClient) SetClientCache(c *ClientCache) {
+	xc.mu.Lock()
+	defer xc.mu.Unlock()
+	if xc.stopSweep != nil {
+		close(xc.stopSweep)
+		xc.stopSweep = nil
+	}
+	if c == nil {
+		xc.cache = nil
+		return
+	}
+	cache := *c
+	xc.cache, xc.stopSweep = &cache, make(chan struct{})
+	go xc.sweepLoop(cache.interval(), xc.stopSweep)
+}
+
+func (xc *XClient) sweepLoop(interval time.Duration, stop chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			xc.sweep(time.Now())
+		case <-stop:
+			return
+		}
+	}
+}
+
+// sweep 关闭空闲的和已经不在 Discovery 中的实例的链接; Discovery 返回错误时只清理空闲的链接
+func (xc *XClient) sweep(now time.Time) {
+	var alive map[string]bool
+	if servers, err := xc.d.GetAll(); err == nil {
+		alive = make(map[string]bool, len(servers))
+		for _, rpcAddr := range servers {
+			alive[rpcAddr] = true
+		}
+	}
+	var closing []*ClientPool
+	xc.mu.Lock()
+	if xc.cache == nil {
+		xc.mu.Unlock()
+		return
+	}
+	idleTimeout := xc.cache.IdleTimeout
+	for key, pool := range xc.clients {
+		if xc.busy(key.rpcAddr) {
+			continue
+		}
+		gone := alive != nil && !alive[key.rpcAddr]
+		if gone || idleTimeout > 0 && now.Sub(xc.used[key]) >= idleTimeout {
+			closing = append(closing, pool)
+			delete(xc.clients, key)
+			delete(xc.used, key)
+		}
+	}
+	for rpcAddr := range xc.endpoints {
+		if alive != nil && !alive[rpcAddr] && !xc.busy(rpcAddr) {
+			delete(xc.endpoints, rpcAddr)
+		}
+	}
+	shared := xc.shared
+	xc.mu.Unlock()
+	for _, pool := range closing {
+		closePool(shared, pool)
+	}
+}
+
+// busy 返回 rpcAddr 是否有未完成的请求, 需要持有 xc.mu
+func (xc *XClient) busy(rpcAddr string) bool {
+	ep := xc.endpoints[rpcAddr]
+	return ep != nil && ep.inflight.Load() > 0
+}
+
+// evictLRU 链接池数超过 MaxAddrs 时关闭最久没有使用的, 没有未完成请求的实例的链接, 不会关闭 keep 的链接, 需要持有 xc.mu
+// 返回需要关闭的链接, 由调用方在释放锁之后关闭
+func (xc *XClient) evictLRU(keep poolKey) []*ClientPool {
+	if xc.cache == nil || xc.cache.MaxAddrs <= 0 {
+		return nil
+	}
+	var closing []*ClientPool
+	for len(xc.clients) > xc.cache.MaxAddrs {
+		var oldest poolKey
+		found := false
+		for key := range xc.clients {
+			if key == keep || xc.busy(key.rpcAddr) {
+				continue
+			}
+			if !found || xc.used[key].Before(xc.used[oldest]) {
+				oldest, found = key, true
+			}
+		}
+		// 所有的实例都有未完成的请求, 暂时超过上限
+		if !found {
+			break
+		}
+		closing = append(closing, xc.clients[oldest])
+		delete(xc.clients, oldest)
+		delete(xc.used, oldest)
+	}
+	return closing
+}
@@ -0,0 +1,111 @@
+package xclient
+
+import (
+	"context"
+	"hash/fnv"
+
+	. "github.com/fanyeke/minirpc"
+)
+
+// XCallOption XClient.Call 单次调用的设置, 覆盖 XClient 的设置, 同一个 XClient 可以同时用于 "从任意副本读" 和 "写到负责的实例"
+type XCallOption func(*xcallOptions)
+
+// xcallOptions XCallOption 设置的值, 零值表示使用 XClient 的设置
+type xcallOptions struct {
+	selectMode *SelectMode
+	failMode   *FailMode
+	affinity   string
+	callOpts   []CallOption
+}
+
+// xcallOptionsKey 在 ctx 中保存 xcallOptions, 选择实例和发出请求时使用
+type xcallOptionsKey struct{}
+
+// WithSelectMode 这次调用使用 mode 选择实例, 不使用 SetSelector 设置的自定义负载均衡
+func WithSelectMode(mode SelectMode) XCallOption {
+	return func(o *xcallOptions) { o.selectMode = &mode }
+}
+
+// WithFailMode 这次调用失败时按 mode 处理, 见 SetFailMode
+func WithFailMode(mode FailMode) XCallOption {
+	return func(o *xcallOptions) { o.failMode = &mode }
+}
+
+// WithAffinityKey 这次调用发给候选实例中按 key 的哈希确定的实例, 相同的 key 总是发给同一个实例, 加入或者删除一个实例时只有大约 1/n 的 key 被重新映射
+// 在路由规则, 分片和金丝雀路由之后进行; 这个实例被熔断时调用失败, 不会发给其他的实例
+func WithAffinityKey(key string) XCallOption {
+	return func(o *xcallOptions) { o.affinity = key }
+}
+
+// WithCallOptions 发出请求时使用 opts, 例如 WithTimeout 和 WithMetadata, 见 Client.Call
+func WithCallOptions(opts ...CallOption) XCallOption {
+	return func(o *xcallOptions) { o.callOpts = append(o.callOpts, opts...) }
+}
+
+// withXCallOptions 把 opts 保存到 ctx 中, 没有设置时原样返回 ctx
+func withXCallOptions(ctx context.Context, opts []XCallOption) context.Context {
+	if len(opts) == 0 {
+		return ctx
+	}
+	o := new(xcallOptions)
+	for _, opt := range opts {
+		opt(o)
+	}
+	return context.WithValue(ctx, xcallOptionsKey{}, o)
+}
+
+// xcallOptionsFrom 返回 ctx 中的设置, 没有时返回零值
+func xcallOptionsFrom(ctx context.Context) *xcallOptions {
+	if o, ok := ctx.Value(xcallOptionsKey{}).(*xcallOptions); ok {
+		return o
+	}
+	return &xcallOptions{}
+}
+
+// outgoingMetadata 返回这次调用随请求发送的元数据, 与 Client.Call 一样把 WithCallOptions 中 WithMetadata 的元数据合并到 ctx 的元数据上
+func outgoingMetadata(ctx context.Context) map[string]string {
+	md, _ := FromOutgoingContext(ctx)
+	if extra := MetadataFromCallOptions(xcallOptionsFrom(ctx).callOpts...); extra != nil {
+		md, _ = FromOutgoingContext(AppendToOutgoingContext(ctx, extra))
+	}
+	return md
+}
+
+// selectMode 返回这次调用的 SelectMode, 以及是否由调用单独设置
+func (xc *XClient) selectMode(ctx context.Context) (SelectMode, bool) {
+	if mode := xcallOptionsFrom(ctx).selectMode; mode != nil {
+		return *mode, true
+	}
+	return xc.mode, false
+}
+
+// affinity 返回 servers 中负责 ctx 的 affinity key 的实例, 没有设置时原样返回 servers
+func affinity(ctx context.Context, servers []string) []string {
+	key := xcallOptionsFrom(ctx).affinity
+	if key == "" || len(servers) == 0 {
+		return servers
+	}
+	return []string{rendezvous(key, servers)}
+}
+
+// rendezvous 使用 rendezvous (HRW) 哈希返回 servers 中 key 得分最高的实例, 结果与 servers 的顺序无关
+// 加入一个实例时只有原来 1/n 的 key 移动到新的实例, 删除一个实例时只有它负责的 key 被重新映射
+func rendezvous(key string, servers []string) string {
+	var best string
+	var bestScore uint64
+	for _, addr := range servers {
+		h := fnv.New64a()
+		_, _ = h.Write([]byte(key))
+		_, _ = h.Write([]byte{0})
+		_, _ = h.Write([]byte(addr))
+		// fnv 的高位分布不均匀, 再经过 splitmix64 的混合
+		score := h.Sum64()
+		score = (score ^ score>>30) * 0xbf58476d1ce4e5b9
+		score = (score ^ score>>27) * 0x94d049bb133111eb
+		score ^= score >> 31
+		if best == "" || score > bestScore || score == bestScore && addr < best {
+			best, bestScore = addr, score
+		}
+	}
+	return best
+}
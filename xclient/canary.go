@@ -0,0 +1,105 @@
+package xclient
+
+import (
+	"context"
+	"hash/fnv"
+	"math/rand"
+)
+
+// Canary 金丝雀路由, 按 Discovery 元数据中的标签把实例分成金丝雀组和稳定组, 按比例或者请求的元数据把请求分给两组, 见 XClient.SetCanary
+type Canary struct {
+	Key   string // 实例元数据中表示分组的键, 为空时是 "group"
+	Value string // 金丝雀组的值, 为空时是 "canary", 其他的实例都属于稳定组
+	// Percent 发给金丝雀组的请求的百分比, 取值 [0, 100]
+	Percent float64
+	// HashKey 不为空并且请求的元数据 (见 NewOutgoingContext 和 WithCallOptions(WithMetadata(...))) 中有这个键时, 按它的值的哈希决定分组,
+	// 例如按用户编号分流, 同一个用户的请求总是落到同一组; 否则每个请求随机决定
+	HashKey string
+	// Match 请求的元数据包含所有这些键值时一定发给金丝雀组, 不受 Percent 影响, 例如 {"x-canary": "1"}
+	Match map[string]string
+}
+
+func (c *Canary) key() string {
+	if c.Key == "" {
+		return "group"
+	}
+	return c.Key
+}
+
+func (c *Canary) value() string {
+	if c.Value == "" {
+		return "canary"
+	}
+	return c.Value
+}
+
+// toCanary 返回这个请求是否发给金丝雀组
+func (c *Canary) toCanary(ctx context.Context) bool {
+	md := outgoingMetadata(ctx)
+	if len(c.Match) > 0 {
+		matched := true
+		for k, v := range c.Match {
+			if md[k] != v {
+				matched = false
+				break
+			}
+		}
+		if matched {
+			return true
+		}
+	}
+	if c.Percent <= 0 {
+		return false
+	}
+	if v, ok := md[c.HashKey]; c.HashKey != "" && ok {
+		h := fnv.New32a()
+		_, _ = h.Write([]byte(v))
+		return float64(h.Sum32()%10000) < c.Percent*100
+	}
+	return rand.Float64()*100 < c.Percent
+}
+
+// metadataProvider Discovery 提供实例元数据时实现的接口, 见 MultiServerDiscovery.Metadata
+type metadataProvider interface {
+	Metadata(addr string) map[string]string
+}
+
+// SetCanary 设置金丝雀路由, 运行时可以再次调用调整比例, c 为 nil 时取消; 在路由规则和分片之后进一步缩小候选的实例
+// 选中的组没有实例时使用另一组, Discovery 没有提供元数据时所有的实例都属于稳定组
+func (xc *XClient) SetCanary(c *Canary) {
+	xc.mu.Lock()
+	defer xc.mu.Unlock()
+	if c == nil {
+		xc.canary = nil
+		return
+	}
+	canary := *c
+	xc.canary = &canary
+}
+
+// splitCanary 返回这个请求所在的组的实例
+func (xc *XClient) splitCanary(ctx context.Context, servers []string) []string {
+	xc.mu.Lock()
+	c := xc.canary
+	xc.mu.Unlock()
+	mp, ok := xc.d.(metadataProvider)
+	if c == nil || !ok {
+		return servers
+	}
+	var canary, stable []string
+	for _, rpcAddr := range servers {
+		if mp.Metadata(rpcAddr)[c.key()] == c.value() {
+			canary = append(canary, rpcAddr)
+		} else {
+			stable = append(stable, rpcAddr)
+		}
+	}
+	group, other := stable, canary
+	if c.toCanary(ctx) {
+		group, other = canary, stable
+	}
+	if len(group) == 0 {
+		return other
+	}
+	return group
+}
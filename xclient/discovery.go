@@ -2,8 +2,10 @@ package xclient
 
 import (
 	"errors"
+	"maps"
 	"math"
 	"math/rand"
+	"strconv"
 	"sync"
 	"time"
 )
@@ -13,6 +15,12 @@ type SelectMode int
 const (
 	RandomSelect SelectMode = iota
 	RoundRobinSelect
+	// LeastConnSelect 选择未完成的请求最少的实例, 由 XClient 根据自己发出的请求选择, Discovery.Get 不支持
+	LeastConnSelect
+	// P2CSelect 随机选择两个实例并取代价较小的一个, 代价由延迟和错误率的指数加权平均以及未完成的请求数计算, 同样由 XClient 选择
+	P2CSelect
+	// WeightedRandomSelect 按 Discovery 提供的权重随机选择, 见 MultiServerDiscovery.SetWeights
+	WeightedRandomSelect
 )
 
 type Discovery interface {
@@ -27,6 +35,10 @@ type MultiServerDiscovery struct {
 	mu      sync.RWMutex
 	servers []string
 	index   int
+	// weights 实例的权重, 没有设置的实例使用元数据中的 weight, 都没有时为 1, 见 WeightedRandomSelect
+	weights map[string]int
+	// metadata 实例的元数据, 例如注册中心返回的 weight 和 partition
+	metadata map[string]map[string]string
 }
 
 func NewMultiServerDiscovery(servers []string) *MultiServerDiscovery {
@@ -50,6 +62,90 @@ func (d *MultiServerDiscovery) Refresh() error {
 	return nil
 }
 
+// SetWeights 设置实例的权重, 替换之前设置的所有权重, 没有设置的实例权重为 1, 权重为 0 的实例不会被 WeightedRandomSelect 选中
+func (d *MultiServerDiscovery) SetWeights(weights map[string]int) {
+	w := make(map[string]int, len(weights))
+	for addr, weight := range weights {
+		w[addr] = weight
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.weights = w
+}
+
+// Weight 返回实例的权重, 没有设置时为 1
+func (d *MultiServerDiscovery) Weight(addr string) int {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	return d.weight(addr)
+}
+
+// weight 与 Weight 相同, 调用方需要持有 mu
+func (d *MultiServerDiscovery) weight(addr string) int {
+	if w, ok := d.weights[addr]; ok {
+		return max(w, 0)
+	}
+	if w, err := strconv.Atoi(d.metadata[addr]["weight"]); err == nil {
+		return max(w, 0)
+	}
+	return 1
+}
+
+// SetMetadata 设置 addr 的元数据, md 为 nil 时删除
+func (d *MultiServerDiscovery) SetMetadata(addr string, md map[string]string) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if md == nil {
+		delete(d.metadata, addr)
+		return
+	}
+	if d.metadata == nil {
+		d.metadata = make(map[string]map[string]string)
+	}
+	d.metadata[addr] = maps.Clone(md)
+}
+
+// Metadata 返回 addr 的元数据, 没有时返回 nil
+func (d *MultiServerDiscovery) Metadata(addr string) map[string]string {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	return maps.Clone(d.metadata[addr])
+}
+
+// Partition 返回元数据 partition 中 addr 所在的分片, 没有设置时返回 false, 见 XClient.SetSharding
+func (d *MultiServerDiscovery) Partition(addr string) (int, bool) {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	p, err := strconv.Atoi(d.metadata[addr]["partition"])
+	return p, err == nil && p >= 0
+}
+
+// weightedRandom 按权重随机选择一个实例, 调用方需要持有 mu
+func (d *MultiServerDiscovery) weightedRandom() (string, error) {
+	if s, ok := weightedPick(d.servers, d.weight, d.r.Intn); ok {
+		return s, nil
+	}
+	return "", errors.New("rpc discovery: no available servers")
+}
+
+// weightedPick 按 weight 返回的权重在 servers 中随机选择一个, 权重之和为 0 时返回 false
+func weightedPick(servers []string, weight func(string) int, intn func(int) int) (string, bool) {
+	total := 0
+	for _, s := range servers {
+		total += weight(s)
+	}
+	if total == 0 {
+		return "", false
+	}
+	n := intn(total)
+	for _, s := range servers {
+		if n -= weight(s); n < 0 {
+			return s, true
+		}
+	}
+	return "", false
+}
+
 // Get 获取一个服务
 func (d *MultiServerDiscovery) Get(mode SelectMode) (string, error) {
 	d.mu.Lock()
@@ -71,6 +167,8 @@ func (d *MultiServerDiscovery) Get(mode SelectMode) (string, error) {
 		// 令 `index` 字段 +1
 		d.index = (d.index + 1) % n
 		return s, nil
+	case WeightedRandomSelect:
+		return d.weightedRandom()
 	default:
 		return "", errors.New("rpc discovery: not supported select mode")
 	}
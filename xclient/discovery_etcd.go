@@ -0,0 +1,198 @@
+package xclient
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+)
+
+// EtcdDiscovery 从 etcd 读取服务实例, 并监听实例的变化
+// 通过 etcd 的 HTTP 网关 (v3 JSON API, 与 etcdctl 使用同一个端口) 访问, 不依赖 etcd 的 Go 客户端
+// 实例注册在 prefix 下, 键是 prefix 加上实例的地址, 值是实例的元数据 (JSON 对象, 可以为空), 见 registry.EtcdHeartbeat
+type EtcdDiscovery struct {
+	*MultiServerDiscovery
+	endpoint string // etcd 的地址, 例如 http://127.0.0.1:2379
+	prefix   string
+	client   *http.Client // 读取实例, 有超时
+	watcher  *http.Client // 监听的请求一直不结束, 没有超时, 通过 ctx 取消
+	cancel   context.CancelFunc
+	done     chan struct{}
+}
+
+const (
+	etcdWatchRetry     = time.Second     // 监听断开之后重新监听之前等待的时间
+	etcdRequestTimeout = 5 * time.Second // 读取实例的超时时间
+)
+
+// NewEtcdDiscovery 读取 prefix 下的实例, 并在后台监听 prefix 的变化, 实例注册或者租约过期时立即更新; 不再使用时调用 Close
+func NewEtcdDiscovery(endpoint, prefix string) (*EtcdDiscovery, error) {
+	ctx, cancel := context.WithCancel(context.Background())
+	d := &EtcdDiscovery{
+		MultiServerDiscovery: NewMultiServerDiscovery(nil),
+		endpoint:             strings.TrimRight(endpoint, "/"),
+		prefix:               prefix,
+		client:               &http.Client{Timeout: etcdRequestTimeout},
+		watcher:              &http.Client{},
+		cancel:               cancel,
+		done:                 make(chan struct{}),
+	}
+	if err := d.Refresh(); err != nil {
+		cancel()
+		return nil, err
+	}
+	go d.watch(ctx)
+	return d, nil
+}
+
+var _ Discovery = (*EtcdDiscovery)(nil)
+
+// etcdKV etcd 返回的键值, 键和值都经过 base64 编码
+type etcdKV struct {
+	Key   string `json:"key"`
+	Value string `json:"value"`
+}
+
+// etcdRangeEnd 返回以 prefix 开头的所有键的范围的结束位置
+func etcdRangeEnd(prefix string) string {
+	end := []byte(prefix)
+	for i := len(end) - 1; i >= 0; i-- {
+		if end[i] < 0xff {
+			end[i]++
+			return string(end[:i+1])
+		}
+	}
+	// prefix 全是 0xff 时表示到最后一个键
+	return "\x00"
+}
+
+func etcdEncode(s string) string { return base64.StdEncoding.EncodeToString([]byte(s)) }
+
+// etcdPost 向 etcd 的 HTTP 网关发送请求, resp 为 nil 时忽略响应
+func etcdPost(ctx context.Context, client *http.Client, url string, req, resp interface{}) error {
+	body, err := json.Marshal(req)
+	if err != nil {
+		return err
+	}
+	httpReq, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	httpResp, err := client.Do(httpReq)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = httpResp.Body.Close() }()
+	if httpResp.StatusCode != http.StatusOK {
+		return fmt.Errorf("rpc discovery: etcd %s: %s", url, httpResp.Status)
+	}
+	if resp == nil {
+		return nil
+	}
+	return json.NewDecoder(httpResp.Body).Decode(resp)
+}
+
+// Refresh 从 etcd 读取 prefix 下所有的实例和元数据
+func (d *EtcdDiscovery) Refresh() error {
+	return d.refresh(context.Background())
+}
+
+// refresh 与 Refresh 相同, 后台监听使用自己的 ctx, Close 时不会等待正在进行的读取
+func (d *EtcdDiscovery) refresh(ctx context.Context) error {
+	var resp struct {
+		Kvs []etcdKV `json:"kvs"`
+	}
+	req := map[string]string{"key": etcdEncode(d.prefix), "range_end": etcdEncode(etcdRangeEnd(d.prefix))}
+	if err := etcdPost(ctx, d.client, d.endpoint+"/v3/kv/range", req, &resp); err != nil {
+		return err
+	}
+	servers := make([]string, 0, len(resp.Kvs))
+	metadata := make(map[string]map[string]string)
+	for _, kv := range resp.Kvs {
+		key, err := base64.StdEncoding.DecodeString(kv.Key)
+		if err != nil {
+			continue
+		}
+		addr := strings.TrimPrefix(string(key), d.prefix)
+		if addr == "" {
+			continue
+		}
+		servers = append(servers, addr)
+		if value, err := base64.StdEncoding.DecodeString(kv.Value); err == nil && len(value) > 0 {
+			var md map[string]string
+			if json.Unmarshal(value, &md) == nil {
+				metadata[addr] = md
+			}
+		}
+	}
+	sort.Strings(servers)
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.servers, d.metadata = servers, metadata
+	return nil
+}
+
+// watch 监听 prefix 的变化, 每次变化之后重新读取所有的实例; 监听断开时等待 etcdWatchRetry 之后重新监听
+func (d *EtcdDiscovery) watch(ctx context.Context) {
+	defer close(d.done)
+	for ctx.Err() == nil {
+		if err := d.watchOnce(ctx); err != nil && ctx.Err() == nil {
+			log.Println("rpc discovery: etcd watch err:", err)
+		}
+		select {
+		case <-time.After(etcdWatchRetry):
+			// 断开期间可能错过了变化
+			_ = d.refresh(ctx)
+		case <-ctx.Done():
+		}
+	}
+}
+
+// watchOnce 建立一次监听, 直到链接断开或者 ctx 结束
+func (d *EtcdDiscovery) watchOnce(ctx context.Context) error {
+	req := map[string]interface{}{"create_request": map[string]string{
+		"key":       etcdEncode(d.prefix),
+		"range_end": etcdEncode(etcdRangeEnd(d.prefix)),
+	}}
+	body, _ := json.Marshal(req)
+	httpReq, err := http.NewRequestWithContext(ctx, http.MethodPost, d.endpoint+"/v3/watch", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	resp, err := d.watcher.Do(httpReq)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = resp.Body.Close() }()
+	// 网关以 JSON 流的方式返回监听的结果, 每个结果一个对象
+	dec := json.NewDecoder(bufio.NewReader(resp.Body))
+	for {
+		var msg struct {
+			Result struct {
+				Events []json.RawMessage `json:"events"`
+			} `json:"result"`
+		}
+		if err := dec.Decode(&msg); err != nil {
+			return err
+		}
+		if len(msg.Result.Events) > 0 {
+			if err := d.refresh(ctx); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// Close 停止监听
+func (d *EtcdDiscovery) Close() error {
+	d.cancel()
+	<-d.done
+	return nil
+}
@@ -0,0 +1,227 @@
+package xclient
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/fanyeke/minirpc/registry"
+)
+
+// fakeEtcd 在内存中实现 etcd HTTP 网关的一部分, 只支持测试用到的请求
+type fakeEtcd struct {
+	mu      sync.Mutex
+	kvs     map[string]string
+	leases  map[string][]string // 租约 -> 绑定的键
+	nextID  int
+	changed chan struct{} // 每次修改之后关闭并替换, 通知所有的监听
+}
+
+func newFakeEtcd() *fakeEtcd {
+	return &fakeEtcd{kvs: make(map[string]string), leases: make(map[string][]string), changed: make(chan struct{})}
+}
+
+func (f *fakeEtcd) notify() {
+	close(f.changed)
+	f.changed = make(chan struct{})
+}
+
+// expire 模拟租约过期
+func (f *fakeEtcd) expire(lease string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for _, key := range f.leases[lease] {
+		delete(f.kvs, key)
+	}
+	delete(f.leases, lease)
+	f.notify()
+}
+
+func decode64(s string) string {
+	b, _ := base64.StdEncoding.DecodeString(s)
+	return string(b)
+}
+
+func (f *fakeEtcd) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	var req map[string]interface{}
+	_ = json.NewDecoder(r.Body).Decode(&req)
+	str := func(k string) string { s, _ := req[k].(string); return s }
+	f.mu.Lock()
+	switch r.URL.Path {
+	case "/v3/kv/range":
+		key, end := decode64(str("key")), decode64(str("range_end"))
+		var kvs []map[string]string
+		for k, v := range f.kvs {
+			if k >= key && k < end {
+				kvs = append(kvs, map[string]string{"key": base64.StdEncoding.EncodeToString([]byte(k)), "value": base64.StdEncoding.EncodeToString([]byte(v))})
+			}
+		}
+		f.mu.Unlock()
+		_ = json.NewEncoder(w).Encode(map[string]interface{}{"kvs": kvs})
+	case "/v3/kv/put":
+		key := decode64(str("key"))
+		f.kvs[key] = decode64(str("value"))
+		if lease := str("lease"); lease != "" {
+			f.leases[lease] = append(f.leases[lease], key)
+		}
+		f.notify()
+		f.mu.Unlock()
+		_, _ = w.Write([]byte("{}"))
+	case "/v3/lease/grant":
+		f.nextID++
+		id := strconv.Itoa(f.nextID)
+		f.leases[id] = nil
+		f.mu.Unlock()
+		_ = json.NewEncoder(w).Encode(map[string]string{"ID": id, "TTL": str("TTL")})
+	case "/v3/lease/keepalive":
+		ttl := "0"
+		if _, ok := f.leases[str("ID")]; ok {
+			ttl = "3"
+		}
+		f.mu.Unlock()
+		_ = json.NewEncoder(w).Encode(map[string]interface{}{"result": map[string]string{"ID": str("ID"), "TTL": ttl}})
+	case "/v3/lease/revoke":
+		f.mu.Unlock()
+		f.expire(str("ID"))
+		_, _ = w.Write([]byte("{}"))
+	case "/v3/watch":
+		changed := f.changed
+		f.mu.Unlock()
+		_ = json.NewEncoder(w).Encode(map[string]interface{}{"result": map[string]bool{"created": true}})
+		w.(http.Flusher).Flush()
+		for {
+			select {
+			case <-changed:
+			case <-r.Context().Done():
+				return
+			}
+			f.mu.Lock()
+			changed = f.changed
+			f.mu.Unlock()
+			_ = json.NewEncoder(w).Encode(map[string]interface{}{"result": map[string]interface{}{"events": []map[string]string{{"type": "PUT"}}}})
+			w.(http.Flusher).Flush()
+		}
+	default:
+		f.mu.Unlock()
+		w.WriteHeader(http.StatusNotFound)
+	}
+}
+
+func waitServers(t *testing.T, d Discovery, expect []string) {
+	t.Helper()
+	var servers []string
+	for i := 0; i < 100; i++ {
+		servers, _ = d.GetAll()
+		if reflect.DeepEqual(servers, expect) || len(servers) == 0 && len(expect) == 0 {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("expect %v, got %v", expect, servers)
+}
+
+func TestEtcdDiscovery(t *testing.T) {
+	f := newFakeEtcd()
+	ts := httptest.NewServer(f)
+	defer ts.Close()
+
+	const prefix = "/minirpc/Foo/"
+	stop1, err := registry.EtcdHeartbeat(ts.URL, prefix, "tcp@127.0.0.1:7001", nil, 3*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stop1()
+	// 其他前缀下的键不属于这个服务
+	stop3, err := registry.EtcdHeartbeat(ts.URL, "/minirpc/Bar/", "tcp@127.0.0.1:7003", nil, 3*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stop3()
+
+	d, err := NewEtcdDiscovery(ts.URL, prefix)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = d.Close() }()
+	waitServers(t, d, []string{"tcp@127.0.0.1:7001"})
+
+	// 新实例注册之后通过监听立即可见
+	stop2, err := registry.EtcdHeartbeat(ts.URL, prefix, "tcp@127.0.0.1:7002", map[string]string{"weight": "3"}, 3*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	waitServers(t, d, []string{"tcp@127.0.0.1:7001", "tcp@127.0.0.1:7002"})
+	if w := d.Weight("tcp@127.0.0.1:7002"); w != 3 {
+		t.Fatalf("expect weight 3, got %d", w)
+	}
+
+	// 撤销租约之后实例下线
+	stop2()
+	waitServers(t, d, []string{"tcp@127.0.0.1:7001"})
+
+	// 租约过期之后实例下线
+	f.expire("1")
+	waitServers(t, d, nil)
+	if !strings.HasPrefix(etcdRangeEnd(prefix), "/minirpc/Foo0") {
+		t.Fatalf("unexpected range end %q", etcdRangeEnd(prefix))
+	}
+}
+
+func TestEtcdDiscovery_CloseWhileRefreshHangs(t *testing.T) {
+	f := newFakeEtcd()
+	var hang atomic.Bool
+	hanging := make(chan struct{}, 1)
+	release := make(chan struct{})
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/v3/kv/range" && hang.Load() {
+			// etcd 没有响应, 直到请求被取消
+			select {
+			case hanging <- struct{}{}:
+			default:
+			}
+			select {
+			case <-r.Context().Done():
+			case <-release:
+			}
+			return
+		}
+		f.ServeHTTP(w, r)
+	}))
+	defer ts.Close()
+	defer close(release)
+
+	d, err := NewEtcdDiscovery(ts.URL, "/minirpc/Foo/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(50 * time.Millisecond) // 等待监听建立
+	hang.Store(true)
+	stop, err := registry.EtcdHeartbeat(ts.URL, "/minirpc/Foo/", "tcp@127.0.0.1:7001", nil, 3*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stop()
+	select {
+	case <-hanging:
+	case <-time.After(time.Second):
+		t.Fatal("expect the watch to refresh")
+	}
+	closed := make(chan struct{})
+	go func() {
+		_ = d.Close()
+		close(closed)
+	}()
+	select {
+	case <-closed:
+	case <-time.After(time.Second):
+		t.Fatal("Close blocked by a hanging refresh")
+	}
+}
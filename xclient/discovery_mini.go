@@ -16,6 +16,9 @@ type MiniRegisterDiscovery struct {
 
 const defaultUpdateTimeout = time.Second * 10
 
+// addrUnescaper 还原注册中心转义的地址, 见 registry.MiniRegister
+var addrUnescaper = strings.NewReplacer("%2C", ",", "%25", "%")
+
 func NewMiniRegisterDiscovery(registerAddr string, timeout time.Duration) *MiniRegisterDiscovery {
 	if timeout == 0 {
 		timeout = defaultUpdateTimeout
@@ -48,12 +51,28 @@ func (d *MiniRegisterDiscovery) Refresh() error {
 		log.Println("rpc registry refresh err:", err)
 		return err
 	}
-	servers := strings.Split(resp.Header.Get("X-Minirpc-Servers"), ",")
-	d.servers = make([]string, 0, len(servers))
-	for _, server := range servers {
-		if strings.TrimSpace(server) != "" {
-			d.servers = append(d.servers, strings.TrimSpace(server))
+	_ = resp.Body.Close()
+	// 注册中心用逗号连接所有的地址, 地址中的逗号转义为 %2C; 同时兼容每个地址单独一个值的格式
+	d.servers = make([]string, 0)
+	for _, v := range resp.Header.Values("X-Minirpc-Servers") {
+		for _, server := range strings.Split(v, ",") {
+			if server = strings.TrimSpace(server); server != "" {
+				d.servers = append(d.servers, addrUnescaper.Replace(server))
+			}
+		}
+	}
+	// 注册中心返回的元数据, 格式为 "<key>=<value> <addr>"
+	d.metadata = make(map[string]map[string]string)
+	for _, v := range resp.Header.Values("X-Minirpc-Metadata") {
+		kv, addr, _ := strings.Cut(strings.TrimSpace(v), " ")
+		k, v, ok := strings.Cut(kv, "=")
+		if !ok || addr == "" {
+			continue
+		}
+		if d.metadata[addr] == nil {
+			d.metadata[addr] = make(map[string]string)
 		}
+		d.metadata[addr][k] = v
 	}
 	d.lastUpdate = time.Now()
 	return nil
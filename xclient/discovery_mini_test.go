@@ -0,0 +1,81 @@
+package xclient
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/fanyeke/minirpc/registry"
+)
+
+func TestMiniRegisterDiscovery_UnixAddr(t *testing.T) {
+	ts := httptest.NewServer(registry.New(time.Minute))
+	defer ts.Close()
+
+	addrs := []string{"tcp@127.0.0.1:7001", "unix@/tmp/minirpc,a@b.sock"}
+	for _, addr := range addrs {
+		registry.Heartbeat(ts.URL, addr, time.Hour)
+	}
+	d := NewMiniRegisterDiscovery(ts.URL, 0)
+	servers, err := d.GetAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(servers, addrs) {
+		t.Fatalf("expect %v, got %v", addrs, servers)
+	}
+}
+
+func TestMiniRegisterDiscovery_HeaderFormat(t *testing.T) {
+	ts := httptest.NewServer(registry.New(time.Minute))
+	defer ts.Close()
+	registry.Heartbeat(ts.URL, "tcp@127.0.0.1:7001", time.Hour)
+	registry.Heartbeat(ts.URL, "tcp@127.0.0.1:7002", time.Hour)
+	// 只读取第一个值的旧客户端也能拿到所有的地址
+	resp, err := http.Get(ts.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = resp.Body.Close()
+	if got := resp.Header.Get("X-Minirpc-Servers"); got != "tcp@127.0.0.1:7001,tcp@127.0.0.1:7002" {
+		t.Fatalf("unexpected servers header %q", got)
+	}
+
+	// 每个地址单独一个值的注册中心
+	old := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Add("X-Minirpc-Servers", "tcp@127.0.0.1:7001")
+		w.Header().Add("X-Minirpc-Servers", "tcp@127.0.0.1:7002")
+	}))
+	defer old.Close()
+	servers, err := NewMiniRegisterDiscovery(old.URL, 0).GetAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expect := []string{"tcp@127.0.0.1:7001", "tcp@127.0.0.1:7002"}; !reflect.DeepEqual(servers, expect) {
+		t.Fatalf("expect %v, got %v", expect, servers)
+	}
+}
+
+func TestMiniRegisterDiscovery_Metadata(t *testing.T) {
+	ts := httptest.NewServer(registry.New(time.Minute))
+	defer ts.Close()
+
+	registry.Heartbeat(ts.URL, "tcp@127.0.0.1:7001", time.Hour)
+	registry.HeartbeatWithWeight(ts.URL, "tcp@127.0.0.1:7002", 3, time.Hour)
+	registry.HeartbeatWithMetadata(ts.URL, "tcp@127.0.0.1:7003", map[string]string{"weight": "0", "partition": "1"}, time.Hour)
+	d := NewMiniRegisterDiscovery(ts.URL, 0)
+	if err := d.Refresh(); err != nil {
+		t.Fatal(err)
+	}
+	if w1, w2, w3 := d.Weight("tcp@127.0.0.1:7001"), d.Weight("tcp@127.0.0.1:7002"), d.Weight("tcp@127.0.0.1:7003"); w1 != 1 || w2 != 3 || w3 != 0 {
+		t.Fatalf("unexpected weights %d %d %d", w1, w2, w3)
+	}
+	if p, ok := d.Partition("tcp@127.0.0.1:7003"); !ok || p != 1 {
+		t.Fatalf("expect partition 1, got %d %v", p, ok)
+	}
+	if _, ok := d.Partition("tcp@127.0.0.1:7001"); ok {
+		t.Fatal("expect no partition without metadata")
+	}
+}
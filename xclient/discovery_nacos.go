@@ -0,0 +1,249 @@
+package xclient
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"net"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// NacosDiscovery 从 Nacos 订阅服务实例, 通过 Nacos 的 Open API 访问, 不依赖 Nacos 的 Go 客户端
+// 实例由 registry.NacosHeartbeat 或者其他语言的 Nacos 客户端注册, 地址是元数据中的 protocol (默认 tcp) 加上实例的 ip 和端口
+// 只返回健康并且启用的实例; Nacos 中的权重乘以 100 作为 weight, 大于 0 的权重至少为 1, 例如 0.3 的金丝雀权重是 30
+type NacosDiscovery struct {
+	*MultiServerDiscovery
+	server      *url.URL
+	service     string
+	interval    time.Duration
+	client      *http.Client
+	push        *net.UDPConn // 接收 Nacos 推送的 UDP 端口, 为 nil 时只轮询
+	clientIP    string       // Nacos 推送的目标地址
+	lastRefTime int64        // 已经应用的实例列表的版本, 较旧的推送被忽略
+	cancel      context.CancelFunc
+	wg          sync.WaitGroup
+}
+
+// nacosPushMaxSize 推送的实例列表解压之后的最大字节数
+const nacosPushMaxSize = 4 << 20
+
+// NewNacosDiscovery 订阅 service 的实例, 不再使用时调用 Close
+// 读取实例时带上本地的 UDP 端口, 实例变化时 Nacos 立即推送新的列表; 同时每 interval 重新读取一次, 用于推送丢失或者 UDP 不通的情况,
+// 也是对订阅的续期 (Nacos 默认 10 秒没有续期的订阅会过期), interval 为 0 时使用 5 秒; 无法监听 UDP 端口时只轮询
+// server 是 Nacos 的地址, 例如 http://127.0.0.1:8848, 可以带上 namespaceId 等查询参数, 每个请求都会带上
+// service 可以写成 "<group>@@<service>" 指定分组, 默认分组是 DEFAULT_GROUP
+func NewNacosDiscovery(server, service string, interval time.Duration) (*NacosDiscovery, error) {
+	u, err := url.Parse(server)
+	if err != nil {
+		return nil, err
+	}
+	if interval == 0 {
+		interval = 5 * time.Second
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	d := &NacosDiscovery{
+		MultiServerDiscovery: NewMultiServerDiscovery(nil),
+		server:               u,
+		service:              service,
+		interval:             interval,
+		client:               &http.Client{Timeout: interval},
+		cancel:               cancel,
+	}
+	if err := d.listenPush(); err != nil {
+		log.Println("rpc discovery: nacos push disabled, polling only:", err)
+	}
+	if err := d.Refresh(); err != nil {
+		d.closePush()
+		cancel()
+		return nil, err
+	}
+	if d.push != nil {
+		d.wg.Add(1)
+		go d.receive()
+	}
+	d.wg.Add(1)
+	go d.poll(ctx)
+	return d, nil
+}
+
+var _ Discovery = (*NacosDiscovery)(nil)
+
+// nacosHost Nacos 返回的实例
+type nacosHost struct {
+	IP       string            `json:"ip"`
+	Port     int               `json:"port"`
+	Weight   float64           `json:"weight"`
+	Healthy  bool              `json:"healthy"`
+	Enabled  *bool             `json:"enabled"`
+	Metadata map[string]string `json:"metadata"`
+}
+
+// nacosService 读取和推送的实例列表
+type nacosService struct {
+	Hosts       []nacosHost `json:"hosts"`
+	LastRefTime int64       `json:"lastRefTime"`
+}
+
+// listenPush 监听 UDP 端口, 本机访问 Nacos 使用的地址作为推送的目标地址
+func (d *NacosDiscovery) listenPush() error {
+	// UDP 的 Dial 不会发送数据, 只是确定路由和本地地址
+	probe, err := net.Dial("udp", net.JoinHostPort(d.server.Hostname(), "8848"))
+	if err != nil {
+		return err
+	}
+	ip := probe.LocalAddr().(*net.UDPAddr).IP
+	_ = probe.Close()
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: ip})
+	if err != nil {
+		return err
+	}
+	d.push, d.clientIP = conn, ip.String()
+	return nil
+}
+
+func (d *NacosDiscovery) closePush() {
+	if d.push != nil {
+		_ = d.push.Close()
+	}
+}
+
+// Refresh 从 Nacos 读取所有的健康实例和元数据, 同时续期推送的订阅
+func (d *NacosDiscovery) Refresh() error {
+	u := *d.server
+	u.Path = "/nacos/v1/ns/instance/list"
+	q := u.Query()
+	q.Set("serviceName", d.service)
+	q.Set("healthyOnly", "true")
+	if d.push != nil {
+		q.Set("udpPort", strconv.Itoa(d.push.LocalAddr().(*net.UDPAddr).Port))
+		q.Set("clientIP", d.clientIP)
+	}
+	u.RawQuery = q.Encode()
+	resp, err := d.client.Get(u.String())
+	if err != nil {
+		return err
+	}
+	defer func() { _ = resp.Body.Close() }()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("rpc discovery: nacos list %s: %s", d.service, resp.Status)
+	}
+	var svc nacosService
+	if err := json.NewDecoder(resp.Body).Decode(&svc); err != nil {
+		return err
+	}
+	d.apply(&svc)
+	return nil
+}
+
+// nacosWeight 把 Nacos 的权重转换为 WeightedRandomSelect 使用的整数权重
+func nacosWeight(w float64) int {
+	if w <= 0 {
+		return 0
+	}
+	return int(math.Max(1, math.Round(w*100)))
+}
+
+// apply 使用 svc 中的实例, svc 比已经应用的列表旧时忽略
+func (d *NacosDiscovery) apply(svc *nacosService) {
+	servers := make([]string, 0, len(svc.Hosts))
+	metadata := make(map[string]map[string]string)
+	for _, h := range svc.Hosts {
+		if !h.Healthy || h.Enabled != nil && !*h.Enabled {
+			continue
+		}
+		protocol := "tcp"
+		if p := h.Metadata["protocol"]; p != "" {
+			protocol = p
+		}
+		addr := protocol + "@" + net.JoinHostPort(h.IP, strconv.Itoa(h.Port))
+		servers = append(servers, addr)
+		md := make(map[string]string, len(h.Metadata)+1)
+		for k, v := range h.Metadata {
+			md[k] = v
+		}
+		md["weight"] = strconv.Itoa(nacosWeight(h.Weight))
+		metadata[addr] = md
+	}
+	sort.Strings(servers)
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if svc.LastRefTime != 0 && svc.LastRefTime < d.lastRefTime {
+		return
+	}
+	d.servers, d.metadata, d.lastRefTime = servers, metadata, svc.LastRefTime
+}
+
+// receive 接收 Nacos 的推送并回复确认, 推送的格式与 Nacos 的 Java 客户端 (PushReceiver) 一致, 较大的数据经过 gzip 压缩
+func (d *NacosDiscovery) receive() {
+	defer d.wg.Done()
+	buf := make([]byte, 64<<10)
+	for {
+		n, addr, err := d.push.ReadFromUDP(buf)
+		if err != nil {
+			return // Close 关闭了端口
+		}
+		data := buf[:n]
+		if len(data) > 2 && data[0] == 0x1f && data[1] == 0x8b {
+			r, err := gzip.NewReader(bytes.NewReader(data))
+			if err != nil {
+				continue
+			}
+			data, err = io.ReadAll(io.LimitReader(r, nacosPushMaxSize))
+			if err != nil {
+				continue
+			}
+		}
+		var msg struct {
+			Type        string `json:"type"`
+			Data        string `json:"data"`
+			LastRefTime int64  `json:"lastRefTime"`
+		}
+		if err := json.Unmarshal(data, &msg); err != nil {
+			log.Println("rpc discovery: nacos push err:", err)
+			continue
+		}
+		if msg.Type == "dom" || msg.Type == "service" {
+			var svc nacosService
+			if err := json.Unmarshal([]byte(msg.Data), &svc); err == nil {
+				d.apply(&svc)
+			}
+		}
+		ack, _ := json.Marshal(map[string]string{"type": "push-ack", "lastRefTime": strconv.FormatInt(msg.LastRefTime, 10), "data": ""})
+		_, _ = d.push.WriteToUDP(ack, addr)
+	}
+}
+
+func (d *NacosDiscovery) poll(ctx context.Context) {
+	defer d.wg.Done()
+	t := time.NewTicker(d.interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-t.C:
+		case <-ctx.Done():
+			return
+		}
+		// 读取失败时保留上一次的实例
+		if err := d.Refresh(); err != nil {
+			log.Println("rpc discovery: nacos refresh err:", err)
+		}
+	}
+}
+
+// Close 停止订阅
+func (d *NacosDiscovery) Close() error {
+	d.cancel()
+	d.closePush()
+	d.wg.Wait()
+	return nil
+}
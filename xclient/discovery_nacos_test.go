@@ -0,0 +1,178 @@
+package xclient
+
+import (
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/fanyeke/minirpc/registry"
+)
+
+// fakeNacos 在内存中实现 Nacos Open API 的一部分, 实例按 namespaceId, serviceName 和 ip:port 区分
+type fakeNacos struct {
+	mu        sync.Mutex
+	instances map[string]map[string]map[string]interface{} // namespaceId/serviceName -> ip:port -> 实例
+	pushAddr  string                                       // 读取实例时带上的推送地址
+}
+
+func (f *fakeNacos) remove(service, hostport string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	delete(f.instances[service], hostport)
+}
+
+func (f *fakeNacos) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	service := q.Get("namespaceId") + "/" + q.Get("serviceName")
+	hostport := q.Get("ip") + ":" + q.Get("port")
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	switch r.Method + " " + r.URL.Path {
+	case "POST /nacos/v1/ns/instance":
+		port, _ := strconv.Atoi(q.Get("port"))
+		weight := 1.0
+		if w := q.Get("weight"); w != "" {
+			weight, _ = strconv.ParseFloat(w, 64)
+		}
+		var md map[string]string
+		_ = json.Unmarshal([]byte(q.Get("metadata")), &md)
+		if f.instances[service] == nil {
+			f.instances[service] = make(map[string]map[string]interface{})
+		}
+		f.instances[service][hostport] = map[string]interface{}{
+			"ip": q.Get("ip"), "port": port, "weight": weight, "healthy": true, "enabled": true, "metadata": md,
+		}
+		_, _ = w.Write([]byte("ok"))
+	case "PUT /nacos/v1/ns/instance/beat":
+		code := 10200
+		if f.instances[service][hostport] == nil {
+			code = 20404
+		}
+		_ = json.NewEncoder(w).Encode(map[string]int{"code": code, "clientBeatInterval": 5000})
+	case "DELETE /nacos/v1/ns/instance":
+		delete(f.instances[service], hostport)
+		_, _ = w.Write([]byte("ok"))
+	case "GET /nacos/v1/ns/instance/list":
+		if q.Get("udpPort") != "" {
+			f.pushAddr = net.JoinHostPort(q.Get("clientIP"), q.Get("udpPort"))
+		}
+		hosts := make([]map[string]interface{}, 0)
+		for _, h := range f.instances[service] {
+			hosts = append(hosts, h)
+		}
+		// 其他服务的实例, 以及不健康的实例
+		hosts = append(hosts, map[string]interface{}{"ip": "10.0.0.9", "port": 7009, "weight": 1, "healthy": false})
+		_ = json.NewEncoder(w).Encode(map[string]interface{}{"hosts": hosts})
+	default:
+		w.WriteHeader(http.StatusNotFound)
+	}
+}
+
+func TestNacosDiscovery(t *testing.T) {
+	f := &fakeNacos{instances: make(map[string]map[string]map[string]interface{})}
+	ts := httptest.NewServer(f)
+	defer ts.Close()
+
+	server := ts.URL + "?namespaceId=dev"
+	const service = "rpc@@Foo"
+	stop1, err := registry.NacosHeartbeat(server, service, "tcp@10.0.0.1:7001", nil, 10*time.Millisecond)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stop1()
+	// 其他命名空间的实例不可见
+	stop3, err := registry.NacosHeartbeat(ts.URL, service, "tcp@10.0.0.3:7003", nil, 10*time.Millisecond)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stop3()
+	if _, err := registry.NacosHeartbeat(server, service, "unix@/tmp/minirpc.sock", nil, 0); err == nil {
+		t.Fatal("expect error for unix address")
+	}
+
+	d, err := NewNacosDiscovery(server, service, 10*time.Millisecond)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = d.Close() }()
+	waitServers(t, d, []string{"tcp@10.0.0.1:7001"})
+
+	stop2, err := registry.NacosHeartbeat(server, service, "tcp@[::1]:7002", map[string]string{"weight": "3"}, 10*time.Millisecond)
+	if err != nil {
+		t.Fatal(err)
+	}
+	waitServers(t, d, []string{"tcp@10.0.0.1:7001", "tcp@[::1]:7002"})
+	// Nacos 的权重乘以 100
+	if w1, w2 := d.Weight("tcp@10.0.0.1:7001"), d.Weight("tcp@[::1]:7002"); w1 != 100 || w2 != 300 {
+		t.Fatalf("expect weights 100 and 300, got %d and %d", w1, w2)
+	}
+
+	// 服务端删除了实例, 下一次心跳重新注册
+	f.remove("dev/"+service, "10.0.0.1:7001")
+	waitServers(t, d, []string{"tcp@10.0.0.1:7001", "tcp@[::1]:7002"})
+
+	// 注销之后实例下线
+	stop2()
+	waitServers(t, d, []string{"tcp@10.0.0.1:7001"})
+}
+
+func TestNacosDiscovery_Push(t *testing.T) {
+	f := &fakeNacos{instances: make(map[string]map[string]map[string]interface{})}
+	ts := httptest.NewServer(f)
+	defer ts.Close()
+	stop, err := registry.NacosHeartbeat(ts.URL, "Foo", "tcp@127.0.0.1:7001", nil, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stop()
+
+	// 轮询的间隔很长, 实例的变化只能通过推送得知
+	d, err := NewNacosDiscovery(ts.URL, "Foo", time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = d.Close() }()
+	waitServers(t, d, []string{"tcp@127.0.0.1:7001"})
+	f.mu.Lock()
+	pushAddr := f.pushAddr
+	f.mu.Unlock()
+	if pushAddr == "" {
+		t.Fatal("expect the list request to subscribe for pushes")
+	}
+
+	conn, err := net.Dial("udp", pushAddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = conn.Close() }()
+	push := func(refTime int64, hosts ...map[string]interface{}) {
+		data, _ := json.Marshal(map[string]interface{}{"hosts": hosts, "lastRefTime": refTime})
+		msg, _ := json.Marshal(map[string]interface{}{"type": "dom", "data": string(data), "lastRefTime": refTime})
+		if _, err := conn.Write(msg); err != nil {
+			t.Fatal(err)
+		}
+		// 每个推送都需要确认
+		_ = conn.SetReadDeadline(time.Now().Add(time.Second))
+		buf := make([]byte, 1024)
+		n, err := conn.Read(buf)
+		var ack map[string]string
+		if err != nil || json.Unmarshal(buf[:n], &ack) != nil || ack["type"] != "push-ack" || ack["lastRefTime"] != strconv.FormatInt(refTime, 10) {
+			t.Fatalf("expect a push ack, got %q %v", buf[:n], err)
+		}
+	}
+	canary := map[string]interface{}{"ip": "127.0.0.1", "port": 7002, "weight": 0.3, "healthy": true}
+	push(time.Now().UnixMilli(), map[string]interface{}{"ip": "127.0.0.1", "port": 7001, "weight": 1, "healthy": true}, canary)
+	waitServers(t, d, []string{"tcp@127.0.0.1:7001", "tcp@127.0.0.1:7002"})
+	// 小于 0.5 的权重仍然可以被选中
+	if w := d.Weight("tcp@127.0.0.1:7002"); w != 30 {
+		t.Fatalf("expect weight 30, got %d", w)
+	}
+	// 较旧的推送被忽略
+	push(1, canary)
+	waitServers(t, d, []string{"tcp@127.0.0.1:7001", "tcp@127.0.0.1:7002"})
+}
@@ -0,0 +1,110 @@
+package xclient
+
+import (
+	"encoding/json"
+	"log"
+	"net/url"
+	"sort"
+	"time"
+
+	"github.com/fanyeke/minirpc/registry"
+)
+
+// ZKDiscovery 从 ZooKeeper 读取服务实例, 并通过 watch 监听实例的变化
+// 每个实例是 path 下的一个临时节点, 节点名是转义后的地址, 数据是实例的元数据 (JSON 对象, 可以为空), 见 registry.ZKRegister
+type ZKDiscovery struct {
+	*MultiServerDiscovery
+	conn registry.ZKConn
+	path string
+	stop chan struct{}
+	done chan struct{}
+}
+
+// zkWatchRetry 读取或者 watch 失败之后重试之前等待的时间, 例如会话断开期间
+const zkWatchRetry = time.Second
+
+// NewZKDiscovery 读取 path 下的实例, 并在后台监听 path 的子节点; 不再使用时调用 Close
+// conn 见 registry.ZKConn, 例如子模块 github.com/fanyeke/minirpc/zookeeper 的 Connect
+func NewZKDiscovery(conn registry.ZKConn, path string) (*ZKDiscovery, error) {
+	d := &ZKDiscovery{
+		MultiServerDiscovery: NewMultiServerDiscovery(nil),
+		conn:                 conn,
+		path:                 path,
+		stop:                 make(chan struct{}),
+		done:                 make(chan struct{}),
+	}
+	watch, err := d.load()
+	if err != nil {
+		return nil, err
+	}
+	go d.watch(watch)
+	return d, nil
+}
+
+var _ Discovery = (*ZKDiscovery)(nil)
+
+// load 读取所有的实例和元数据, 返回子节点的 watch
+func (d *ZKDiscovery) load() (<-chan struct{}, error) {
+	children, watch, err := d.conn.ChildrenW(d.path)
+	if err != nil {
+		return nil, err
+	}
+	servers := make([]string, 0, len(children))
+	metadata := make(map[string]map[string]string)
+	for _, child := range children {
+		addr, err := url.PathUnescape(child)
+		if err != nil || addr == "" {
+			continue
+		}
+		data, err := d.conn.Get(d.path + "/" + child)
+		if err != nil {
+			// 读取列表之后节点被删除了, watch 会再次触发
+			continue
+		}
+		servers = append(servers, addr)
+		if len(data) > 0 {
+			var md map[string]string
+			if json.Unmarshal(data, &md) == nil {
+				metadata[addr] = md
+			}
+		}
+	}
+	sort.Strings(servers)
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.servers, d.metadata = servers, metadata
+	return watch, nil
+}
+
+// Refresh 从 ZooKeeper 重新读取实例, 通常不需要调用, 变化由 watch 通知
+func (d *ZKDiscovery) Refresh() error {
+	_, err := d.load()
+	return err
+}
+
+func (d *ZKDiscovery) watch(watch <-chan struct{}) {
+	defer close(d.done)
+	for {
+		select {
+		case <-watch:
+		case <-d.stop:
+			return
+		}
+		var err error
+		for watch, err = d.load(); err != nil; watch, err = d.load() {
+			log.Println("rpc discovery: zookeeper watch err:", err)
+			select {
+			case <-time.After(zkWatchRetry):
+			case <-d.stop:
+				return
+			}
+		}
+	}
+}
+
+// Close 停止监听, 不关闭 conn
+func (d *ZKDiscovery) Close() error {
+	close(d.stop)
+	<-d.done
+	return nil
+}
@@ -0,0 +1,131 @@
+package xclient
+
+import (
+	"errors"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/fanyeke/minirpc/registry"
+)
+
+// fakeZK 在内存中模拟 ZooKeeper 的节点和一次性的 watch, 实现 registry.ZKConn
+type fakeZK struct {
+	mu          sync.Mutex
+	nodes       map[string][]byte
+	childWatch  map[string][]chan struct{}
+	existsWatch map[string][]chan struct{}
+}
+
+func newFakeZK() *fakeZK {
+	return &fakeZK{
+		nodes:       make(map[string][]byte),
+		childWatch:  make(map[string][]chan struct{}),
+		existsWatch: make(map[string][]chan struct{}),
+	}
+}
+
+func fire(watches map[string][]chan struct{}, path string) {
+	for _, ch := range watches[path] {
+		close(ch)
+	}
+	delete(watches, path)
+}
+
+func parent(path string) string { return path[:strings.LastIndex(path, "/")] }
+
+func (z *fakeZK) ChildrenW(path string) ([]string, <-chan struct{}, error) {
+	z.mu.Lock()
+	defer z.mu.Unlock()
+	var children []string
+	for node := range z.nodes {
+		if parent(node) == path {
+			children = append(children, node[len(path)+1:])
+		}
+	}
+	ch := make(chan struct{})
+	z.childWatch[path] = append(z.childWatch[path], ch)
+	return children, ch, nil
+}
+
+func (z *fakeZK) Get(path string) ([]byte, error) {
+	z.mu.Lock()
+	defer z.mu.Unlock()
+	data, ok := z.nodes[path]
+	if !ok {
+		return nil, errors.New("zk: node does not exist")
+	}
+	return data, nil
+}
+
+func (z *fakeZK) CreateEphemeral(path string, data []byte) error {
+	z.mu.Lock()
+	defer z.mu.Unlock()
+	if _, ok := z.nodes[path]; ok {
+		return errors.New("zk: node already exists")
+	}
+	z.nodes[path] = data
+	fire(z.existsWatch, path)
+	fire(z.childWatch, parent(path))
+	return nil
+}
+
+func (z *fakeZK) ExistsW(path string) (bool, <-chan struct{}, error) {
+	z.mu.Lock()
+	defer z.mu.Unlock()
+	_, ok := z.nodes[path]
+	ch := make(chan struct{})
+	z.existsWatch[path] = append(z.existsWatch[path], ch)
+	return ok, ch, nil
+}
+
+func (z *fakeZK) Delete(path string) error {
+	z.mu.Lock()
+	defer z.mu.Unlock()
+	if _, ok := z.nodes[path]; !ok {
+		return errors.New("zk: node does not exist")
+	}
+	delete(z.nodes, path)
+	fire(z.existsWatch, path)
+	fire(z.childWatch, parent(path))
+	return nil
+}
+
+func TestZKDiscovery(t *testing.T) {
+	z := newFakeZK()
+	const path = "/minirpc/Foo"
+	unregister1, err := registry.ZKRegister(z, path, "unix@/tmp/minirpc.sock", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = unregister1() }()
+
+	d, err := NewZKDiscovery(z, path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = d.Close() }()
+	waitServers(t, d, []string{"unix@/tmp/minirpc.sock"})
+
+	// 新实例注册之后通过 watch 立即可见
+	unregister2, err := registry.ZKRegister(z, path, "tcp@127.0.0.1:7002", map[string]string{"weight": "3"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	waitServers(t, d, []string{"tcp@127.0.0.1:7002", "unix@/tmp/minirpc.sock"})
+	if w := d.Weight("tcp@127.0.0.1:7002"); w != 3 {
+		t.Fatalf("expect weight 3, got %d", w)
+	}
+
+	// 会话过期删除了临时节点, 注册方重新创建
+	if err := z.Delete(path + "/tcp@127.0.0.1:7002"); err != nil {
+		t.Fatal(err)
+	}
+	waitServers(t, d, []string{"tcp@127.0.0.1:7002", "unix@/tmp/minirpc.sock"})
+
+	// 注销之后实例下线
+	if err := unregister2(); err != nil {
+		t.Fatal(err)
+	}
+	waitServers(t, d, []string{"unix@/tmp/minirpc.sock"})
+}
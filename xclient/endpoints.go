@@ -0,0 +1,52 @@
+package xclient
+
+import (
+	"sort"
+
+	. "github.com/fanyeke/minirpc"
+)
+
+// EndpointInfo 一个实例的链接状态, 见 XClient.Endpoints
+type EndpointInfo struct {
+	Addr     string
+	Inflight int64 // 通过 XClient 发出还没有完成的请求数
+	// Clients 已经建立的链接, 可以查看 IsAvailable, Stats 等; 包括 SetServiceOption 设置的服务单独使用的链接
+	Clients []*Client
+}
+
+// Client 返回 rpcAddr 的一条可用的链接, 需要时建立, 用于把管理和调试命令发给指定的实例
+// rpcAddr 不需要在 Discovery 中; 直接在链接上发出的请求不经过负载均衡, 重试和熔断, 也不计入 XClient 的统计
+func (xc *XClient) Client(rpcAddr string) (*Client, error) {
+	return xc.dial(rpcAddr, "")
+}
+
+// Endpoints 返回 Discovery 中的实例和已经建立链接的实例, 按地址排序
+func (xc *XClient) Endpoints() ([]EndpointInfo, error) {
+	servers, err := xc.d.GetAll()
+	if err != nil {
+		return nil, err
+	}
+	xc.mu.Lock()
+	pools := make(map[string][]*ClientPool)
+	for key, pool := range xc.clients {
+		pools[key.rpcAddr] = append(pools[key.rpcAddr], pool)
+	}
+	xc.mu.Unlock()
+	addrs := make(map[string]bool, len(servers)+len(pools))
+	for _, rpcAddr := range servers {
+		addrs[rpcAddr] = true
+	}
+	for rpcAddr := range pools {
+		addrs[rpcAddr] = true
+	}
+	infos := make([]EndpointInfo, 0, len(addrs))
+	for rpcAddr := range addrs {
+		info := EndpointInfo{Addr: rpcAddr, Inflight: xc.endpoint(rpcAddr).inflight.Load()}
+		for _, pool := range pools[rpcAddr] {
+			info.Clients = append(info.Clients, pool.Clients()...)
+		}
+		infos = append(infos, info)
+	}
+	sort.Slice(infos, func(i, j int) bool { return infos[i].Addr < infos[j].Addr })
+	return infos, nil
+}
@@ -0,0 +1,116 @@
+package xclient
+
+import (
+	"context"
+	"reflect"
+	"time"
+
+	. "github.com/fanyeke/minirpc"
+)
+
+// FailMode Call 失败时的处理方式, 见 XClient.SetFailMode
+type FailMode int
+
+const (
+	Failfast   FailMode = iota // 失败时直接返回错误, 默认的方式
+	Failover                   // 按 RetryPolicy 重试, 每次重试换一个实例
+	Failtry                    // 按 RetryPolicy 重试, 一直使用同一个实例
+	Failbackup                 // 第一个请求在 BackupDelay 之内没有返回或者失败时, 向另一个实例发送备份请求, 使用先成功的结果
+)
+
+// defaultRetry Failover 和 Failtry 没有设置 RetryPolicy 时使用的重试策略
+var defaultRetry = RetryPolicy{MaxAttempts: 3}
+
+// defaultBackupDelay Failbackup 默认等待的时间
+const defaultBackupDelay = 10 * time.Millisecond
+
+// SetFailMode 设置 Call 失败时的处理方式, 重试的次数和等待时间见 SetRetryPolicy, 没有设置时最多尝试 3 次
+func (xc *XClient) SetFailMode(mode FailMode) {
+	xc.mu.Lock()
+	defer xc.mu.Unlock()
+	xc.failMode = mode
+}
+
+// SetBackupDelay 设置 Failbackup 发送备份请求之前等待的时间, 0 表示 10ms
+// 一般设置为延迟的 P90 到 P99 之间, 只为少数慢的请求多发一次
+func (xc *XClient) SetBackupDelay(d time.Duration) {
+	xc.mu.Lock()
+	defer xc.mu.Unlock()
+	xc.backupDelay = d
+}
+
+// callBackup 按 Failbackup 调用, 两个请求都失败时返回包括两个错误的 *MultiError
+func (xc *XClient) callBackup(ctx context.Context, delay time.Duration, serviceMethod string, args, reply interface{}) error {
+	if delay <= 0 {
+		delay = defaultBackupDelay
+	}
+	// 先返回的请求成功之后取消另一个
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	type result struct {
+		rpcAddr string
+		attempt int
+		reply   interface{}
+		err     error
+	}
+	results := make(chan result, 2)
+	send := func(attempt int, avoid map[string]bool) string {
+		rpcAddr, err := xc.pickAvoiding(ctx, serviceMethod, args, avoid)
+		if err != nil {
+			results <- result{attempt: attempt, err: err}
+			return ""
+		}
+		// 两个请求不能写入同一个 reply
+		var cloned interface{}
+		if reply != nil {
+			cloned = reflect.New(reflect.ValueOf(reply).Elem().Type()).Interface()
+		}
+		go func() {
+			err := xc.call(rpcAddr, NewAttemptContext(ctx, attempt), serviceMethod, args, cloned)
+			results <- result{rpcAddr: rpcAddr, attempt: attempt, reply: cloned, err: err}
+		}()
+		return rpcAddr
+	}
+	first := send(AttemptFromContext(ctx), nil)
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	inflight, backup := 1, false
+	errs := new(MultiError)
+	// 超出重试预算时不发送备份请求, 只等待第一个请求
+	sendBackup := func() bool {
+		backup = true
+		if !xc.allowRetry() {
+			return false
+		}
+		inflight++
+		send(AttemptFromContext(ctx)+1, map[string]bool{first: true})
+		return true
+	}
+	for {
+		select {
+		case r := <-results:
+			inflight--
+			if r.err == nil {
+				if reply != nil {
+					reflect.ValueOf(reply).Elem().Set(reflect.ValueOf(r.reply).Elem())
+				}
+				return nil
+			}
+			errs.Add(r.rpcAddr, r.attempt, r.err)
+			// 第一个请求很快失败时不需要等到 delay
+			if !backup && sendBackup() {
+				continue
+			}
+			if inflight == 0 {
+				if len(errs.Errors) == 1 {
+					return r.err
+				}
+				return errs
+			}
+		case <-timer.C:
+			if !backup {
+				sendBackup()
+			}
+		}
+	}
+}
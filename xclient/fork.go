@@ -0,0 +1,77 @@
+package xclient
+
+import (
+	"context"
+	"reflect"
+
+	. "github.com/fanyeke/minirpc"
+)
+
+// Fork 将请求同时发给所有服务实例, 使用第一个成功的结果并取消其他的请求, 适合从任意一个副本读取数据
+// 所有的实例都失败时返回包括每个实例的错误的 *MultiError; 请求会在多个实例上执行, 只能用于幂等的方法
+func (xc *XClient) Fork(ctx context.Context, serviceMethod string, args, reply interface{}) error {
+	servers, err := xc.candidates(serviceMethod)
+	if err != nil {
+		return err
+	}
+	return xc.fork(ctx, servers, serviceMethod, args, reply)
+}
+
+// ForkN 与 Fork 相同, 但是只发给按负载均衡选出的 n 个不同的实例, n 不小于实例数时与 Fork 相同
+func (xc *XClient) ForkN(ctx context.Context, n int, serviceMethod string, args, reply interface{}) error {
+	chosen := make(map[string]bool, n)
+	var servers []string
+	for len(servers) < n {
+		rpcAddr, err := xc.pickAvoiding(ctx, serviceMethod, args, chosen)
+		if err != nil {
+			return err
+		}
+		// 所有的候选实例都已经选过了
+		if chosen[rpcAddr] {
+			break
+		}
+		chosen[rpcAddr] = true
+		servers = append(servers, rpcAddr)
+	}
+	return xc.fork(ctx, servers, serviceMethod, args, reply)
+}
+
+// fork 将请求同时发给 servers, 第一个成功的结果写入 reply
+func (xc *XClient) fork(ctx context.Context, servers []string, serviceMethod string, args, reply interface{}) error {
+	leave, err := xc.enterBulkhead(ctx, serviceMethod)
+	if err != nil {
+		return err
+	}
+	defer leave()
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	type result struct {
+		rpcAddr string
+		reply   interface{}
+		err     error
+	}
+	results := make(chan result, len(servers))
+	for _, rpcAddr := range servers {
+		// 每个请求使用自己的 reply, 避免同时写入
+		var cloned interface{}
+		if reply != nil {
+			cloned = reflect.New(reflect.ValueOf(reply).Elem().Type()).Interface()
+		}
+		go func(rpcAddr string) {
+			err := xc.call(rpcAddr, ctx, serviceMethod, args, cloned)
+			results <- result{rpcAddr: rpcAddr, reply: cloned, err: err}
+		}(rpcAddr)
+	}
+	errs := new(MultiError)
+	for range servers {
+		r := <-results
+		if r.err == nil {
+			if reply != nil {
+				reflect.ValueOf(reply).Elem().Set(reflect.ValueOf(r.reply).Elem())
+			}
+			return nil
+		}
+		errs.Add(r.rpcAddr, 0, r.err)
+	}
+	return errs
+}
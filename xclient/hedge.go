@@ -0,0 +1,136 @@
+package xclient
+
+import (
+	"fmt"
+	"path"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Hedging 对冲请求的设置, 见 XClient.SetHedging
+// 第一个请求超过方法最近延迟的 Percentile 分位数还没有返回时, 向另一个实例发送相同的请求, 使用先成功的结果并取消另一个.
+// 同一个请求可能被执行两次, 只能用于幂等的方法
+type Hedging struct {
+	// Methods 幂等的 ServiceMethod, 语法与 path.Match 相同, 例如 "Cache.Get", "Query.*"; 只有匹配的方法发送对冲请求
+	Methods    []string
+	Percentile float64       // 延迟的分位数, 0 表示 0.95
+	MinDelay   time.Duration // 等待时间的下限, 避免延迟很稳定时发送太多对冲请求, 0 表示 1ms
+	MaxDelay   time.Duration // 等待时间的上限, 0 表示不限制
+}
+
+func (h *Hedging) percentile() float64 {
+	if h.Percentile <= 0 || h.Percentile >= 1 {
+		return 0.95
+	}
+	return h.Percentile
+}
+
+func (h *Hedging) minDelay() time.Duration {
+	if h.MinDelay <= 0 {
+		return time.Millisecond
+	}
+	return h.MinDelay
+}
+
+// match 返回 serviceMethod 是否被标记为幂等
+func (h *Hedging) match(serviceMethod string) bool {
+	for _, pattern := range h.Methods {
+		if ok, _ := path.Match(pattern, serviceMethod); ok {
+			return true
+		}
+	}
+	return false
+}
+
+const (
+	latencyWindowSize = 128 // 每个方法保留最近的这么多次延迟
+	minHedgeSamples   = 20  // 样本少于这个数时分位数不可靠, 不发送对冲请求
+)
+
+// latencyWindow 方法最近成功调用的延迟
+type latencyWindow struct {
+	mu      sync.Mutex
+	samples [latencyWindowSize]time.Duration
+	n, next int
+}
+
+func (w *latencyWindow) add(d time.Duration) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.samples[w.next] = d
+	w.next = (w.next + 1) % latencyWindowSize
+	if w.n < latencyWindowSize {
+		w.n++
+	}
+}
+
+// quantile 返回延迟的 q 分位数, 样本不足时返回 false
+func (w *latencyWindow) quantile(q float64) (time.Duration, bool) {
+	w.mu.Lock()
+	if w.n < minHedgeSamples {
+		w.mu.Unlock()
+		return 0, false
+	}
+	sorted := append([]time.Duration(nil), w.samples[:w.n]...)
+	w.mu.Unlock()
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+	return sorted[int(q*float64(len(sorted)-1))], true
+}
+
+// SetHedging 为 h.Methods 中的方法开启对冲请求, h 为 nil 时关闭
+// 只在 Failfast 时生效, Failover 和 Failtry 按 RetryPolicy 重试, Failbackup 使用固定的 BackupDelay
+func (xc *XClient) SetHedging(h *Hedging) error {
+	if h != nil {
+		for _, pattern := range h.Methods {
+			if _, err := path.Match(pattern, ""); err != nil {
+				return fmt.Errorf("rpc xclient: invalid hedging pattern %q: %w", pattern, err)
+			}
+		}
+	}
+	xc.mu.Lock()
+	defer xc.mu.Unlock()
+	if h == nil {
+		xc.hedging = nil
+		return nil
+	}
+	hedging := *h
+	hedging.Methods = append([]string(nil), h.Methods...)
+	xc.hedging = &hedging
+	return nil
+}
+
+// latencies 返回 serviceMethod 的延迟记录, serviceMethod 没有开启对冲请求时返回 nil
+func (xc *XClient) latencies(serviceMethod string) (*Hedging, *latencyWindow) {
+	xc.mu.Lock()
+	defer xc.mu.Unlock()
+	if xc.hedging == nil || !xc.hedging.match(serviceMethod) {
+		return nil, nil
+	}
+	w, ok := xc.windows[serviceMethod]
+	if !ok {
+		if xc.windows == nil {
+			xc.windows = make(map[string]*latencyWindow)
+		}
+		w = new(latencyWindow)
+		xc.windows[serviceMethod] = w
+	}
+	return xc.hedging, w
+}
+
+// hedgeDelay 返回 serviceMethod 发送对冲请求之前等待的时间, 没有开启或者样本不足时返回 false
+func (xc *XClient) hedgeDelay(serviceMethod string) (time.Duration, bool) {
+	h, w := xc.latencies(serviceMethod)
+	if h == nil {
+		return 0, false
+	}
+	d, ok := w.quantile(h.percentile())
+	if !ok {
+		return 0, false
+	}
+	d = max(d, h.minDelay())
+	if h.MaxDelay > 0 {
+		d = min(d, h.MaxDelay)
+	}
+	return d, true
+}
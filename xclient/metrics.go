@@ -0,0 +1,56 @@
+package xclient
+
+import (
+	"time"
+)
+
+// EndpointStats 一个实例的调用统计, 见 XClient.Stats 和 Selector
+type EndpointStats struct {
+	Addr     string
+	Inflight int64  // 已经发出但还没有完成的请求数
+	Calls    uint64 // 完成的请求数, 包括失败的请求, 不包括调用方取消的请求
+	Failures uint64
+	// Latency 延迟的指数加权平均, PeakLatency 变慢时直接取最近的延迟, 是 P2CSelect 使用的延迟
+	Latency     time.Duration
+	PeakLatency time.Duration
+	ErrorRate   float64 // 错误率的指数加权平均, 在 0 到 1 之间
+	Breaker     string  // 熔断器的状态, "closed", "open" 或者 "half-open", 见 SetBreaker
+	Ejected     bool    // 是否作为异常实例被摘除, 见 SetOutlierDetection
+}
+
+// Selector 自定义的负载均衡, 从候选实例的调用统计中选择一个, 返回它的 Addr; candidates 至少有一个实例
+// 候选实例已经经过路由规则, 分片, 异常实例检测和熔断器的过滤
+type Selector func(candidates []EndpointStats) string
+
+// SetSelector 使用 s 代替 SelectMode 选择实例, 例如根据延迟和错误率选择; s 为 nil 时恢复使用 SelectMode
+func (xc *XClient) SetSelector(s Selector) {
+	xc.mu.Lock()
+	defer xc.mu.Unlock()
+	xc.customSelect = s
+}
+
+func (xc *XClient) selector() Selector {
+	xc.mu.Lock()
+	defer xc.mu.Unlock()
+	return xc.customSelect
+}
+
+// endpointStats 返回 rpcAddr 现在的调用统计
+func (xc *XClient) endpointStats(rpcAddr string, now time.Time) EndpointStats {
+	ep := xc.endpoint(rpcAddr)
+	stats := EndpointStats{
+		Addr:     rpcAddr,
+		Inflight: ep.inflight.Load(),
+		Calls:    ep.calls.Load(),
+		Failures: ep.failures.Load(),
+	}
+	ep.mu.Lock()
+	stats.Latency, stats.PeakLatency = time.Duration(ep.mean), time.Duration(ep.latency)
+	stats.ErrorRate = ep.errRate
+	stats.Ejected = now.Before(ep.ejectedUntil)
+	ep.mu.Unlock()
+	ep.breaker.mu.Lock()
+	stats.Breaker = ep.breaker.state.String()
+	ep.breaker.mu.Unlock()
+	return stats
+}
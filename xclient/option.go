@@ -0,0 +1,40 @@
+package xclient
+
+import (
+	"strings"
+
+	. "github.com/fanyeke/minirpc"
+)
+
+// poolKey 链接池的键, service 为空时使用 NewXClient 的 Option, 否则使用 SetServiceOption 为这个服务设置的 Option
+type poolKey struct {
+	rpcAddr string
+	service string
+}
+
+// SetServiceOption 为 service 的请求使用 opt 建立的链接, 例如不同的编码, 超时和压缩, opt 为 nil 时恢复使用 NewXClient 的 Option
+// 一个 XClient 通过同一个注册中心访问多个不同的服务时使用; 这个服务在每个实例上使用单独的链接, 已经建立的链接不受影响
+func (xc *XClient) SetServiceOption(service string, opt *Option) {
+	xc.mu.Lock()
+	defer xc.mu.Unlock()
+	if opt == nil {
+		delete(xc.serviceOpts, service)
+		return
+	}
+	if xc.serviceOpts == nil {
+		xc.serviceOpts = make(map[string]*Option)
+	}
+	xc.serviceOpts[service] = opt
+}
+
+// poolKey 返回 rpcAddr 上调用 serviceMethod 使用的链接池和 Option, 需要持有 xc.mu
+func (xc *XClient) poolKey(rpcAddr, serviceMethod string) (poolKey, *Option) {
+	service := serviceMethod
+	if dot := strings.LastIndex(serviceMethod, "."); dot >= 0 {
+		service = serviceMethod[:dot]
+	}
+	if opt, ok := xc.serviceOpts[service]; ok {
+		return poolKey{rpcAddr: rpcAddr, service: service}, opt
+	}
+	return poolKey{rpcAddr: rpcAddr}, xc.opt
+}
@@ -0,0 +1,180 @@
+package xclient
+
+import (
+	"sort"
+	"time"
+)
+
+// OutlierConfig 异常实例检测的设置, 见 XClient.SetOutlierDetection
+// 延迟或者错误率明显偏离所有实例中位数的实例被暂时摘除, 摘除时间结束之后重新接纳, 统计从头开始;
+// 再次被摘除时摘除时间按次数增加. 与熔断器不同, 它能发现变慢但是没有完全失败的实例
+type OutlierConfig struct {
+	Interval       time.Duration // 检测的间隔, 0 表示 10s
+	LatencyFactor  float64       // 平均延迟超过中位数的这么多倍时摘除, 0 表示 3
+	ErrorRateDelta float64       // 错误率比中位数高出这么多时摘除, 0 表示 0.3
+	MinRequests    int           // 参与检测的实例至少需要的调用次数, 0 表示 10
+	EjectionTime   time.Duration // 第一次摘除的时间, 0 表示 30s
+	// MaxEjectionPercent 最多同时摘除的实例比例, 0 表示 50, 避免大面积故障时把所有的实例都摘除
+	MaxEjectionPercent int
+}
+
+func (c *OutlierConfig) interval() time.Duration {
+	if c.Interval <= 0 {
+		return 10 * time.Second
+	}
+	return c.Interval
+}
+
+func (c *OutlierConfig) latencyFactor() float64 {
+	if c.LatencyFactor <= 0 {
+		return 3
+	}
+	return c.LatencyFactor
+}
+
+func (c *OutlierConfig) errorRateDelta() float64 {
+	if c.ErrorRateDelta <= 0 {
+		return 0.3
+	}
+	return c.ErrorRateDelta
+}
+
+func (c *OutlierConfig) minRequests() int {
+	if c.MinRequests <= 0 {
+		return 10
+	}
+	return c.MinRequests
+}
+
+func (c *OutlierConfig) ejectionTime() time.Duration {
+	if c.EjectionTime <= 0 {
+		return 30 * time.Second
+	}
+	return c.EjectionTime
+}
+
+func (c *OutlierConfig) maxEjectionPercent() int {
+	if c.MaxEjectionPercent <= 0 {
+		return 50
+	}
+	return c.MaxEjectionPercent
+}
+
+// maxEjectionMultiplier 摘除时间最多增加到 EjectionTime 的这么多倍
+const maxEjectionMultiplier = 10
+
+// SetOutlierDetection 开启异常实例检测, cfg 为 nil 时关闭, 已经摘除的实例立即重新接纳
+// 检测在选择实例时按 Interval 进行, 不需要额外的 goroutine
+func (xc *XClient) SetOutlierDetection(cfg *OutlierConfig) {
+	xc.mu.Lock()
+	defer xc.mu.Unlock()
+	if cfg == nil {
+		xc.outlier = nil
+		return
+	}
+	c := *cfg
+	xc.outlier, xc.lastDetect = &c, time.Now()
+}
+
+// healthy 返回 servers 中没有被摘除的实例, 全部被摘除时返回 servers; 到了检测的时间先进行检测
+func (xc *XClient) healthy(servers []string) []string {
+	xc.mu.Lock()
+	cfg := xc.outlier
+	due := cfg != nil && time.Since(xc.lastDetect) >= cfg.interval()
+	if due {
+		xc.lastDetect = time.Now()
+	}
+	xc.mu.Unlock()
+	if cfg == nil {
+		return servers
+	}
+	now := time.Now()
+	if due {
+		xc.detectOutliers(cfg, servers, now)
+	}
+	var ok []string
+	for _, rpcAddr := range servers {
+		if !xc.endpoint(rpcAddr).ejected(now) {
+			ok = append(ok, rpcAddr)
+		}
+	}
+	if len(ok) == 0 {
+		return servers
+	}
+	return ok
+}
+
+// detectOutliers 比较 servers 的统计, 摘除偏离中位数的实例, 至少需要 3 个有足够调用的实例才有意义
+func (xc *XClient) detectOutliers(cfg *OutlierConfig, servers []string, now time.Time) {
+	type stat struct {
+		ep            *endpoint
+		mean, errRate float64
+	}
+	var stats []stat
+	ejected := 0
+	for _, rpcAddr := range servers {
+		ep := xc.endpoint(rpcAddr)
+		if ep.ejected(now) {
+			ejected++
+			continue
+		}
+		ep.mu.Lock()
+		if ep.samples >= cfg.minRequests() {
+			stats = append(stats, stat{ep: ep, mean: ep.mean, errRate: ep.errRate})
+		}
+		ep.mu.Unlock()
+	}
+	if len(stats) < 3 {
+		return
+	}
+	median := func(v func(stat) float64) float64 {
+		values := make([]float64, len(stats))
+		for i, s := range stats {
+			values[i] = v(s)
+		}
+		sort.Float64s(values)
+		n := len(values)
+		return (values[(n-1)/2] + values[n/2]) / 2
+	}
+	medianLatency := median(func(s stat) float64 { return s.mean })
+	medianErrRate := median(func(s stat) float64 { return s.errRate })
+	// 偏离最多的实例先被摘除
+	sort.Slice(stats, func(i, j int) bool { return stats[i].mean > stats[j].mean })
+	limit := len(servers) * cfg.maxEjectionPercent() / 100
+	for _, s := range stats {
+		outlier := s.mean > cfg.latencyFactor()*medianLatency || s.errRate-medianErrRate >= cfg.errorRateDelta()
+		if outlier && ejected < limit {
+			s.ep.eject(cfg, now)
+			ejected++
+		} else if !outlier {
+			s.ep.mu.Lock()
+			if s.ep.ejections > 0 {
+				s.ep.ejections--
+			}
+			s.ep.mu.Unlock()
+		}
+	}
+}
+
+// eject 摘除实例, 摘除时间随连续被摘除的次数增加
+func (ep *endpoint) eject(cfg *OutlierConfig, now time.Time) {
+	ep.mu.Lock()
+	defer ep.mu.Unlock()
+	ep.ejections = min(ep.ejections+1, maxEjectionMultiplier)
+	ep.ejectedUntil = now.Add(cfg.ejectionTime() * time.Duration(ep.ejections))
+}
+
+// ejected 返回实例现在是否被摘除, 摘除时间结束时清空统计, 让实例重新积累调用
+func (ep *endpoint) ejected(now time.Time) bool {
+	ep.mu.Lock()
+	defer ep.mu.Unlock()
+	if ep.ejectedUntil.IsZero() {
+		return false
+	}
+	if now.Before(ep.ejectedUntil) {
+		return true
+	}
+	ep.ejectedUntil = time.Time{}
+	ep.latency, ep.mean, ep.errRate, ep.updated, ep.samples = 0, 0, 0, time.Time{}, 0
+	return false
+}
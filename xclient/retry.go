@@ -0,0 +1,85 @@
+package xclient
+
+import (
+	"context"
+	"errors"
+
+	. "github.com/fanyeke/minirpc"
+)
+
+// connectError 建立到实例的链接失败, 请求一定没有发出, 总是可以换一个实例重试
+type connectError struct{ err error }
+
+func (e *connectError) Error() string { return e.err.Error() }
+func (e *connectError) Unwrap() error { return e.err }
+
+// isConnectError 返回 err 是否是建立链接失败, 包括建立链接超时
+func isConnectError(err error) bool {
+	var ce *connectError
+	return errors.As(err, &ce)
+}
+
+// SetRetryPolicy 设置 Failover 和 Failtry 重试的次数, 等待时间和可以重试的错误, p 为 nil 时最多尝试 3 次
+// 除了 p.Retryable 允许的错误之外, 建立链接失败 (包括超时) 时总是重试, 因为请求还没有发出; 重试的次数还受 SetRetryBudget 限制
+func (xc *XClient) SetRetryPolicy(p *RetryPolicy) {
+	xc.mu.Lock()
+	defer xc.mu.Unlock()
+	if p == nil {
+		xc.retry = nil
+		return
+	}
+	policy := *p
+	xc.retry = &policy
+}
+
+// callWithRetry 按 retry 调用 serviceMethod, 等待时间和 ctx 结束由 RetryPolicy.Do 处理
+// sameServer 为 true 时一直使用第一次选择的实例 (Failtry), 否则每次重试尽量避开已经失败的实例 (Failover)
+// 尝试了多次都失败时返回 *MultiError, 包括每次尝试的实例和错误
+func (xc *XClient) callWithRetry(ctx context.Context, retry *RetryPolicy, sameServer bool, serviceMethod string, args, reply interface{}) error {
+	policy := *retry
+	policy.RetryOn = func(err error) bool {
+		return (isConnectError(err) || retry.Retryable(err)) && xc.allowRetry()
+	}
+	failed := make(map[string]bool)
+	errs := new(MultiError)
+	var rpcAddr string
+	err := policy.Do(ctx, func(ctx context.Context) (err error) {
+		if rpcAddr == "" || !sameServer {
+			if rpcAddr, err = xc.pickAvoiding(ctx, serviceMethod, args, failed); err != nil {
+				errs.Add("", AttemptFromContext(ctx), err)
+				return err
+			}
+		}
+		if err = xc.call(rpcAddr, ctx, serviceMethod, args, reply); err != nil {
+			failed[rpcAddr] = true
+			errs.Add(rpcAddr, AttemptFromContext(ctx), err)
+		}
+		return err
+	})
+	if err != nil && len(errs.Errors) > 1 {
+		return errs
+	}
+	return err
+}
+
+// pickAvoiding 选择一个实例, 选中 failed 中的实例时在其他的候选实例中重新选择, 所有的实例都失败过时仍然使用选中的实例
+func (xc *XClient) pickAvoiding(ctx context.Context, serviceMethod string, args interface{}, failed map[string]bool) (string, error) {
+	rpcAddr, err := xc.pick(ctx, serviceMethod, args)
+	if err != nil || !failed[rpcAddr] {
+		return rpcAddr, err
+	}
+	servers, err := xc.eligible(ctx, serviceMethod, args)
+	if err != nil {
+		return "", err
+	}
+	var rest []string
+	for _, s := range servers {
+		if !failed[s] {
+			rest = append(rest, s)
+		}
+	}
+	if len(rest) == 0 {
+		return rpcAddr, nil
+	}
+	return xc.selectAdmitted(ctx, xc.healthy(rest))
+}
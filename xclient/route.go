@@ -0,0 +1,79 @@
+package xclient
+
+import (
+	"fmt"
+	"path"
+)
+
+// Route 路由规则, 在负载均衡之前根据 ServiceMethod 缩小候选的实例, 例如把 Report.* 交给分析用的实例,
+// 让 Foo.Sum 优先使用 zone-a 的实例
+type Route struct {
+	// Method ServiceMethod 的模式, 语法与 path.Match 相同, 例如 "Report.*", "Foo.Sum"
+	Method string
+	// Match 返回实例是否可以处理匹配的请求
+	Match func(rpcAddr string) bool
+	// Prefer 为 true 时 Match 只是优先选择, 没有实例满足时使用所有的实例; 否则没有实例满足时请求失败
+	Prefer bool
+}
+
+// InServers 返回只选择 addrs 中实例的 Route.Match
+func InServers(addrs ...string) func(rpcAddr string) bool {
+	set := make(map[string]bool, len(addrs))
+	for _, addr := range addrs {
+		set[addr] = true
+	}
+	return func(rpcAddr string) bool { return set[rpcAddr] }
+}
+
+// AddRoute 在已有的规则之后加入 routes, 请求使用第一条匹配的规则, 没有匹配的规则时在所有的实例中选择
+func (xc *XClient) AddRoute(routes ...Route) error {
+	for _, r := range routes {
+		if _, err := path.Match(r.Method, ""); err != nil {
+			return fmt.Errorf("rpc xclient: invalid route pattern %q: %w", r.Method, err)
+		}
+		if r.Match == nil {
+			return fmt.Errorf("rpc xclient: route %q has no Match", r.Method)
+		}
+	}
+	xc.mu.Lock()
+	defer xc.mu.Unlock()
+	xc.routes = append(xc.routes, routes...)
+	return nil
+}
+
+// route 返回 serviceMethod 匹配的第一条规则, 没有时返回 nil
+func (xc *XClient) route(serviceMethod string) *Route {
+	xc.mu.Lock()
+	defer xc.mu.Unlock()
+	for i := range xc.routes {
+		if ok, _ := path.Match(xc.routes[i].Method, serviceMethod); ok {
+			return &xc.routes[i]
+		}
+	}
+	return nil
+}
+
+// candidates 返回 serviceMethod 可以使用的实例, 经过第一条匹配的路由规则过滤
+func (xc *XClient) candidates(serviceMethod string) ([]string, error) {
+	servers, err := xc.d.GetAll()
+	if err != nil {
+		return nil, err
+	}
+	r := xc.route(serviceMethod)
+	if r == nil {
+		return servers, nil
+	}
+	var matched []string
+	for _, rpcAddr := range servers {
+		if r.Match(rpcAddr) {
+			matched = append(matched, rpcAddr)
+		}
+	}
+	if len(matched) == 0 {
+		if r.Prefer {
+			return servers, nil
+		}
+		return nil, fmt.Errorf("rpc xclient: no servers for %s by route %q", serviceMethod, r.Method)
+	}
+	return matched, nil
+}
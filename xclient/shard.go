@@ -0,0 +1,84 @@
+package xclient
+
+import (
+	"context"
+	"fmt"
+	"hash/fnv"
+)
+
+// Sharding 分片路由, 调用的分片键确定地映射到一个分片, 请求只发给这个分片的实例, 见 XClient.SetSharding
+// 实例所在的分片来自 Discovery 的元数据, 例如注册中心心跳中的 partition
+type Sharding struct {
+	// Key 从调用中取出分片键, 返回 false 时这个调用不分片, 在所有的实例中选择
+	Key func(ctx context.Context, serviceMethod string, args interface{}) (string, bool)
+	// Partitions 分片的数量, 0 表示使用 Discovery 中最大的分片编号加 1
+	// 固定分片数可以保证某个分片的实例全部下线时, 其他分片的键不会被重新映射
+	Partitions int
+}
+
+// partitioner Discovery 提供实例所在的分片时实现的接口, 见 MultiServerDiscovery.Partition
+type partitioner interface {
+	Partition(addr string) (int, bool)
+}
+
+// SetSharding 设置分片路由, 分片在路由规则之后进一步缩小候选的实例, 之后仍然按 SelectMode 在分片的副本中选择
+// s 为 nil 时取消分片路由
+func (xc *XClient) SetSharding(s *Sharding) {
+	xc.mu.Lock()
+	defer xc.mu.Unlock()
+	xc.sharding = s
+}
+
+// shard 返回分片路由之后的实例, 调用不需要分片时原样返回 servers
+func (xc *XClient) shard(ctx context.Context, serviceMethod string, args interface{}, servers []string) ([]string, error) {
+	xc.mu.Lock()
+	s := xc.sharding
+	xc.mu.Unlock()
+	if s == nil {
+		return servers, nil
+	}
+	key, ok := s.Key(ctx, serviceMethod, args)
+	if !ok {
+		return servers, nil
+	}
+	p, ok := xc.d.(partitioner)
+	if !ok {
+		return nil, fmt.Errorf("rpc xclient: discovery %T does not provide partitions", xc.d)
+	}
+	n := s.Partitions
+	if n <= 0 {
+		for _, rpcAddr := range servers {
+			if i, ok := p.Partition(rpcAddr); ok && i+1 > n {
+				n = i + 1
+			}
+		}
+		if n == 0 {
+			return nil, fmt.Errorf("rpc xclient: no partitioned servers for %s", serviceMethod)
+		}
+	}
+	want := jumpHash(key, n)
+	var matched []string
+	for _, rpcAddr := range servers {
+		if i, ok := p.Partition(rpcAddr); ok && i == want {
+			matched = append(matched, rpcAddr)
+		}
+	}
+	if len(matched) == 0 {
+		return nil, fmt.Errorf("rpc xclient: no servers for partition %d of %s", want, serviceMethod)
+	}
+	return matched, nil
+}
+
+// jumpHash 把 key 映射到 [0, n) 中的一个分片, 分片数增加时只有少部分的键会移动, 见 Lamping 和 Veach 的 Jump Consistent Hash
+func jumpHash(key string, n int) int {
+	h := fnv.New64a()
+	_, _ = h.Write([]byte(key))
+	k := h.Sum64()
+	b, j := int64(-1), int64(0)
+	for j < int64(n) {
+		b = j
+		k = k*2862933555777941757 + 1
+		j = int64(float64(b+1) * (float64(int64(1)<<31) / float64((k>>33)+1)))
+	}
+	return int(b)
+}
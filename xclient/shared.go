@@ -0,0 +1,109 @@
+package xclient
+
+import (
+	"fmt"
+	"hash/fnv"
+	"sync"
+
+	. "github.com/fanyeke/minirpc"
+)
+
+// SharedPools 进程内共用的链接池, 同一个进程中的多个 XClient 访问相同的实例时使用同一组链接, 见 XClient.SetSharedPools
+// 链接池按地址和 Option 区分, Option 的字段值相同 (指针和函数字段指向同一个对象) 时认为相同; 使用引用计数, 最后一个 XClient 释放时关闭
+type SharedPools struct {
+	mu    sync.Mutex
+	pools map[sharedKey]*sharedPool
+	byRef map[*ClientPool]*sharedPool
+}
+
+type sharedKey struct {
+	rpcAddr string
+	opt     uint64 // Option 的哈希, 见 optionHash
+}
+
+type sharedPool struct {
+	key  sharedKey
+	pool *ClientPool
+	refs int
+}
+
+// NewSharedPools 创建一组共用的链接池
+func NewSharedPools() *SharedPools {
+	return &SharedPools{
+		pools: make(map[sharedKey]*sharedPool),
+		byRef: make(map[*ClientPool]*sharedPool),
+	}
+}
+
+// optionHash 返回 opt 的字段值的哈希, nil 为 0
+func optionHash(opt *Option) uint64 {
+	if opt == nil {
+		return 0
+	}
+	h := fnv.New64a()
+	_, _ = fmt.Fprintf(h, "%+v", *opt)
+	return h.Sum64() | 1
+}
+
+// Len 返回共用的链接池数
+func (s *SharedPools) Len() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.pools)
+}
+
+// acquire 返回 rpcAddr 使用 opt 的链接池, 不存在时创建, 引用计数加一
+func (s *SharedPools) acquire(rpcAddr string, opt *Option) *ClientPool {
+	key := sharedKey{rpcAddr: rpcAddr, opt: optionHash(opt)}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	sp, ok := s.pools[key]
+	if !ok {
+		size := 1
+		if opt != nil {
+			size = opt.ConnsPerAddr
+		}
+		sp = &sharedPool{key: key, pool: NewClientPool(size, func() (*Client, error) { return XDial(rpcAddr, opt) })}
+		s.pools[key] = sp
+		s.byRef[sp.pool] = sp
+	}
+	sp.refs++
+	return sp.pool
+}
+
+// release 引用计数减一, 没有引用时关闭链接池; pool 不是共用的链接池时返回 false
+func (s *SharedPools) release(pool *ClientPool) bool {
+	s.mu.Lock()
+	sp, ok := s.byRef[pool]
+	if !ok {
+		s.mu.Unlock()
+		return false
+	}
+	sp.refs--
+	last := sp.refs == 0
+	if last {
+		delete(s.pools, sp.key)
+		delete(s.byRef, pool)
+	}
+	s.mu.Unlock()
+	if last {
+		_ = pool.Close()
+	}
+	return true
+}
+
+// SetSharedPools 让 XClient 使用共用的链接池, 需要在第一次调用之前设置; s 为 nil 时使用自己的链接
+// XClient 关闭或者清理链接 (见 SetClientCache) 时只释放引用, 其他 XClient 仍然可以使用这些链接
+func (xc *XClient) SetSharedPools(s *SharedPools) {
+	xc.mu.Lock()
+	defer xc.mu.Unlock()
+	xc.shared = s
+}
+
+// closePool 关闭 XClient 不再使用的链接池, 共用的链接池只释放引用
+func closePool(shared *SharedPools, pool *ClientPool) {
+	if shared != nil && shared.release(pool) {
+		return
+	}
+	_ = pool.Close()
+}
@@ -0,0 +1,87 @@
+package xclient
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// Warmup 为 Discovery 中的所有实例建立链接 (每个实例 Option.ConnsPerAddr 条), 第一个请求不需要等待建立链接和握手
+// 已经建立的可用链接不会重建. 建立链接失败的实例记录为一次失败的调用, P2CSelect 和熔断器在请求到来之前就能避开它;
+// 返回所有失败的实例的错误
+func (xc *XClient) Warmup() error {
+	servers, err := xc.d.GetAll()
+	if err != nil {
+		return err
+	}
+	var wg sync.WaitGroup
+	errs := make([]error, len(servers))
+	for i, rpcAddr := range servers {
+		wg.Add(1)
+		go func(i int, rpcAddr string) {
+			defer wg.Done()
+			errs[i] = xc.warmup(rpcAddr)
+		}(i, rpcAddr)
+	}
+	wg.Wait()
+	return errors.Join(errs...)
+}
+
+// warmup 建立 rpcAddr 的所有链接, 包括 SetServiceOption 设置的服务单独使用的链接
+func (xc *XClient) warmup(rpcAddr string) error {
+	xc.mu.Lock()
+	methods := []string{""}
+	for service := range xc.serviceOpts {
+		methods = append(methods, service+".")
+	}
+	xc.mu.Unlock()
+	for _, serviceMethod := range methods {
+		xc.mu.Lock()
+		_, opt := xc.poolKey(rpcAddr, serviceMethod)
+		xc.mu.Unlock()
+		size := 1
+		if opt != nil && opt.ConnsPerAddr > 1 {
+			size = opt.ConnsPerAddr
+		}
+		for i := 0; i < size; i++ {
+			if _, err := xc.dial(rpcAddr, serviceMethod); err != nil {
+				err = &connectError{err: err}
+				ep := xc.endpoint(rpcAddr)
+				ep.observe(0, true)
+				if cfg := xc.breakerConfig(); cfg != nil {
+					ep.breaker.record(cfg, time.Now(), cfg.isFailure(err))
+				}
+				return fmt.Errorf("rpc xclient: warmup %s: %w", rpcAddr, err)
+			}
+		}
+	}
+	return nil
+}
+
+// SetWarmupInterval 每隔 d 调用一次 Warmup, 重建断开的链接并为新出现的实例建立链接, goroutine 在 Close 时退出; d 为 0 时停止
+func (xc *XClient) SetWarmupInterval(d time.Duration) {
+	xc.mu.Lock()
+	defer xc.mu.Unlock()
+	if xc.stopWarmup != nil {
+		close(xc.stopWarmup)
+		xc.stopWarmup = nil
+	}
+	if d <= 0 {
+		return
+	}
+	stop := make(chan struct{})
+	xc.stopWarmup = stop
+	go func() {
+		ticker := time.NewTicker(d)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				_ = xc.Warmup()
+			case <-stop:
+				return
+			}
+		}
+	}()
+}
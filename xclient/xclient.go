@@ -2,9 +2,12 @@ package xclient
 
 import (
 	"context"
+	"errors"
 	"io"
 	"reflect"
 	"sync"
+	"sync/atomic"
+	"time"
 
 	. "github.com/fanyeke/minirpc"
 )
@@ -14,17 +17,50 @@ type XClient struct {
 	mode    SelectMode
 	opt     *Option
 	mu      sync.Mutex
-	clients map[string]*Client
+	clients map[poolKey]*ClientPool
+	// serviceOpts 单独设置了 Option 的服务, 见 SetServiceOption
+	serviceOpts map[string]*Option
+	// used 每个链接池最近一次使用的时间, 见 SetClientCache
+	used      map[poolKey]time.Time
+	cache     *ClientCache
+	stopSweep chan struct{} // 关闭时定期清理的 goroutine 退出
+	// stopWarmup 关闭时定期建立链接的 goroutine 退出, 见 SetWarmupInterval
+	stopWarmup chan struct{}
+	// endpoints 每个实例的调用状态, 见 LeastConnSelect
+	endpoints map[string]*endpoint
+	routes    []Route        // 见 AddRoute
+	sharding  *Sharding      // 见 SetSharding
+	retry     *RetryPolicy   // 见 SetRetryPolicy
+	failMode  FailMode       // 见 SetFailMode
+	breaker   *BreakerConfig // 见 SetBreaker
+	outlier   *OutlierConfig // 见 SetOutlierDetection
+	hedging   *Hedging       // 见 SetHedging
+	budget    *RetryBudget   // 见 SetRetryBudget
+	bulkheads []*bulkhead    // 见 AddBulkhead
+	canary    *Canary        // 见 SetCanary
+	shared    *SharedPools   // 见 SetSharedPools
+	// customSelect 代替 SelectMode 选择实例, 见 SetSelector
+	customSelect Selector
+	// windows 开启对冲请求的方法最近的延迟
+	windows map[string]*latencyWindow
+	// lastDetect 最近一次检测异常实例的时间
+	lastDetect time.Time
+	// backupDelay Failbackup 发送备份请求之前等待的时间, 见 SetBackupDelay
+	backupDelay time.Duration
+	index       atomic.Uint64 // 在路由规则选出的实例中轮流选择时使用
+	stats       xclientCounters
 }
 
 var _ io.Closer = (*Client)(nil)
 
 func NewXClient(d Discovery, mode SelectMode, opt *Option) *XClient {
 	return &XClient{
-		d:       d,
-		mode:    mode,
-		opt:     opt,
-		clients: make(map[string]*Client),
+		d:         d,
+		mode:      mode,
+		opt:       opt,
+		clients:   make(map[poolKey]*ClientPool),
+		used:      make(map[poolKey]time.Time),
+		endpoints: make(map[string]*endpoint),
 	}
 }
 
@@ -32,48 +68,118 @@ func NewXClient(d Discovery, mode SelectMode, opt *Option) *XClient {
 func (xc *XClient) Close() error {
 	xc.mu.Lock()
 	defer xc.mu.Unlock()
+	if xc.stopSweep != nil {
+		close(xc.stopSweep)
+		xc.stopSweep = nil
+	}
+	if xc.stopWarmup != nil {
+		close(xc.stopWarmup)
+		xc.stopWarmup = nil
+	}
 
-	for key, client := range xc.clients {
-		_ = client.Close()
+	for key, pool := range xc.clients {
+		closePool(xc.shared, pool)
 		// 记得删除客户端的注册
 		delete(xc.clients, key)
 	}
 	return nil
 }
-func (xc *XClient) dial(rpcAddr string) (*Client, error) {
+
+// dial 返回 rpcAddr 上调用 serviceMethod 使用的一条可用的链接, 设置了 Option.ConnsPerAddr 时在多条链接之间轮流选择
+// 不可用的链接由 ClientPool 重新建立, 正在关闭的链接等已经发出的请求完成后会自己关闭
+func (xc *XClient) dial(rpcAddr, serviceMethod string) (*Client, error) {
 	xc.mu.Lock()
-	defer xc.mu.Unlock()
-	// 通过 `rpcAddr` 获取客户端 `client`
-	client, ok := xc.clients[rpcAddr]
-	// 客户端存在但是不可用
-	if ok && !client.IsAvailable() {
-		_ = client.Close()
-		delete(xc.clients, rpcAddr)
-		client = nil
-	}
-	// 客户端不存在
-	if client == nil {
-		var err error
-		client, err = XDial(rpcAddr, xc.opt)
-		if err != nil {
-			return nil, err
+	// 通过 `rpcAddr` 和服务的 Option 获取链接
+	key, opt := xc.poolKey(rpcAddr, serviceMethod)
+	pool, ok := xc.clients[key]
+	if !ok {
+		if xc.shared != nil {
+			pool = xc.shared.acquire(rpcAddr, opt)
+		} else {
+			size := 1
+			if opt != nil {
+				size = opt.ConnsPerAddr
+			}
+			pool = NewClientPool(size, func() (*Client, error) { return XDial(rpcAddr, opt) })
 		}
-		xc.clients[rpcAddr] = client
+		xc.clients[key] = pool
+	}
+	xc.used[key] = time.Now()
+	evicted, shared := xc.evictLRU(key), xc.shared
+	xc.mu.Unlock()
+	for _, p := range evicted {
+		closePool(shared, p)
 	}
-	// 返回获取到的客户端
-	return client, nil
+	return pool.Get()
 }
-func (xc *XClient) call(rpcAddr string, ctx context.Context, serviceMethod string, args, reply interface{}) error {
+func (xc *XClient) call(rpcAddr string, ctx context.Context, serviceMethod string, args, reply interface{}) (err error) {
+	ep := xc.endpoint(rpcAddr)
+	ep.inflight.Add(1)
+	start := time.Now()
+	defer func() {
+		ep.inflight.Add(-1)
+		// 调用方主动取消的请求不能说明实例的情况
+		if !errors.Is(err, context.Canceled) {
+			ep.observe(time.Since(start), err != nil)
+			if cfg := xc.breakerConfig(); cfg != nil {
+				ep.breaker.record(cfg, time.Now(), err != nil && cfg.isFailure(err))
+			}
+		}
+		if err == nil {
+			if _, w := xc.latencies(serviceMethod); w != nil {
+				w.add(time.Since(start))
+			}
+		}
+	}()
 	// 进行连接
-	client, err := xc.dial(rpcAddr)
+	client, err := xc.dial(rpcAddr, serviceMethod)
 	if err != nil {
-		return err
+		return &connectError{err: err}
 	}
-	return client.Call(ctx, serviceMethod, args, reply)
+	callOpts := xcallOptionsFrom(ctx).callOpts
+	err = client.Call(ctx, serviceMethod, args, reply, callOpts...)
+	// 请求还没有发出链接就开始关闭了, 换一个新的链接重试
+	if errors.Is(err, ErrGoAway) {
+		if client, err = xc.dial(rpcAddr, serviceMethod); err != nil {
+			return &connectError{err: err}
+		}
+		err = client.Call(NewAttemptContext(ctx, AttemptFromContext(ctx)+1), serviceMethod, args, reply, callOpts...)
+	}
+	return err
 }
-func (xc *XClient) Call(ctx context.Context, serviceMethod string, args, reply interface{}) error {
+
+// Call 选择一个实例调用 serviceMethod, opts 可以覆盖这次调用的 SelectMode, FailMode 等设置, 见 XCallOption
+func (xc *XClient) Call(ctx context.Context, serviceMethod string, args, reply interface{}, opts ...XCallOption) error {
+	ctx = withXCallOptions(ctx, opts)
+	xc.mu.Lock()
+	mode, retry, delay, budget := xc.failMode, xc.retry, xc.backupDelay, xc.budget
+	xc.mu.Unlock()
+	if m := xcallOptionsFrom(ctx).failMode; m != nil {
+		mode = *m
+	}
+	xc.stats.calls.Add(1)
+	leave, err := xc.enterBulkhead(ctx, serviceMethod)
+	if err != nil {
+		return err
+	}
+	defer leave()
+	if budget != nil {
+		budget.deposit()
+	}
+	if retry == nil {
+		retry = &defaultRetry
+	}
+	switch mode {
+	case Failover, Failtry:
+		return xc.callWithRetry(ctx, retry, mode == Failtry, serviceMethod, args, reply)
+	case Failbackup:
+		return xc.callBackup(ctx, delay, serviceMethod, args, reply)
+	}
+	if delay, ok := xc.hedgeDelay(serviceMethod); ok {
+		return xc.callBackup(ctx, delay, serviceMethod, args, reply)
+	}
 	// 通过负载均衡选择一个去处, 获得他的 `rpcAddr`
-	rpcAddr, err := xc.d.Get(xc.mode)
+	rpcAddr, err := xc.pick(ctx, serviceMethod, args)
 	if err != nil {
 		return err
 	}
@@ -85,20 +191,30 @@ func (xc *XClient) Call(ctx context.Context, serviceMethod string, args, reply i
 // 1. 请求是并发的
 // 2. 需要使用互斥锁保证 `error` 和 `reply` 被正确赋值
 // 3. 借助 `context.WithCancel` 确保发生错误时快速失败
+// 4. 失败时返回 *MultiError, 包括每个失败的实例的错误
 func (xc *XClient) Broadcast(ctx context.Context, serviceMethod string, args, reply interface{}) error {
-	servers, err := xc.d.GetAll()
+	// 广播同样只发给路由规则选出的实例
+	servers, err := xc.candidates(serviceMethod)
+	if err != nil {
+		return err
+	}
+	// 一次广播只占用一个位置
+	leave, err := xc.enterBulkhead(ctx, serviceMethod)
 	if err != nil {
 		return err
 	}
+	defer leave()
 	// 任务编排
 	var wg sync.WaitGroup
 	// 互斥锁, 实现正确赋值
 	var mu sync.Mutex
-	// 拿到子协程中的错误
-	var e error
+	// 拿到子协程中的错误, 第一个错误之后取消的请求不需要报告
+	errs := new(MultiError)
+	canceled := false
 	replyDone := reply == nil
 	// 掌控子协程生命周期
 	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
 	for _, rpcAddr := range servers {
 		wg.Add(1)
 		go func(rpcAddr string) {
@@ -110,8 +226,11 @@ func (xc *XClient) Broadcast(ctx context.Context, serviceMethod string, args, re
 			}
 			err := xc.call(rpcAddr, ctx, serviceMethod, args, clonedReply)
 			mu.Lock()
-			if err != nil && e == nil {
-				e = err
+			if err != nil && !(canceled && errors.Is(err, context.Canceled)) {
+				errs.Add(rpcAddr, 0, err)
+			}
+			if err != nil && !canceled {
+				canceled = true
 				cancel()
 			}
 			if err == nil && !replyDone {
@@ -122,5 +241,45 @@ func (xc *XClient) Broadcast(ctx context.Context, serviceMethod string, args, re
 		}(rpcAddr)
 	}
 	wg.Wait()
-	return e
+	if len(errs.Errors) == 0 {
+		return nil
+	}
+	return errs
+}
+
+// Result 一个实例的调用结果, 见 BroadcastAll
+type Result struct {
+	Addr  string
+	Reply interface{} // 与 BroadcastAll 的 reply 类型相同的新值, 调用失败时没有意义
+	Err   error
+}
+
+// BroadcastAll 将请求并发地发给所有服务实例, 等待全部完成, 按实例的顺序返回每个实例的结果
+// 与 Broadcast 不同, 一个实例失败时不会取消其他的请求, 调用方可以汇总, 比较结果或者报告部分失败;
+// reply 只用来确定响应的类型, 不会被修改, 为 nil 时 Result.Reply 也为 nil. 返回的错误只表示请求没有发出
+func (xc *XClient) BroadcastAll(ctx context.Context, serviceMethod string, args, reply interface{}) ([]Result, error) {
+	servers, err := xc.candidates(serviceMethod)
+	if err != nil {
+		return nil, err
+	}
+	leave, err := xc.enterBulkhead(ctx, serviceMethod)
+	if err != nil {
+		return nil, err
+	}
+	defer leave()
+	results := make([]Result, len(servers))
+	var wg sync.WaitGroup
+	for i, rpcAddr := range servers {
+		results[i].Addr = rpcAddr
+		if reply != nil {
+			results[i].Reply = reflect.New(reflect.ValueOf(reply).Elem().Type()).Interface()
+		}
+		wg.Add(1)
+		go func(r *Result) {
+			defer wg.Done()
+			r.Err = xc.call(r.Addr, ctx, serviceMethod, args, r.Reply)
+		}(&results[i])
+	}
+	wg.Wait()
+	return results, nil
 }
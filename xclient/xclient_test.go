@@ -0,0 +1,1156 @@
+package xclient
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/fanyeke/minirpc"
+	"github.com/fanyeke/minirpc/codec"
+)
+
+// Counter 统计被调用的次数
+type Counter struct{ calls atomic.Int32 }
+
+func (c *Counter) Get(key string, reply *string) error {
+	c.calls.Add(1)
+	*reply = key
+	return nil
+}
+
+// startServers 启动 n 个服务实例, 返回它们的地址和服务
+func startServers(t *testing.T, n int) ([]string, []*Counter) {
+	var addrs []string
+	var counters []*Counter
+	for i := 0; i < n; i++ {
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { _ = l.Close() })
+		server, counter := minirpc.NewServer(), new(Counter)
+		_ = server.Register(counter)
+		go server.Accept(l)
+		addrs = append(addrs, "tcp@"+l.Addr().String())
+		counters = append(counters, counter)
+	}
+	return addrs, counters
+}
+
+func TestXClient_ResponseCache(t *testing.T) {
+	addrs, counters := startServers(t, 2)
+	cache := &minirpc.ResponseCache{TTL: map[string]time.Duration{"Counter.Get": time.Minute}}
+	xc := NewXClient(NewMultiServerDiscovery(addrs), RoundRobinSelect, &minirpc.Option{Interceptors: []minirpc.ClientInterceptor{cache.Interceptor()}})
+	defer func() { _ = xc.Close() }()
+	for i := 0; i < 4; i++ {
+		var reply string
+		if err := xc.Call(context.Background(), "Counter.Get", "a", &reply); err != nil || reply != "a" {
+			t.Fatalf("call %d: %q, %v", i, reply, err)
+		}
+	}
+	// 所有服务实例共用同一个缓存
+	if n := counters[0].calls.Load() + counters[1].calls.Load(); n != 1 {
+		t.Fatalf("expect 1 call to reach the servers, got %d", n)
+	}
+}
+
+func TestXClient_ConnsPerAddr(t *testing.T) {
+	addrs, _ := startServers(t, 1)
+	xc := NewXClient(NewMultiServerDiscovery(addrs), RandomSelect, &minirpc.Option{ConnsPerAddr: 3})
+	defer func() { _ = xc.Close() }()
+	seen := make(map[*minirpc.Client]bool)
+	for i := 0; i < 6; i++ {
+		var reply string
+		if err := xc.Call(context.Background(), "Counter.Get", "a", &reply); err != nil {
+			t.Fatal(err)
+		}
+		client, err := xc.dial(addrs[0], "Counter.Get")
+		if err != nil {
+			t.Fatal(err)
+		}
+		seen[client] = true
+	}
+	if len(seen) != 3 || xc.clients[poolKey{rpcAddr: addrs[0]}].Size() != 3 {
+		t.Fatalf("expect 3 connections, got %d", len(seen))
+	}
+}
+
+func TestXClient_LeastConnSelect(t *testing.T) {
+	addrs, counters := startServers(t, 2)
+	xc := NewXClient(NewMultiServerDiscovery(addrs), LeastConnSelect, nil)
+	defer func() { _ = xc.Close() }()
+
+	// 第一个实例还有未完成的请求时, 新的请求都交给第二个实例
+	xc.endpoint(addrs[0]).inflight.Add(2)
+	for i := 0; i < 5; i++ {
+		var reply string
+		if err := xc.Call(context.Background(), "Counter.Get", "a", &reply); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if n := counters[1].calls.Load(); n != 5 {
+		t.Fatalf("expect 5 calls on the idle server, got %d", n)
+	}
+	if n := xc.endpoint(addrs[1]).inflight.Load(); n != 0 {
+		t.Fatalf("expect no in-flight calls after they finish, got %d", n)
+	}
+
+	// 请求数相同时随机选择, 不会总是选择第一个
+	xc.endpoint(addrs[0]).inflight.Add(-2)
+	seen := make(map[string]bool)
+	for i := 0; i < 50; i++ {
+		rpcAddr, err := xc.pick(context.Background(), "Counter.Get", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		seen[rpcAddr] = true
+	}
+	if len(seen) != 2 {
+		t.Fatalf("expect ties to be broken randomly, got %v", seen)
+	}
+}
+
+func TestXClient_P2CSelect(t *testing.T) {
+	addrs, _ := startServers(t, 2)
+	// 第三个实例无法连接
+	dead, _ := net.Listen("tcp", "127.0.0.1:0")
+	_ = dead.Close()
+	addrs = append(addrs, "tcp@"+dead.Addr().String())
+	xc := NewXClient(NewMultiServerDiscovery(addrs), P2CSelect, nil)
+	defer func() { _ = xc.Close() }()
+
+	// 失败过一次的实例代价很高, 之后两两比较时总是输给正常的实例
+	failed := 0
+	for i := 0; i < 30; i++ {
+		var reply string
+		if err := xc.Call(context.Background(), "Counter.Get", "a", &reply); err != nil {
+			failed++
+		}
+	}
+	if failed > 1 {
+		t.Fatalf("expect the dead server to be avoided after 1 failure, got %d", failed)
+	}
+
+	// 延迟高的实例同样被避开
+	slow, fast := xc.endpoint(addrs[0]), xc.endpoint(addrs[1])
+	slow.observe(100*time.Millisecond, false)
+	fast.observe(time.Millisecond, false)
+	for i := 0; i < 20; i++ {
+		if rpcAddr := xc.p2c(addrs[:2]); rpcAddr != addrs[1] {
+			t.Fatalf("expect the fast server, got %s", rpcAddr)
+		}
+	}
+	// 快的实例排队的请求太多时, 慢的实例反而更好
+	fast.inflight.Add(1000)
+	defer fast.inflight.Add(-1000)
+	if rpcAddr := xc.p2c(addrs[:2]); rpcAddr != addrs[0] {
+		t.Fatalf("expect the idle server, got %s", rpcAddr)
+	}
+}
+
+func TestMultiServerDiscovery_WeightedRandomSelect(t *testing.T) {
+	d := NewMultiServerDiscovery([]string{"a", "b", "c"})
+	d.SetWeights(map[string]int{"a": 9, "c": 0})
+	counts := make(map[string]int)
+	for i := 0; i < 1000; i++ {
+		s, err := d.Get(WeightedRandomSelect)
+		if err != nil {
+			t.Fatal(err)
+		}
+		counts[s]++
+	}
+	// a 的权重是 9, b 没有设置权重按 1 处理, c 不会被选中
+	if counts["c"] != 0 || counts["a"] < 800 || counts["b"] < 50 {
+		t.Fatalf("unexpected distribution %v", counts)
+	}
+
+	d.SetWeights(map[string]int{"a": 0, "b": 0, "c": 0})
+	if _, err := d.Get(WeightedRandomSelect); err == nil {
+		t.Fatal("expect an error when all weights are 0")
+	}
+}
+
+func TestXClient_AddRoute(t *testing.T) {
+	addrs, counters := startServers(t, 3)
+	xc := NewXClient(NewMultiServerDiscovery(addrs), RoundRobinSelect, nil)
+	defer func() { _ = xc.Close() }()
+	if err := xc.AddRoute(Route{Method: "[", Match: InServers()}); err == nil {
+		t.Fatal("expect an error for an invalid pattern")
+	}
+	err := xc.AddRoute(
+		Route{Method: "Counter.*", Match: InServers(addrs[1], addrs[2])},
+		Route{Method: "Report.*", Match: InServers("tcp@analytics:7001")},
+		Route{Method: "Foo.Sum", Match: InServers("tcp@zone-a:7001"), Prefer: true},
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 4; i++ {
+		var reply string
+		if err := xc.Call(context.Background(), "Counter.Get", "a", &reply); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// 广播同样只发给规则选出的实例
+	if err := xc.Broadcast(context.Background(), "Counter.Get", "a", nil); err != nil {
+		t.Fatal(err)
+	}
+	if c0, c1, c2 := counters[0].calls.Load(), counters[1].calls.Load(), counters[2].calls.Load(); c0 != 0 || c1 != 3 || c2 != 3 {
+		t.Fatalf("expect calls only on the routed servers, got %d %d %d", c0, c1, c2)
+	}
+
+	// 没有实例满足规则时, Prefer 退回到所有实例, 否则请求失败
+	if _, err := xc.pick(context.Background(), "Report.Daily", nil); err == nil {
+		t.Fatal("expect an error without servers for the route")
+	}
+	if _, err := xc.pick(context.Background(), "Foo.Sum", nil); err != nil {
+		t.Fatalf("expect a fallback for a preferred route, got %v", err)
+	}
+}
+
+func TestXClient_SetSharding(t *testing.T) {
+	addrs, counters := startServers(t, 4)
+	d := NewMultiServerDiscovery(addrs)
+	for i, addr := range addrs {
+		d.SetMetadata(addr, map[string]string{"partition": strconv.Itoa(i / 2)})
+	}
+	xc := NewXClient(d, RandomSelect, nil)
+	defer func() { _ = xc.Close() }()
+	xc.SetSharding(&Sharding{Key: func(ctx context.Context, serviceMethod string, args interface{}) (string, bool) {
+		key, ok := args.(string)
+		return key, ok && key != ""
+	}})
+
+	// 同一个键总是落在同一个分片, 在分片的副本之间随机选择
+	for _, key := range []string{"user-1", "user-2", "user-3"} {
+		partitions, seen := make(map[int]bool), make(map[string]bool)
+		for i := 0; i < 30; i++ {
+			rpcAddr, err := xc.pick(context.Background(), "Counter.Get", key)
+			if err != nil {
+				t.Fatal(err)
+			}
+			p, _ := d.Partition(rpcAddr)
+			partitions[p], seen[rpcAddr] = true, true
+		}
+		if len(partitions) != 1 || len(seen) != 2 {
+			t.Fatalf("key %s: expect 1 partition with 2 replicas, got %v %v", key, partitions, seen)
+		}
+	}
+	var reply string
+	if err := xc.Call(context.Background(), "Counter.Get", "user-1", &reply); err != nil || reply != "user-1" {
+		t.Fatalf("failed to call a sharded server: %q %v", reply, err)
+	}
+	// 没有分片键的调用在所有的实例中选择
+	for i := 0; i < 40; i++ {
+		if err := xc.Call(context.Background(), "Counter.Get", "", &reply); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for i, c := range counters {
+		if c.calls.Load() == 0 {
+			t.Fatalf("expect unsharded calls on server %d", i)
+		}
+	}
+
+	// 分片数固定时, 没有实例的分片返回错误而不是映射到其他分片
+	key := "k"
+	for jumpHash(key, 100) < 2 {
+		key += "k"
+	}
+	xc.SetSharding(&Sharding{Partitions: 100, Key: func(context.Context, string, interface{}) (string, bool) { return key, true }})
+	if _, err := xc.pick(context.Background(), "Counter.Get", nil); err == nil {
+		t.Fatal("expect an error for a partition without servers")
+	}
+}
+
+func TestJumpHash(t *testing.T) {
+	moved := 0
+	for i := 0; i < 1000; i++ {
+		key := strconv.Itoa(i)
+		a, b := jumpHash(key, 10), jumpHash(key, 11)
+		if a < 0 || a >= 10 || b < 0 || b >= 11 {
+			t.Fatalf("partition out of range: %d %d", a, b)
+		}
+		if a != b {
+			if b != 10 {
+				t.Fatalf("key %s moved between old partitions %d -> %d", key, a, b)
+			}
+			moved++
+		}
+	}
+	// 增加一个分片只移动大约 1/11 的键
+	if moved < 50 || moved > 150 {
+		t.Fatalf("expect about 91 keys to move, got %d", moved)
+	}
+}
+
+func TestXClient_SetRetryPolicy(t *testing.T) {
+	addrs, _ := startServers(t, 2)
+	dead, _ := net.Listen("tcp", "127.0.0.1:0")
+	_ = dead.Close()
+	deadAddr := "tcp@" + dead.Addr().String()
+	xc := NewXClient(NewMultiServerDiscovery(append(addrs, deadAddr)), RoundRobinSelect, nil)
+	defer func() { _ = xc.Close() }()
+
+	// 没有重试时无法连接的实例直接让调用失败
+	failed := 0
+	for i := 0; i < 3; i++ {
+		if err := xc.Call(context.Background(), "Counter.Get", "a", new(string)); err != nil {
+			failed++
+		}
+	}
+	if failed != 1 {
+		t.Fatalf("expect 1 failure without retries, got %d", failed)
+	}
+
+	// 建立链接失败总是重试, 并且换一个实例
+	xc.SetFailMode(Failover)
+	xc.SetRetryPolicy(&minirpc.RetryPolicy{MaxAttempts: 2, Backoff: time.Millisecond, Jitter: 0.5})
+	for i := 0; i < 6; i++ {
+		var reply string
+		if err := xc.Call(context.Background(), "Counter.Get", "a", &reply); err != nil || reply != "a" {
+			t.Fatalf("call %d: expect to retry on another server, got %q %v", i, reply, err)
+		}
+	}
+	// 方法不存在不属于可以重试的错误
+	if err := xc.Call(context.Background(), "Counter.Missing", "a", new(string)); !errors.Is(err, minirpc.ErrNotFound) {
+		t.Fatalf("expect a not found error, got %v", err)
+	}
+
+	// 重试的等待会被 ctx 打断
+	only := NewXClient(NewMultiServerDiscovery([]string{deadAddr}), RandomSelect, nil)
+	defer func() { _ = only.Close() }()
+	only.SetFailMode(Failover)
+	only.SetRetryPolicy(&minirpc.RetryPolicy{MaxAttempts: 10, Backoff: time.Second})
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	if err := only.Call(ctx, "Counter.Get", "a", new(string)); !isConnectError(err) {
+		t.Fatalf("expect a connect error, got %v", err)
+	}
+	if d := time.Since(start); d > 500*time.Millisecond {
+		t.Fatalf("retries should stop with ctx, took %s", d)
+	}
+}
+
+// Delay 等待 d 之后返回, 失败 fails 次之后才成功
+type Delay struct {
+	d     time.Duration
+	fails atomic.Int32
+	calls atomic.Int32
+}
+
+func (s *Delay) Get(key string, reply *string) error {
+	s.calls.Add(1)
+	time.Sleep(s.d)
+	if s.fails.Add(-1) >= 0 {
+		return minirpc.Errorf(minirpc.CodeUnavailable, "try again")
+	}
+	*reply = key
+	return nil
+}
+
+// serve 启动注册了 rcvrs 的服务实例, 返回它的地址
+func serve(t *testing.T, rcvrs ...interface{}) string {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = l.Close() })
+	server := minirpc.NewServer()
+	for _, rcvr := range rcvrs {
+		_ = server.Register(rcvr)
+	}
+	go server.Accept(l)
+	return "tcp@" + l.Addr().String()
+}
+
+func TestXClient_SetFailMode(t *testing.T) {
+	flaky := new(Delay)
+	addr := serve(t, flaky)
+	xc := NewXClient(NewMultiServerDiscovery([]string{addr}), RandomSelect, nil)
+	defer func() { _ = xc.Close() }()
+
+	flaky.fails.Store(2)
+	if err := xc.Call(context.Background(), "Delay.Get", "a", new(string)); err == nil {
+		t.Fatal("expect Failfast to return the first error")
+	}
+	// Failtry 在同一个实例上重试, 默认最多尝试 3 次
+	xc.SetFailMode(Failtry)
+	flaky.fails.Store(2)
+	flaky.calls.Store(0)
+	var reply string
+	if err := xc.Call(context.Background(), "Delay.Get", "a", &reply); err != nil || reply != "a" || flaky.calls.Load() != 3 {
+		t.Fatalf("expect Failtry to succeed on the 3rd attempt, got %q %v after %d calls", reply, err, flaky.calls.Load())
+	}
+
+	// Failtry 不会换到其他实例, Failover 会
+	dead, _ := net.Listen("tcp", "127.0.0.1:0")
+	_ = dead.Close()
+	both := NewXClient(NewMultiServerDiscovery([]string{"tcp@" + dead.Addr().String(), addr}), RandomSelect, nil)
+	defer func() { _ = both.Close() }()
+	both.SetFailMode(Failtry)
+	failed := 0
+	for i := 0; i < 20; i++ {
+		if err := both.Call(context.Background(), "Delay.Get", "a", new(string)); err != nil {
+			failed++
+		}
+	}
+	if failed == 0 {
+		t.Fatal("expect Failtry to keep failing on the dead server")
+	}
+	both.SetFailMode(Failover)
+	for i := 0; i < 20; i++ {
+		if err := both.Call(context.Background(), "Delay.Get", "a", new(string)); err != nil {
+			t.Fatalf("expect Failover to move to the live server, got %v", err)
+		}
+	}
+}
+
+func TestXClient_Failbackup(t *testing.T) {
+	slow, fast := &Delay{d: time.Second}, new(Delay)
+	xc := NewXClient(NewMultiServerDiscovery([]string{serve(t, slow), serve(t, fast)}), RoundRobinSelect, nil)
+	defer func() { _ = xc.Close() }()
+	xc.SetFailMode(Failbackup)
+	xc.SetBackupDelay(20 * time.Millisecond)
+	for i := 0; i < 4; i++ {
+		start := time.Now()
+		var reply string
+		if err := xc.Call(context.Background(), "Delay.Get", "a", &reply); err != nil || reply != "a" {
+			t.Fatalf("call %d: %q %v", i, reply, err)
+		}
+		if d := time.Since(start); d > 500*time.Millisecond {
+			t.Fatalf("call %d: expect the backup request to answer, took %s", i, d)
+		}
+	}
+
+	// 第一个请求很快失败时立即发送备份请求
+	failing := new(Delay)
+	failing.fails.Store(100)
+	xc = NewXClient(NewMultiServerDiscovery([]string{serve(t, failing), serve(t, new(Delay))}), RoundRobinSelect, nil)
+	defer func() { _ = xc.Close() }()
+	xc.SetFailMode(Failbackup)
+	xc.SetBackupDelay(time.Hour)
+	for i := 0; i < 2; i++ {
+		if err := xc.Call(context.Background(), "Delay.Get", "a", new(string)); err != nil {
+			t.Fatalf("expect the backup request to succeed, got %v", err)
+		}
+	}
+}
+
+func TestBreaker(t *testing.T) {
+	cfg := &BreakerConfig{ConsecutiveFailures: 3, CoolDown: time.Second, HalfOpenProbes: 1}
+	var b breaker
+	now := time.Now()
+	for i := 0; i < 3; i++ {
+		if !b.admit(cfg, now) {
+			t.Fatalf("closed breaker should admit request %d", i)
+		}
+		b.record(cfg, now, true)
+	}
+	if b.ready(cfg, now) || b.admit(cfg, now) {
+		t.Fatal("expect the breaker to open after 3 consecutive failures")
+	}
+	// 冷却之后只放行一个试探请求, 失败时重新打开
+	now = now.Add(time.Second)
+	if !b.admit(cfg, now) || b.admit(cfg, now) {
+		t.Fatal("expect exactly 1 probe in half-open state")
+	}
+	b.record(cfg, now, true)
+	if b.admit(cfg, now) {
+		t.Fatal("expect a failed probe to reopen the breaker")
+	}
+	now = now.Add(time.Second)
+	if !b.admit(cfg, now) {
+		t.Fatal("expect a probe after another cool-down")
+	}
+	b.record(cfg, now, false)
+	if b.state != breakerClosed || !b.admit(cfg, now) || !b.admit(cfg, now) {
+		t.Fatal("expect a successful probe to close the breaker")
+	}
+
+	// 按错误率打开
+	cfg = &BreakerConfig{ConsecutiveFailures: 100, ErrorRate: 0.5, MinRequests: 10}
+	b = breaker{}
+	for i := 0; i < 10; i++ {
+		b.record(cfg, now, i%2 == 1)
+	}
+	if b.state != breakerOpen {
+		t.Fatal("expect the breaker to open at a 50% error rate")
+	}
+}
+
+func TestXClient_SetBreaker(t *testing.T) {
+	addrs, _ := startServers(t, 1)
+	dead, _ := net.Listen("tcp", "127.0.0.1:0")
+	_ = dead.Close()
+	deadAddr := "tcp@" + dead.Addr().String()
+	xc := NewXClient(NewMultiServerDiscovery([]string{deadAddr, addrs[0]}), RoundRobinSelect, nil)
+	defer func() { _ = xc.Close() }()
+	xc.SetBreaker(&BreakerConfig{ConsecutiveFailures: 2, CoolDown: time.Hour})
+
+	failed := 0
+	for i := 0; i < 20; i++ {
+		if err := xc.Call(context.Background(), "Counter.Get", "a", new(string)); err != nil {
+			failed++
+		}
+	}
+	if failed != 2 {
+		t.Fatalf("expect the dead server to be skipped after 2 failures, got %d", failed)
+	}
+	// 方法返回的普通错误不会打开熔断器
+	for i := 0; i < 5; i++ {
+		_ = xc.Call(context.Background(), "Counter.Missing", "a", new(string))
+	}
+	if err := xc.Call(context.Background(), "Counter.Get", "a", new(string)); err != nil {
+		t.Fatalf("expect the live server to stay available, got %v", err)
+	}
+
+	only := NewXClient(NewMultiServerDiscovery([]string{deadAddr}), RandomSelect, nil)
+	defer func() { _ = only.Close() }()
+	only.SetBreaker(&BreakerConfig{ConsecutiveFailures: 1, CoolDown: time.Hour})
+	_ = only.Call(context.Background(), "Counter.Get", "a", new(string))
+	if err := only.Call(context.Background(), "Counter.Get", "a", new(string)); !errors.Is(err, ErrBreakerOpen) {
+		t.Fatalf("expect ErrBreakerOpen, got %v", err)
+	}
+}
+
+func TestXClient_SetOutlierDetection(t *testing.T) {
+	servers := []string{"tcp@a", "tcp@b", "tcp@c", "tcp@d"}
+	xc := NewXClient(NewMultiServerDiscovery(servers), RandomSelect, nil)
+	defer func() { _ = xc.Close() }()
+	xc.SetOutlierDetection(&OutlierConfig{Interval: time.Nanosecond, MinRequests: 5, EjectionTime: 50 * time.Millisecond})
+	for i := 0; i < 10; i++ {
+		xc.endpoint("tcp@a").observe(100*time.Millisecond, false)
+		xc.endpoint("tcp@b").observe(time.Millisecond, true)
+		xc.endpoint("tcp@c").observe(time.Millisecond, false)
+		xc.endpoint("tcp@d").observe(time.Millisecond, false)
+	}
+	time.Sleep(time.Millisecond)
+	// 最多摘除一半的实例, 延迟偏离最多的 a 和错误率高的 b 都被摘除
+	got := xc.healthy(servers)
+	if len(got) != 2 || got[0] != "tcp@c" || got[1] != "tcp@d" {
+		t.Fatalf("expect a and b to be ejected, got %v", got)
+	}
+	for i := 0; i < 20; i++ {
+		if rpcAddr, _ := xc.pick(context.Background(), "Counter.Get", "a"); rpcAddr != "tcp@c" && rpcAddr != "tcp@d" {
+			t.Fatalf("expect ejected servers to be skipped, got %s", rpcAddr)
+		}
+	}
+
+	time.Sleep(60 * time.Millisecond)
+	if got := xc.healthy(servers); len(got) != 4 {
+		t.Fatalf("expect ejected servers to be readmitted, got %v", got)
+	}
+	// 重新接纳的实例统计清零, 需要重新积累调用才会参与检测
+	if xc.endpoint("tcp@a").samples != 0 {
+		t.Fatal("expect stats to be reset after probation")
+	}
+
+	xc.SetOutlierDetection(&OutlierConfig{Interval: time.Nanosecond, MinRequests: 5, MaxEjectionPercent: 25})
+	for i := 0; i < 10; i++ {
+		xc.endpoint("tcp@a").observe(100*time.Millisecond, false)
+		xc.endpoint("tcp@b").observe(50*time.Millisecond, false)
+	}
+	time.Sleep(time.Millisecond)
+	if got := xc.healthy(servers); len(got) != 3 || got[0] != "tcp@b" {
+		t.Fatalf("expect only the worst server to be ejected, got %v", got)
+	}
+}
+
+func TestXClient_SetHedging(t *testing.T) {
+	slow, fast := &Delay{d: 300 * time.Millisecond}, new(Delay)
+	xc := NewXClient(NewMultiServerDiscovery([]string{serve(t, slow), serve(t, fast)}), RoundRobinSelect, nil)
+	defer func() { _ = xc.Close() }()
+	if err := xc.SetHedging(&Hedging{Methods: []string{"["}}); err == nil {
+		t.Fatal("expect invalid pattern to be rejected")
+	}
+	if err := xc.SetHedging(&Hedging{Methods: []string{"Delay.*"}, MaxDelay: 20 * time.Millisecond}); err != nil {
+		t.Fatal(err)
+	}
+	// 样本不足时不发送对冲请求
+	if _, ok := xc.hedgeDelay("Delay.Get"); ok {
+		t.Fatal("expect no hedging without enough samples")
+	}
+	_, w := xc.latencies("Delay.Get")
+	for i := 0; i < minHedgeSamples; i++ {
+		w.add(time.Duration(i+1) * time.Millisecond)
+	}
+	if d, ok := xc.hedgeDelay("Delay.Get"); !ok || d != 19*time.Millisecond {
+		t.Fatalf("expect the P95 delay, got %s %v", d, ok)
+	}
+	for i := 0; i < 4; i++ {
+		start := time.Now()
+		var reply string
+		if err := xc.Call(context.Background(), "Delay.Get", "a", &reply); err != nil || reply != "a" {
+			t.Fatalf("call %d: %q %v", i, reply, err)
+		}
+		if d := time.Since(start); d > 200*time.Millisecond {
+			t.Fatalf("call %d: expect the hedged request to answer, took %s", i, d)
+		}
+	}
+
+	// 没有标记为幂等的方法不发送对冲请求
+	_ = xc.SetHedging(&Hedging{Methods: []string{"Other.*"}})
+	slowCalls := 0
+	for i := 0; i < 2; i++ {
+		start := time.Now()
+		_ = xc.Call(context.Background(), "Delay.Get", "a", new(string))
+		if time.Since(start) >= 300*time.Millisecond {
+			slowCalls++
+		}
+	}
+	if slowCalls != 1 {
+		t.Fatalf("expect the slow server to answer without hedging, got %d slow calls", slowCalls)
+	}
+}
+
+func TestXClient_SetRetryBudget(t *testing.T) {
+	b := NewRetryBudget(0, 1)
+	for i := 0; i < budgetBuckets; i++ {
+		if !b.withdraw() {
+			t.Fatalf("expect %d retries per window to be allowed", budgetBuckets)
+		}
+	}
+	if b.withdraw() {
+		t.Fatal("expect the budget to be exhausted")
+	}
+	if s := b.Stats(); s.Retries != budgetBuckets || s.Available != 0 || s.Throttled != 1 {
+		t.Fatalf("unexpected budget stats %+v", s)
+	}
+
+	failing := new(Delay)
+	failing.fails.Store(1 << 20)
+	xc := NewXClient(NewMultiServerDiscovery([]string{serve(t, failing)}), RandomSelect, nil)
+	defer func() { _ = xc.Close() }()
+	xc.SetFailMode(Failover)
+	xc.SetRetryBudget(NewRetryBudget(0.1, 0))
+	for i := 0; i < 100; i++ {
+		_ = xc.Call(context.Background(), "Delay.Get", "a", new(string))
+	}
+	// 重试最多增加 10% 的请求
+	s := xc.Stats()
+	if s.Calls != 100 || s.Retries > 10 || s.Retries < 9 || s.Throttled < 80 || failing.calls.Load() != int32(100+s.Retries) {
+		t.Fatalf("unexpected stats %+v after %d server calls", s, failing.calls.Load())
+	}
+	if s.RetryBudget == nil || s.RetryBudget.Requests != 100 || s.RetryBudget.Throttled != s.Throttled {
+		t.Fatalf("unexpected budget stats %+v", s.RetryBudget)
+	}
+}
+
+func TestXClient_AddBulkhead(t *testing.T) {
+	xc := NewXClient(NewMultiServerDiscovery([]string{serve(t, &Delay{d: 200 * time.Millisecond}, new(Counter))}), RandomSelect, nil)
+	defer func() { _ = xc.Close() }()
+	if err := xc.AddBulkhead(Bulkhead{Method: "Delay.*"}); err == nil {
+		t.Fatal("expect MaxConcurrent to be required")
+	}
+	if err := xc.AddBulkhead(Bulkhead{Method: "Delay.*", MaxConcurrent: 2}); err != nil {
+		t.Fatal(err)
+	}
+	done := make(chan error, 2)
+	for i := 0; i < 2; i++ {
+		go func() { done <- xc.Call(context.Background(), "Delay.Get", "a", new(string)) }()
+	}
+	time.Sleep(50 * time.Millisecond)
+	// 慢的服务占满了位置, 其他服务不受影响
+	if err := xc.Call(context.Background(), "Delay.Get", "a", new(string)); !errors.Is(err, ErrBulkheadFull) {
+		t.Fatalf("expect ErrBulkheadFull, got %v", err)
+	}
+	start := time.Now()
+	if err := xc.Call(context.Background(), "Counter.Get", "a", new(string)); err != nil || time.Since(start) > 100*time.Millisecond {
+		t.Fatalf("expect other services to be unaffected, got %v after %s", err, time.Since(start))
+	}
+	for i := 0; i < 2; i++ {
+		if err := <-done; err != nil {
+			t.Fatal(err)
+		}
+	}
+	if s := xc.Stats(); s.Rejected != 1 {
+		t.Fatalf("expect 1 rejected call, got %d", s.Rejected)
+	}
+
+	// Wait 为 true 时等待位置, 最多等到 ctx 结束
+	waiting := NewXClient(NewMultiServerDiscovery([]string{serve(t, &Delay{d: 100 * time.Millisecond})}), RandomSelect, nil)
+	defer func() { _ = waiting.Close() }()
+	_ = waiting.AddBulkhead(Bulkhead{Method: "Delay.Get", MaxConcurrent: 1, Wait: true})
+	go func() { done <- waiting.Call(context.Background(), "Delay.Get", "a", new(string)) }()
+	time.Sleep(20 * time.Millisecond)
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if err := waiting.Call(ctx, "Delay.Get", "a", new(string)); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("expect the wait to stop with ctx, got %v", err)
+	}
+	if err := waiting.Call(context.Background(), "Delay.Get", "a", new(string)); err != nil {
+		t.Fatalf("expect the call to wait for a free slot, got %v", err)
+	}
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestXClient_BroadcastAll(t *testing.T) {
+	addrs, _ := startServers(t, 2)
+	dead, _ := net.Listen("tcp", "127.0.0.1:0")
+	_ = dead.Close()
+	servers := []string{addrs[0], "tcp@" + dead.Addr().String(), addrs[1]}
+	xc := NewXClient(NewMultiServerDiscovery(servers), RandomSelect, nil)
+	defer func() { _ = xc.Close() }()
+	var reply string
+	results, err := xc.BroadcastAll(context.Background(), "Counter.Get", "a", &reply)
+	if err != nil || len(results) != 3 {
+		t.Fatalf("expect 3 results, got %d %v", len(results), err)
+	}
+	// 一个实例失败时其他实例的结果仍然返回
+	for i, r := range results {
+		if r.Addr != servers[i] {
+			t.Fatalf("expect results in server order, got %s at %d", r.Addr, i)
+		}
+		if failed := i == 1; (r.Err != nil) != failed {
+			t.Fatalf("%s: unexpected error %v", r.Addr, r.Err)
+		}
+		if r.Err == nil && *r.Reply.(*string) != "a" {
+			t.Fatalf("%s: unexpected reply %q", r.Addr, *r.Reply.(*string))
+		}
+	}
+	if reply != "" {
+		t.Fatal("expect reply to be left untouched")
+	}
+}
+
+func TestXClient_Fork(t *testing.T) {
+	slow, fast := &Delay{d: time.Second}, new(Delay)
+	failing := new(Delay)
+	failing.fails.Store(1 << 20)
+	xc := NewXClient(NewMultiServerDiscovery([]string{serve(t, slow), serve(t, failing), serve(t, fast)}), RoundRobinSelect, nil)
+	defer func() { _ = xc.Close() }()
+	start := time.Now()
+	var reply string
+	if err := xc.Fork(context.Background(), "Delay.Get", "a", &reply); err != nil || reply != "a" {
+		t.Fatalf("expect the fast server to answer, got %q %v", reply, err)
+	}
+	if d := time.Since(start); d > 500*time.Millisecond {
+		t.Fatalf("expect the first success to win, took %s", d)
+	}
+
+	// ForkN 只发给 n 个不同的实例, 都失败时返回错误
+	var servers []string
+	var all []*Delay
+	for i := 0; i < 3; i++ {
+		d := new(Delay)
+		d.fails.Store(1 << 20)
+		servers, all = append(servers, serve(t, d)), append(all, d)
+	}
+	failed := NewXClient(NewMultiServerDiscovery(servers), RandomSelect, nil)
+	defer func() { _ = failed.Close() }()
+	if err := failed.ForkN(context.Background(), 2, "Delay.Get", "a", new(string)); err == nil {
+		t.Fatal("expect the error when every server fails")
+	}
+	var calls []int32
+	for _, d := range all {
+		calls = append(calls, d.calls.Load())
+	}
+	if calls[0]+calls[1]+calls[2] != 2 || calls[0] > 1 || calls[1] > 1 || calls[2] > 1 {
+		t.Fatalf("expect 2 different servers to be called, got %v", calls)
+	}
+	if err := failed.ForkN(context.Background(), 5, "Delay.Get", "a", new(string)); err == nil {
+		t.Fatal("expect the error when every server fails")
+	}
+	if total := all[0].calls.Load() + all[1].calls.Load() + all[2].calls.Load(); total != 5 {
+		t.Fatalf("expect n to be capped by the number of servers, got %d calls", total-2)
+	}
+}
+
+func TestXClient_SetClientCache(t *testing.T) {
+	addrs, _ := startServers(t, 3)
+	d := NewMultiServerDiscovery(addrs)
+	xc := NewXClient(d, RoundRobinSelect, nil)
+	defer func() { _ = xc.Close() }()
+	xc.SetClientCache(&ClientCache{MaxAddrs: 2, IdleTimeout: time.Hour, Interval: time.Hour})
+	for i := 0; i < 3; i++ {
+		if err := xc.Call(context.Background(), "Counter.Get", "a", new(string)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// 超过 MaxAddrs 时关闭最久没有使用的实例的链接
+	if len(xc.clients) != 2 {
+		t.Fatalf("expect 2 cached addresses, got %d", len(xc.clients))
+	}
+
+	// 不在 Discovery 中的实例的链接和调用状态被清理
+	_ = d.Update(addrs[:1])
+	xc.sweep(time.Now())
+	for rpcAddr := range xc.endpoints {
+		if rpcAddr != addrs[0] {
+			t.Fatalf("expect %s to be removed", rpcAddr)
+		}
+	}
+	if len(xc.clients) > 1 {
+		t.Fatalf("expect clients of removed servers to be closed, got %d", len(xc.clients))
+	}
+
+	// 空闲的链接被关闭, 下一次调用时重新建立
+	if err := xc.Call(context.Background(), "Counter.Get", "a", new(string)); err != nil {
+		t.Fatal(err)
+	}
+	xc.sweep(time.Now().Add(time.Hour))
+	if len(xc.clients) != 0 {
+		t.Fatalf("expect idle clients to be closed, got %d", len(xc.clients))
+	}
+	if err := xc.Call(context.Background(), "Counter.Get", "a", new(string)); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestXClient_Warmup(t *testing.T) {
+	addrs, counters := startServers(t, 3)
+	dead, _ := net.Listen("tcp", "127.0.0.1:0")
+	_ = dead.Close()
+	deadAddr := "tcp@" + dead.Addr().String()
+	d := NewMultiServerDiscovery([]string{addrs[0], deadAddr, addrs[1]})
+	xc := NewXClient(d, RoundRobinSelect, &minirpc.Option{ConnsPerAddr: 2})
+	defer func() { _ = xc.Close() }()
+	xc.SetBreaker(&BreakerConfig{ConsecutiveFailures: 1, CoolDown: time.Hour})
+	err := xc.Warmup()
+	if err == nil || !strings.Contains(err.Error(), deadAddr) {
+		t.Fatalf("expect the dead server to be reported, got %v", err)
+	}
+	for _, rpcAddr := range addrs[:2] {
+		pool := xc.clients[poolKey{rpcAddr: rpcAddr}]
+		if pool == nil {
+			t.Fatalf("expect %s to be dialed", rpcAddr)
+		}
+		for i := 0; i < pool.Size(); i++ {
+			if client, err := pool.Get(); err != nil || !client.IsAvailable() {
+				t.Fatalf("expect %s to have available clients, got %v", rpcAddr, err)
+			}
+		}
+	}
+	// 建立链接失败的实例在请求到来之前就被熔断
+	for i := 0; i < 10; i++ {
+		if err := xc.Call(context.Background(), "Counter.Get", "a", new(string)); err != nil {
+			t.Fatalf("expect the dead server to be skipped, got %v", err)
+		}
+	}
+
+	// 定期为新出现的实例建立链接
+	_ = d.Update(addrs)
+	xc.SetWarmupInterval(10 * time.Millisecond)
+	deadline := time.Now().Add(time.Second)
+	for {
+		xc.mu.Lock()
+		_, ok := xc.clients[poolKey{rpcAddr: addrs[2]}]
+		xc.mu.Unlock()
+		if ok {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("expect the new server to be dialed")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	if counters[2].calls.Load() != 0 {
+		t.Fatal("expect warmup not to send requests")
+	}
+}
+
+func TestXClient_SetServiceOption(t *testing.T) {
+	addr := serve(t, new(Counter), new(Delay))
+	xc := NewXClient(NewMultiServerDiscovery([]string{addr}), RandomSelect, nil)
+	defer func() { _ = xc.Close() }()
+	xc.SetServiceOption("Delay", &minirpc.Option{CodecType: codec.JsonType, ConnsPerAddr: 2})
+	for _, serviceMethod := range []string{"Counter.Get", "Delay.Get"} {
+		var reply string
+		if err := xc.Call(context.Background(), serviceMethod, "a", &reply); err != nil || reply != "a" {
+			t.Fatalf("%s: %q %v", serviceMethod, reply, err)
+		}
+	}
+	// 单独设置了 Option 的服务使用自己的链接
+	if len(xc.clients) != 2 || xc.clients[poolKey{rpcAddr: addr}].Size() != 1 || xc.clients[poolKey{rpcAddr: addr, service: "Delay"}].Size() != 2 {
+		t.Fatalf("expect a separate pool for Delay, got %d pools", len(xc.clients))
+	}
+	xc.SetServiceOption("Delay", nil)
+	if key, _ := xc.poolKey(addr, "Delay.Get"); key.service != "" {
+		t.Fatal("expect Delay to use the default option again")
+	}
+}
+
+func TestXClient_Endpoints(t *testing.T) {
+	addrs, counters := startServers(t, 3)
+	xc := NewXClient(NewMultiServerDiscovery(addrs[:2]), RandomSelect, &minirpc.Option{ConnsPerAddr: 2})
+	defer func() { _ = xc.Close() }()
+	// 指定实例的链接, 不需要在 Discovery 中
+	client, err := xc.Client(addrs[2])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := client.Call(context.Background(), "Counter.Get", "a", new(string)); err != nil || counters[2].calls.Load() != 1 {
+		t.Fatalf("expect the call to be pinned to %s, got %v", addrs[2], err)
+	}
+	infos, err := xc.Endpoints()
+	if err != nil || len(infos) != 3 {
+		t.Fatalf("expect 3 endpoints, got %d %v", len(infos), err)
+	}
+	for _, info := range infos {
+		want := 0
+		if info.Addr == addrs[2] {
+			want = 1
+		}
+		if len(info.Clients) != want || info.Inflight != 0 {
+			t.Fatalf("%s: unexpected endpoint %+v", info.Addr, info)
+		}
+		if want == 1 && !info.Clients[0].IsAvailable() {
+			t.Fatal("expect the pinned client to be available")
+		}
+	}
+}
+
+func TestXClient_SetSelector(t *testing.T) {
+	slow, fast := &Delay{d: 20 * time.Millisecond}, new(Delay)
+	servers := []string{serve(t, slow), serve(t, fast)}
+	xc := NewXClient(NewMultiServerDiscovery(servers), RoundRobinSelect, nil)
+	defer func() { _ = xc.Close() }()
+	for i := 0; i < 4; i++ {
+		if err := xc.Call(context.Background(), "Delay.Get", "a", new(string)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	stats := xc.Stats().Endpoints
+	if len(stats) != 2 {
+		t.Fatalf("expect stats of 2 endpoints, got %d", len(stats))
+	}
+	byAddr := map[string]EndpointStats{stats[0].Addr: stats[0], stats[1].Addr: stats[1]}
+	s, f := byAddr[servers[0]], byAddr[servers[1]]
+	if s.Calls != 2 || f.Calls != 2 || s.Failures != 0 || s.Breaker != "closed" || s.Latency < 20*time.Millisecond || s.Latency <= f.Latency {
+		t.Fatalf("unexpected endpoint stats %+v %+v", s, f)
+	}
+
+	// 自定义的负载均衡根据调用统计选择延迟最低的实例
+	xc.SetSelector(func(candidates []EndpointStats) string {
+		best := candidates[0]
+		for _, c := range candidates[1:] {
+			if c.Latency < best.Latency {
+				best = c
+			}
+		}
+		return best.Addr
+	})
+	slow.calls.Store(0)
+	for i := 0; i < 10; i++ {
+		if err := xc.Call(context.Background(), "Delay.Get", "a", new(string)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if slow.calls.Load() != 0 {
+		t.Fatalf("expect the slow server to be avoided, got %d calls", slow.calls.Load())
+	}
+}
+
+func TestXClient_SetCanary(t *testing.T) {
+	d := NewMultiServerDiscovery([]string{"tcp@a", "tcp@b", "tcp@c"})
+	d.SetMetadata("tcp@c", map[string]string{"group": "canary"})
+	xc := NewXClient(d, RandomSelect, nil)
+	defer func() { _ = xc.Close() }()
+	count := func(ctx context.Context, n int) int {
+		canary := 0
+		for i := 0; i < n; i++ {
+			rpcAddr, err := xc.pick(ctx, "Foo.Get", nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if rpcAddr == "tcp@c" {
+				canary++
+			}
+		}
+		return canary
+	}
+	xc.SetCanary(&Canary{Match: map[string]string{"x-canary": "1"}})
+	if n := count(context.Background(), 100); n != 0 {
+		t.Fatalf("expect no traffic to the canary, got %d", n)
+	}
+	// 请求的元数据匹配时一定发给金丝雀组
+	if n := count(minirpc.NewOutgoingContext(context.Background(), map[string]string{"x-canary": "1"}), 100); n != 100 {
+		t.Fatalf("expect matched requests to go to the canary, got %d", n)
+	}
+	// 单次调用通过 WithCallOptions 设置的元数据同样参与匹配
+	perCall := withXCallOptions(context.Background(), []XCallOption{WithCallOptions(minirpc.WithMetadata(map[string]string{"x-canary": "1"}))})
+	if n := count(perCall, 100); n != 100 {
+		t.Fatalf("expect per-call metadata to route to the canary, got %d", n)
+	}
+	// 运行时调整比例
+	xc.SetCanary(&Canary{Percent: 20, HashKey: "user"})
+	if n := count(context.Background(), 2000); n < 300 || n > 500 {
+		t.Fatalf("expect about 20%% of the traffic to go to the canary, got %d", n)
+	}
+	// 同一个用户总是落到同一组
+	user := minirpc.NewOutgoingContext(context.Background(), map[string]string{"user": "42"})
+	if n := count(user, 50); n != 0 && n != 50 {
+		t.Fatalf("expect requests of the same user to stick to one group, got %d", n)
+	}
+	// 金丝雀组没有实例时使用稳定组
+	xc.SetCanary(&Canary{Percent: 100})
+	if n := count(context.Background(), 10); n != 10 {
+		t.Fatalf("expect all traffic to go to the canary, got %d", n)
+	}
+	_ = d.Update([]string{"tcp@a", "tcp@b"})
+	if n := count(context.Background(), 10); n != 0 {
+		t.Fatalf("expect the stable group to be used, got %d", n)
+	}
+}
+
+func TestXClient_MultiError(t *testing.T) {
+	addrs, _ := startServers(t, 1)
+	dead, _ := net.Listen("tcp", "127.0.0.1:0")
+	_ = dead.Close()
+	deadAddr := "tcp@" + dead.Addr().String()
+	failing := new(Delay)
+	failing.fails.Store(1 << 20)
+	failingAddr := serve(t, failing)
+
+	// 广播返回每个失败的实例
+	xc := NewXClient(NewMultiServerDiscovery([]string{addrs[0], deadAddr}), RandomSelect, nil)
+	defer func() { _ = xc.Close() }()
+	err := xc.Broadcast(context.Background(), "Counter.Get", "a", new(string))
+	var me *minirpc.MultiError
+	if !errors.As(err, &me) || len(me.Errors) != 1 || me.Errors[0].Addr != deadAddr {
+		t.Fatalf("expect a MultiError for %s, got %v", deadAddr, err)
+	}
+
+	// 重试返回每次尝试的实例和错误
+	retry := NewXClient(NewMultiServerDiscovery([]string{deadAddr, failingAddr}), RoundRobinSelect, nil)
+	defer func() { _ = retry.Close() }()
+	retry.SetFailMode(Failover)
+	err = retry.Call(context.Background(), "Delay.Get", "a", new(string))
+	if !errors.As(err, &me) || len(me.Errors) != 3 || len(me.Addrs()) != 2 || !errors.Is(err, minirpc.ErrUnavailable) {
+		t.Fatalf("expect 3 attempts on 2 servers, got %v", err)
+	}
+	for i, e := range me.Errors {
+		if e.Attempt != i {
+			t.Fatalf("expect attempt %d, got %d", i, e.Attempt)
+		}
+	}
+}
+
+func TestXClient_SetSharedPools(t *testing.T) {
+	addrs, _ := startServers(t, 2)
+	shared := NewSharedPools()
+	newXClient := func(opt *minirpc.Option) *XClient {
+		xc := NewXClient(NewMultiServerDiscovery(addrs), RoundRobinSelect, opt)
+		xc.SetSharedPools(shared)
+		for i := 0; i < 4; i++ {
+			if err := xc.Call(context.Background(), "Counter.Get", "a", new(string)); err != nil {
+				t.Fatal(err)
+			}
+		}
+		return xc
+	}
+	a, b := newXClient(&minirpc.Option{ConnsPerAddr: 1}), newXClient(&minirpc.Option{ConnsPerAddr: 1})
+	// 字段值相同的 Option 使用同一组链接
+	if shared.Len() != 2 || a.clients[poolKey{rpcAddr: addrs[0]}] != b.clients[poolKey{rpcAddr: addrs[0]}] {
+		t.Fatalf("expect 2 shared pools, got %d", shared.Len())
+	}
+	c := newXClient(&minirpc.Option{ConnsPerAddr: 2})
+	if shared.Len() != 4 {
+		t.Fatalf("expect a different option to use its own pools, got %d", shared.Len())
+	}
+	_ = c.Close()
+	// 还有其他 XClient 引用时链接不会被关闭
+	_ = a.Close()
+	if shared.Len() != 2 {
+		t.Fatalf("expect pools of b to be kept, got %d", shared.Len())
+	}
+	if err := b.Call(context.Background(), "Counter.Get", "a", new(string)); err != nil {
+		t.Fatal(err)
+	}
+	_ = b.Close()
+	if shared.Len() != 0 {
+		t.Fatalf("expect pools to be closed with the last reference, got %d", shared.Len())
+	}
+}
+
+func TestRendezvous(t *testing.T) {
+	servers := make([]string, 10)
+	for i := range servers {
+		servers[i] = fmt.Sprintf("tcp@10.0.0.%d:7001", i)
+	}
+	const keys = 10000
+	owners := make(map[string]string, keys)
+	load := make(map[string]int)
+	for i := 0; i < keys; i++ {
+		key := strconv.Itoa(i)
+		owners[key] = rendezvous(key, servers)
+		load[owners[key]]++
+	}
+	for _, addr := range servers {
+		if load[addr] < keys/20 {
+			t.Fatalf("expect keys to spread over all servers, got %v", load)
+		}
+	}
+	// 在排序的中间加入一个实例, 只有大约 1/11 的 key 移动, 并且都移动到新的实例
+	added := "tcp@10.0.0.15:7001"
+	moved := 0
+	for key, owner := range owners {
+		if now := rendezvous(key, append([]string{added}, servers...)); now != owner {
+			if now != added {
+				t.Fatalf("expect key %s to move to the new server, got %s", key, now)
+			}
+			moved++
+		}
+	}
+	if moved < keys/11/2 || moved > keys/11*3/2 {
+		t.Fatalf("expect about %d keys to move, got %d", keys/11, moved)
+	}
+	// 删除一个实例时只有它负责的 key 移动
+	for key, owner := range owners {
+		if now := rendezvous(key, servers[1:]); owner != servers[0] && now != owner {
+			t.Fatalf("expect key %s to stay on %s, got %s", key, owner, now)
+		}
+	}
+}
+
+func TestXClient_CallOptions(t *testing.T) {
+	addrs, counters := startServers(t, 3)
+	dead, _ := net.Listen("tcp", "127.0.0.1:0")
+	_ = dead.Close()
+	xc := NewXClient(NewMultiServerDiscovery(append(addrs, "tcp@"+dead.Addr().String())), RoundRobinSelect, nil)
+	defer func() { _ = xc.Close() }()
+
+	// 相同的 affinity key 总是发给同一个实例
+	for i := 0; i < 3; i++ {
+		key := strconv.Itoa(i)
+		for j := 0; j < 5; j++ {
+			_ = xc.Call(context.Background(), "Counter.Get", "a", new(string), WithAffinityKey(key))
+		}
+	}
+	for i, c := range counters {
+		if n := c.calls.Load(); n%5 != 0 {
+			t.Fatalf("expect calls of the same key to stick to one server, got %d on %s", n, addrs[i])
+		}
+	}
+
+	// 单独设置 FailMode 时绕过失败的实例, 默认的 Failfast 不会
+	failed := 0
+	for i := 0; i < 8; i++ {
+		if err := xc.Call(context.Background(), "Counter.Get", "a", new(string)); err != nil {
+			failed++
+		}
+		if err := xc.Call(context.Background(), "Counter.Get", "a", new(string), WithFailMode(Failover), WithSelectMode(RandomSelect)); err != nil {
+			t.Fatalf("expect Failover to move to a live server, got %v", err)
+		}
+	}
+	if failed == 0 {
+		t.Fatal("expect Failfast to report the dead server")
+	}
+
+	slow := NewXClient(NewMultiServerDiscovery([]string{serve(t, &Delay{d: 200 * time.Millisecond})}), RandomSelect, nil)
+	defer func() { _ = slow.Close() }()
+	if err := slow.Call(context.Background(), "Delay.Get", "a", new(string), WithCallOptions(minirpc.WithTimeout(20*time.Millisecond))); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("expect the call options to be forwarded, got %v", err)
+	}
+}
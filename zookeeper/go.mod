@@ -0,0 +1,11 @@
+module github.com/fanyeke/minirpc/zookeeper
+
+go 1.21.3
+
+require (
+	github.com/fanyeke/minirpc v0.0.0
+	github.com/go-zookeeper/zk v1.0.3
+)
+
+// 与 minirpc 在同一个仓库中开发
+replace github.com/fanyeke/minirpc => ../
@@ -0,0 +1,99 @@
+// Package zookeeper 基于 github.com/go-zookeeper/zk 实现 registry.ZKConn, 用于 registry.ZKRegister 和 xclient.ZKDiscovery
+// 单独作为一个模块, 不使用 ZooKeeper 的项目不需要引入 go-zookeeper/zk
+package zookeeper
+
+import (
+	"errors"
+	"strings"
+	"time"
+
+	"github.com/fanyeke/minirpc/registry"
+	"github.com/go-zookeeper/zk"
+)
+
+// Conn 包装 go-zookeeper/zk 的链接
+type Conn struct {
+	*zk.Conn
+}
+
+var _ registry.ZKConn = (*Conn)(nil)
+
+// Connect 连接 ZooKeeper 集群, sessionTimeout 是会话的超时时间, 进程退出之后临时节点在会话超时之后被删除
+// 链接断开时 go-zookeeper/zk 会自动重连, 不再使用时调用 Close
+func Connect(servers []string, sessionTimeout time.Duration) (*Conn, error) {
+	conn, _, err := zk.Connect(servers, sessionTimeout)
+	if err != nil {
+		return nil, err
+	}
+	return &Conn{Conn: conn}, nil
+}
+
+// New 包装已经建立的链接, 例如设置了认证信息的链接
+func New(conn *zk.Conn) *Conn {
+	return &Conn{Conn: conn}
+}
+
+// watch 把 zk 的一次性 watch 转换为关闭的 channel, 链接关闭时 zk 同样会发送事件
+func watch(events <-chan zk.Event) <-chan struct{} {
+	ch := make(chan struct{})
+	go func() {
+		<-events
+		close(ch)
+	}()
+	return ch
+}
+
+// ChildrenW 见 registry.ZKConn, path 不存在时 watch 它的创建
+func (c *Conn) ChildrenW(path string) ([]string, <-chan struct{}, error) {
+	for {
+		children, _, events, err := c.Conn.ChildrenW(path)
+		if err == nil {
+			return children, watch(events), nil
+		}
+		if !errors.Is(err, zk.ErrNoNode) {
+			return nil, nil, err
+		}
+		exists, _, events, err := c.Conn.ExistsW(path)
+		if err != nil {
+			return nil, nil, err
+		}
+		if !exists {
+			return nil, watch(events), nil
+		}
+		// 两次请求之间 path 被创建了, 重新读取子节点; 多余的 watch 在下一次变化时结束
+	}
+}
+
+// Get 见 registry.ZKConn
+func (c *Conn) Get(path string) ([]byte, error) {
+	data, _, err := c.Conn.Get(path)
+	return data, err
+}
+
+// CreateEphemeral 见 registry.ZKConn, 父节点是持久节点, 使用开放的 ACL
+func (c *Conn) CreateEphemeral(path string, data []byte) error {
+	acl := zk.WorldACL(zk.PermAll)
+	parts := strings.Split(strings.Trim(path, "/"), "/")
+	for i := 1; i < len(parts); i++ {
+		parent := "/" + strings.Join(parts[:i], "/")
+		if _, err := c.Conn.Create(parent, nil, 0, acl); err != nil && !errors.Is(err, zk.ErrNodeExists) {
+			return err
+		}
+	}
+	_, err := c.Conn.Create(path, data, zk.FlagEphemeral, acl)
+	return err
+}
+
+// ExistsW 见 registry.ZKConn
+func (c *Conn) ExistsW(path string) (bool, <-chan struct{}, error) {
+	exists, _, events, err := c.Conn.ExistsW(path)
+	if err != nil {
+		return false, nil, err
+	}
+	return exists, watch(events), nil
+}
+
+// Delete 见 registry.ZKConn, 不检查版本
+func (c *Conn) Delete(path string) error {
+	return c.Conn.Delete(path, -1)
+}
@@ -0,0 +1,24 @@
+package zookeeper
+
+import (
+	"testing"
+	"time"
+
+	"github.com/go-zookeeper/zk"
+)
+
+func TestWatch(t *testing.T) {
+	events := make(chan zk.Event, 1)
+	ch := watch(events)
+	select {
+	case <-ch:
+		t.Fatal("expect the watch to wait for an event")
+	case <-time.After(10 * time.Millisecond):
+	}
+	events <- zk.Event{Type: zk.EventNodeChildrenChanged, Path: "/minirpc/Foo"}
+	select {
+	case <-ch:
+	case <-time.After(time.Second):
+		t.Fatal("expect the watch to fire after an event")
+	}
+}